@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -20,6 +21,7 @@ var (
 	listenTo    string
 	dumpConfig  bool
 	serve       string
+	snapshotDir string
 	extract     string
 )
 
@@ -28,6 +30,7 @@ func init() {
 	flag.StringVar(&listenTo, "listen", "127.0.0.1:8090", "Address to listen to")
 	flag.BoolVar(&dumpConfig, "dump", false, "Dump the parsed config and exit")
 	flag.StringVar(&serve, "serve", "", "Serve a given zip from a local HTTP server")
+	flag.StringVar(&snapshotDir, "snapshot", "", "Directory to save the -serve extraction to, and restore it from when the zip is unchanged")
 	flag.StringVar(&extract, "extract", "", "Extract zip file to random name on GCS (requires a config with bucket)")
 }
 
@@ -54,7 +57,20 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "selftest" {
+		runSelfTest(config, flag.Args()[1:])
+		return
+	}
+
+	if flag.Arg(0) == "worker" {
+		must(zipserver.StartQueueWorker(config))
+		return
+	}
+
 	if serve != "" {
+		if snapshotDir != "" {
+			config.ServeSnapshotDir = snapshotDir
+		}
 		must(zipserver.ServeZip(config, serve))
 		return
 	}
@@ -96,3 +112,30 @@ func main() {
 	err = zipserver.StartZipServer(listenTo, config)
 	must(err)
 }
+
+// runSelfTest runs `zipserver selftest`, an extract/copy/delete cycle meant to
+// run as a canary after deploying. It exits with an error status on failure.
+func runSelfTest(config *zipserver.Config, args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	memory := flags.Bool("memory", false, "Use in-memory storage instead of the configured bucket")
+	target := flags.String("target", "", "Storage target to also copy a file to")
+	must(flags.Parse(args))
+
+	steps, err := zipserver.RunSelfTest(config, *memory, *target)
+
+	result := struct {
+		Success bool
+		Error   string `json:",omitempty"`
+		Steps   []zipserver.SelfTestStep
+	}{Success: err == nil, Steps: steps}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	blob, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(blob))
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
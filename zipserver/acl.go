@@ -0,0 +1,110 @@
+package zipserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ACLMode is how a storage target applies the ACLs uploads are made with
+type ACLMode string
+
+const (
+	// ACLs are sent as canned ACLs (the default)
+	ACLCanned ACLMode = "canned"
+	// ACLs are dropped, eg. for R2 which rejects or ignores them
+	ACLIgnore ACLMode = "ignore"
+)
+
+// canned ACLs are requested by their XML API names, eg. public-read, which
+// both GCS and S3 mostly share
+var gcsCannedACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+	"project-private":           true,
+}
+
+var s3CannedACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"aws-exec-read":             true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// GCS only ACLs and their closest S3 equivalent, so requests made with the
+// primary bucket in mind work for S3 targets too
+var s3ACLEquivalents = map[string]string{
+	"project-private": "private",
+}
+
+func knownACLs(acls map[string]bool) string {
+	names := []string{}
+	for name := range acls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checkGCSACL fails when acl isn't a canned ACL GCS understands
+func checkGCSACL(acl string) error {
+	if acl != "" && !gcsCannedACLs[acl] {
+		return badRequestf("Invalid acl %q, expected one of %s", acl, knownACLs(gcsCannedACLs))
+	}
+	return nil
+}
+
+// translateACL returns the canned ACL sent when uploading to the target for
+// a requested one, DefaultACL if none was requested. An empty result means
+// no ACL is sent and the bucket's defaults apply.
+func (s *StorageConfig) translateACL(acl string) (string, error) {
+	if acl == "" {
+		acl = s.DefaultACL
+	}
+	if mapped, ok := s.ACLMap[acl]; ok {
+		acl = mapped
+	}
+	if acl == "" || s.ACLMode == ACLIgnore {
+		return "", nil
+	}
+
+	if s.Type != S3 {
+		if !gcsCannedACLs[acl] {
+			return "", badRequestf("ACL %q isn't supported by target %s", acl, s.Name)
+		}
+		return acl, nil
+	}
+
+	if equivalent, ok := s3ACLEquivalents[acl]; ok {
+		acl = equivalent
+	}
+	if !s3CannedACLs[acl] {
+		return "", badRequestf("ACL %q isn't supported by target %s", acl, s.Name)
+	}
+	return acl, nil
+}
+
+func (s *StorageConfig) validateACL() error {
+	switch s.ACLMode {
+	case "", ACLCanned, ACLIgnore:
+	default:
+		return fmt.Errorf("Config error: [Storage %s] invalid ACLMode %q, expected canned or ignore", s.Name, s.ACLMode)
+	}
+
+	if _, err := s.translateACL(""); err != nil {
+		return fmt.Errorf("Config error: [Storage %s] invalid DefaultACL: %v", s.Name, err)
+	}
+	for requested := range s.ACLMap {
+		if _, err := s.translateACL(requested); err != nil {
+			return fmt.Errorf("Config error: [Storage %s] invalid ACLMap: %v", s.Name, err)
+		}
+	}
+	return nil
+}
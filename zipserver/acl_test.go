@@ -0,0 +1,65 @@
+package zipserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TranslateACL(t *testing.T) {
+	s3 := &StorageConfig{Name: "s3", Type: S3, S3Endpoint: "x", S3Region: "x", Bucket: "b"}
+
+	translate := func(target *StorageConfig, requested string) string {
+		acl, err := target.translateACL(requested)
+		require.NoError(t, err)
+		return acl
+	}
+
+	assert.Equal(t, "", translate(s3, ""), "no ACL unless asked for")
+	assert.Equal(t, "public-read", translate(s3, "public-read"))
+	assert.Equal(t, "private", translate(s3, "project-private"), "GCS only ACLs get their S3 equivalent")
+	_, err := s3.translateACL("publicRead")
+	assert.Error(t, err)
+
+	s3.DefaultACL = "public-read"
+	assert.Equal(t, "public-read", translate(s3, ""))
+	assert.Equal(t, "private", translate(s3, "private"))
+
+	s3.ACLMap = map[string]string{"public-read": "", "authenticated-read": "private"}
+	assert.Equal(t, "", translate(s3, ""))
+	assert.Equal(t, "private", translate(s3, "authenticated-read"))
+	assert.NoError(t, s3.Validate())
+
+	r2 := &StorageConfig{Name: "r2", Type: S3, S3Endpoint: "x", S3Region: "auto", Bucket: "b", ACLMode: ACLIgnore}
+	assert.Equal(t, "", translate(r2, "public-read"))
+	assert.Equal(t, "", translate(r2, "anything"), "nothing is sent so nothing is checked")
+	assert.NoError(t, r2.Validate())
+
+	gcs := &StorageConfig{Name: "gcs", Type: GCS, GCSPrivateKeyPath: "x", GCSClientEmail: "x", Bucket: "b"}
+	assert.Equal(t, "project-private", translate(gcs, "project-private"))
+	assert.NoError(t, gcs.Validate())
+
+	// gcs-sdk is only a client for the primary bucket
+	gcsSDK := *gcs
+	gcsSDK.Type = GCSSDK
+	assert.Error(t, gcsSDK.Validate())
+	_, err = gcs.translateACL("aws-exec-read")
+	assert.Error(t, err)
+
+	assert.NoError(t, checkGCSACL(""))
+	assert.NoError(t, checkGCSACL("bucket-owner-full-control"))
+	assert.Error(t, checkGCSACL("public"))
+
+	invalid := *s3
+	invalid.ACLMode = "strict"
+	assert.Error(t, invalid.Validate())
+
+	invalid = *s3
+	invalid.DefaultACL = "aws-exec"
+	assert.Error(t, invalid.Validate())
+
+	invalid = *s3
+	invalid.ACLMap = map[string]string{"public-read": "everyone"}
+	assert.Error(t, invalid.Validate())
+}
@@ -0,0 +1,205 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long clients are asked to wait when AdmissionRetryAfter isn't set
+const defaultAdmissionRetryAfter = time.Second
+
+// admissionSlots counts the requests holding one of limit slots, a limit of
+// 0 means no limit
+type admissionSlots struct {
+	limit   int
+	running int
+}
+
+func (s *admissionSlots) full() bool {
+	return s != nil && s.limit > 0 && s.running >= s.limit
+}
+
+// AdmissionStats is a snapshot of the admission controller for /status
+type AdmissionStats struct {
+	Limit      int
+	Running    int
+	ByEndpoint map[string]AdmissionStats `json:",omitempty"`
+}
+
+// admissionController refuses requests past MaxConcurrentRequests, or past
+// the limit of their endpoint in MaxConcurrentRequestsByEndpoint, instead of
+// letting their jobs pile up. A request holds its slot until it's answered,
+// and until the async job it started is over.
+type admissionController struct {
+	mutex      sync.Mutex
+	global     admissionSlots
+	endpoints  map[string]*admissionSlots
+	retryAfter time.Duration
+}
+
+var admission = newAdmissionController(&Config{})
+
+func setupAdmission(config *Config) {
+	admission = newAdmissionController(config)
+}
+
+func newAdmissionController(config *Config) *admissionController {
+	controller := &admissionController{
+		global:     admissionSlots{limit: config.MaxConcurrentRequests},
+		endpoints:  map[string]*admissionSlots{},
+		retryAfter: time.Duration(config.AdmissionRetryAfter),
+	}
+	for path, limit := range config.MaxConcurrentRequestsByEndpoint {
+		controller.endpoints[path] = &admissionSlots{limit: limit}
+	}
+	if controller.retryAfter <= 0 {
+		controller.retryAfter = defaultAdmissionRetryAfter
+	}
+	return controller
+}
+
+// validateAdmission checks that the per-endpoint limits are for known routes
+func validateAdmission(config *Config) error {
+	if config.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("Config error: MaxConcurrentRequests can't be negative")
+	}
+
+	for path, limit := range config.MaxConcurrentRequestsByEndpoint {
+		known := false
+		for _, route := range routes {
+			known = known || route.path == path
+		}
+		if !known {
+			return fmt.Errorf("Config error: MaxConcurrentRequestsByEndpoint has unknown endpoint %q", path)
+		}
+		if limit < 0 {
+			return fmt.Errorf("Config error: MaxConcurrentRequestsByEndpoint limit of %s can't be negative", path)
+		}
+	}
+	return nil
+}
+
+// admit takes a slot for a request to path, or fails with an overloadedError
+// when there's none left
+func (c *admissionController) admit(path string) (*admissionTicket, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	endpoint := c.endpoints[path]
+	if c.global.full() || endpoint.full() {
+		globalMetrics.TotalRejectedRequests.Add(1)
+		return nil, &overloadedError{path: path, retryAfter: c.retryAfter}
+	}
+
+	c.global.running++
+	if endpoint != nil {
+		endpoint.running++
+	}
+
+	ticket := &admissionTicket{controller: c, path: path}
+	ticket.holders.Store(1)
+	return ticket, nil
+}
+
+func (c *admissionController) release(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.global.running--
+	if endpoint := c.endpoints[path]; endpoint != nil {
+		endpoint.running--
+	}
+}
+
+// Stats returns the current state of the controller
+func (c *admissionController) Stats() AdmissionStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := AdmissionStats{Limit: c.global.limit, Running: c.global.running}
+	if len(c.endpoints) > 0 {
+		stats.ByEndpoint = map[string]AdmissionStats{}
+		for path, endpoint := range c.endpoints {
+			stats.ByEndpoint[path] = AdmissionStats{Limit: endpoint.limit, Running: endpoint.running}
+		}
+	}
+	return stats
+}
+
+// admissionTicket is the slot of an admitted request. It's held by the
+// request, and by the job it started if any, and freed once both let go.
+type admissionTicket struct {
+	controller *admissionController
+	path       string
+	holders    atomic.Int32
+}
+
+// hold keeps the slot taken until a matching release, eg. by an async job
+func (t *admissionTicket) hold() *admissionTicket {
+	if t == nil {
+		return nil
+	}
+	t.holders.Add(1)
+	return t
+}
+
+func (t *admissionTicket) release() {
+	if t == nil {
+		return
+	}
+	if t.holders.Add(-1) == 0 {
+		t.controller.release(t.path)
+	}
+}
+
+type admissionContextKey struct{}
+
+func admissionFromContext(ctx context.Context) *admissionTicket {
+	ticket, _ := ctx.Value(admissionContextKey{}).(*admissionTicket)
+	return ticket
+}
+
+// overloadedError is a request refused by the admission controller, reported
+// with a 429, a Retry-After header and a JSON body
+type overloadedError struct {
+	path       string
+	retryAfter time.Duration
+}
+
+func (e *overloadedError) Error() string {
+	return fmt.Sprintf("zipserver is overloaded, no slot left for a %s request", e.path)
+}
+
+func (e *overloadedError) writeTo(w http.ResponseWriter) {
+	blob, _ := json.Marshal(struct {
+		Type  string
+		Error string
+	}{"Overloaded", e.Error()})
+
+	seconds := int(math.Ceil(e.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(blob)
+}
+
+// admitRequests refuses requests to fn, registered at path, once the
+// admission controller is saturated
+func admitRequests(path string, fn wrapErrors) wrapErrors {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ticket, err := admission.admit(path)
+		if err != nil {
+			return err
+		}
+		defer ticket.release()
+
+		return fn(w, r.WithContext(context.WithValue(r.Context(), admissionContextKey{}, ticket)))
+	}
+}
@@ -0,0 +1,98 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AdmissionController(t *testing.T) {
+	controller := newAdmissionController(&Config{
+		MaxConcurrentRequests:           2,
+		MaxConcurrentRequestsByEndpoint: map[string]int{"/extract": 1},
+	})
+
+	extract, err := controller.admit("/extract")
+	require.NoError(t, err)
+
+	_, err = controller.admit("/extract")
+	var overloaded *overloadedError
+	require.ErrorAs(t, err, &overloaded)
+	assert.Equal(t, defaultAdmissionRetryAfter, overloaded.retryAfter)
+
+	copyTicket, err := controller.admit("/copy")
+	require.NoError(t, err)
+
+	_, err = controller.admit("/list")
+	assert.ErrorAs(t, err, &overloaded)
+
+	stats := controller.Stats()
+	assert.Equal(t, 2, stats.Running)
+	assert.Equal(t, AdmissionStats{Limit: 1, Running: 1}, stats.ByEndpoint["/extract"])
+
+	// a job started by the request keeps the slot until it's over
+	job := jobs.newJob("extract", "zips/game.zip", "games/1", "", time.Second, jobCaller{})
+	job.linkRequest(context.WithValue(context.Background(), admissionContextKey{}, extract))
+	extract.release()
+	copyTicket.release()
+	assert.Equal(t, 1, controller.Stats().Running)
+
+	_, err = controller.admit("/extract")
+	assert.ErrorAs(t, err, &overloaded)
+
+	job.finish(nil)
+	assert.Equal(t, 0, controller.Stats().Running)
+
+	extract, err = controller.admit("/extract")
+	require.NoError(t, err)
+	extract.release()
+
+	assert.NoError(t, validateAdmission(&Config{MaxConcurrentRequestsByEndpoint: map[string]int{"/slurp": 4}}))
+	assert.Error(t, validateAdmission(&Config{MaxConcurrentRequestsByEndpoint: map[string]int{"/unzip": 4}}))
+	assert.Error(t, validateAdmission(&Config{MaxConcurrentRequests: -1}))
+}
+
+func Test_AdmissionRejects(t *testing.T) {
+	oldConfig := globalConfig
+	oldAdmission := admission
+	defer func() {
+		globalConfig = oldConfig
+		admission = oldAdmission
+	}()
+	globalConfig = emptyConfig()
+	globalConfig.MaxConcurrentRequestsByEndpoint = map[string]int{"/extract": 1}
+	globalConfig.AdmissionRetryAfter = Duration(1500 * time.Millisecond)
+	setupAdmission(globalConfig)
+
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, ""))
+
+	request := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		return rec
+	}
+
+	ticket, err := admission.admit("/extract")
+	require.NoError(t, err)
+
+	rec := request("/extract?key=a.zip&prefix=b")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	var body struct{ Type, Error string }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "Overloaded", body.Type)
+
+	assert.Equal(t, http.StatusOK, request("/status").Code)
+
+	ticket.release()
+	assert.NotEqual(t, http.StatusTooManyRequests, request("/extract").Code)
+	assert.Equal(t, 0, admission.Stats().Running)
+}
@@ -0,0 +1,360 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The /v2 API serves every route under /v2 with JSON request bodies, camelCase
+// JSON responses and errors, and JSON callbacks. It runs the same handlers as
+// the legacy routes, which are left as they are.
+
+const v2Prefix = "/v2"
+
+// how big a /v2 JSON request body can be
+const maxV2BodySize = 1024 * 1024
+
+// routes whose handler reads a JSON body of its own, their params can only
+// be passed in the query string
+var v2RawBodyRoutes = map[string]bool{
+	"/compare_manifest": true,
+	"/exists":           true,
+}
+
+// objects keyed by data rather than field names, eg. storage keys, their keys
+// are left as they are
+var v2DataMaps = map[string]bool{
+	"Exists":     true,
+	"ByEndpoint": true,
+}
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+type apiVersionContextKey struct{}
+
+// apiVersionFromContext is 2 for /v2 requests, 0 for legacy ones
+func apiVersionFromContext(ctx context.Context) int {
+	version, _ := ctx.Value(apiVersionContextKey{}).(int)
+	return version
+}
+
+// v2Handler takes params from a JSON body as well as the query string,
+// rewrites JSON responses in camelCase and reports errors as JSON
+func v2Handler(fn wrapErrors) wrapErrors {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		r, err := v2Request(w, r)
+		if err != nil {
+			return &v2Error{err}
+		}
+
+		rw := &v2ResponseWriter{ResponseWriter: w}
+		err = fn(rw, r)
+		if err != nil {
+			// drop what was buffered, the error is the response
+			rw.buffer = nil
+			return &v2Error{err}
+		}
+		rw.finish()
+		return nil
+	}
+}
+
+// v2Request is r with the fields of its JSON body added to the query string,
+// and every camelCase param also under its snake_case name
+func v2Request(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	params := r.URL.Query()
+
+	// only a JSON body is read as params, anything else (eg. an uploaded zip)
+	// is left for the handler
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	consumedBody := mediaType == "application/json" && !v2RawBodyRoutes[r.URL.Path]
+	if consumedBody {
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxV2BodySize))
+		decoder.UseNumber()
+
+		var fields map[string]interface{}
+		if err := decoder.Decode(&fields); err != nil && err != io.EOF {
+			return nil, badRequestf("Invalid JSON body, expected an object: %v", err)
+		}
+
+		for name, value := range fields {
+			values, err := v2ParamValues(value)
+			if err != nil {
+				return nil, badRequestf("Invalid field %s: %v", name, err)
+			}
+			params[name] = append(params[name], values...)
+		}
+	}
+
+	for name, values := range params {
+		if snake := snakeCase(name); snake != name {
+			if _, ok := params[snake]; !ok {
+				params[snake] = values
+			}
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), apiVersionContextKey{}, 2)
+	r = r.Clone(ctx)
+	r.URL.RawQuery = params.Encode()
+	if consumedBody {
+		r.Body = http.NoBody
+	}
+	return r, nil
+}
+
+// v2ParamValues are the param values for a JSON field: arrays are repeated
+// params, objects are passed as JSON
+func v2ParamValues(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case json.Number:
+		return []string{value.String()}, nil
+	case bool:
+		return []string{strconv.FormatBool(value)}, nil
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if _, ok := item.([]interface{}); ok {
+				return nil, fmt.Errorf("nested arrays aren't supported")
+			}
+			itemValues, err := v2ParamValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	default:
+		blob, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(blob)}, nil
+	}
+}
+
+// v2Error is reported as {"error": "..."}, or for an error with a response of
+// its own, that response in camelCase
+type v2Error struct {
+	err error
+}
+
+func (e *v2Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *v2Error) Unwrap() error {
+	return e.err
+}
+
+func (e *v2Error) writeTo(w http.ResponseWriter) {
+	rw := &v2ResponseWriter{ResponseWriter: w}
+	defer rw.finish()
+
+	var custom responseError
+	if errors.As(e.err, &custom) {
+		custom.writeTo(rw)
+		return
+	}
+
+	blob, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{e.err.Error()})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(errorStatus(e.err))
+	rw.Write(blob)
+}
+
+// v2ResponseWriter holds back JSON responses to rewrite them in camelCase,
+// anything else goes through as is
+type v2ResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// nil unless the response is JSON
+	buffer *bytes.Buffer
+}
+
+func (w *v2ResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType == "application/json" {
+		w.buffer = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *v2ResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffer != nil {
+		return w.buffer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes through for streamed responses
+func (w *v2ResponseWriter) Flush() {
+	if w.buffer != nil {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the held back JSON response
+func (w *v2ResponseWriter) finish() {
+	if w.buffer == nil {
+		return
+	}
+
+	blob, err := camelCaseJSON(w.buffer.Bytes())
+	if err != nil {
+		blob = w.buffer.Bytes()
+	}
+	w.buffer = nil
+
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(blob)
+}
+
+// camelCaseJSON renames the object keys in blob to camelCase
+func camelCaseJSON(blob []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(blob))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(camelCaseKeys(value))
+}
+
+func camelCaseKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			if v2DataMaps[key] {
+				renamed[camelCase(key)] = child
+			} else {
+				renamed[camelCase(key)] = camelCaseKeys(child)
+			}
+		}
+		return renamed
+	case []interface{}:
+		for i, child := range value {
+			value[i] = camelCaseKeys(child)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// nameWords splits a Go or snake_case name into words, eg. JobID into Job
+// and ID. Names that aren't identifiers, eg. storage keys, are one word.
+func nameWords(name string) []string {
+	if !identifierPattern.MatchString(name) {
+		return []string{name}
+	}
+
+	var words []string
+	for _, part := range strings.Split(name, "_") {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			if !unicode.IsUpper(runes[i]) {
+				continue
+			}
+			// a new word after a lowercase letter or digit, or at the end of
+			// an acronym, eg. the Tag of ETag
+			if !unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+		}
+		if start < len(runes) {
+			words = append(words, string(runes[start:]))
+		}
+	}
+	return words
+}
+
+// camelCase is the /v2 name of a field, eg. jobId for JobID or copyLocks for
+// copy_locks
+func camelCase(name string) string {
+	words := nameWords(name)
+	if len(words) == 1 && !identifierPattern.MatchString(name) {
+		return name
+	}
+
+	var out strings.Builder
+	for i, word := range words {
+		word = strings.ToLower(word)
+		if i > 0 && word != "" {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		out.WriteString(word)
+	}
+	return out.String()
+}
+
+// snakeCase is the legacy name of a /v2 param, eg. if_not_exists for
+// ifNotExists
+func snakeCase(name string) string {
+	words := nameWords(name)
+	for i, word := range words {
+		words[i] = strings.ToLower(word)
+	}
+	return strings.Join(words, "_")
+}
+
+// callbackJSON is the JSON callback body of a /v2 job: result, a struct or
+// map marshaled as in responses, with fields added and every key in
+// camelCase like /v2 responses
+func callbackJSON(result interface{}, fields callbackFields) string {
+	body := map[string]interface{}{}
+	for _, value := range []interface{}{result, fields} {
+		if value == nil {
+			continue
+		}
+		blob, err := json.Marshal(value)
+		if err != nil {
+			log.Print("Failed to encode callback: ", err)
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(blob))
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			log.Print("Failed to encode callback: ", err)
+		}
+	}
+
+	blob, _ := json.Marshal(camelCaseKeys(body))
+	return string(blob)
+}
@@ -0,0 +1,230 @@
+package zipserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_V2Names(t *testing.T) {
+	for name, expected := range map[string]string{
+		"JobID":               "jobId",
+		"ETag":                "eTag",
+		"TotalExtractedFiles": "totalExtractedFiles",
+		"copy_locks":          "copyLocks",
+		"extraction_threads":  "extractionThreads",
+		"Md5":                 "md5",
+		"URL":                 "url",
+		"games/1/Index.html":  "games/1/Index.html",
+		"/delete":             "/delete",
+	} {
+		assert.Equal(t, expected, camelCase(name), name)
+	}
+
+	for name, expected := range map[string]string{
+		"ifNotExists":           "if_not_exists",
+		"contentDisposition":    "content_disposition",
+		"key":                   "key",
+		"maxExtractionDuration": "max_extraction_duration",
+	} {
+		assert.Equal(t, expected, snakeCase(name), name)
+	}
+}
+
+func Test_CallbackJSON(t *testing.T) {
+	result := struct {
+		Success bool
+		*ExtractResult
+	}{true, &ExtractResult{
+		TotalBytes: 42,
+		ExtractedFiles: []ExtractedFile{
+			{Key: "games/1/index.html", Size: 40},
+			{Key: "games/1/true", Size: 2, Metadata: map[string]interface{}{"video": &VideoMetadata{Width: 640}}},
+		},
+		DeniedFiles: []DeniedFile{{Name: "123", Reason: "404"}},
+	}}
+
+	var callback struct {
+		Success        bool
+		JobID          string `json:"jobId"`
+		Attempt        int
+		TotalBytes     int
+		ExtractedFiles []struct {
+			Key      string
+			Size     int
+			Metadata *struct {
+				Video struct{ Width int }
+			}
+		}
+		DeniedFiles []struct {
+			Name   string
+			Reason string
+		}
+	}
+	body := callbackJSON(result, callbackFields{JobID: "1234", Attempt: 2})
+	require.NoError(t, json.Unmarshal([]byte(body), &callback))
+	assert.True(t, callback.Success)
+	assert.Equal(t, "1234", callback.JobID)
+	assert.Equal(t, 2, callback.Attempt)
+	assert.Equal(t, 42, callback.TotalBytes)
+	require.Len(t, callback.ExtractedFiles, 2)
+	assert.Equal(t, "games/1/index.html", callback.ExtractedFiles[0].Key)
+	assert.Equal(t, 40, callback.ExtractedFiles[0].Size)
+	assert.Nil(t, callback.ExtractedFiles[0].Metadata)
+	assert.Equal(t, "games/1/true", callback.ExtractedFiles[1].Key)
+	assert.Equal(t, 640, callback.ExtractedFiles[1].Metadata.Video.Width)
+	// strings stay strings, whatever they look like
+	require.Len(t, callback.DeniedFiles, 1)
+	assert.Equal(t, "404", callback.DeniedFiles[0].Reason)
+	assert.Contains(t, body, `"name":"123"`)
+
+	// /renameprefix's prefixes, and error details
+	body = callbackJSON(struct {
+		Success bool
+		From    string
+		To      string
+		Renamed int
+	}{true, "1", "true", 3}, callbackFields{})
+	assert.JSONEq(t, `{"success": true, "from": "1", "to": "true", "renamed": 3}`, body)
+
+	body = callbackJSON(map[string]interface{}{
+		"Type":       "MalwareDetected",
+		"Detections": []MalwareDetection{{Name: "a.exe", Signature: "1"}},
+	}, callbackFields{})
+	assert.JSONEq(t, `{"type": "MalwareDetected", "detections": [{"name": "a.exe", "signature": "1"}]}`, body)
+}
+
+func Test_V2Routes(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+	defer setReadOnly(false, "")
+
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, ""))
+
+	request := func(target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// params from the JSON body, camelCase response
+	rec := request("/v2/readonly", `{"enabled": true, "reason": "storage migration"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.Equal(t, true, state["enabled"])
+	assert.Equal(t, "storage migration", state["reason"])
+
+	// a response of its own, in camelCase
+	rec = request("/v2/delete", `{"prefix": "games/1"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"type": "ReadOnly", "error": "zipserver is read-only: storage migration", "reason": "storage migration"}`, rec.Body.String())
+
+	// the legacy route is left as it was
+	rec = request("/readonly", "")
+	assert.Contains(t, rec.Body.String(), `"Enabled":true`)
+
+	rec = request("/v2/readonly", `{"enabled": "maybe"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"error": "Invalid enabled param \"maybe\""}`, rec.Body.String())
+
+	rec = request("/v2/readonly", `[1, 2]`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error"`)
+
+	rec = request("/v2/job/nope", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"type": "JobNotFound", "error": "No job with ID nope"}`, rec.Body.String())
+
+	// non-JSON responses go through as they are
+	rec = request("/v2/metrics", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Header().Get("Content-Type"), "json")
+}
+
+func Test_V2JobCallbacks(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	job := jobs.newJob("copy", "zips/1.zip", "", server.URL, time.Second, jobCaller{})
+	job.APIVersion = 2
+	values := url.Values{}
+	values.Set("Success", "true")
+	values.Set("Size", "12")
+	require.NoError(t, notifyCallback(server.URL, time.Second, job, values, struct {
+		Success bool
+		Size    int
+		Md5     string
+	}{true, 12, "1234"}))
+
+	r := <-received
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	var callback map[string]interface{}
+	require.NoError(t, json.Unmarshal(<-bodies, &callback))
+	assert.Equal(t, true, callback["success"])
+	assert.EqualValues(t, 12, callback["size"])
+	assert.Equal(t, "1234", callback["md5"])
+	assert.Equal(t, job.ID, callback["jobId"])
+}
+
+func Test_V2Upload(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	contents := []byte("PK\x03\x04 pretend zip")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "game.zip")
+	require.NoError(t, err)
+	fw.Write(contents)
+	require.NoError(t, mw.Close())
+
+	for contentType, body := range map[string][]byte{
+		"application/zip":        contents,
+		mw.FormDataContentType(): buf.Bytes(),
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v2/extract?prefix=games/1", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+
+		// the uploaded zip is left for the handler to read
+		req, err := v2Request(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "games/1", req.URL.Query().Get("prefix"))
+
+		fname, err := saveUploadedZip(httptest.NewRecorder(), req, 1024)
+		require.NoError(t, err, contentType)
+		saved, err := os.ReadFile(fname)
+		os.Remove(fname)
+		require.NoError(t, err)
+		assert.EqualValues(t, contents, saved, contentType)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"mime"
@@ -13,6 +15,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"archive/zip"
@@ -20,9 +23,9 @@ import (
 	errors "github.com/go-errors/errors"
 )
 
-var (
-	tmpDir = "zip_tmp"
-)
+// tempExtractPrefix is where CLI and test extractions are written. Objects
+// under it are tagged with an expiry and removed by PurgeExpiredExtractions.
+const tempExtractPrefix = "_zipserver"
 
 func init() {
 	mime.AddExtensionType(".unityweb", "application/octet-stream")
@@ -38,17 +41,140 @@ type Archiver struct {
 	*Config
 }
 
+// ExtractOptions holds per-job settings that change how extracted files are
+// stored, the zero value stores files as-is
+type ExtractOptions struct {
+	// tags every uploaded object as temporary, see PurgeExpiredExtractions
+	ExpiresAt time.Time
+	// applied to every text/html file that isn't pre-compressed
+	HTMLTransforms []HTMLTransform
+	// uploads a filetree.json listing alongside the extracted files
+	FileTree bool
+	// added to the configured IgnorePatterns
+	IgnorePatterns []string
+	// checked along with the configured ContentPolicy, files have to pass both
+	ContentPolicy ContentPolicy
+	// when set, filled in with the files the content policies left out
+	DeniedFiles *[]DeniedFile
+	// overrides Config.EmptyEntryPolicy
+	EmptyEntryPolicy EmptyEntryPolicy
+	// fail with PrefixNotEmptyError rather than mixing with existing files
+	RequireEmptyPrefix bool
+	// decrypts encrypted entries, see openZipEntry
+	Password string
+	// keeps files unchanged since the previous extraction to the prefix and
+	// deletes the ones no longer in the zip, see reuseExtractedFiles
+	Incremental bool
+	// only extracts one kind of file, eg. videos along with their metadata
+	Contents ExtractContents
+	// removes EXIF and XMP metadata from jpeg, png and webp files, see
+	// stripImageMetadata
+	StripImageMetadata bool
+	// stores files at other keys than prefix/name, see KeyTemplate
+	KeyTemplate *KeyTemplate
+
+	// when set, filled in with the results of the malware scan, see
+	// ClamAVConfig
+	ScanReport *ScanReport
+
+	// set by analyzeContents when extracting a kind of contents
+	analyses fileAnalyses
+	buffers  *bufferedEntries
+}
+
 // ExtractedFile represents a file extracted from a .zip into a GCS bucket
 type ExtractedFile struct {
-	Key  string
-	Size uint64
+	Key             string
+	Size            uint64
+	MD5             string `json:",omitempty"` // hex encoded checksum of the stored bytes
+	ContentType     string `json:",omitempty"`
+	ContentEncoding string `json:",omitempty"`
+	// Unix permissions in octal (eg. "0755"), for entries from zips made on Unix
+	Mode string `json:",omitempty"`
+	// of the zip entry the file came from, used by incremental extractions
+	CRC32 uint32 `json:",omitempty"`
+	// hex encoded sha256 of the zip entry as it was in the zip, before HTML
+	// transforms, used by /compare_manifest
+	SHA256 string `json:",omitempty"`
+	// what the analyzer of the extraction's contents found out, under its
+	// name, eg. a *VideoMetadata under "video"
+	Metadata map[string]interface{} `json:",omitempty"`
+}
+
+// ExtractionDurationError is returned when an extraction runs past
+// MaxExtractionDuration, along with how far it got
+type ExtractionDurationError struct {
+	MaxDuration    time.Duration
+	FilesCompleted int
+	BytesUploaded  uint64
+}
+
+func (e *ExtractionDurationError) Error() string {
+	return fmt.Sprintf("Extraction took longer than %v (%d files, %d bytes uploaded)",
+		e.MaxDuration, e.FilesCompleted, e.BytesUploaded)
+}
+
+// UploadFailure groups the extracted files that failed to upload with the
+// same error
+type UploadFailure struct {
+	Error       string
+	Count       int
+	ExampleKeys []string
+}
+
+// maxFailureExampleKeys is how many keys are kept per UploadFailure
+const maxFailureExampleKeys = 3
+
+// UploadFailuresError reports every distinct error the upload workers ran
+// into, so a systemic problem (eg. permission denied) is obvious from the
+// first failure report
+type UploadFailuresError struct {
+	Failures []UploadFailure
+	first    error
+}
+
+func (e *UploadFailuresError) add(key string, err error) {
+	if e.first == nil {
+		e.first = err
+	}
+
+	message := err.Error()
+	for i := range e.Failures {
+		failure := &e.Failures[i]
+		if failure.Error == message {
+			failure.Count++
+			if len(failure.ExampleKeys) < maxFailureExampleKeys {
+				failure.ExampleKeys = append(failure.ExampleKeys, key)
+			}
+			return
+		}
+	}
+
+	e.Failures = append(e.Failures, UploadFailure{message, 1, []string{key}})
+}
+
+func (e *UploadFailuresError) Error() string {
+	if len(e.Failures) == 1 && e.Failures[0].Count == 1 {
+		return e.Failures[0].Error
+	}
+
+	descriptions := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%d files, eg. %s)",
+			failure.Error, failure.Count, strings.Join(failure.ExampleKeys, ", ")))
+	}
+	return fmt.Sprintf("%d distinct upload errors: %s", len(e.Failures), strings.Join(descriptions, "; "))
+}
+
+func (e *UploadFailuresError) Unwrap() error {
+	return e.first
 }
 
 // NewArchiver creates a new archiver from the given config
 func NewArchiver(config *Config) *Archiver {
-	storage, err := NewGcsStorage(config)
+	storage, err := NewPrimaryStorage(config)
 
-	if storage == nil {
+	if err != nil {
 		log.Fatal("Failed to create storage:", err)
 	}
 
@@ -62,32 +188,56 @@ func fetchZipFilename(bucket, key string) string {
 }
 
 func (a *Archiver) fetchZip(ctx context.Context, key string) (string, error) {
-	os.MkdirAll(tmpDir, os.ModeDir|0777)
+	ctx, span := startSpan(ctx, "fetchZip", "zipserver.key", key)
+	fname, err := a.downloadZip(ctx, key)
+	span.finish(err)
+	return fname, err
+}
 
+// downloadZip stores the object at key in a temporary file
+func (a *Archiver) downloadZip(ctx context.Context, key string) (string, error) {
 	fname := fetchZipFilename(a.Bucket, key)
-	fname = path.Join(tmpDir, fname)
-
-	src, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
-	if err != nil {
-		return "", errors.Wrap(err, 0)
-	}
-
-	defer src.Close()
+	fname = path.Join(a.tempDir(ctx), fname)
 
 	dest, err := os.Create(fname)
 	if err != nil {
 		return "", errors.Wrap(err, 0)
 	}
-	_, err = os.Stat(fname)
 
 	defer func() {
 		dest.Close()
-		// Clean up if io.Copy below errs.
+		// Clean up if the download below errs.
 		if err != nil {
 			os.Remove(fname)
 		}
 	}()
 
+	if a.Config.DownloadThreads > 1 {
+		err = a.downloadRanged(ctx, key, dest)
+		if err == nil {
+			return fname, nil
+		}
+		if !errors.Is(err, errRangesUnavailable) {
+			return "", err
+		}
+
+		// start over with a single stream
+		_, err = dest.Seek(0, io.SeekStart)
+		if err == nil {
+			err = dest.Truncate(0)
+		}
+		if err != nil {
+			return "", errors.Wrap(err, 0)
+		}
+	}
+
+	src, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	defer src.Close()
+
 	_, err = io.Copy(dest, src)
 	if err != nil {
 		return "", errors.Wrap(err, 0)
@@ -96,58 +246,50 @@ func (a *Archiver) fetchZip(ctx context.Context, key string) (string, error) {
 	return fname, nil
 }
 
-// delete all files that have been uploaded so far
+// delete all files that have been uploaded so far. It runs in detached
+// contexts, since the extraction's may have been canceled, which is when
+// cleaning up matters most.
 func (a *Archiver) abortUpload(files []ExtractedFile) error {
+	failed := 0
 	for _, file := range files {
-		// FIXME: code quality - what if we fail here? any retry strategies?
-		ctx := context.Background()
-		a.Storage.DeleteFile(ctx, a.Bucket, file.Key)
-	}
-
-	return nil
-}
-
-func shouldIgnoreFile(fname string) bool {
-	if strings.HasSuffix(fname, "/") {
-		return true
-	}
-
-	if strings.Contains(fname, "..") {
-		return true
-	}
-
-	if strings.Contains(fname, "__MACOSX/") {
-		return true
-	}
-
-	if strings.Contains(fname, ".git/") {
-		return true
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.Config.FilePutTimeout))
+		err := a.Storage.DeleteFile(ctx, a.Bucket, file.Key)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to delete %s after an aborted extraction: %v", file.Key, err)
+			failed++
+		}
 	}
 
-	if path.IsAbs(fname) {
-		return true
+	if failed > 0 {
+		return fmt.Errorf("Failed to delete %d of %d uploaded files", failed, len(files))
 	}
-
-	return false
+	return nil
 }
 
 // UploadFileTask contains the information needed to extract a single file from a .zip
 type UploadFileTask struct {
 	File *zip.File
 	Key  string
+	// set instead of Key when the key template needs the contents of the
+	// file, the worker reads them to work out the key
+	Prefix string
 }
 
 // UploadFileResult is successful is Error is nil - in that case, it contains the
 // GCS key the file was uploaded under, and the number of bytes written for that file.
 type UploadFileResult struct {
-	Error error
-	Key   string
-	Size  uint64
+	Error       error
+	Key         string
+	Size        uint64
+	ContentType string
+	File        ExtractedFile // what's listed in results and the manifest
 }
 
 func uploadWorker(
 	ctx context.Context,
 	a *Archiver,
+	opts *ExtractOptions,
 	tasks <-chan UploadFileTask,
 	results chan<- UploadFileResult,
 	done chan struct{},
@@ -155,21 +297,164 @@ func uploadWorker(
 	defer func() { done <- struct{}{} }()
 
 	for task := range tasks {
+		// don't start another upload once the extraction was canceled
+		if err := ctx.Err(); err != nil {
+			results <- UploadFileResult{Error: err, Key: task.Key}
+			return
+		}
+
 		file := task.File
 		key := task.Key
 
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FilePutTimeout))
-		resource, err := a.extractAndUploadOne(ctx, key, file)
-		cancel() // Free resources now instead of deferring till func returns
+		if key == "" {
+			var err error
+			key, err = opts.contentKey(task.Prefix, file)
+			if err != nil {
+				logPrint(ctx, "Failed working out the key of "+file.Name+": "+err.Error())
+				results <- UploadFileResult{Error: err, Key: file.Name}
+				return
+			}
+		}
+
+		uploadCtx, span := startSpan(ctx, "upload",
+			"zipserver.source", file.Name, "zipserver.key", key, "zipserver.target", primaryTargetLabel)
+		resource, err := a.extractWithRetries(uploadCtx, key, file, opts)
+		span.finish(err)
 
 		if err != nil {
-			log.Print("Failed sending " + key + ": " + err.Error())
-			results <- UploadFileResult{err, key, 0}
+			logPrint(ctx, "Failed sending "+key+": "+err.Error())
+			results <- UploadFileResult{Error: err, Key: key}
 			return
 		}
 
-		results <- UploadFileResult{nil, resource.key, resource.size}
+		results <- UploadFileResult{
+			Key:         resource.key,
+			Size:        resource.size,
+			ContentType: resource.contentType,
+			File:        resource.extractedFile(),
+		}
+	}
+}
+
+// LimitViolation is an extraction limit a zip goes over
+type LimitViolation struct {
+	Limit   string // eg. MaxFileSize
+	Name    string `json:",omitempty"` // the entry at fault, if any
+	Message string
+}
+
+// LimitError is returned when an archive goes over an extraction limit
+type LimitError struct {
+	LimitViolation
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// selectZipFiles checks the zip's entries against limits and returns the ones
+// that should be extracted
+func (a *Archiver) selectZipFiles(ctx context.Context, files []*zip.File, limits *ExtractLimits, opts *ExtractOptions) ([]*zip.File, error) {
+	fileList, violations := a.checkZipFiles(ctx, files, limits, opts, true)
+	if len(violations) > 0 {
+		return nil, errors.Wrap(&LimitError{violations[0]}, 0)
+	}
+	return fileList, nil
+}
+
+// checkZipFiles returns the entries that should be extracted, along with every
+// limit they go over. With stopEarly, it returns at the first violation.
+func (a *Archiver) checkZipFiles(ctx context.Context, files []*zip.File, limits *ExtractLimits, opts *ExtractOptions, stopEarly bool) ([]*zip.File, []LimitViolation) {
+	violations := []LimitViolation{}
+
+	if len(files) > limits.MaxNumFiles {
+		violations = append(violations, LimitViolation{
+			Limit:   "MaxNumFiles",
+			Message: fmt.Sprintf("Too many files in zip (%v > %v)", len(files), limits.MaxNumFiles),
+		})
+		if stopEarly {
+			return nil, violations
+		}
+	}
+
+	ignorePatterns := append([]string{}, a.Config.ignorePatterns()...)
+	ignorePatterns = append(ignorePatterns, opts.IgnorePatterns...)
+
+	emptyEntryPolicy := opts.EmptyEntryPolicy
+	if emptyEntryPolicy == "" {
+		emptyEntryPolicy = a.Config.EmptyEntryPolicy
+	}
+	directories := zipDirectories(files)
+
+	var byteCount uint64
+	fileList := []*zip.File{}
+
+	for _, file := range files {
+		if shouldIgnoreFile(file.Name, ignorePatterns) {
+			logPrintf(ctx, "Ignoring file %s", file.Name)
+			continue
+		}
+
+		if shouldSkipEmptyEntry(file, directories, emptyEntryPolicy) {
+			logPrintf(ctx, "Skipping empty entry %s", file.Name)
+			continue
+		}
+
+		fileViolations := []LimitViolation{}
+
+		if opts.FileTree && file.Name == fileTreeName {
+			fileViolations = append(fileViolations, LimitViolation{
+				Limit:   "FileTree",
+				Name:    file.Name,
+				Message: fmt.Sprintf("Zip contains %s, which is reserved for the file tree", fileTreeName),
+			})
+		}
+
+		if len(file.Name) > limits.MaxFileNameLength {
+			fileViolations = append(fileViolations, LimitViolation{
+				Limit:   "MaxFileNameLength",
+				Name:    file.Name,
+				Message: "Zip contains file paths that are too long",
+			})
+		}
+
+		if a.Config.MaxEntrySize > 0 && file.UncompressedSize64 > a.Config.MaxEntrySize {
+			fileViolations = append(fileViolations, LimitViolation{
+				Limit: "MaxEntrySize",
+				Name:  file.Name,
+				Message: fmt.Sprintf("Zip entry %s is too large (%v bytes, server max %v)", file.Name,
+					file.UncompressedSize64, a.Config.MaxEntrySize),
+			})
+		}
+
+		if file.UncompressedSize64 > limits.MaxFileSize {
+			fileViolations = append(fileViolations, LimitViolation{
+				Limit:   "MaxFileSize",
+				Name:    file.Name,
+				Message: fmt.Sprintf("Zip contains file that is too large (%s)", file.Name),
+			})
+		}
+
+		previousCount := byteCount
+		byteCount += file.UncompressedSize64
+
+		// only reported once, for the entry that crosses the limit
+		if byteCount > limits.MaxTotalSize && previousCount <= limits.MaxTotalSize {
+			fileViolations = append(fileViolations, LimitViolation{
+				Limit:   "MaxTotalSize",
+				Message: fmt.Sprintf("Extracted zip too large (max %v bytes)", limits.MaxTotalSize),
+			})
+		}
+
+		violations = append(violations, fileViolations...)
+		if stopEarly && len(violations) > 0 {
+			return nil, violations
+		}
+
+		fileList = append(fileList, file)
 	}
+
+	return fileList, violations
 }
 
 // extracts and sends all files to prefix
@@ -177,93 +462,163 @@ func (a *Archiver) sendZipExtracted(
 	ctx context.Context,
 	prefix, fname string,
 	limits *ExtractLimits,
+	opts *ExtractOptions,
 ) ([]ExtractedFile, error) {
-	zipReader, err := zip.OpenReader(fname)
+	extractStart := time.Now()
+
+	if opts.RequireEmptyPrefix {
+		err := a.checkPrefixEmpty(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cleanup, err := a.withTempDir(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, 0)
+		return nil, err
+	}
+	defer cleanup()
+
+	zipReader, err := a.openArchive(ctx, fname, limits, opts)
+	if err != nil {
+		return nil, err
 	}
 
 	defer zipReader.Close()
 
-	if len(zipReader.File) > limits.MaxNumFiles {
-		err := fmt.Errorf("Too many files in zip (%v > %v)",
-			len(zipReader.File), limits.MaxNumFiles)
+	fileList, err := a.selectZipFiles(ctx, zipReader.File, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkZipPassword(fileList, opts.Password)
+	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
 
-	extractedFiles := []ExtractedFile{}
+	fileList, denied, err := a.applyContentPolicies(fileList, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DeniedFiles != nil {
+		*opts.DeniedFiles = denied
+	}
 
-	fileCount := 0
-	var byteCount uint64
+	fileList, opts.analyses = a.analyzeContents(ctx, fileList, opts)
+	defer opts.buffers.release()
 
-	fileList := []*zip.File{}
+	fileList, denied = a.applyRenamedContentPolicies(fileList, opts)
+	if opts.DeniedFiles != nil {
+		*opts.DeniedFiles = append(*opts.DeniedFiles, denied...)
+	}
 
-	for _, file := range zipReader.File {
-		if shouldIgnoreFile(file.Name) {
-			log.Printf("Ignoring file %s", file.Name)
-			continue
-		}
+	err = checkTemplatedKeys(prefix, fileList, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
 
-		if len(file.Name) > limits.MaxFileNameLength {
-			err := fmt.Errorf("Zip contains file paths that are too long")
-			return nil, errors.Wrap(err, 0)
+	var previous *ExtractManifest
+	if opts.Incremental {
+		previous, err = a.loadExtractManifest(ctx, prefix)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if file.UncompressedSize64 > limits.MaxFileSize {
-			err := fmt.Errorf("Zip contains file that is too large (%s)", file.Name)
-			return nil, errors.Wrap(err, 0)
-		}
+	fileList, reusedFiles := reuseExtractedFiles(prefix, fileList, previous)
+	if len(reusedFiles) > 0 {
+		logPrintf(ctx, "Keeping %d unchanged files under %s", len(reusedFiles), prefix)
+	}
 
-		byteCount += file.UncompressedSize64
+	threads, err := extractionThreadBudget.Acquire(ctx, limits.ExtractionThreads)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	defer extractionThreadBudget.Release(threads)
+	if threads < limits.ExtractionThreads {
+		logPrintf(ctx, "Extracting with %d of %d threads, the rest are busy", threads, limits.ExtractionThreads)
+	}
 
-		if byteCount > limits.MaxTotalSize {
-			err := fmt.Errorf("Extracted zip too large (max %v bytes)", limits.MaxTotalSize)
-			return nil, errors.Wrap(err, 0)
+	if a.Config.ClamAV.Address != "" {
+		var report *ScanReport
+		fileList, report, err = a.scanZipFiles(ctx, fileList, threads, opts)
+		if err != nil {
+			return nil, err
 		}
+		if opts.ScanReport != nil {
+			*opts.ScanReport = *report
+		}
+	}
 
-		fileList = append(fileList, file)
+	extractedFiles := []ExtractedFile{}
+	treeEntries := []fileTreeEntry{}
+	for _, reused := range reusedFiles {
+		treeEntries = append(treeEntries, fileTreeEntry{reused.Key, reused.Size, reused.ContentType})
 	}
 
+	fileCount := 0
+	startTime := time.Now()
+
+	job := jobFromContext(ctx)
+	job.setTotalFiles(len(fileList))
+
 	tasks := make(chan UploadFileTask)
 	results := make(chan UploadFileResult)
-	done := make(chan struct{}, limits.ExtractionThreads)
+	done := make(chan struct{}, threads)
 
 	// Context can be canceled by caller or when an individual task fails.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	for i := 0; i < limits.ExtractionThreads; i++ {
-		go uploadWorker(ctx, a, tasks, results, done)
+	// Set when MaxExtractionDuration is hit, to tell it apart from the job timeout
+	var durationExceeded atomic.Bool
+	if limits.MaxExtractionDuration > 0 {
+		timer := time.AfterFunc(limits.MaxExtractionDuration, func() {
+			durationExceeded.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	for i := 0; i < threads; i++ {
+		go uploadWorker(ctx, a, opts, tasks, results, done)
 	}
 
-	activeWorkers := limits.ExtractionThreads
+	activeWorkers := threads
 
 	go func() {
 		defer func() { close(tasks) }()
 		for _, file := range fileList {
-			key := path.Join(prefix, file.Name)
-			task := UploadFileTask{file, key}
+			// templates were checked against every file by checkTemplatedKeys
+			key, _ := opts.storedKey(prefix, file)
+			task := UploadFileTask{File: file, Key: key, Prefix: prefix}
 			select {
 			case tasks <- task:
 			case <-ctx.Done():
 				// Something went wrong!
-				log.Println("Remaining tasks were canceled")
+				logPrint(ctx, "Remaining tasks were canceled")
 				return
 			}
 		}
 	}()
 
 	var extractError error
+	failures := &UploadFailuresError{}
 
 	for activeWorkers > 0 {
 		select {
 		case result := <-results:
 			if result.Error != nil {
-				extractError = result.Error
+				// workers interrupted by the first failure aren't worth reporting
+				if failures.first == nil || !errors.Is(result.Error, context.Canceled) {
+					failures.add(result.Key, result.Error)
+				}
 				cancel()
 			} else {
-				extractedFiles = append(extractedFiles, ExtractedFile{result.Key, result.Size})
+				extractedFiles = append(extractedFiles, result.File)
+				treeEntries = append(treeEntries, fileTreeEntry{result.Key, result.Size, result.ContentType})
 				fileCount++
+				job.addProgress(1, result.Size)
 			}
 		case <-done:
 			activeWorkers--
@@ -272,27 +627,71 @@ func (a *Archiver) sendZipExtracted(
 
 	close(results)
 
+	if failures.first != nil {
+		extractError = failures
+	}
+
+	if durationExceeded.Load() {
+		durationError := &ExtractionDurationError{
+			MaxDuration:    limits.MaxExtractionDuration,
+			FilesCompleted: fileCount,
+		}
+		for _, extractedFile := range extractedFiles {
+			durationError.BytesUploaded += extractedFile.Size
+		}
+		extractError = durationError
+	}
+
+	// the manifest and results list kept files too, only uploads are aborted
+	allFiles := append(reusedFiles, extractedFiles...)
+
+	if extractError == nil {
+		putCtx, putCancel := context.WithTimeout(ctx, time.Duration(a.Config.FilePutTimeout))
+		_, extractError = a.uploadExtractManifest(putCtx, prefix, fname, allFiles, opts)
+		putCancel()
+	}
+
+	if extractError == nil && opts.FileTree {
+		putCtx, putCancel := context.WithTimeout(ctx, time.Duration(a.Config.FilePutTimeout))
+		_, extractError = a.uploadFileTree(putCtx, prefix, treeEntries, opts)
+		putCancel()
+	}
+
 	if extractError != nil {
-		log.Printf("Upload error: %s", extractError.Error())
+		logPrintf(ctx, "Upload error: %s", extractError.Error())
 		a.abortUpload(extractedFiles)
 		return nil, extractError
 	}
 
-	log.Printf("Sent %d files", fileCount)
-	return extractedFiles, nil
-}
+	logPrintf(ctx, "Sent %d files", fileCount)
 
-// sends an individual file from a zip
-// Caller should set the job timeout in ctx.
-func (a *Archiver) extractAndUploadOne(ctx context.Context, key string, file *zip.File) (*ResourceSpec, error) {
-	readerCloser, err := file.Open()
-	if err != nil {
-		return nil, err
+	var byteCount uint64
+	for _, extractedFile := range extractedFiles {
+		byteCount += extractedFile.Size
+	}
+	recordExtractThroughput(byteCount, fileCount, time.Since(startTime))
+
+	globalMetrics.JobDuration.Observe(time.Since(extractStart), "extract", primaryTargetLabel)
+	globalMetrics.ExtractedBytes.Observe(byteCount, "extract")
+	if info, err := os.Stat(fname); err == nil {
+		globalMetrics.ZipSize.Observe(uint64(info.Size()), "extract")
+	}
+
+	if previous != nil {
+		a.deleteRemovedFiles(ctx, previous.Files, allFiles)
 	}
-	defer readerCloser.Close()
 
-	var reader io.Reader = readerCloser
+	return allFiles, nil
+}
 
+// zstdMagic starts every zstandard frame
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// sniffResource works out the content type and encoding of the file that'll be
+// stored at key from its extension and first bytes, then runs sniffAnalyzers.
+// The returned reader yields the full contents, including the sniffed bytes,
+// and must be released by the caller.
+func sniffResource(key string, reader io.Reader) (*ResourceSpec, *sniffedReader, error) {
 	resource := &ResourceSpec{
 		key: key,
 	}
@@ -300,16 +699,12 @@ func (a *Archiver) extractAndUploadOne(ctx context.Context, key string, file *zi
 	// try determining MIME by extension
 	mimeType := mime.TypeByExtension(path.Ext(key))
 
-	var buffer bytes.Buffer
-	_, err = io.Copy(&buffer, io.LimitReader(reader, 512))
-
+	sniffed, err := newSniffedReader(reader)
 	if err != nil {
-		return nil, errors.Wrap(err, 0)
+		return nil, nil, errors.Wrap(err, 0)
 	}
 
-	contentMimeType := http.DetectContentType(buffer.Bytes())
-	// join the bytes read and the original reader
-	reader = io.MultiReader(&buffer, reader)
+	contentMimeType := http.DetectContentType(sniffed.Prefix())
 
 	if contentMimeType == "application/x-gzip" || contentMimeType == "application/gzip" {
 		resource.contentEncoding = "gzip"
@@ -323,6 +718,17 @@ func (a *Archiver) extractAndUploadOne(ctx context.Context, key string, file *zi
 			}
 		}
 
+	} else if bytes.HasPrefix(sniffed.Prefix(), zstdMagic) {
+		resource.contentEncoding = "zstd"
+
+		// same as gzip, the real type may be hidden beneath a .zst extension
+		if strings.HasSuffix(key, ".zst") {
+			realMimeType := mime.TypeByExtension(path.Ext(strings.TrimSuffix(key, ".zst")))
+
+			if realMimeType != "" {
+				mimeType = realMimeType
+			}
+		}
 	} else if strings.HasSuffix(key, ".br") {
 		// there is no way to detect a brotli stream by content, so we assume if it ends if .br then it's brotli
 		// this path is used for Unity 2020 webgl games built with brotli compression
@@ -345,16 +751,127 @@ func (a *Archiver) extractAndUploadOne(ctx context.Context, key string, file *zi
 
 	resource.applyRewriteRules()
 
-	log.Printf("Sending: %s", resource)
+	for _, analyze := range sniffAnalyzers {
+		if err := analyze(resource, sniffed.Prefix()); err != nil {
+			sniffed.release()
+			return nil, nil, err
+		}
+	}
+
+	return resource, sniffed, nil
+}
 
-	limited := limitedReader(reader, file.UncompressedSize64, &resource.size)
+// sends an individual file from a zip, uploading it again when what was
+// stored doesn't match what was sent
+// Caller should set the job timeout in ctx.
+func (a *Archiver) extractAndUploadOne(ctx context.Context, key string, file *zip.File, opts *ExtractOptions) (*ResourceSpec, error) {
+	for attempt := 1; ; attempt++ {
+		uploadStart := time.Now()
+		resource, err := a.uploadZipEntry(ctx, key, file, opts)
+		if err != nil {
+			return resource, err
+		}
 
-	err = a.Storage.PutFileWithSetup(ctx, a.Bucket, resource.key, limited, resource.setupRequest)
+		err = a.verifyUpload(ctx, resource)
+		if err == nil {
+			globalMetrics.TotalExtractedFiles.Add(1)
+			globalMetrics.FileUploadDuration.Observe(time.Since(uploadStart), "extract", primaryTargetLabel)
+			return resource, nil
+		}
+
+		var mismatchErr *ChecksumMismatchError
+		if !errors.As(err, &mismatchErr) || attempt >= uploadVerifyAttempts {
+			return resource, err
+		}
+
+		globalMetrics.TotalChecksumMismatches.Add(1)
+		logPrintf(ctx, "Uploading %s again: %s", key, err.Error())
+	}
+}
+
+// uploadZipEntry stores a single zip entry at key, checking its CRC32 along
+// the way
+func (a *Archiver) uploadZipEntry(ctx context.Context, key string, file *zip.File, opts *ExtractOptions) (*ResourceSpec, error) {
+	// reuses the copy made for the analyzer, if any
+	entryReader := opts.buffers.reader(file.Name)
+	if entryReader == nil {
+		readerCloser, err := openZipEntry(file, opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		defer readerCloser.Close()
+		entryReader = readerCloser
+	}
+
+	resource, reader, err := sniffResource(key, entryReader)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.release()
+	if analysis := opts.analyses[file.Name]; analysis != nil {
+		analysis.override(resource)
+	}
+	resource.expiresAt = opts.ExpiresAt
+	resource.mode = zipEntryMode(file)
+	resource.crc32 = file.CRC32
+
+	logPrintf(ctx, "Sending: %s", resource)
+
+	// checked against the entry's own CRC32, before HTML transforms
+	crcHasher := crc32.NewIEEE()
+	entryHasher := sha256.New()
+	var limited io.Reader = limitedReader(io.TeeReader(reader, io.MultiWriter(crcHasher, entryHasher)), file.UncompressedSize64, &resource.size)
+
+	if len(opts.HTMLTransforms) > 0 && resource.contentEncoding == "" && isHTMLContentType(resource.contentType) {
+		doc, err := io.ReadAll(limited)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		doc = applyHTMLTransforms(doc, opts.HTMLTransforms)
+		resource.size = uint64(len(doc))
+		limited = bytes.NewReader(doc)
+	}
+
+	if opts.StripImageMetadata && resource.contentEncoding == "" && canStripImageMetadata(resource.contentType) {
+		data, err := io.ReadAll(limited)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		data, err = stripImageMetadata(resource.contentType, data)
+		if err != nil {
+			return nil, errors.Wrap(fmt.Errorf("Failed to strip metadata from %s: %v", file.Name, err), 0)
+		}
+		resource.size = uint64(len(data))
+		limited = bytes.NewReader(data)
+	}
+
+	hasher := md5.New()
+	limited = io.TeeReader(limited, hasher)
+
+	c, canCompose := a.Storage.(composer)
+	if canCompose && a.Config.GCSComposeThreshold > 0 && file.UncompressedSize64 >= a.Config.GCSComposeThreshold {
+		err = a.putFileComposed(ctx, c, resource.key, limited, file.UncompressedSize64, resource.setupRequest)
+	} else if a.Config.HedgedPutDelay > 0 && file.UncompressedSize64 <= a.Config.HedgedPutMaxSize {
+		var data []byte
+		data, err = io.ReadAll(limited)
+		if err == nil {
+			err = a.hedgedPut(ctx, resource.key, data, resource.setupRequest, time.Duration(a.Config.HedgedPutDelay))
+		}
+	} else {
+		err = a.Storage.PutFileWithSetup(ctx, a.Bucket, resource.key, limited, resource.setupRequest)
+	}
 	if err != nil {
 		return resource, errors.Wrap(err, 0)
 	}
+	resource.md5 = hex.EncodeToString(hasher.Sum(nil))
+	resource.sha256 = hex.EncodeToString(entryHasher.Sum(nil))
 
-	globalMetrics.TotalExtractedFiles.Add(1)
+	// entries without a CRC32, eg. AES encrypted ones, are checked by their MAC
+	if file.CRC32 != 0 && crcHasher.Sum32() != file.CRC32 {
+		return resource, errors.Wrap(fmt.Errorf("CRC32 mismatch for %s: expected %08x, got %08x", file.Name, file.CRC32, crcHasher.Sum32()), 0)
+	}
 
 	return resource, nil
 }
@@ -366,23 +883,47 @@ func (a *Archiver) ExtractZip(
 	ctx context.Context,
 	key, prefix string,
 	limits *ExtractLimits,
+	opts ExtractOptions,
 ) ([]ExtractedFile, error) {
-	fname, err := a.fetchZip(ctx, key)
+	ctx, cleanup, err := a.withTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fname, err := a.fetchZipParts(ctx, key)
 	if err != nil {
 		return nil, err
 	}
 
-	defer os.Remove(fname)
 	prefix = path.Join(a.ExtractPrefix, prefix)
-	return a.sendZipExtracted(ctx, prefix, fname, limits)
+	return a.sendZipExtracted(ctx, prefix, fname, limits, &opts)
+}
+
+// ExtractZipFile extracts a zip that's already on the local filesystem, eg.
+// one uploaded in the request body, to `prefix`
+// Caller should set the job timeout in ctx.
+func (a *Archiver) ExtractZipFile(
+	ctx context.Context,
+	fname, prefix string,
+	limits *ExtractLimits,
+	opts ExtractOptions,
+) ([]ExtractedFile, error) {
+	prefix = path.Join(a.ExtractPrefix, prefix)
+	return a.sendZipExtracted(ctx, prefix, fname, limits, &opts)
 }
 
+// UploadZipFromFile extracts a local zip to a temporary prefix, the extracted
+// objects expire after TempExtractionTTL.
 // Caller should set the job timeout in ctx.
 func (a *Archiver) UploadZipFromFile(
 	ctx context.Context,
 	fname, prefix string,
 	limits *ExtractLimits,
 ) ([]ExtractedFile, error) {
-	prefix = path.Join("_zipserver", prefix)
-	return a.sendZipExtracted(ctx, prefix, fname, limits)
+	prefix = path.Join(tempExtractPrefix, prefix)
+	opts := &ExtractOptions{
+		ExpiresAt: time.Now().Add(time.Duration(a.Config.TempExtractionTTL)),
+	}
+	return a.sendZipExtracted(ctx, prefix, fname, limits, opts)
 }
@@ -53,7 +53,7 @@ func Test_ExtractOnGCS(t *testing.T) {
 		err = storage.PutFile(ctx, config.Bucket, "zipserver_test/test.zip", r, "application/zip")
 		assert.NoError(t, err)
 
-		_, err = archiver.ExtractZip(ctx, "zipserver_test/test.zip", "zipserver_test/extract", testLimits())
+		_, err = archiver.ExtractZip(ctx, "zipserver_test/test.zip", "zipserver_test/extract", testLimits(), ExtractOptions{})
 		assert.NoError(t, err)
 	})
 }
@@ -134,7 +134,7 @@ func Test_ExtractInMemory(t *testing.T) {
 	prefix := "zipserver_test/mem_test_extracted"
 	zipPath := "mem_test.zip"
 
-	_, err = archiver.ExtractZip(ctx, zipPath, prefix, testLimits())
+	_, err = archiver.ExtractZip(ctx, zipPath, prefix, testLimits(), ExtractOptions{})
 	assert.Error(t, err)
 
 	withZip := func(zl *zipLayout, cb func(zl *zipLayout)) {
@@ -204,6 +204,18 @@ func Test_ExtractInMemory(t *testing.T) {
 				expectedMimeType:        "application/octet-stream",
 				expectedContentEncoding: "gzip",
 			},
+			zipEntry{
+				name:                    "gamedata.wasm.zst",
+				data:                    []byte{0x28, 0xB5, 0x2F, 0xFD, 4, 0, 9, 3, 1, 2, 5},
+				expectedMimeType:        "application/wasm",
+				expectedContentEncoding: "zstd",
+			},
+			zipEntry{
+				name:                    "zstd.unityweb",
+				data:                    []byte{0x28, 0xB5, 0x2F, 0xFD, 4, 0, 2, 3, 5, 2, 6},
+				expectedMimeType:        "application/octet-stream",
+				expectedContentEncoding: "zstd",
+			},
 			zipEntry{
 				name:    "__MACOSX/hello",
 				data:    []byte{},
@@ -226,7 +238,7 @@ func Test_ExtractInMemory(t *testing.T) {
 			},
 		},
 	}, func(zl *zipLayout) {
-		_, err := archiver.ExtractZip(ctx, zipPath, prefix, testLimits())
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, testLimits(), ExtractOptions{})
 		assert.NoError(t, err)
 
 		zl.Check(t, storage, config.Bucket, prefix)
@@ -244,7 +256,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxFileNameLength = 100
 
-		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits, ExtractOptions{})
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "paths that are too long"))
 	})
@@ -261,7 +273,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxFileSize = 499
 
-		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits, ExtractOptions{})
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "file that is too large"))
 	})
@@ -293,7 +305,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxNumFiles = 3
 
-		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits, ExtractOptions{})
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "Too many files"))
 	})
@@ -325,7 +337,7 @@ func Test_ExtractInMemory(t *testing.T) {
 		limits := testLimits()
 		limits.MaxTotalSize = 6
 
-		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits, ExtractOptions{})
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "zip too large"))
 	})
@@ -363,7 +375,7 @@ func Test_ExtractInMemory(t *testing.T) {
 	}, func(zl *zipLayout) {
 		limits := testLimits()
 
-		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits)
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits, ExtractOptions{})
 		assert.Error(t, err)
 		assert.True(t, strings.Contains(err.Error(), "intentional failure"))
 
@@ -372,6 +384,33 @@ func Test_ExtractInMemory(t *testing.T) {
 			assert.EqualValues(t, k, storage.objectPath(config.Bucket, zipPath), "make sure the only remaining object is the zip")
 		}
 	})
+
+	// reset storage for this next test
+	storage, err = NewMemStorage()
+	assert.NoError(t, err)
+	storage.putDelay = 100 * time.Millisecond
+	archiver = &Archiver{storage, config}
+
+	withZip(&zipLayout{
+		entries: []zipEntry{
+			zipEntry{name: "1", data: []byte("slow"), expectedMimeType: "text/plain; charset=utf-8"},
+			zipEntry{name: "2", data: []byte("slow"), expectedMimeType: "text/plain; charset=utf-8"},
+			zipEntry{name: "3", data: []byte("slow"), expectedMimeType: "text/plain; charset=utf-8"},
+			zipEntry{name: "4", data: []byte("slow"), expectedMimeType: "text/plain; charset=utf-8"},
+			zipEntry{name: "5", data: []byte("slow"), expectedMimeType: "text/plain; charset=utf-8"},
+			zipEntry{name: "6", data: []byte("slow"), expectedMimeType: "text/plain; charset=utf-8"},
+		},
+	}, func(zl *zipLayout) {
+		limits := testLimits()
+		limits.ExtractionThreads = 1
+		limits.MaxExtractionDuration = 250 * time.Millisecond
+
+		_, err := archiver.ExtractZip(ctx, zipPath, prefix, limits, ExtractOptions{})
+		var durationErr *ExtractionDurationError
+		require.ErrorAs(t, err, &durationErr)
+		assert.True(t, durationErr.FilesCompleted >= 1 && durationErr.FilesCompleted < 6)
+		assert.EqualValues(t, durationErr.FilesCompleted*4, durationErr.BytesUploaded)
+	})
 }
 
 // TestFetchZipFailing simulates a download failing after the ouptut file has been created,
@@ -381,7 +420,7 @@ func TestFetchZipFailing(t *testing.T) {
 	bucket := "bucket" + strconv.Itoa(rand.Int())
 	key := "key" + strconv.Itoa(rand.Int())
 	path := fetchZipFilename(bucket, key)
-	path = filepath.Join(tmpDir, path)
+	path = filepath.Join(defaultTmpDir, path)
 	require.False(t, fileExists(path), "test output file existed ahead of time")
 	t.Logf("temp file: %s", path)
 
@@ -418,6 +457,14 @@ func (m *mockFailingStorage) GetFile(_ context.Context, _, _ string) (io.ReadClo
 	return &mockFailingReadCloser{m.t, m.path}, nil, nil
 }
 
+func (m *mockFailingStorage) GetFileRange(_ context.Context, _, _ string, _, _ int64) (io.ReadCloser, http.Header, error) {
+	return &mockFailingReadCloser{m.t, m.path}, nil, nil
+}
+
+func (m *mockFailingStorage) HeadFile(_ context.Context, _, _ string) (http.Header, error) {
+	return nil, nil
+}
+
 func (m *mockFailingStorage) PutFile(_ context.Context, _, _ string, contents io.Reader, _ string) error {
 	return nil
 }
@@ -426,10 +473,22 @@ func (m *mockFailingStorage) PutFileWithSetup(_ context.Context, _, _ string, co
 	return nil
 }
 
+func (m *mockFailingStorage) CopyFile(_ context.Context, _, _, _ string) error {
+	return nil
+}
+
 func (m *mockFailingStorage) DeleteFile(_ context.Context, _, _ string) error {
 	return nil
 }
 
+func (m *mockFailingStorage) ListObjects(_ context.Context, _, _ string) ([]ObjectInfo, error) {
+	return nil, nil
+}
+
+func (m *mockFailingStorage) ListObjectsPage(_ context.Context, _, _, _ string, _ int) ([]ObjectInfo, string, error) {
+	return nil, "", nil
+}
+
 type mockFailingReadCloser struct {
 	t    *testing.T
 	path string
@@ -443,3 +502,70 @@ func (m *mockFailingReadCloser) Read(p []byte) (int, error) {
 func (m *mockFailingReadCloser) Close() error {
 	return nil
 }
+
+func Test_UploadFailuresError(t *testing.T) {
+	failures := &UploadFailuresError{}
+	failures.add("a/1", errors.New("403 Forbidden"))
+	assert.Equal(t, "403 Forbidden", failures.Error())
+
+	for i := 2; i <= 5; i++ {
+		failures.add(fmt.Sprintf("a/%d", i), errors.New("403 Forbidden"))
+	}
+	failures.add("a/6", context.DeadlineExceeded)
+
+	require.Len(t, failures.Failures, 2)
+	assert.Equal(t, 5, failures.Failures[0].Count)
+	assert.Equal(t, []string{"a/1", "a/2", "a/3"}, failures.Failures[0].ExampleKeys)
+	assert.Contains(t, failures.Error(), "2 distinct upload errors")
+	assert.Contains(t, failures.Error(), "403 Forbidden (5 files, eg. a/1, a/2, a/3)")
+
+	// the first error stays reachable for errors.Is checks
+	failures = &UploadFailuresError{}
+	failures.add("a/1", context.DeadlineExceeded)
+	assert.True(t, errors.Is(failures, context.DeadlineExceeded))
+}
+
+func Test_ExtractFileModes(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	header := &zip.FileHeader{Name: "game.x86_64", Method: zip.Deflate}
+	header.SetMode(0755)
+	w, err := zw.CreateHeader(header)
+	require.NoError(t, err)
+	w.Write([]byte("binary"))
+
+	// made on MS-DOS, no Unix mode
+	header = &zip.FileHeader{Name: "readme.txt", Method: zip.Deflate, CreatorVersion: 20}
+	w, err = zw.CreateHeader(header)
+	require.NoError(t, err)
+	w.Write([]byte("hello"))
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "modes.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "modes", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+
+	modes := map[string]string{}
+	for _, file := range files {
+		modes[file.Key] = file.Mode
+	}
+	assert.EqualValues(t, map[string]string{"modes/game.x86_64": "0755", "modes/readme.txt": ""}, modes)
+
+	_, headers, err := storage.GetFile(ctx, config.Bucket, "modes/game.x86_64")
+	require.NoError(t, err)
+	assert.EqualValues(t, "0755", headers.Get(modeHeader))
+
+	_, headers, err = storage.GetFile(ctx, config.Bucket, "modes/readme.txt")
+	require.NoError(t, err)
+	assert.EqualValues(t, "", headers.Get(modeHeader))
+}
@@ -0,0 +1,143 @@
+package zipserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// APIScope is a group of endpoints an API key may call
+type APIScope string
+
+const (
+	ScopeExtract APIScope = "extract" // /extract, /list, /slurp, /fetch, /exists, /compare_manifest
+	ScopeCopy    APIScope = "copy"    // /copy
+	ScopeDelete  APIScope = "delete"  // /delete, /move, /renameprefix, /purge
+	ScopeStatus  APIScope = "status"  // /status, /metrics, /job, /history, /selftest
+	ScopeAdmin   APIScope = "admin"   // /callbacks, /readonly
+)
+
+var validAPIScopes = map[APIScope]bool{
+	ScopeExtract: true,
+	ScopeCopy:    true,
+	ScopeDelete:  true,
+	ScopeStatus:  true,
+	ScopeAdmin:   true,
+}
+
+// APIKeyConfig is a key accepted in the Authorization header
+type APIKeyConfig struct {
+	Name string // shown in logs
+	Key  string
+	// What the key may do, every scope when empty
+	Scopes []APIScope `json:",omitempty"`
+	// Jobs of this key started in a row while others wait for a slot, see
+	// fairQueue. Defaults to 1
+	Weight int `json:",omitempty"`
+}
+
+func (k *APIKeyConfig) hasScope(scope APIScope) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, allowed := range k.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authError is a request without a valid API key (401), or with a key lacking
+// the scope (403)
+type authError struct {
+	status  int
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+func validateAPIKeys(keys []APIKeyConfig) error {
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key.Key == "" {
+			return fmt.Errorf("Config error: API key %q has no Key", key.Name)
+		}
+		if seen[key.Key] {
+			return fmt.Errorf("Config error: API key %q is listed twice", key.Name)
+		}
+		seen[key.Key] = true
+
+		if key.Weight < 0 {
+			return fmt.Errorf("Config error: API key %q has a negative Weight", key.Name)
+		}
+
+		for _, scope := range key.Scopes {
+			if !validAPIScopes[scope] {
+				return fmt.Errorf("Config error: API key %q has invalid scope %q", key.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// findAPIKey returns the configured key sent as a bearer token, or nil
+func findAPIKey(keys []APIKeyConfig, r *http.Request) *APIKeyConfig {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == "" {
+		return nil
+	}
+
+	var found *APIKeyConfig
+	for i := range keys {
+		// compare against every key so the timing doesn't tell which matched
+		if subtle.ConstantTimeCompare([]byte(keys[i].Key), []byte(token)) == 1 {
+			found = &keys[i]
+		}
+	}
+	return found
+}
+
+// requireScope only lets requests through when they carry an API key with
+// scope. Requests aren't checked when no APIKeys are configured.
+func requireScope(scope APIScope, fn wrapErrors) wrapErrors {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if len(globalConfig.APIKeys) == 0 {
+			return fn(w, r)
+		}
+
+		key := findAPIKey(globalConfig.APIKeys, r)
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zipserver"`)
+			return &authError{http.StatusUnauthorized, "Missing or invalid API key"}
+		}
+
+		if !key.hasScope(scope) {
+			log.Printf("API key %q denied %s (missing scope %s)", key.Name, r.URL.Path, scope)
+			return &authError{http.StatusForbidden, fmt.Sprintf("API key lacks the %s scope", scope)}
+		}
+
+		return fn(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the API key of the request, or of the request
+// that started the job running in ctx. It's nil when requests aren't
+// authenticated.
+func apiKeyFromContext(ctx context.Context) *APIKeyConfig {
+	if key, ok := ctx.Value(apiKeyContextKey{}).(*APIKeyConfig); ok {
+		return key
+	}
+	return jobFromContext(ctx).requestAPIKey()
+}
@@ -0,0 +1,53 @@
+package zipserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RequireScope(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+
+	config := emptyConfig()
+	globalConfig = config
+
+	handler := wrapErrors(requireScope(ScopeCopy, func(w http.ResponseWriter, r *http.Request) error {
+		return writeJSONMessage(w, struct{ Success bool }{true})
+	}))
+
+	request := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/copy", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// no keys configured, nothing is checked
+	assert.Equal(t, http.StatusOK, request(""))
+
+	config.APIKeys = []APIKeyConfig{
+		{Name: "builds", Key: "extract-key", Scopes: []APIScope{ScopeExtract}},
+		{Name: "uploader", Key: "copy-key", Scopes: []APIScope{ScopeExtract, ScopeCopy}},
+		{Name: "ops", Key: "ops-key"},
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request(""))
+	assert.Equal(t, http.StatusUnauthorized, request("wrong-key"))
+	assert.Equal(t, http.StatusForbidden, request("extract-key"))
+	assert.Equal(t, http.StatusOK, request("copy-key"))
+	assert.Equal(t, http.StatusOK, request("ops-key"))
+}
+
+func Test_ValidateAPIKeys(t *testing.T) {
+	assert.NoError(t, validateAPIKeys([]APIKeyConfig{{Name: "a", Key: "1", Scopes: []APIScope{ScopeDelete}}}))
+	assert.Error(t, validateAPIKeys([]APIKeyConfig{{Name: "a"}}))
+	assert.Error(t, validateAPIKeys([]APIKeyConfig{{Name: "a", Key: "1"}, {Name: "b", Key: "1"}}))
+	assert.Error(t, validateAPIKeys([]APIKeyConfig{{Name: "a", Key: "1", Scopes: []APIScope{"everything"}}}))
+}
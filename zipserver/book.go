@@ -0,0 +1,383 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	errors "github.com/go-errors/errors"
+)
+
+// BookMetadata describes an extracted pdf, epub or cbz file
+type BookMetadata struct {
+	Format string // pdf, epub or cbz
+	Pages  int    `json:",omitempty"` // unknown for epub files, which reflow
+	Title  string `json:",omitempty"`
+	Author string `json:",omitempty"`
+}
+
+var bookExtensions = map[string]bool{
+	".pdf": true, ".epub": true, ".cbz": true,
+}
+
+func isBookFile(name string) bool {
+	return bookExtensions[strings.ToLower(path.Ext(name))]
+}
+
+func init() {
+	RegisterAnalyzer(ExtractContentsBook, bookAnalyzer{})
+}
+
+// bookAnalyzer keeps the books probeBook validates, for contents=book
+type bookAnalyzer struct{}
+
+var _ BufferedAnalyzer = bookAnalyzer{}
+var _ tempDirAnalyzer = bookAnalyzer{}
+
+func (bookAnalyzer) Accepts(filename string) bool {
+	return isBookFile(filename)
+}
+
+func (a bookAnalyzer) Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error) {
+	return a.analyzeInDir(reader, filename, size, "")
+}
+
+// analyzeInDir copies epub and cbz files to dir to read them
+func (bookAnalyzer) analyzeInDir(reader io.Reader, filename string, size uint64, dir string) (*Analysis, error) {
+	metadata, err := probeBook(filename, reader, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Metadata: metadata}, nil
+}
+
+// AnalyzeBuffered reads epub and cbz files, which are zips, straight from the
+// buffered copy instead of making a temporary one like probeBook
+func (bookAnalyzer) AnalyzeBuffered(entry *BufferedEntry, filename string) (*Analysis, error) {
+	var metadata *BookMetadata
+	var err error
+
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".epub", ".cbz":
+		metadata, err = probeBookZip(filename, entry, entry.Size())
+	default:
+		metadata, err = probeBook(filename, entry.NewReader(), "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Metadata: metadata}, nil
+}
+
+// probeBook validates the book stored in reader and reads its metadata. Zips
+// are copied to a temporary file in dir first, the system's when it's empty
+func probeBook(name string, reader io.Reader, dir string) (*BookMetadata, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".pdf":
+		return probePDF(reader)
+	case ".epub", ".cbz":
+		// both are zips, which need random access
+		tmpFile, err := os.CreateTemp(dir, "zipserver-book-*")
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		size, err := io.Copy(tmpFile, reader)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		return probeBookZip(name, tmpFile, size)
+	default:
+		return nil, errors.Errorf("Unsupported book format: %s", name)
+	}
+}
+
+// probeBookZip validates an epub or cbz file, which are both zips
+func probeBookZip(name string, reader io.ReaderAt, size int64) (*BookMetadata, error) {
+	zipReader, err := zip.NewReader(reader, size)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	if strings.ToLower(path.Ext(name)) == ".epub" {
+		return probeEPUB(zipReader)
+	}
+	return probeCBZ(zipReader)
+}
+
+// how much of the end of the previous chunk is scanned again, longer than any
+// match of the pdf patterns below
+const pdfScanOverlap = 4096
+
+var (
+	pdfPagesCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+	pdfPage       = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfTitle      = regexp.MustCompile(`/Title\s*(\((?:\\.|[^\\)]){0,1000}\)|<[0-9A-Fa-f\s]{0,1000}>)`)
+	pdfAuthor     = regexp.MustCompile(`/Author\s*(\((?:\\.|[^\\)]){0,1000}\)|<[0-9A-Fa-f\s]{0,1000}>)`)
+)
+
+// probePDF reads a pdf in chunks, counting its pages from the page tree and
+// taking the title and author from its document info. Both are missing when
+// they're in compressed object streams, in which case the page count falls
+// back to the number of page objects found.
+func probePDF(reader io.Reader) (*BookMetadata, error) {
+	metadata := &BookMetadata{Format: "pdf"}
+
+	chunk := make([]byte, 1024*1024)
+	var window []byte
+	var pageObjects, maxCount int
+	first := true
+	lastBytes := []byte{}
+
+	for {
+		n, err := io.ReadFull(reader, chunk)
+		if n > 0 {
+			fresh := len(window)
+			window = append(window, chunk[:n]...)
+
+			if first {
+				if !bytes.HasPrefix(window, []byte("%PDF-")) {
+					return nil, errors.Errorf("Missing pdf header")
+				}
+				first = false
+			}
+
+			// matches ending in the part already scanned were counted before
+			for _, match := range pdfPagesCount.FindAllSubmatchIndex(window, -1) {
+				if match[1] > fresh {
+					count, _ := strconv.Atoi(string(pdfSubmatch(window, match)))
+					if count > maxCount {
+						maxCount = count
+					}
+				}
+			}
+			for _, match := range pdfPage.FindAllIndex(window, -1) {
+				if match[1] > fresh {
+					pageObjects++
+				}
+			}
+			if metadata.Title == "" {
+				metadata.Title = findPDFInfoString(window, pdfTitle)
+			}
+			if metadata.Author == "" {
+				metadata.Author = findPDFInfoString(window, pdfAuthor)
+			}
+
+			lastBytes = window
+			if len(window) > pdfScanOverlap {
+				window = append([]byte{}, window[len(window)-pdfScanOverlap:]...)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+	}
+
+	if first {
+		return nil, errors.Errorf("Empty pdf file")
+	}
+
+	if tail := lastBytes[len(lastBytes)-minInt(len(lastBytes), 1024):]; !bytes.Contains(tail, []byte("%%EOF")) {
+		return nil, errors.Errorf("Truncated pdf file, missing %%%%EOF")
+	}
+
+	metadata.Pages = maxCount
+	if metadata.Pages == 0 {
+		metadata.Pages = pageObjects
+	}
+	return metadata, nil
+}
+
+// findPDFInfoString returns the first string matched by pattern that isn't
+// in an outline item, which have a /Title too
+func findPDFInfoString(window []byte, pattern *regexp.Regexp) string {
+	for _, match := range pattern.FindAllSubmatchIndex(window, -1) {
+		start := bytes.LastIndex(window[:match[0]], []byte("<<"))
+		end := bytes.Index(window[match[1]:], []byte(">>"))
+		if start == -1 || end == -1 {
+			continue
+		}
+
+		dict := window[start : match[1]+end]
+		if bytes.Contains(dict, []byte("/Parent")) {
+			continue
+		}
+		return decodePDFString(window[match[2]:match[3]])
+	}
+	return ""
+}
+
+func pdfSubmatch(window []byte, match []int) []byte {
+	for i := 2; i+1 < len(match); i += 2 {
+		if match[i] >= 0 {
+			return window[match[i]:match[i+1]]
+		}
+	}
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// decodePDFString decodes a literal (parenthesized) or hex pdf string, which
+// is UTF-16 when it starts with a byte order mark
+func decodePDFString(raw []byte) string {
+	var decoded []byte
+
+	if raw[0] == '<' {
+		hex := bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+				return -1
+			}
+			return r
+		}, raw[1:len(raw)-1])
+		if len(hex)%2 == 1 {
+			hex = append(hex, '0')
+		}
+		for i := 0; i < len(hex); i += 2 {
+			value, _ := strconv.ParseUint(string(hex[i:i+2]), 16, 8)
+			decoded = append(decoded, byte(value))
+		}
+	} else {
+		body := raw[1 : len(raw)-1]
+		for i := 0; i < len(body); i++ {
+			if body[i] != '\\' || i+1 == len(body) {
+				decoded = append(decoded, body[i])
+				continue
+			}
+			i++
+			switch c := body[i]; c {
+			case 'n':
+				decoded = append(decoded, '\n')
+			case 'r':
+				decoded = append(decoded, '\r')
+			case 't':
+				decoded = append(decoded, '\t')
+			case 'b':
+				decoded = append(decoded, '\b')
+			case 'f':
+				decoded = append(decoded, '\f')
+			default:
+				if c >= '0' && c <= '7' {
+					end := i + 1
+					for end < len(body) && end < i+3 && body[end] >= '0' && body[end] <= '7' {
+						end++
+					}
+					value, _ := strconv.ParseUint(string(body[i:end]), 8, 8)
+					decoded = append(decoded, byte(value))
+					i = end - 1
+				} else {
+					decoded = append(decoded, c)
+				}
+			}
+		}
+	}
+
+	if len(decoded) >= 2 && decoded[0] == 0xFE && decoded[1] == 0xFF {
+		units := make([]uint16, 0, len(decoded)/2)
+		for i := 2; i+1 < len(decoded); i += 2 {
+			units = append(units, uint16(decoded[i])<<8|uint16(decoded[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	}
+
+	return strings.TrimSpace(string(decoded))
+}
+
+// probeEPUB finds the package document through META-INF/container.xml and
+// reads the title and author from it
+func probeEPUB(zipReader *zip.Reader) (*BookMetadata, error) {
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := readZipXML(zipReader, "META-INF/container.xml", &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.Errorf("No package document in epub")
+	}
+
+	var pkg struct {
+		Titles   []string `xml:"metadata>title"`
+		Creators []string `xml:"metadata>creator"`
+	}
+	if err := readZipXML(zipReader, container.Rootfiles[0].FullPath, &pkg); err != nil {
+		return nil, err
+	}
+
+	metadata := &BookMetadata{Format: "epub"}
+	if len(pkg.Titles) > 0 {
+		metadata.Title = strings.TrimSpace(pkg.Titles[0])
+	}
+	if len(pkg.Creators) > 0 {
+		metadata.Author = strings.TrimSpace(pkg.Creators[0])
+	}
+	return metadata, nil
+}
+
+// probeCBZ counts the pages of a comic book zip, reading the title and writer
+// from its ComicInfo.xml if there's one
+func probeCBZ(zipReader *zip.Reader) (*BookMetadata, error) {
+	metadata := &BookMetadata{Format: "cbz"}
+
+	for _, file := range zipReader.File {
+		if isImageFile(file.Name) {
+			metadata.Pages++
+		}
+	}
+	if metadata.Pages == 0 {
+		return nil, errors.Errorf("No pages in cbz")
+	}
+
+	var info struct {
+		Title  string
+		Writer string
+	}
+	if err := readZipXML(zipReader, "ComicInfo.xml", &info); err == nil {
+		metadata.Title = strings.TrimSpace(info.Title)
+		metadata.Author = strings.TrimSpace(info.Writer)
+	}
+	return metadata, nil
+}
+
+// the largest metadata file read from inside a book
+const maxBookMetadataSize = 1024 * 1024
+
+func readZipXML(zipReader *zip.Reader, name string, out interface{}) error {
+	for _, file := range zipReader.File {
+		if file.Name != name {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		defer reader.Close()
+
+		if err := xml.NewDecoder(io.LimitReader(reader, maxBookMetadataSize)).Decode(out); err != nil {
+			return errors.Wrap(err, 0)
+		}
+		return nil
+	}
+	return errors.Errorf("Missing %s", name)
+}
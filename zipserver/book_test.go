@@ -0,0 +1,126 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPDF has the given number of pages, an outline item and document info
+// at the end, after the pages
+func testPDF(pages int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	buf.WriteString("1 0 obj << /Type /Catalog /Pages 2 0 R /Outlines 3 0 R >> endobj\n")
+	fmt.Fprintf(&buf, "2 0 obj << /Type /Pages /Kids [] /Count %d >> endobj\n", pages)
+	buf.WriteString("3 0 obj << /Title (Chapter 1) /Parent 4 0 R /Dest [5 0 R /Fit] >> endobj\n")
+	for i := 0; i < pages; i++ {
+		fmt.Fprintf(&buf, "%d 0 obj << /Type /Page /Parent 2 0 R >> endobj\n", 10+i)
+		// enough filler that the info dictionary is in a later chunk
+		buf.WriteString(strings.Repeat("%filler\n", 150000/pages))
+	}
+	buf.WriteString("9 0 obj << /Title (The \\(Long\\) Road) /Author <FEFF004C00E9006100> >> endobj\n")
+	buf.WriteString("trailer << /Root 1 0 R /Info 9 0 R >>\n%%EOF\n")
+	return buf.Bytes()
+}
+
+func testZipFile(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(contents))
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func testEPUB(t *testing.T) []byte {
+	return testZipFile(t, map[string]string{
+		"mimetype": "application/epub+zip",
+		"META-INF/container.xml": `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>A Game Manual</dc:title>
+    <dc:creator>Some Author</dc:creator>
+  </metadata>
+</package>`,
+	})
+}
+
+func Test_ProbeBook(t *testing.T) {
+	pdf := testPDF(3)
+	require.Greater(t, len(pdf), 1024*1024, "the pdf should span several chunks")
+
+	metadata, err := probeBook("manual.pdf", bytes.NewReader(pdf), t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, &BookMetadata{Format: "pdf", Pages: 3, Title: "The (Long) Road", Author: "Léa"}, metadata)
+
+	_, err = probeBook("truncated.pdf", bytes.NewReader(pdf[:len(pdf)/2]), t.TempDir())
+	assert.Error(t, err)
+
+	_, err = probeBook("fake.pdf", bytes.NewReader([]byte("<html></html>")), t.TempDir())
+	assert.Error(t, err)
+
+	metadata, err = probeBook("manual.epub", bytes.NewReader(testEPUB(t)), t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, &BookMetadata{Format: "epub", Title: "A Game Manual", Author: "Some Author"}, metadata)
+
+	cbz := testZipFile(t, map[string]string{
+		"01.png":        "",
+		"02.jpg":        "",
+		"notes.txt":     "",
+		"ComicInfo.xml": "<ComicInfo><Title>Issue 1</Title><Writer>Someone</Writer></ComicInfo>",
+	})
+	metadata, err = probeBook("issue1.cbz", bytes.NewReader(cbz), t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, &BookMetadata{Format: "cbz", Pages: 2, Title: "Issue 1", Author: "Someone"}, metadata)
+
+	_, err = probeBook("empty.cbz", bytes.NewReader(testZipFile(t, map[string]string{"notes.txt": ""})), t.TempDir())
+	assert.Error(t, err)
+
+	_, err = probeBook("broken.epub", bytes.NewReader([]byte("not a zip")), t.TempDir())
+	assert.Error(t, err)
+}
+
+func Test_ExtractBookContents(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	zipData := testZipFile(t, map[string]string{
+		"manual.pdf":  string(testPDF(1)),
+		"manual.epub": string(testEPUB(t)),
+		"broken.pdf":  "nope",
+		"game.exe":    "MZ",
+	})
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "books.zip", bytes.NewReader(zipData), "application/zip"))
+
+	limits := testLimits()
+	limits.MaxFileSize = 10 * 1024 * 1024
+	limits.MaxTotalSize = 20 * 1024 * 1024
+	extracted, err := archiver.ExtractZip(ctx, "books.zip", "books", limits, ExtractOptions{Contents: ExtractContentsBook})
+	require.NoError(t, err)
+
+	books := map[string]*BookMetadata{}
+	for _, file := range extracted {
+		books[file.Key] = file.Metadata["book"].(*BookMetadata)
+	}
+	require.Len(t, books, 2)
+	assert.Equal(t, 1, books["books/manual.pdf"].Pages)
+	assert.Equal(t, "A Game Manual", books["books/manual.epub"].Title)
+}
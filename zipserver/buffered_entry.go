@@ -0,0 +1,157 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	errors "github.com/go-errors/errors"
+)
+
+// BufferedAnalyzer is an Analyzer that needs more than one pass over a file,
+// or random access to it, eg. to read tags at its end. Files up to
+// Config.MaxAnalyzerBufferSize are copied into a BufferedEntry, which the
+// upload then reads instead of decompressing the entry again as long as the
+// extraction's copies fit in Config.AnalyzerBufferMemory. Bigger files are
+// streamed to Analyze as usual.
+type BufferedAnalyzer interface {
+	Analyzer
+	// AnalyzeBuffered reads an accepted file from its buffered copy, which
+	// is only valid until it returns
+	AnalyzeBuffered(entry *BufferedEntry, filename string) (*Analysis, error)
+}
+
+// BufferedEntry is a decompressed copy of a zip entry that can be read at any
+// offset. It's kept in memory while the extraction's copies fit in
+// Config.AnalyzerBufferMemory, and spilled to a temporary file past that.
+type BufferedEntry struct {
+	size int64
+	data []byte
+	file *os.File
+}
+
+// Size is the length of the entry's contents
+func (e *BufferedEntry) Size() int64 {
+	return e.size
+}
+
+// ReadAt implements io.ReaderAt
+func (e *BufferedEntry) ReadAt(p []byte, off int64) (int, error) {
+	if e.file != nil {
+		return e.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(e.data).ReadAt(p, off)
+}
+
+// NewReader reads the entry from its start, independently of other readers
+func (e *BufferedEntry) NewReader() io.Reader {
+	return io.NewSectionReader(e, 0, e.size)
+}
+
+func (e *BufferedEntry) release() {
+	if e.file != nil {
+		e.file.Close()
+		os.Remove(e.file.Name())
+		e.file = nil
+	}
+	e.data = nil
+}
+
+// bufferZipEntry decompresses file into a BufferedEntry, keeping at most
+// memoryLimit bytes of it in memory and spilling to a file in dir
+func bufferZipEntry(file *zip.File, password string, memoryLimit uint64, dir string) (*BufferedEntry, error) {
+	reader, err := openZipEntry(file, password)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// the central directory may lie about the entry's size
+	var readBytes uint64
+	limited := limitedReader(reader, file.UncompressedSize64, &readBytes)
+
+	entry := &BufferedEntry{}
+	if file.UncompressedSize64 <= memoryLimit {
+		entry.data, err = io.ReadAll(limited)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+		entry.size = int64(len(entry.data))
+		return entry, nil
+	}
+
+	entry.file, err = os.CreateTemp(dir, "entry-*")
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	entry.size, err = io.Copy(entry.file, limited)
+	if err != nil {
+		entry.release()
+		return nil, errors.Wrap(fmt.Errorf("Failed to buffer %s: %v", file.Name, err), 0)
+	}
+	return entry, nil
+}
+
+// bufferedEntries holds the buffered copies of an extraction's files by their
+// name in the zip, for their upload. Only copies in memory are kept, up to
+// budget bytes for the whole extraction: the others are released once
+// analyzed and their entry is decompressed again for the upload.
+type bufferedEntries struct {
+	entries map[string]*BufferedEntry
+	memory  uint64
+	budget  uint64
+}
+
+func newBufferedEntries(budget uint64) *bufferedEntries {
+	return &bufferedEntries{entries: map[string]*BufferedEntry{}, budget: budget}
+}
+
+// buffer copies file, in memory if it fits in what's left of the budget
+func (b *bufferedEntries) buffer(file *zip.File, password string, dir string) (*BufferedEntry, error) {
+	return bufferZipEntry(file, password, b.budget-b.memory, dir)
+}
+
+// keep holds on to the analyzed copy of the entry named name when it's in
+// memory, and releases it otherwise
+func (b *bufferedEntries) keep(name string, entry *BufferedEntry) {
+	if entry.file != nil {
+		entry.release()
+		return
+	}
+	b.entries[name] = entry
+	b.memory += uint64(entry.size)
+}
+
+// reader returns a reader of the buffered copy of the entry named name, or
+// nil when it wasn't kept
+func (b *bufferedEntries) reader(name string) io.Reader {
+	if b == nil {
+		return nil
+	}
+	if entry := b.entries[name]; entry != nil {
+		return entry.NewReader()
+	}
+	return nil
+}
+
+// drop releases the copy of a file left out of the extraction
+func (b *bufferedEntries) drop(name string) {
+	if entry := b.entries[name]; entry != nil {
+		b.memory -= uint64(entry.size)
+		entry.release()
+		delete(b.entries, name)
+	}
+}
+
+// release lets go of the copies, once the extraction is over
+func (b *bufferedEntries) release() {
+	if b == nil {
+		return
+	}
+	for name := range b.entries {
+		b.drop(name)
+	}
+}
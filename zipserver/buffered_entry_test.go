@@ -0,0 +1,137 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tailAnalyzer keeps the .bin files ending with TAIL, reading their end
+// without going through the rest when they're buffered
+type tailAnalyzer struct {
+	spilled  map[string]bool
+	streamed map[string]bool
+}
+
+func (tailAnalyzer) Accepts(filename string) bool {
+	return strings.HasSuffix(filename, ".bin")
+}
+
+func (a tailAnalyzer) Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error) {
+	a.streamed[filename] = true
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Skip: !bytes.HasSuffix(data, []byte("TAIL"))}, nil
+}
+
+func (a tailAnalyzer) AnalyzeBuffered(entry *BufferedEntry, filename string) (*Analysis, error) {
+	a.spilled[filename] = entry.file != nil
+
+	tail := make([]byte, 4)
+	if _, err := entry.ReadAt(tail, entry.Size()-4); err != nil {
+		return nil, err
+	}
+	return &Analysis{Skip: string(tail) != "TAIL"}, nil
+}
+
+func Test_BufferedAnalyzer(t *testing.T) {
+	ctx := context.Background()
+
+	const tails ExtractContents = "tails"
+	analyzer := tailAnalyzer{spilled: map[string]bool{}, streamed: map[string]bool{}}
+	RegisterAnalyzer(tails, analyzer)
+	defer delete(contentAnalyzers, tails)
+
+	config := emptyConfig()
+	config.MaxAnalyzerBufferSize = 8192
+	config.AnalyzerBufferMemory = 1024
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	files := map[string]string{
+		"small.bin": "small TAIL",
+		"large.bin": strings.Repeat("x", 4096) + "TAIL",
+		"huge.bin":  strings.Repeat("y", 10000) + "TAIL",
+		"other.bin": strings.Repeat("z", 4096),
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(data))
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "tails.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	extracted, err := archiver.ExtractZip(ctx, "tails.zip", "tails", testLimits(), ExtractOptions{Contents: tails})
+	require.NoError(t, err)
+
+	keys := []string{}
+	for _, file := range extracted {
+		keys = append(keys, file.Key)
+	}
+	assert.ElementsMatch(t, []string{"tails/small.bin", "tails/large.bin", "tails/huge.bin"}, keys)
+
+	assert.Equal(t, map[string]bool{"small.bin": false, "large.bin": true, "other.bin": true}, analyzer.spilled)
+	assert.Equal(t, map[string]bool{"huge.bin": true}, analyzer.streamed)
+
+	for _, name := range []string{"small.bin", "large.bin", "huge.bin"} {
+		reader, _, err := storage.GetFile(ctx, config.Bucket, "tails/"+name)
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		require.NoError(t, err)
+		assert.Equal(t, files[name], string(data), name)
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(defaultTmpDir, "entry-*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func Test_BufferedEntriesBudget(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"first.bin", "second.bin"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(bytes.Repeat([]byte("x"), 600))
+	}
+	require.NoError(t, zw.Close())
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	buffers := newBufferedEntries(1024)
+	defer buffers.release()
+
+	first, err := buffers.buffer(zr.File[0], "", t.TempDir())
+	require.NoError(t, err)
+	assert.Nil(t, first.file)
+	buffers.keep("first.bin", first)
+	assert.NotNil(t, buffers.reader("first.bin"))
+
+	// the two copies don't fit in the budget together
+	second, err := buffers.buffer(zr.File[1], "", t.TempDir())
+	require.NoError(t, err)
+	require.NotNil(t, second.file)
+	spilled := second.file.Name()
+	buffers.keep("second.bin", second)
+	assert.Nil(t, buffers.reader("second.bin"))
+	assert.NoFileExists(t, spilled)
+
+	buffers.drop("first.bin")
+	assert.Equal(t, uint64(0), buffers.memory)
+}
@@ -0,0 +1,569 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCallbackRecords is how many deliveries callbackTable remembers, the
+// oldest delivered ones are forgotten first
+const maxCallbackRecords = 1000
+
+// CallbackDelivery records a callback notification and whether the consumer
+// received it
+type CallbackDelivery struct {
+	ID             int64
+	JobID          string `json:",omitempty"`
+	IdempotencyKey string `json:",omitempty"`
+	URL            string
+	Attempts       int
+	StatusCode     int    `json:",omitempty"` // of the last attempt
+	Error          string `json:",omitempty"` // of the last attempt
+	Delivered      bool
+	Suppressed     bool `json:",omitempty"` // skipped, the idempotency key was already acknowledged
+	CreatedAt      time.Time
+	LastAttemptAt  time.Time
+
+	body        string
+	contentType string
+	timeout     time.Duration
+	// still being attempted, a concurrent callback with the key is skipped
+	sending bool
+	// a sync response the caller received, acknowledges the key for any URL
+	response bool
+}
+
+type callbackTable struct {
+	sync.Mutex
+	nextID     int64
+	deliveries []*CallbackDelivery
+}
+
+var callbackDeliveries = &callbackTable{}
+
+func (t *callbackTable) add(delivery *CallbackDelivery) {
+	t.Lock()
+	defer t.Unlock()
+	t.addLocked(delivery)
+}
+
+func (t *callbackTable) addLocked(delivery *CallbackDelivery) {
+	t.nextID++
+	delivery.ID = t.nextID
+	t.deliveries = append(t.deliveries, delivery)
+
+	if len(t.deliveries) <= maxCallbackRecords {
+		return
+	}
+
+	for i, existing := range t.deliveries {
+		if existing.Delivered {
+			t.deliveries = append(t.deliveries[:i], t.deliveries[i+1:]...)
+			return
+		}
+	}
+	t.deliveries = t.deliveries[1:]
+}
+
+// update runs fn on the delivery with the table locked
+func (t *callbackTable) update(delivery *CallbackDelivery, fn func(*CallbackDelivery)) {
+	t.Lock()
+	defer t.Unlock()
+	fn(delivery)
+}
+
+// pending returns copies of the deliveries that haven't succeeded yet
+func (t *callbackTable) pending() []CallbackDelivery {
+	t.Lock()
+	defer t.Unlock()
+
+	pending := []CallbackDelivery{}
+	for _, delivery := range t.deliveries {
+		if !delivery.Delivered {
+			pending = append(pending, *delivery)
+		}
+	}
+	return pending
+}
+
+// find returns the latest delivery for a job, id is either a job ID or the
+// ID of a delivery without a job
+func (t *callbackTable) find(id string) *CallbackDelivery {
+	t.Lock()
+	defer t.Unlock()
+
+	for i := len(t.deliveries) - 1; i >= 0; i-- {
+		delivery := t.deliveries[i]
+		if delivery.JobID == id || (delivery.JobID == "" && strconv.FormatInt(delivery.ID, 10) == id) {
+			return delivery
+		}
+	}
+	return nil
+}
+
+// addUnlessAcknowledged adds delivery, or when a callback with its
+// idempotency key was delivered (or is being delivered) to the same URL, or a
+// sync response with the key was sent, records it as suppressed instead. It
+// returns true when delivery should be sent.
+func (t *callbackTable) addUnlessAcknowledged(delivery *CallbackDelivery) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, existing := range t.deliveries {
+		if existing.IdempotencyKey != delivery.IdempotencyKey || existing.Suppressed {
+			continue
+		}
+		if (existing.response || existing.URL == delivery.URL) && (existing.Delivered || existing.sending) {
+			delivery.Delivered = true
+			delivery.Suppressed = true
+			t.addLocked(delivery)
+			return false
+		}
+	}
+
+	delivery.sending = true
+	t.addLocked(delivery)
+	return true
+}
+
+// recordSyncResponse records that the caller received the result of a sync
+// request with an idempotency key, so callbacks with that key, eg. from an
+// async retry of the same request, are skipped
+func recordSyncResponse(caller jobCaller) {
+	if caller.IdempotencyKey == "" {
+		return
+	}
+	now := time.Now()
+	callbackDeliveries.add(&CallbackDelivery{
+		IdempotencyKey: caller.IdempotencyKey,
+		Delivered:      true,
+		CreatedAt:      now,
+		LastAttemptAt:  now,
+		response:       true,
+	})
+}
+
+// retryPendingCallbacks makes one more attempt at each undelivered callback
+// that failed in a way a retry could fix
+func retryPendingCallbacks(ctx context.Context) error {
+	pending := callbackDeliveries.pending()
+
+	failed := 0
+	for _, snapshot := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryableCallbackStatus(snapshot.StatusCode) {
+			continue
+		}
+
+		delivery := callbackDeliveries.find(snapshot.JobID)
+		if snapshot.JobID == "" {
+			delivery = callbackDeliveries.find(strconv.FormatInt(snapshot.ID, 10))
+		}
+		if delivery == nil {
+			continue
+		}
+
+		if deliverCallback(delivery) != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d callbacks still undelivered", failed)
+	}
+	return nil
+}
+
+// retryPolicy decides how failed operations are retried, see the
+// CallbackRetry and UploadRetry config fields
+type retryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	MaxElapsed time.Duration
+}
+
+// a single attempt until setupCallbackRetries is called
+var callbackRetries = retryPolicy{Attempts: 1}
+
+func setupCallbackRetries(config *Config) {
+	callbackRetries = retryPolicy{
+		Attempts:   config.CallbackRetryAttempts,
+		Backoff:    time.Duration(config.CallbackRetryBackoff),
+		MaxBackoff: time.Duration(config.CallbackRetryMaxBackoff),
+		MaxElapsed: time.Duration(config.CallbackRetryMaxElapsed),
+	}
+}
+
+// wait returns how long to sleep before the given retry (1 for the first),
+// with up to 50% jitter so that services coming back from an outage aren't
+// hit by every retry at once
+func (p retryPolicy) wait(retry int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryableCallbackStatus is false for responses that another attempt won't
+// change, eg. a 404 for a mistyped callback URL
+func retryableCallbackStatus(statusCode int) bool {
+	if statusCode == 0 || statusCode >= 500 {
+		return true
+	}
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+// loadCallbackTimeout reads callback_timeout, which overrides
+// AsyncNotificationTimeout up to MaxAsyncNotificationTimeout
+func loadCallbackTimeout(params url.Values, config *Config) (time.Duration, error) {
+	timeout := time.Duration(config.AsyncNotificationTimeout)
+
+	value := params.Get("callback_timeout")
+	if value == "" {
+		return timeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, badRequestf("Invalid callback_timeout: %s", value)
+	}
+
+	if config.MaxAsyncNotificationTimeout > 0 && timeout > time.Duration(config.MaxAsyncNotificationTimeout) {
+		return 0, badRequestf("callback_timeout is over the limit of %v", time.Duration(config.MaxAsyncNotificationTimeout))
+	}
+
+	return timeout, nil
+}
+
+// jobCaller is what the caller of an async operation passes along to be
+// sent back with its callbacks
+type jobCaller struct {
+	IdempotencyKey string
+	Context        string // opaque to zipserver, echoed verbatim
+	AutoRetry      int    // failed attempts made again, up to MaxJobAutoRetry
+}
+
+// loadJobCaller reads idempotency_key, auto_retry and context (or metadata,
+// its alias), which can be up to MaxCallbackContextLength bytes
+func loadJobCaller(params url.Values, config *Config) (jobCaller, error) {
+	name := "context"
+	if _, ok := params[name]; !ok {
+		name = "metadata"
+	}
+
+	if err := checkParamLength(params, name, config.MaxCallbackContextLength); err != nil {
+		return jobCaller{}, err
+	}
+
+	autoRetry := 0
+	if value := params.Get("auto_retry"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return jobCaller{}, badRequestf("Invalid auto_retry: %s", value)
+		}
+		if parsed > config.MaxJobAutoRetry {
+			return jobCaller{}, badRequestf("auto_retry is too high (%d, max %d)", parsed, config.MaxJobAutoRetry)
+		}
+		autoRetry = parsed
+	}
+
+	return jobCaller{
+		IdempotencyKey: params.Get("idempotency_key"),
+		Context:        params.Get(name),
+		AutoRetry:      autoRetry,
+	}, nil
+}
+
+// callbackFields identify the job a callback is about, they're added to
+// every callback
+type callbackFields struct {
+	JobID          string `json:",omitempty"`
+	Context        string `json:",omitempty"`
+	RequestID      string `json:",omitempty"`
+	Attempt        int    `json:",omitempty"`
+	IdempotencyKey string `json:",omitempty"`
+}
+
+// progressCallbackFields are the fields of job's progress updates, which
+// aren't attempts of their own
+func progressCallbackFields(job *Job) callbackFields {
+	if job == nil {
+		return callbackFields{}
+	}
+	return callbackFields{JobID: job.ID, Context: job.Context, RequestID: job.RequestID}
+}
+
+func (f callbackFields) addTo(values url.Values) {
+	for name, value := range map[string]string{
+		"JobID":          f.JobID,
+		"Context":        f.Context,
+		"RequestID":      f.RequestID,
+		"IdempotencyKey": f.IdempotencyKey,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	if f.Attempt > 0 {
+		values.Set("Attempt", strconv.Itoa(f.Attempt))
+	}
+}
+
+// notify the callback URL of task completion, the job ID is sent along when
+// there's a job. Legacy jobs post resValues as a form, /v2 jobs post result
+// as JSON instead, see callbackJSON. Jobs with an idempotency key don't
+// notify a URL that already acknowledged a callback with that key, eg. for an
+// earlier attempt at the same operation, nor any URL once a sync response
+// with the key was sent: the skipped delivery is only recorded.
+func notifyCallback(callbackURL string, timeout time.Duration, job *Job, resValues url.Values, result interface{}) error {
+	fields := progressCallbackFields(job)
+	if job != nil {
+		fields.IdempotencyKey = job.IdempotencyKey
+		if job.AutoRetry > 0 {
+			fields.Attempt = job.Attempt
+		}
+	}
+	idempotencyKey := fields.IdempotencyKey
+	fields.addTo(resValues)
+
+	body, contentType := callbackBody(job, resValues, fields, result)
+	delivery := &CallbackDelivery{
+		JobID:          job.jobID(),
+		IdempotencyKey: idempotencyKey,
+		URL:            callbackURL,
+		CreatedAt:      time.Now(),
+		body:           body,
+		contentType:    contentType,
+		timeout:        timeout,
+	}
+
+	if idempotencyKey == "" {
+		callbackDeliveries.add(delivery)
+		return deliverCallbackWithRetries(shutdownContext, delivery, callbackRetries)
+	}
+
+	if !callbackDeliveries.addUnlessAcknowledged(delivery) {
+		globalMetrics.TotalSuppressedCallbacks.Add(1)
+		log.Printf("Skipping callback %s, idempotency key %s was already acknowledged", callbackURL, idempotencyKey)
+		return nil
+	}
+
+	err := deliverCallbackWithRetries(shutdownContext, delivery, callbackRetries)
+	callbackDeliveries.update(delivery, func(d *CallbackDelivery) { d.sending = false })
+	return err
+}
+
+// notify the callback URL that an error happened
+func notifyError(callbackURL string, timeout time.Duration, job *Job, err error) error {
+	globalMetrics.TotalErrors.Add(1)
+	err = job.canceledError(err)
+
+	message := url.Values{}
+	message.Add("Success", "false")
+	message.Add("Error", err.Error())
+	return notifyCallback(callbackURL, timeout, job, message, struct {
+		Success bool
+		Error   string
+	}{false, err.Error()})
+}
+
+// notifyProgress posts an intermediate update for a job to callbackURL. It's
+// best effort: a single attempt that isn't recorded or retried, since the
+// next update or the final callback supersedes it, and it's abandoned when the
+// job is canceled. Like notifyCallback, /v2 jobs get result as JSON instead of
+// resValues.
+func notifyProgress(callbackURL string, timeout time.Duration, job *Job, resValues url.Values, result interface{}) {
+	// the final callback reports the cancellation
+	if job.isCanceled() {
+		return
+	}
+	fields := progressCallbackFields(job)
+	fields.addTo(resValues)
+
+	body, contentType := callbackBody(job, resValues, fields, result)
+	_, err := postCallback(job.detachedContext(), callbackURL, timeout, job.jobID(), contentType, body)
+	if err != nil {
+		log.Print("Failed to deliver progress update: ", err)
+	}
+}
+
+// deliverCallbackWithRetries attempts delivery until it succeeds, policy says
+// to give up, or ctx is done while waiting for the next attempt. The delivery
+// is left pending for retryPendingCallbacks and replays either way.
+func deliverCallbackWithRetries(ctx context.Context, delivery *CallbackDelivery, policy retryPolicy) error {
+	startTime := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := deliverCallback(delivery)
+		if err == nil {
+			return nil
+		}
+
+		callbackDeliveries.Lock()
+		statusCode := delivery.StatusCode
+		callbackDeliveries.Unlock()
+
+		wait := policy.wait(attempt)
+		giveUp := attempt >= policy.Attempts || !retryableCallbackStatus(statusCode) ||
+			(policy.MaxElapsed > 0 && time.Since(startTime)+wait > policy.MaxElapsed)
+
+		if giveUp {
+			globalMetrics.TotalCallbackFailures.Add(1)
+			log.Printf("Giving up on callback %s after %d attempts: %v", delivery.URL, attempt, err)
+			return err
+		}
+
+		globalMetrics.TotalCallbackRetries.Add(1)
+		log.Printf("Retrying callback %s in %v", delivery.URL, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			globalMetrics.TotalCallbackFailures.Add(1)
+			log.Printf("Giving up on callback %s after %d attempts: %v", delivery.URL, attempt, ctx.Err())
+			return err
+		}
+	}
+}
+
+// deliverCallback makes one attempt at sending a recorded callback
+func deliverCallback(delivery *CallbackDelivery) error {
+	log.Print("Notifying " + delivery.URL)
+
+	var statusCode int
+	var err error
+	if strings.HasPrefix(delivery.URL, localCallbackScheme) {
+		err = deliverLocalReply(delivery.URL, delivery.body)
+		if err == nil {
+			statusCode = http.StatusOK
+		}
+	} else {
+		statusCode, err = postCallback(context.Background(), delivery.URL, delivery.timeout, delivery.JobID, delivery.contentType, delivery.body)
+	}
+
+	callbackDeliveries.update(delivery, func(d *CallbackDelivery) {
+		d.Attempts++
+		d.LastAttemptAt = time.Now()
+		d.StatusCode = statusCode
+		d.Error = ""
+		if err != nil {
+			d.Error = err.Error()
+		}
+		d.Delivered = err == nil
+	})
+
+	return err
+}
+
+// callbackBody encodes a callback as a form, or as JSON for /v2 jobs
+func callbackBody(job *Job, resValues url.Values, fields callbackFields, result interface{}) (body, contentType string) {
+	if job.jsonCallbacks() {
+		return callbackJSON(result, fields), "application/json"
+	}
+	return resValues.Encode(), "application/x-www-form-urlencoded"
+}
+
+// postCallback makes a single request to callbackURL, ctx can stop it early
+func postCallback(ctx context.Context, callbackURL string, timeout time.Duration, jobID, contentType, body string) (statusCode int, err error) {
+	notifyCtx, notifyCancel := context.WithTimeout(ctx, timeout)
+	defer notifyCancel()
+
+	if job, ok := jobs.get(jobID); ok && job.span != nil {
+		notifyCtx = withSpan(notifyCtx, job.span)
+	}
+	notifyCtx, span := startClientSpan(notifyCtx, "callback", "zipserver.job", jobID, "server.address", urlHost(callbackURL))
+	defer func() { span.finish(err) }()
+
+	req, err := http.NewRequestWithContext(notifyCtx, http.MethodPost, callbackURL, bytes.NewBufferString(body))
+	if err != nil {
+		log.Print("Failed to create callback request: ", err)
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	setOutboundHeaders(req, jobID)
+
+	startTime := time.Now()
+	response, err := outboundHTTPClient.Do(req)
+	globalMetrics.CallbackDuration.Observe(time.Since(startTime))
+	if err != nil {
+		log.Print("Failed to deliver callback: ", err)
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		log.Printf("Callback returned unexpected code: %d %s", response.StatusCode, callbackURL)
+		bodyBytes, _ := io.ReadAll(response.Body)
+		log.Print(string(bodyBytes))
+		return response.StatusCode, fmt.Errorf("Callback returned unexpected code: %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// pendingCallbacksHandler lists the callbacks that couldn't be delivered
+func pendingCallbacksHandler(w http.ResponseWriter, r *http.Request) error {
+	return writeJSONMessage(w, struct {
+		Callbacks []CallbackDelivery
+	}{callbackDeliveries.pending()})
+}
+
+// replayCallbackHandler sends a recorded callback again, eg. after the
+// consumer had an outage
+func replayCallbackHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return badRequestf("Replaying a callback requires POST")
+	}
+
+	params := r.URL.Query()
+	id, err := getParam(params, "job")
+	if err != nil {
+		return badRequestf("%v", err)
+	}
+
+	delivery := callbackDeliveries.find(id)
+	if delivery == nil {
+		return badRequestf("No callback recorded for job %s", id)
+	}
+
+	err = deliverCallback(delivery)
+
+	callbackDeliveries.Lock()
+	result := *delivery
+	callbackDeliveries.Unlock()
+
+	if err != nil {
+		return writeJSONMessage(w, struct {
+			Success  bool
+			Error    string
+			Callback CallbackDelivery
+		}{false, err.Error(), result})
+	}
+
+	return writeJSONMessage(w, struct {
+		Success  bool
+		Callback CallbackDelivery
+	}{true, result})
+}
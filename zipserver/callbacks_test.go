@@ -0,0 +1,295 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadCallbackTimeout(t *testing.T) {
+	config := defaultConfig
+
+	timeout, err := loadCallbackTimeout(url.Values{}, &config)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(config.AsyncNotificationTimeout), timeout)
+
+	timeout, err = loadCallbackTimeout(url.Values{"callback_timeout": {"30s"}}, &config)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, timeout)
+
+	_, err = loadCallbackTimeout(url.Values{"callback_timeout": {"1h"}}, &config)
+	assert.Error(t, err)
+
+	_, err = loadCallbackTimeout(url.Values{"callback_timeout": {"soon"}}, &config)
+	assert.Error(t, err)
+}
+
+func Test_NotifyCallbackRecordsDelivery(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	err := notifyCallback(server.URL, time.Second, nil, url.Values{"Success": {"true"}}, nil)
+	assert.Error(t, err)
+
+	callbackDeliveries.Lock()
+	delivery := callbackDeliveries.deliveries[len(callbackDeliveries.deliveries)-1]
+	callbackDeliveries.Unlock()
+
+	assert.Equal(t, server.URL, delivery.URL)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, delivery.StatusCode)
+	assert.False(t, delivery.Delivered)
+
+	status = http.StatusOK
+	assert.NoError(t, deliverCallback(delivery))
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Equal(t, http.StatusOK, delivery.StatusCode)
+	assert.True(t, delivery.Delivered)
+	assert.Empty(t, delivery.Error)
+}
+
+func Test_ReplayCallback(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	assert.Error(t, notifyCallback(server.URL, time.Second, nil, url.Values{"Success": {"true"}}, nil))
+
+	var delivery *CallbackDelivery
+	for _, pending := range callbackDeliveries.pending() {
+		if pending.URL == server.URL {
+			delivery = callbackDeliveries.find(fmt.Sprint(pending.ID))
+		}
+	}
+	assert.NotNil(t, delivery)
+
+	replay := wrapErrors(replayCallbackHandler)
+
+	rec := httptest.NewRecorder()
+	replay.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/callbacks/replay?job=nope", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	status = http.StatusOK
+	rec = httptest.NewRecorder()
+	replay.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/callbacks/replay?job=%d", delivery.ID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"Success":true`)
+
+	for _, pending := range callbackDeliveries.pending() {
+		assert.NotEqual(t, delivery.ID, pending.ID)
+	}
+}
+
+func Test_CallbackRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	policy := retryPolicy{Attempts: 5, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+
+	delivery := &CallbackDelivery{URL: server.URL, timeout: time.Second}
+	callbackDeliveries.add(delivery)
+
+	assert.NoError(t, deliverCallbackWithRetries(context.Background(), delivery, policy))
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.True(t, delivery.Delivered)
+
+	// client errors aren't retried
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+
+	delivery = &CallbackDelivery{URL: notFound.URL, timeout: time.Second}
+	callbackDeliveries.add(delivery)
+
+	assert.Error(t, deliverCallbackWithRetries(context.Background(), delivery, policy))
+	assert.Equal(t, 1, delivery.Attempts)
+
+	// a shutdown doesn't wait for the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts = 0
+	delivery = &CallbackDelivery{URL: server.URL, timeout: time.Second}
+	callbackDeliveries.add(delivery)
+
+	policy.Backoff = time.Hour
+	policy.MaxBackoff = time.Hour
+	assert.Error(t, deliverCallbackWithRetries(ctx, delivery, policy))
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.False(t, delivery.Delivered)
+}
+
+func Test_NotifyProgressCanceledJob(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	job := jobs.newJob("extract", "zips/game.zip", "games/45", server.URL, time.Second, jobCaller{})
+
+	done := make(chan struct{})
+	go func() {
+		notifyProgress(server.URL, time.Minute, job, url.Values{"Uploaded": {"1"}}, nil)
+		close(done)
+	}()
+	<-received
+
+	// canceling the job stops the update in flight
+	require.NoError(t, CancelJob(job.ID, ""))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("progress update still in flight after the job was canceled")
+	}
+}
+
+func Test_CallbackRetryWait(t *testing.T) {
+	policy := retryPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for retry, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		wait := policy.wait(retry)
+		assert.GreaterOrEqual(t, wait, expected/2)
+		assert.LessOrEqual(t, wait, expected)
+	}
+}
+
+func Test_NotifyCallbackSuppressesAcknowledgedKey(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "upload-42", r.PostForm.Get("IdempotencyKey"))
+		received++
+	}))
+	defer server.Close()
+
+	first := jobs.newJob("extract", "zips/game.zip", "games/42", server.URL, time.Second, jobCaller{IdempotencyKey: "upload-42"})
+	second := jobs.newJob("extract", "zips/game.zip", "games/42", server.URL, time.Second, jobCaller{IdempotencyKey: "upload-42"})
+	other := jobs.newJob("extract", "zips/game.zip", "games/42", server.URL+"/other", time.Second, jobCaller{IdempotencyKey: "upload-42"})
+
+	assert.NoError(t, notifyCallback(server.URL, time.Second, first, url.Values{"Success": {"true"}}, nil))
+	assert.NoError(t, notifyCallback(server.URL, time.Second, second, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, 1, received)
+
+	suppressed := callbackDeliveries.find(second.ID)
+	require.NotNil(t, suppressed)
+	assert.True(t, suppressed.Suppressed)
+	assert.Equal(t, 0, suppressed.Attempts)
+
+	assert.NoError(t, notifyCallback(server.URL+"/other", time.Second, other, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, 2, received, "keys are only shared by the same callback URL")
+}
+
+func Test_NotifyCallbackConcurrentKey(t *testing.T) {
+	var received atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		<-release
+	}))
+	defer server.Close()
+
+	first := jobs.newJob("extract", "zips/game.zip", "games/43", server.URL, time.Second, jobCaller{IdempotencyKey: "upload-43"})
+	second := jobs.newJob("extract", "zips/game.zip", "games/43", server.URL, time.Second, jobCaller{IdempotencyKey: "upload-43"})
+
+	done := make(chan error)
+	go func() { done <- notifyCallback(server.URL, time.Second, first, url.Values{"Success": {"true"}}, nil) }()
+	require.Eventually(t, func() bool { return received.Load() == 1 }, time.Second, time.Millisecond)
+
+	// the first one is still being delivered
+	assert.NoError(t, notifyCallback(server.URL, time.Second, second, url.Values{"Success": {"true"}}, nil))
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(1), received.Load())
+	assert.True(t, callbackDeliveries.find(second.ID).Suppressed)
+}
+
+func Test_NotifyCallbackAfterSyncResponse(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer server.Close()
+
+	recordSyncResponse(jobCaller{IdempotencyKey: "upload-44"})
+
+	job := jobs.newJob("extract", "zips/game.zip", "games/44", server.URL, time.Second, jobCaller{IdempotencyKey: "upload-44"})
+	assert.NoError(t, notifyCallback(server.URL, time.Second, job, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, 0, received)
+	assert.True(t, callbackDeliveries.find(job.ID).Suppressed)
+}
+
+func Test_CallbackIdentifiesJob(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	job := jobs.newJob("extract", "uploads/1.zip", "builds/1", server.URL, time.Second, jobCaller{})
+	require.NoError(t, notifyCallback(server.URL, time.Second, job, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, "zipserver/"+Version+" (job "+job.ID+")", headers.Get("User-Agent"))
+	assert.Equal(t, job.ID, headers.Get(jobHeader))
+
+	globalConfig.UserAgent = "itch-zipserver/2"
+	require.NoError(t, notifyCallback(server.URL, time.Second, nil, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, "itch-zipserver/2", headers.Get("User-Agent"))
+	assert.Empty(t, headers.Get(jobHeader))
+}
+
+func Test_CallbackEchoesContext(t *testing.T) {
+	config := defaultConfig
+	config.MaxCallbackContextLength = 16
+
+	caller, err := loadJobCaller(url.Values{"context": {"row=42"}, "idempotency_key": {"k"}}, &config)
+	require.NoError(t, err)
+	assert.Equal(t, jobCaller{IdempotencyKey: "k", Context: "row=42"}, caller)
+
+	caller, err = loadJobCaller(url.Values{"metadata": {`{"row":42}`}}, &config)
+	require.NoError(t, err)
+	assert.Equal(t, `{"row":42}`, caller.Context)
+
+	_, err = loadJobCaller(url.Values{"context": {strings.Repeat("x", 17)}}, &config)
+	assert.Error(t, err)
+
+	var received url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r.PostForm
+	}))
+	defer server.Close()
+
+	job := jobs.newJob("slurp", "uploads/1", "", server.URL, time.Second, jobCaller{Context: "a=1&b=2"})
+	require.NoError(t, notifyCallback(server.URL, time.Second, job, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, "a=1&b=2", received.Get("Context"))
+
+	status, ok := jobs.get(job.ID)
+	require.True(t, ok)
+	assert.Equal(t, "a=1&b=2", status.Context)
+}
@@ -0,0 +1,239 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	errors "github.com/go-errors/errors"
+)
+
+// ClamAVConfig sets up scanning extracted files with clamd
+type ClamAVConfig struct {
+	// clamd's address, eg. "127.0.0.1:3310", or its socket, eg.
+	// "unix:/run/clamav/clamd.ctl". Scanning is off when empty
+	Address string `json:",omitempty"`
+	// Longest a single file's scan can take. Defaults to 1m
+	Timeout Duration `json:",omitempty"`
+	// What's done with a file where malware is found: "fail" the extraction
+	// (the default) or "skip" the file
+	OnDetection string `json:",omitempty"`
+}
+
+const (
+	clamAVFail = "fail"
+	clamAVSkip = "skip"
+)
+
+// how much of a file is sent to clamd at once
+const clamAVChunkSize = 64 * 1024
+
+func validateClamAV(config ClamAVConfig) error {
+	switch config.OnDetection {
+	case "", clamAVFail, clamAVSkip:
+		return nil
+	default:
+		return fmt.Errorf("Config error: invalid ClamAV.OnDetection %q, expected fail or skip", config.OnDetection)
+	}
+}
+
+// MalwareDetection is a file clamd found malware in
+type MalwareDetection struct {
+	Name      string // in the zip
+	Signature string // eg. "Win.Test.EICAR_HDB-1"
+}
+
+// ScanReport sums up the malware scan of an extraction's files
+type ScanReport struct {
+	ScannedFiles int
+	// the files left out of the extraction with ClamAV.OnDetection=skip
+	Detections []MalwareDetection `json:",omitempty"`
+}
+
+// MalwareDetectedError fails an extraction when clamd found malware in some
+// of its files
+type MalwareDetectedError struct {
+	Detections []MalwareDetection
+}
+
+func (e *MalwareDetectedError) Error() string {
+	names := []string{}
+	for _, detection := range e.Detections {
+		names = append(names, fmt.Sprintf("%s (%s)", detection.Name, detection.Signature))
+	}
+	return fmt.Sprintf("Malware found in %d files: %s", len(e.Detections), strings.Join(names, ", "))
+}
+
+// clamdScan streams reader to clamd with the INSTREAM command, returning the
+// signature it found or an empty string when the file is clean
+func clamdScan(ctx context.Context, config *ClamAVConfig, reader io.Reader) (string, error) {
+	timeout := time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if socket := strings.TrimPrefix(config.Address, "unix:"); socket != config.Address {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	} else {
+		conn, err = dialOutbound(ctx, "tcp", config.Address)
+	}
+	if err != nil {
+		return "", errors.Wrap(fmt.Errorf("Failed to connect to clamd: %v", err), 0)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	// clamd answers as soon as it gives up, eg. over StreamMaxLength, so the
+	// reply is read even when sending fails
+	sendErr := sendClamdStream(conn, reader)
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if sendErr != nil {
+			return "", errors.Wrap(fmt.Errorf("Failed to send file to clamd: %v", sendErr), 0)
+		}
+		return "", errors.Wrap(fmt.Errorf("Failed to read clamd reply: %v", err), 0)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+func sendClamdStream(conn net.Conn, reader io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, err := reader.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a zero length chunk ends the stream
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply reads "stream: OK" or "stream: <signature> FOUND"
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", errors.Errorf("clamd failed to scan file: %s", reply)
+	}
+}
+
+// scanZipFiles has clamd scan every file before any of them is uploaded, a
+// few at a time. Files with malware fail the extraction, or are left out of
+// it with ClamAV.OnDetection=skip. Scan errors, eg. clamd being down, always
+// fail it.
+func (a *Archiver) scanZipFiles(ctx context.Context, files []*zip.File, threads int, opts *ExtractOptions) ([]*zip.File, *ScanReport, error) {
+	config := &a.Config.ClamAV
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signatures := make([]string, len(files))
+	indices := make(chan int)
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				signature, err := scanZipFile(ctx, config, files[idx], opts)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				signatures[idx] = signature
+			}
+		}()
+	}
+
+	for idx := range files {
+		select {
+		case indices <- idx:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	report := &ScanReport{ScannedFiles: len(files)}
+	clean := []*zip.File{}
+	for idx, file := range files {
+		if signatures[idx] == "" {
+			clean = append(clean, file)
+			continue
+		}
+		logPrintf(ctx, "Malware found in %s: %s", file.Name, signatures[idx])
+		report.Detections = append(report.Detections, MalwareDetection{file.Name, signatures[idx]})
+	}
+
+	globalMetrics.TotalScannedFiles.Add(int64(len(files)))
+	globalMetrics.TotalMalwareDetections.Add(int64(len(report.Detections)))
+
+	if len(report.Detections) > 0 && config.OnDetection != clamAVSkip {
+		return nil, nil, &MalwareDetectedError{report.Detections}
+	}
+	return clean, report, nil
+}
+
+func scanZipFile(ctx context.Context, config *ClamAVConfig, file *zip.File, opts *ExtractOptions) (string, error) {
+	reader, err := openZipEntry(file, opts.Password)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	signature, err := clamdScan(ctx, config, reader)
+	if err != nil {
+		return "", errors.Wrap(fmt.Errorf("Failed to scan %s: %v", file.Name, err), 0)
+	}
+	return signature, nil
+}
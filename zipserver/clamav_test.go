@@ -0,0 +1,138 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd answers INSTREAM scans, finding a signature in streams holding
+// EICAR, and returns its address
+func fakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+
+				command, err := reader.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(reader, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+
+				if bytes.Contains(data, []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func Test_ClamdScan(t *testing.T) {
+	ctx := context.Background()
+	config := &ClamAVConfig{Address: fakeClamd(t)}
+
+	signature, err := clamdScan(ctx, config, strings.NewReader(strings.Repeat("clean ", 50000)))
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+
+	signature, err = clamdScan(ctx, config, strings.NewReader("X5O!P%@AP EICAR-STANDARD-ANTIVIRUS-TEST-FILE"))
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR")
+	assert.Error(t, err)
+
+	_, err = clamdScan(ctx, &ClamAVConfig{Address: "127.0.0.1:1"}, strings.NewReader("clean"))
+	assert.Error(t, err)
+}
+
+func Test_ExtractScansForMalware(t *testing.T) {
+	ctx := context.Background()
+
+	config := emptyConfig()
+	config.ClamAV.Address = fakeClamd(t)
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string]string{
+		"index.html":  "<html></html>",
+		"game.js":     "console.log('hi')",
+		"payload.exe": "EICAR",
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(data))
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "game.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	_, err = archiver.ExtractZip(ctx, "game.zip", "failed", testLimits(), ExtractOptions{})
+	var malwareErr *MalwareDetectedError
+	require.ErrorAs(t, err, &malwareErr)
+	assert.Equal(t, []MalwareDetection{{"payload.exe", "Eicar-Test-Signature"}}, malwareErr.Detections)
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "failed/index.html")
+	assert.ErrorIs(t, err, ErrObjectNotFound, "nothing is uploaded")
+
+	config.ClamAV.OnDetection = clamAVSkip
+	report := &ScanReport{}
+	extracted, err := archiver.ExtractZip(ctx, "game.zip", "skipped", testLimits(), ExtractOptions{ScanReport: report})
+	require.NoError(t, err)
+	assert.Len(t, extracted, 2)
+	assert.Equal(t, &ScanReport{
+		ScannedFiles: 3,
+		Detections:   []MalwareDetection{{"payload.exe", "Eicar-Test-Signature"}},
+	}, report)
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "skipped/payload.exe")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// clamd being unreachable fails the extraction rather than skipping the scan
+	config.ClamAV.Address = "127.0.0.1:1"
+	_, err = archiver.ExtractZip(ctx, "game.zip", "unscanned", testLimits(), ExtractOptions{})
+	assert.Error(t, err)
+}
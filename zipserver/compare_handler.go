@@ -0,0 +1,185 @@
+package zipserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maximum size of a client-submitted manifest
+const maxManifestBodySize = 10 * 1024 * 1024
+
+// ManifestDiff lists the differences between an expected and an actual
+// manifest, all paths are relative to the extraction prefix
+type ManifestDiff struct {
+	Missing    []string // in expected, not extracted
+	Unexpected []string // extracted, not in expected
+	Mismatched []string // present in both with different checksums
+}
+
+// Identical returns true if both manifests matched exactly
+func (md *ManifestDiff) Identical() bool {
+	return len(md.Missing) == 0 && len(md.Unexpected) == 0 && len(md.Mismatched) == 0
+}
+
+// compareManifests compares two path→checksum maps
+func compareManifests(expected, actual map[string]string) *ManifestDiff {
+	diff := &ManifestDiff{
+		Missing:    []string{},
+		Unexpected: []string{},
+		Mismatched: []string{},
+	}
+
+	for name, checksum := range expected {
+		actualChecksum, ok := actual[name]
+		if !ok {
+			diff.Missing = append(diff.Missing, name)
+		} else if !strings.EqualFold(checksum, actualChecksum) {
+			diff.Mismatched = append(diff.Mismatched, name)
+		}
+	}
+
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			diff.Unexpected = append(diff.Unexpected, name)
+		}
+	}
+
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Unexpected)
+	sort.Strings(diff.Mismatched)
+
+	return diff
+}
+
+// PrefixChecksums downloads every object under prefix and returns a map of
+// relative path to hex-encoded sha256. The objects zipserver writes next to
+// the extracted files (its manifests and the file tree) are left out.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) PrefixChecksums(ctx context.Context, prefix string) (map[string]string, error) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	fileTreeKey := prefix + fileTreeName
+
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := make(map[string]string, len(objects))
+
+	for _, object := range objects {
+		if isZipserverManifest(object.Key) || object.Key == fileTreeKey {
+			continue
+		}
+
+		checksum, err := a.objectChecksum(ctx, object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed hashing %s: %s", object.Key, err.Error())
+		}
+
+		checksums[strings.TrimPrefix(object.Key, prefix)] = checksum
+	}
+
+	return checksums, nil
+}
+
+// ExtractedChecksums returns a map of relative path to hex-encoded sha256 of
+// the files extracted under prefix, as they were in the zip. The checksums
+// recorded in the extraction's manifest are used, files without one, eg. from
+// older extractions, are downloaded and hashed as stored: for pre-compressed
+// entries (stored with a Content-Encoding) that's the compressed bytes. Without
+// a manifest, every object under prefix is hashed, see PrefixChecksums.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) ExtractedChecksums(ctx context.Context, prefix string) (map[string]string, error) {
+	manifest, err := a.loadExtractManifest(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return a.PrefixChecksums(ctx, prefix)
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	checksums := make(map[string]string, len(manifest.Files))
+
+	for _, file := range manifest.Files {
+		checksum := file.SHA256
+		if checksum == "" {
+			checksum, err = a.objectChecksum(ctx, file.Key)
+			if err != nil {
+				return nil, fmt.Errorf("Failed hashing %s: %s", file.Key, err.Error())
+			}
+		}
+
+		checksums[strings.TrimPrefix(file.Key, prefix)] = checksum
+	}
+
+	return checksums, nil
+}
+
+func (a *Archiver) objectChecksum(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FileGetTimeout))
+	defer cancel()
+
+	reader, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Compares a client-computed manifest (JSON object of path to sha256, POSTed
+// as the body) against what was extracted under prefix
+func compareManifestHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return badRequestf("Manifest must be POSTed")
+	}
+
+	prefixParam, err := getParam(r.URL.Query(), "prefix")
+	if err != nil {
+		return err
+	}
+
+	prefix, err := extractedPrefix(prefixParam)
+	if err != nil {
+		return err
+	}
+
+	var expected map[string]string
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManifestBodySize)).Decode(&expected)
+	if err != nil {
+		return badRequestf("Invalid manifest: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	archiver := NewArchiver(globalConfig)
+	actual, err := archiver.ExtractedChecksums(ctx, prefix)
+	if err != nil {
+		return writeJSONError(w, "CompareError", err)
+	}
+
+	diff := compareManifests(expected, actual)
+
+	return writeJSONMessage(w, struct {
+		Success   bool
+		Identical bool
+		*ManifestDiff
+	}{true, diff.Identical(), diff})
+}
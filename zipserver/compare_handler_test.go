@@ -0,0 +1,110 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CompareManifests(t *testing.T) {
+	diff := compareManifests(map[string]string{
+		"index.html": "AAAA",
+		"game.wasm":  "bbbb",
+		"gone.png":   "cccc",
+	}, map[string]string{
+		"index.html": "aaaa",
+		"game.wasm":  "dddd",
+		"extra.txt":  "eeee",
+	})
+
+	assert.False(t, diff.Identical())
+	assert.EqualValues(t, []string{"gone.png"}, diff.Missing)
+	assert.EqualValues(t, []string{"extra.txt"}, diff.Unexpected)
+	assert.EqualValues(t, []string{"game.wasm"}, diff.Mismatched)
+
+	diff = compareManifests(map[string]string{"a": "b"}, map[string]string{"a": "b"})
+	assert.True(t, diff.Identical())
+}
+
+func Test_PrefixChecksums(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	err = storage.PutFile(ctx, config.Bucket, "games/1/hello.txt", strings.NewReader("hello"), "text/plain")
+	assert.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+	checksums, err := archiver.PrefixChecksums(ctx, "games/1")
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[string]string{
+		"hello.txt": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}, checksums)
+}
+
+func Test_ExtractedChecksums(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	gzipped := []byte{0x1F, 0x8B, 0x08, 1, 5, 2}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range map[string][]byte{"hello.txt": []byte("hello"), "game.jsgz": gzipped} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(contents)
+	}
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "game.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	_, err = archiver.ExtractZipFile(ctx, fname, "games/1", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+
+	// game.jsgz is stored as game.js with a Content-Encoding, its checksum is
+	// still the one of the zip entry
+	checksums, err := archiver.ExtractedChecksums(ctx, "games/1")
+	require.NoError(t, err)
+	assert.EqualValues(t, map[string]string{
+		"hello.txt": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"game.js":   fmt.Sprintf("%x", sha256.Sum256(gzipped)),
+	}, checksums)
+}
+
+func Test_CompareManifestHandlerBadRequests(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+	globalConfig.ExtractPrefix = "extracted"
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/compare_manifest?prefix=games/1", nil),
+		httptest.NewRequest(http.MethodPost, "/compare_manifest?prefix=games/1", strings.NewReader("{")),
+		httptest.NewRequest(http.MethodPost, "/compare_manifest?prefix=.", strings.NewReader("{}")),
+		httptest.NewRequest(http.MethodPost, "/compare_manifest?prefix=../other", strings.NewReader("{}")),
+	} {
+		rec := httptest.NewRecorder()
+		err := compareManifestHandler(rec, req)
+		var badRequest *badRequestError
+		require.ErrorAs(t, err, &badRequest, req.URL.String())
+	}
+}
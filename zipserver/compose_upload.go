@@ -0,0 +1,140 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GCS refuses to compose more than this many objects at once
+const maxComposeComponents = 32
+
+// composer is implemented by storages that can concatenate objects server-side
+type composer interface {
+	ComposeFile(ctx context.Context, bucket, key string, componentKeys []string, setup StorageSetupFunc) error
+}
+
+// composeChunkSize returns how big each part of a size-byte upload should be
+// so that it doesn't exceed maxComposeComponents parts
+func composeChunkSize(size uint64, minChunkSize uint64) uint64 {
+	chunkSize := (size + maxComposeComponents - 1) / maxComposeComponents
+	if chunkSize < minChunkSize {
+		chunkSize = minChunkSize
+	}
+	return chunkSize
+}
+
+func composePartKey(key string, index int) string {
+	return fmt.Sprintf("%s.zipserver-part-%d", key, index)
+}
+
+// putFileComposed uploads contents as chunks in parallel, then composes them
+// into key. Chunks are read sequentially but uploaded while the next ones are
+// read, at most GCSComposeConcurrency at a time. The temporary part objects
+// are always removed.
+func (a *Archiver) putFileComposed(ctx context.Context, c composer, key string, contents io.Reader, size uint64, setup StorageSetupFunc) error {
+	chunkSize := composeChunkSize(size, a.Config.GCSComposeChunkSize)
+
+	concurrency := a.Config.GCSComposeConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var uploadErr error
+	var errMutex sync.Mutex
+	slots := make(chan struct{}, concurrency)
+	partKeys := []string{}
+
+	defer func() {
+		// parts are cleaned up even when the job was canceled
+		cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), time.Duration(a.Config.FilePutTimeout))
+		defer cleanupCancel()
+
+		for _, partKey := range partKeys {
+			if err := a.Storage.DeleteFile(cleanupCtx, a.Bucket, partKey); err != nil {
+				log.Print("Failed to remove compose part ", partKey, ": ", err)
+			}
+		}
+	}()
+
+	setFailed := func(err error) {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+
+		if uploadErr == nil {
+			uploadErr = err
+			cancel()
+		}
+	}
+
+	for index := 0; ; index++ {
+		chunk := make([]byte, chunkSize)
+		n, readErr := io.ReadFull(contents, chunk)
+
+		if n > 0 {
+			// only once there's data left over, a file that fills every part
+			// exactly ends with an empty read
+			if len(partKeys) == maxComposeComponents {
+				setFailed(fmt.Errorf("File needs more than %d compose parts", maxComposeComponents))
+				break
+			}
+
+			partKey := composePartKey(key, index)
+			partKeys = append(partKeys, partKey)
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+
+			if ctx.Err() != nil {
+				break
+			}
+
+			wg.Add(1)
+			go func(chunk []byte) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				err := a.Storage.PutFileWithSetup(ctx, a.Bucket, partKey, bytes.NewReader(chunk), func(req *http.Request) error {
+					req.Header.Set("Content-Type", "application/octet-stream")
+					return nil
+				})
+				if err != nil {
+					setFailed(err)
+				}
+			}(chunk[:n])
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if readErr != nil {
+			setFailed(readErr)
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	log.Printf("Composing %s from %d parts", key, len(partKeys))
+	return c.ComposeFile(ctx, a.Bucket, key, partKeys, setup)
+}
@@ -0,0 +1,88 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ComposeChunkSize(t *testing.T) {
+	assert.EqualValues(t, 64, composeChunkSize(100, 64))
+	assert.EqualValues(t, 100, composeChunkSize(3200, 64))
+	assert.EqualValues(t, 101, composeChunkSize(3201, 64))
+}
+
+func Test_PutFileComposed(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.GCSComposeChunkSize = 10
+	config.GCSComposeConcurrency = 3
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 7)
+
+	err = archiver.putFileComposed(ctx, storage, "big.data", bytes.NewReader(data), uint64(len(data)), func(req *http.Request) error {
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("x-goog-acl", "public-read")
+		return nil
+	})
+	assert.NoError(t, err)
+
+	reader, headers, err := storage.GetFile(ctx, config.Bucket, "big.data")
+	assert.NoError(t, err)
+	composed, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, data, composed)
+	assert.EqualValues(t, "public-read", headers.Get("x-goog-acl"))
+
+	// only the composed object remains
+	objects, err := storage.ListObjects(ctx, config.Bucket, "")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(objects))
+
+	// failing parts fail the upload and still get cleaned up
+	storage.planForFailure(config.Bucket, composePartKey("broken.data", 2))
+	err = archiver.putFileComposed(ctx, storage, "broken.data", bytes.NewReader(data), uint64(len(data)), func(req *http.Request) error {
+		return nil
+	})
+	assert.Error(t, err)
+
+	objects, err = storage.ListObjects(ctx, config.Bucket, "")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(objects))
+}
+
+func Test_PutFileComposedBoundary(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.GCSComposeChunkSize = 10
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+	noSetup := func(req *http.Request) error { return nil }
+
+	// exactly as many parts as can be composed
+	data := bytes.Repeat([]byte("0123456789"), maxComposeComponents)
+	err = archiver.putFileComposed(ctx, storage, "full.data", bytes.NewReader(data), uint64(len(data)), noSetup)
+	assert.NoError(t, err)
+
+	reader, _, err := storage.GetFile(ctx, config.Bucket, "full.data")
+	assert.NoError(t, err)
+	composed, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, data, composed)
+
+	// one byte more than the size it was planned for
+	longer := append(data, 'x')
+	err = archiver.putFileComposed(ctx, storage, "long.data", bytes.NewReader(longer), uint64(len(data)), noSetup)
+	assert.EqualError(t, err, "File needs more than 32 compose parts")
+}
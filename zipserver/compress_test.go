@@ -0,0 +1,52 @@
+package zipserver
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GzipResponseWriter(t *testing.T) {
+	// JSON is compressed
+	rec := httptest.NewRecorder()
+	gzw := &gzipResponseWriter{ResponseWriter: rec}
+	require.NoError(t, writeJSONMessage(gzw, map[string]bool{"Success": true}))
+	require.NoError(t, gzw.Close())
+
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Success":true}`, string(body))
+
+	// anything else goes through as-is
+	rec = httptest.NewRecorder()
+	gzw = &gzipResponseWriter{ResponseWriter: rec}
+	http.Error(gzw, "oops", http.StatusInternalServerError)
+	require.NoError(t, gzw.Close())
+
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "oops\n", rec.Body.String())
+}
+
+func Test_AcceptsGzip(t *testing.T) {
+	accepts := func(value string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/list", nil)
+		if value != "" {
+			req.Header.Set("Accept-Encoding", value)
+		}
+		return acceptsGzip(req)
+	}
+
+	assert.True(t, accepts("gzip"))
+	assert.True(t, accepts("deflate, gzip;q=0.8, br"))
+	assert.False(t, accepts(""))
+	assert.False(t, accepts("br"))
+	assert.False(t, accepts("gzip;q=0"))
+}
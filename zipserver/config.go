@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	errors "github.com/go-errors/errors"
@@ -20,23 +21,28 @@ type ExtractLimits struct {
 	MaxNumFiles       int
 	MaxFileNameLength int
 	ExtractionThreads int
+	// wall time allowed for the extraction itself, 0 means only the job timeout applies
+	MaxExtractionDuration time.Duration
 }
 
 type StorageType int
 
 const (
-	GCS StorageType = iota // Google Cloud Storage
-	S3                     // Amazon S3 Storage
+	GCS    StorageType = iota // Google Cloud Storage
+	S3                        // Amazon S3 Storage
+	GCSSDK                    // Google Cloud Storage through the client library
 )
 
 var storageTypeString = map[string]StorageType{
-	"GCS": GCS,
-	"S3":  S3,
+	"GCS":     GCS,
+	"S3":      S3,
+	"gcs-sdk": GCSSDK,
 }
 
 var storageTypeInt = map[StorageType]string{
-	GCS: "GCS",
-	S3:  "S3",
+	GCS:    "GCS",
+	S3:     "S3",
+	GCSSDK: "gcs-sdk",
 }
 
 func (s *StorageType) MarshalJSON() ([]byte, error) {
@@ -71,7 +77,37 @@ type StorageConfig struct {
 	S3Endpoint    string `json:",omitempty"`
 	S3Region      string `json:",omitempty"`
 
+	// Multipart upload settings, by default the part size is picked from the
+	// object size and measured throughput
+	S3UploadPartSize       int64 `json:",omitempty"`
+	S3UploadMaxConcurrency int   `json:",omitempty"`
+	// Every part being sent is buffered, part size × concurrency is kept under
+	// this many bytes per upload. Defaults to 512MB
+	S3UploadMemory int64 `json:",omitempty"`
+
 	Bucket string `json:",omitempty"`
+
+	// When set, only keys under these prefixes may be written to or deleted
+	// from this target, for buckets shared with other data
+	AllowedPrefixes []string `json:",omitempty"`
+
+	// Name of the target copies are written to when puts to this one fail,
+	// eg. during a regional outage
+	Fallback string `json:",omitempty"`
+
+	// Canned ACL used when a request doesn't ask for one, eg. "public-read".
+	// Empty to leave it to the bucket's defaults
+	DefaultACL string `json:",omitempty"`
+	// Replaces requested ACLs before they're sent, eg. {"public-read": "private"}
+	// for a bucket served through a CDN. An empty value sends no ACL
+	ACLMap map[string]string `json:",omitempty"`
+	// canned (the default) or ignore, for providers without ACLs like R2
+	ACLMode ACLMode `json:",omitempty"`
+
+	// Lays out the files extracted from archives read from this target
+	// (source=), for requests without a key_template. Takes precedence over
+	// ExtractKeyTemplate
+	KeyTemplate string `json:",omitempty"`
 }
 
 // TODO: eventually this should be a factory that can return different storage types
@@ -95,6 +131,11 @@ func (s *StorageConfig) Validate() error {
 		return errors.New(fmt.Sprintf("Config error: [Storage %s] %s field missing", s.Name, field))
 	}
 
+	// gcs-sdk is only a client for the primary bucket, see Config.StorageType
+	if s.Type == GCSSDK {
+		return fmt.Errorf("Config error: [Storage %s] gcs-sdk can't be used for storage targets", s.Name)
+	}
+
 	if s.Type == GCS {
 		if s.GCSPrivateKeyPath == "" {
 			return missingFieldError("GCSPrivateKeyPath")
@@ -118,7 +159,19 @@ func (s *StorageConfig) Validate() error {
 		return missingFieldError("Bucket")
 	}
 
-	return nil
+	for _, prefix := range s.AllowedPrefixes {
+		if strings.Trim(prefix, "/") == "" {
+			return fmt.Errorf("Config error: [Storage %s] invalid allowed prefix %q", s.Name, prefix)
+		}
+	}
+
+	if s.KeyTemplate != "" {
+		if _, err := parseKeyTemplate(s.KeyTemplate); err != nil {
+			return fmt.Errorf("Config error: [Storage %s] %v", s.Name, err)
+		}
+	}
+
+	return s.validateACL()
 }
 
 // Config contains both storage configuration and the enforced extraction limits
@@ -128,6 +181,13 @@ type Config struct {
 	Bucket         string
 	ExtractPrefix  string
 	MetricsHost    string `json:",omitempty"`
+	// Extra labels added to every metric next to host, eg. {"region": "us-east1"}
+	MetricsLabels map[string]string `json:",omitempty"`
+
+	// Client used for Bucket: GCS (the default) or gcs-sdk, which makes
+	// resumable uploads that survive dropped connections. Storage targets
+	// can't use gcs-sdk
+	StorageType StorageType `json:",omitempty"`
 
 	MaxFileSize       uint64
 	MaxTotalSize      uint64
@@ -135,13 +195,232 @@ type Config struct {
 	MaxFileNameLength int
 	ExtractionThreads int
 
+	// Zips larger than DownloadChunkSize are downloaded as that many chunks
+	// at once. 0 or 1 downloads them as a single stream
+	DownloadThreads   int    `json:",omitempty"`
+	DownloadChunkSize uint64 `json:",omitempty"`
+
+	// Largest single entry a zip may contain, checked against the central
+	// directory before anything is extracted. Unlike MaxFileSize it can't be
+	// raised per request. 0 means no limit
+	MaxEntrySize uint64 `json:",omitempty"`
+
+	// Time allowed to extract and upload a zip's entries, not counting the
+	// download or queueing. Unlike JobTimeout, hitting it reports progress
+	MaxExtractionDuration Duration `json:",omitempty"`
+
+	// Largest entry copied for a BufferedAnalyzer, bigger ones are streamed
+	// to its Analyze method. Copies are kept in memory for the upload up to
+	// AnalyzerBufferMemory bytes per extraction, and written to a temporary
+	// file past that
+	MaxAnalyzerBufferSize uint64 `json:",omitempty"`
+	AnalyzerBufferMemory  uint64 `json:",omitempty"`
+
+	// Highest extractionThreads a request can ask for, 0 means no limit
+	MaxExtractionThreadsPerJob int `json:",omitempty"`
+	// Upload threads shared by every running extraction. An extraction
+	// waits for one to be free and may get fewer than it asked for. 0 means
+	// no limit
+	ExtractionThreadBudget int `json:",omitempty"`
+
+	// Jobs of each operation type beyond these limits wait for a slot,
+	// interactive ones first. 0 means no limit
+	MaxConcurrentExtractions int `json:",omitempty"`
+	MaxConcurrentCopies      int `json:",omitempty"`
+	MaxConcurrentSlurps      int `json:",omitempty"`
+
+	// Requests beyond these limits are refused with a 429 rather than
+	// queued. A request counts until it's answered, or until its async job
+	// is over. Status and admin requests aren't limited. 0 means no limit
+	MaxConcurrentRequests int `json:",omitempty"`
+	// Limits by endpoint, eg. {"/extract": 20}
+	MaxConcurrentRequestsByEndpoint map[string]int `json:",omitempty"`
+	// Sent as the Retry-After of refused requests, defaults to 1s
+	AdmissionRetryAfter Duration `json:",omitempty"`
+
 	JobTimeout               Duration `json:",omitempty"` // Time to complete entire extract or upload job
+	LockTTL                  Duration `json:",omitempty"` // Keys locked longer than this are released, defaults to twice JobTimeout per possible attempt plus the retry backoffs
 	FileGetTimeout           Duration `json:",omitempty"` // Time to download a single object
 	FilePutTimeout           Duration `json:",omitempty"` // Time to upload a single object
 	AsyncNotificationTimeout Duration `json:",omitempty"` // Time to complete webhook request
+	// Upper bound for the callback_timeout param, which overrides AsyncNotificationTimeout
+	MaxAsyncNotificationTimeout Duration `json:",omitempty"`
+
+	// Failed callbacks are retried up to CallbackRetryAttempts times in all,
+	// waiting CallbackRetryBackoff (doubled after each retry, up to
+	// CallbackRetryMaxBackoff, with jitter) in between, and giving up once
+	// CallbackRetryMaxElapsed has passed since the first attempt
+	CallbackRetryAttempts   int      `json:",omitempty"`
+	CallbackRetryBackoff    Duration `json:",omitempty"`
+	CallbackRetryMaxBackoff Duration `json:",omitempty"`
+	CallbackRetryMaxElapsed Duration `json:",omitempty"`
+
+	// Async jobs started with auto_retry=N are attempted again up to N times
+	// (at most MaxJobAutoRetry) when they fail, waiting JobRetryBackoff
+	// (doubled after each retry, up to JobRetryMaxBackoff, with jitter) in
+	// between
+	MaxJobAutoRetry    int      `json:",omitempty"`
+	JobRetryBackoff    Duration `json:",omitempty"`
+	JobRetryMaxBackoff Duration `json:",omitempty"`
+
+	// Uploads of extracted files failing with one of UploadRetryStatusCodes
+	// (by default 408, 429 and 5xx gateway errors), a network error or a
+	// timeout are tried up to UploadRetryAttempts times in all, waiting
+	// UploadRetryBackoff (doubled after each retry, up to
+	// UploadRetryMaxBackoff, with jitter) in between
+	UploadRetryAttempts    int      `json:",omitempty"`
+	UploadRetryBackoff     Duration `json:",omitempty"`
+	UploadRetryMaxBackoff  Duration `json:",omitempty"`
+	UploadRetryStatusCodes []int    `json:",omitempty"`
+
+	CompressResponses bool `json:",omitempty"` // Gzip JSON responses for clients that accept it
+
+	// Refuse to extract to a prefix that already holds files unless the
+	// request passes replace=true. Can also be asked for with require_empty=true
+	RequireEmptyExtractPrefix bool `json:",omitempty"`
+
+	// Extract results listing more files than this only include the first
+	// ones, the full list is uploaded as a manifest. 0 means no limit
+	MaxInlineExtractedFiles int `json:",omitempty"`
+
+	// Sync extract responses for more files than this leave out
+	// ExtractedFiles altogether, only giving the manifest key and totals
+	MaxSyncResponseFiles int `json:",omitempty"`
+
+	MaxSlurpURLLength    int `json:",omitempty"` // Longest url accepted by /slurp
+	MaxCallbackURLLength int `json:",omitempty"` // Longest callback or async url accepted
+	// Longest context param accepted, it's echoed in callbacks and job status
+	MaxCallbackContextLength int `json:",omitempty"`
+
+	MaxFetchSize         uint64 `json:",omitempty"` // Largest byte range /fetch will return
+	MaxExtractUploadSize int64  `json:",omitempty"` // Largest zip accepted in a POST /extract body
+
+	// Extracted files at least this large are uploaded to GCS as parallel
+	// chunks that are then composed into one object. 0 disables it
+	GCSComposeThreshold   uint64 `json:",omitempty"`
+	GCSComposeChunkSize   uint64 `json:",omitempty"` // Smallest chunk size
+	GCSComposeConcurrency int    `json:",omitempty"` // Chunks uploaded at once, per file
+
+	// Extracted files up to HedgedPutMaxSize are uploaded a second time if
+	// the first upload hasn't finished after HedgedPutDelay, whichever ends
+	// first wins. 0 delay disables it
+	HedgedPutMaxSize uint64   `json:",omitempty"`
+	HedgedPutDelay   Duration `json:",omitempty"`
+
+	// Outbound connections (storage, slurp, callbacks) resolve names with
+	// these DNS servers (eg. "8.8.8.8:53") instead of the system resolver
+	DNSServers []string `json:",omitempty"`
+	// Lookups failing with a temporary error are retried this many times
+	DNSRetryAttempts int `json:",omitempty"`
+	// Time to open an outbound connection
+	DialTimeout Duration `json:",omitempty"`
+	// How long to wait on the preferred address family before also trying
+	// the other one (happy eyeballs). 0 means 300ms, negative disables it
+	DialFallbackDelay Duration `json:",omitempty"`
+
+	// Extracted files are scanned for malware by clamd before they're
+	// uploaded when ClamAV.Address is set
+	ClamAV ClamAVConfig
+
+	// text (the default) or json, one object per line with the request and
+	// job IDs as fields
+	LogFormat string `json:",omitempty"`
+
+	// Product part of the User-Agent sent with slurp, zip listing and
+	// callback requests, defaults to zipserver/<version>
+	UserAgent string `json:",omitempty"`
+
+	// Idle connections kept open to each storage host, should be at least
+	// ExtractionThreads to avoid reconnecting during extractions. Defaults to 16
+	StorageMaxIdleConnsPerHost int `json:",omitempty"`
+
+	// Snippets used by the html_transforms extract and copy parameter
+	HTMLContentSecurityPolicy string `json:",omitempty"` // csp: value of the injected CSP meta tag
+	HTMLAnalyticsSnippet      string `json:",omitempty"` // analytics: inserted before </head>
+	HTMLFooterSnippet         string `json:",omitempty"` // footer: inserted before </body>
+
+	// Directory for temporary files, eg. downloaded zips, defaults to zip_tmp
+	// in the working directory. Each job gets a subdirectory of its own
+	TmpDir string `json:",omitempty"`
+
+	TempExtractionTTL   Duration `json:",omitempty"` // How long temporary (_zipserver/) extractions are kept
+	TempPurgeInterval   Duration `json:",omitempty"` // How often expired temporary extractions are purged, 0 to disable
+	TempJanitorInterval Duration `json:",omitempty"` // How often stale local temporary files are removed, 0 to disable
+
+	// Extractions are refused with a 503 while the disk holding the local
+	// temporary directory has less free space than this. 0 means no check
+	MinFreeTempSpace uint64 `json:",omitempty"`
+
+	// Recurring maintenance tasks by name, eg. {"temp-janitor": "@every 1h"},
+	// see maintenanceTasks
+	MaintenanceSchedule map[string]string `json:",omitempty"`
+
+	// Lays out extracted files for extractions without a key_template, eg.
+	// "{{prefix}}/{{sha1}}/{{name}}", see keyTemplateVars. Empty for prefix/name
+	ExtractKeyTemplate string `json:",omitempty"`
+
+	// Zip entries matching any of these are skipped when extracting. Patterns
+	// without a slash (eg. "__MACOSX", ".*") match any path component, others
+	// are matched against the whole path. Defaults to defaultIgnorePatterns
+	IgnorePatterns []string `json:",omitempty"`
+	// Extracted files it denies by extension or content type are left out,
+	// eg. {"DenyExtensions": [".exe", ".dll"]}. Requests can only add rules
+	ContentPolicy ContentPolicy
+	// What to do with zero-byte entries: skip-markers (default), skip-all or keep
+	EmptyEntryPolicy EmptyEntryPolicy `json:",omitempty"`
+
+	// Keys under these prefixes are never written to or deleted, whatever
+	// the request asks for
+	ProtectedPrefixes []string `json:",omitempty"`
+
+	// /delete refuses prefixes extracted within this long, unless force=true
+	// is passed, so cleanup jobs can't race with an extraction that just
+	// finished. 0 disables it
+	DeleteProtectionWindow Duration `json:",omitempty"`
+
+	// Lets a new process bind the listen address while the old one drains, linux only
+	ReusePort bool `json:",omitempty"`
+	// Sends a span per request and job, with child spans for downloads,
+	// uploads and callbacks, to an OpenTelemetry collector
+	Tracing TracingConfig
+	// Starts with mutating endpoints refused with a 503, eg. during a storage
+	// migration. Can be switched at runtime with /readonly
+	ReadOnly       bool   `json:",omitempty"`
+	ReadOnlyReason string `json:",omitempty"`
+	// Certificate and key to serve HTTPS with, plus optional client CAs for
+	// mutual TLS. Files are read again on SIGHUP
+	TLS TLSConfig
+	// Address the gRPC API of zipserver.proto listens on, eg. 127.0.0.1:9090.
+	// It's plain HTTP/2, meant for internal services. Empty to not serve it
+	GRPCListen string `json:",omitempty"`
+	// How long a stopping process waits for async jobs, defaults to JobTimeout
+	ShutdownTimeout Duration `json:",omitempty"`
+	// Directory where unfinished async jobs are saved, so that the ones
+	// interrupted by a restart are reported as failed. Empty to disable
+	JobStateDir string `json:",omitempty"`
+	// Directory where -serve saves the extracted zip, and restores it from
+	// on the next start when the zip hasn't changed. Empty to always extract
+	ServeSnapshotDir string `json:",omitempty"`
+
+	// Keys accepted as "Authorization: Bearer <key>". When empty, requests
+	// aren't authenticated
+	APIKeys []APIKeyConfig `json:",omitempty"`
+
+	// Origin that /copy?if_not_exists=true fetches sources missing from
+	// Bucket from, the key is appended to it
+	CopyOriginURL string `json:",omitempty"`
 
 	// Places that can be written to
 	StorageTargets []StorageConfig `json:",omitempty"`
+
+	// Job requests received from Pub/Sub or SQS by `zipserver worker`
+	Queue QueueConfig
+
+	// Skips checking on startup that the bucket and every target exist and
+	// can be written to
+	SkipPreflight bool `json:",omitempty"`
+	// How long /readyz reuses its last check of the buckets
+	ReadyzInterval Duration `json:",omitempty"`
 }
 
 // GetStorageTargetByName returns the storage target with the given name from the config.
@@ -162,10 +441,51 @@ var defaultConfig = Config{
 	MaxFileNameLength: 80,
 	ExtractionThreads: 4,
 
-	JobTimeout:               Duration(5 * time.Minute),
-	FileGetTimeout:           Duration(1 * time.Minute),
-	FilePutTimeout:           Duration(1 * time.Minute),
-	AsyncNotificationTimeout: Duration(5 * time.Second),
+	MaxSyncResponseFiles: 10000,
+
+	DownloadThreads:   4,
+	DownloadChunkSize: 1024 * 1024 * 32,
+
+	JobTimeout:                  Duration(5 * time.Minute),
+	FileGetTimeout:              Duration(1 * time.Minute),
+	FilePutTimeout:              Duration(1 * time.Minute),
+	AsyncNotificationTimeout:    Duration(5 * time.Second),
+	MaxAsyncNotificationTimeout: Duration(1 * time.Minute),
+
+	CallbackRetryAttempts:   5,
+	CallbackRetryBackoff:    Duration(1 * time.Second),
+	CallbackRetryMaxBackoff: Duration(30 * time.Second),
+	CallbackRetryMaxElapsed: Duration(2 * time.Minute),
+
+	ReadyzInterval: Duration(30 * time.Second),
+
+	MaxJobAutoRetry:    5,
+	JobRetryBackoff:    Duration(10 * time.Second),
+	JobRetryMaxBackoff: Duration(5 * time.Minute),
+
+	DNSRetryAttempts: 2,
+	DialTimeout:      Duration(30 * time.Second),
+
+	UploadRetryAttempts:   3,
+	UploadRetryBackoff:    Duration(500 * time.Millisecond),
+	UploadRetryMaxBackoff: Duration(5 * time.Second),
+
+	TempExtractionTTL:   Duration(24 * time.Hour),
+	TempJanitorInterval: Duration(10 * time.Minute),
+
+	MaxSlurpURLLength:    8192,
+	MaxCallbackURLLength: 2048,
+
+	MaxCallbackContextLength: 4096,
+
+	MaxFetchSize:         1024 * 1024,
+	MaxExtractUploadSize: 1024 * 1024 * 50,
+
+	MaxAnalyzerBufferSize: 1024 * 1024 * 512,
+	AnalyzerBufferMemory:  1024 * 1024 * 8,
+
+	GCSComposeChunkSize:   1024 * 1024 * 64,
+	GCSComposeConcurrency: 4,
 }
 
 // Duration adds JSON (de)serialization to time.Duration.
@@ -219,6 +539,64 @@ func LoadConfig(fname string) (*Config, error) {
 		return nil, errors.New("Config error: ExtractPrefix field missing")
 	}
 
+	if err := validateIgnorePatterns(config.IgnorePatterns); err != nil {
+		return nil, err
+	}
+
+	if _, err := parseEmptyEntryPolicy(string(config.EmptyEntryPolicy)); err != nil {
+		return nil, err
+	}
+
+	if err := validateProtectedPrefixes(config.ProtectedPrefixes); err != nil {
+		return nil, err
+	}
+
+	if err := validateDNSServers(config.DNSServers); err != nil {
+		return nil, err
+	}
+
+	if err := validateMetricsLabels(config.MetricsLabels); err != nil {
+		return nil, err
+	}
+
+	if err := validateAPIKeys(config.APIKeys); err != nil {
+		return nil, err
+	}
+
+	if err := validateMaintenanceSchedule(config.MaintenanceSchedule); err != nil {
+		return nil, err
+	}
+
+	if err := validateContentPolicy(config.ContentPolicy); err != nil {
+		return nil, err
+	}
+
+	if err := validateClamAV(config.ClamAV); err != nil {
+		return nil, err
+	}
+
+	if err := validateTLS(config.TLS); err != nil {
+		return nil, err
+	}
+
+	if err := validateAdmission(&config); err != nil {
+		return nil, err
+	}
+
+	if err := validateLogFormat(config.LogFormat); err != nil {
+		return nil, err
+	}
+
+	if err := validateQueue(config.Queue); err != nil {
+		return nil, err
+	}
+
+	if config.ExtractKeyTemplate != "" {
+		if _, err := parseKeyTemplate(config.ExtractKeyTemplate); err != nil {
+			return nil, err
+		}
+	}
+
 	// validate storage targets
 	for _, target := range config.StorageTargets {
 		if err := target.Validate(); err != nil {
@@ -226,6 +604,10 @@ func LoadConfig(fname string) (*Config, error) {
 		}
 	}
 
+	if err := validateFallbackTargets(&config); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
@@ -246,5 +628,7 @@ func DefaultExtractLimits(config *Config) *ExtractLimits {
 		MaxNumFiles:       config.MaxNumFiles,
 		MaxFileNameLength: config.MaxFileNameLength,
 		ExtractionThreads: config.ExtractionThreads,
+
+		MaxExtractionDuration: time.Duration(config.MaxExtractionDuration),
 	}
 }
@@ -0,0 +1,115 @@
+package zipserver
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizeContentDisposition parses a Content-Disposition value and renders
+// it again safely: the type must be inline or attachment, and the filename
+// loses any path, quotes and control characters. Non-ASCII filenames are
+// sent as an RFC 5987 filename* with an ASCII filename fallback for older
+// clients.
+func sanitizeContentDisposition(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		// commonly an unquoted filename with spaces in it
+		disposition, params, err = parseLenientContentDisposition(value)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if disposition != "inline" && disposition != "attachment" {
+		return "", fmt.Errorf("Invalid Content-Disposition type %q, expected inline or attachment", disposition)
+	}
+
+	filename := sanitizeFilename(params["filename"])
+	if filename == "" {
+		return disposition, nil
+	}
+
+	fallback := asciiFilename(filename)
+	rendered := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback)
+	if fallback != filename {
+		rendered += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return rendered, nil
+}
+
+// parseLenientContentDisposition reads "type; filename=rest of the value"
+func parseLenientContentDisposition(value string) (string, map[string]string, error) {
+	disposition, rest, _ := strings.Cut(value, ";")
+	disposition = strings.ToLower(strings.TrimSpace(disposition))
+	params := map[string]string{}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		name, filename, ok := strings.Cut(rest, "=")
+		if !ok || strings.ToLower(strings.TrimSpace(name)) != "filename" {
+			return "", nil, fmt.Errorf("Invalid Content-Disposition %q", value)
+		}
+		params["filename"] = strings.Trim(strings.TrimSpace(filename), `"'`)
+	}
+	return disposition, params, nil
+}
+
+// sanitizeFilename keeps the last path element of name, without characters
+// that break the header or that browsers refuse
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+
+	return strings.Trim(name, " .")
+}
+
+// asciiFilename replaces the non-ASCII characters of name for the plain
+// filename parameter
+func asciiFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// encodeRFC5987 percent-encodes every byte of value that isn't an attr-char
+func encodeRFC5987(value string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if isRFC5987AttrChar(c) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func isRFC5987AttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
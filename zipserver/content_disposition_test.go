@@ -0,0 +1,37 @@
+package zipserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SanitizeContentDisposition(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                                     "",
+		"attachment":                           "attachment",
+		"Attachment; filename=game.zip":        `attachment; filename="game.zip"`,
+		`inline; filename="my game.zip"`:       `inline; filename="my game.zip"`,
+		"attachment; filename=my game (1).zip": `attachment; filename="my game (1).zip"`,
+		`attachment; filename="../../etc/passwd"`:                      `attachment; filename="passwd"`,
+		`attachment; filename="C:\\games\\a.exe"`:                      `attachment; filename="a.exe"`,
+		"attachment; filename=\"bad\x01name.zip\"":                     `attachment; filename="badname.zip"`,
+		"attachment; filename=\"jeu été.zip\"":                         `attachment; filename="jeu _t_.zip"; filename*=UTF-8''jeu%20%C3%A9t%C3%A9.zip`,
+		"attachment; filename*=UTF-8''%E3%82%B2%E3%83%BC%E3%83%A0.zip": `attachment; filename="___.zip"; filename*=UTF-8''%E3%82%B2%E3%83%BC%E3%83%A0.zip`,
+		"attachment; size=12":                                          "attachment",
+		`attachment; filename=".."`:                                    `attachment`,
+	} {
+		sanitized, err := sanitizeContentDisposition(value)
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, expected, sanitized, value)
+		}
+	}
+
+	for _, value := range []string{
+		"evil; filename=a.zip",
+		"attachment; name",
+	} {
+		_, err := sanitizeContentDisposition(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,258 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	errors "github.com/go-errors/errors"
+)
+
+// ContentPolicy restricts the files an extraction stores by extension and by
+// content type. Deny rules win over allow rules, and an empty allow list
+// allows everything.
+type ContentPolicy struct {
+	AllowExtensions []string `json:",omitempty"` // eg. ".html", case insensitive
+	DenyExtensions  []string `json:",omitempty"`
+	AllowMIME       []string `json:",omitempty"` // eg. "image/png" or "text/*"
+	DenyMIME        []string `json:",omitempty"`
+}
+
+// DeniedFile is a zip entry a content policy kept from being extracted
+type DeniedFile struct {
+	Name   string
+	Reason string
+}
+
+func (p *ContentPolicy) isEmpty() bool {
+	return len(p.AllowExtensions) == 0 && len(p.DenyExtensions) == 0 && !p.hasMIMERules()
+}
+
+func (p *ContentPolicy) hasMIMERules() bool {
+	return len(p.AllowMIME) > 0 || len(p.DenyMIME) > 0
+}
+
+func validateContentPolicy(policy ContentPolicy) error {
+	for _, pattern := range append(append([]string{}, policy.AllowMIME...), policy.DenyMIME...) {
+		if !strings.Contains(pattern, "/") {
+			return fmt.Errorf("Invalid MIME pattern %q, expected eg. image/png or image/*", pattern)
+		}
+	}
+	return nil
+}
+
+// loadContentPolicy reads the per-request allow_extensions, deny_extensions,
+// allow_mime and deny_mime parameters, comma separated lists
+func loadContentPolicy(params url.Values) (ContentPolicy, error) {
+	policy := ContentPolicy{
+		AllowExtensions: splitParamList(params.Get("allow_extensions")),
+		DenyExtensions:  splitParamList(params.Get("deny_extensions")),
+		AllowMIME:       splitParamList(params.Get("allow_mime")),
+		DenyMIME:        splitParamList(params.Get("deny_mime")),
+	}
+
+	if err := validateContentPolicy(policy); err != nil {
+		return ContentPolicy{}, err
+	}
+	return policy, nil
+}
+
+func splitParamList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// checkName returns why the policy denies a file going by its name, or an
+// empty string if it doesn't. Every extension of the name is checked against
+// the denied ones, so game.exe.gz doesn't get past .exe, while the allowed
+// ones have to match its last extension or a compound one like .tar.gz
+func (p *ContentPolicy) checkName(name string) string {
+	extensions, suffixes := nameExtensions(name)
+
+	for _, ext := range append(suffixes, extensions...) {
+		if matchesExtension(ext, p.DenyExtensions) {
+			return fmt.Sprintf("Extension %s is denied", ext)
+		}
+	}
+	if len(p.AllowExtensions) == 0 {
+		return ""
+	}
+	for _, ext := range suffixes {
+		if matchesExtension(ext, p.AllowExtensions) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Extension %s is not allowed", strings.ToLower(path.Ext(name)))
+}
+
+// nameExtensions returns each extension of the base of name, and the
+// suffixes made of one or more of them, lowercase: .exe and .gz, then
+// .exe.gz and .gz for game.exe.gz
+func nameExtensions(name string) (extensions, suffixes []string) {
+	parts := strings.Split(strings.ToLower(path.Base(name)), ".")[1:]
+	for i, part := range parts {
+		extensions = append(extensions, "."+part)
+		suffixes = append(suffixes, "."+strings.Join(parts[i:], "."))
+	}
+	return extensions, suffixes
+}
+
+// checkContentType returns why the policy denies a file stored with
+// contentType, or an empty string if it doesn't
+func (p *ContentPolicy) checkContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	if matchesMIME(mediaType, p.DenyMIME) {
+		return fmt.Sprintf("Content type %s is denied", mediaType)
+	}
+	if len(p.AllowMIME) > 0 && !matchesMIME(mediaType, p.AllowMIME) {
+		return fmt.Sprintf("Content type %s is not allowed", mediaType)
+	}
+	return ""
+}
+
+func matchesExtension(ext string, extensions []string) bool {
+	for _, candidate := range extensions {
+		candidate = strings.ToLower(candidate)
+		if !strings.HasPrefix(candidate, ".") {
+			candidate = "." + candidate
+		}
+		if ext == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesMIME(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyContentPolicies leaves out the zip entries denied by the configured or
+// requested content policy. Content types are sniffed the same way as when
+// uploading, so MIME rules can't be dodged by renaming a file.
+func (a *Archiver) applyContentPolicies(files []*zip.File, opts *ExtractOptions) ([]*zip.File, []DeniedFile, error) {
+	policies := a.contentPolicies(opts)
+	if len(policies) == 0 {
+		return files, nil, nil
+	}
+
+	allowed := []*zip.File{}
+	denied := []DeniedFile{}
+
+	for _, file := range files {
+		reason, err := a.checkContentPolicies(file, policies, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reason != "" {
+			log.Printf("Denying %s: %s", file.Name, reason)
+			denied = append(denied, DeniedFile{file.Name, reason})
+			continue
+		}
+		allowed = append(allowed, file)
+	}
+
+	return allowed, denied, nil
+}
+
+// applyRenamedContentPolicies leaves out the zip entries an analyzer renamed
+// to a name the configured or requested content policy denies
+func (a *Archiver) applyRenamedContentPolicies(files []*zip.File, opts *ExtractOptions) ([]*zip.File, []DeniedFile) {
+	policies := a.contentPolicies(opts)
+	if len(policies) == 0 {
+		return files, nil
+	}
+
+	allowed := []*zip.File{}
+	denied := []DeniedFile{}
+
+	for _, file := range files {
+		renamed := opts.analyses.storedName(file.Name)
+		reason := ""
+		if renamed != file.Name {
+			for _, policy := range policies {
+				if reason = policy.checkName(renamed); reason != "" {
+					break
+				}
+			}
+		}
+		if reason != "" {
+			log.Printf("Denying %s, renamed to %s: %s", file.Name, renamed, reason)
+			denied = append(denied, DeniedFile{file.Name, reason})
+			opts.buffers.drop(file.Name)
+			continue
+		}
+		allowed = append(allowed, file)
+	}
+
+	return allowed, denied
+}
+
+// contentPolicies are the configured and requested content policies that
+// have rules
+func (a *Archiver) contentPolicies(opts *ExtractOptions) []*ContentPolicy {
+	policies := []*ContentPolicy{}
+	for _, policy := range []*ContentPolicy{&a.Config.ContentPolicy, &opts.ContentPolicy} {
+		if !policy.isEmpty() {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+func (a *Archiver) checkContentPolicies(file *zip.File, policies []*ContentPolicy, opts *ExtractOptions) (string, error) {
+	for _, policy := range policies {
+		if reason := policy.checkName(file.Name); reason != "" {
+			return reason, nil
+		}
+	}
+
+	contentType := ""
+	for _, policy := range policies {
+		if !policy.hasMIMERules() {
+			continue
+		}
+
+		if contentType == "" {
+			reader, err := openZipEntry(file, opts.Password)
+			if err != nil {
+				return "", err
+			}
+			resource, sniffed, err := sniffResource(file.Name, reader)
+			reader.Close()
+			if err != nil {
+				return "", errors.Wrap(err, 0)
+			}
+			sniffed.release()
+			contentType = resource.contentType
+		}
+
+		if reason := policy.checkContentType(contentType); reason != "" {
+			return reason, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,149 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ContentPolicyRules(t *testing.T) {
+	policy := ContentPolicy{
+		DenyExtensions: []string{".exe", "DLL"},
+		AllowMIME:      []string{"text/*", "image/png"},
+	}
+
+	assert.Equal(t, "Extension .exe is denied", policy.checkName("bin/Game.EXE"))
+	assert.Equal(t, "Extension .dll is denied", policy.checkName("lib.dll"))
+	assert.Empty(t, policy.checkName("index.html"))
+
+	assert.Empty(t, policy.checkContentType("text/html; charset=utf-8"))
+	assert.Empty(t, policy.checkContentType("image/png"))
+	assert.Equal(t, "Content type image/jpeg is not allowed", policy.checkContentType("image/jpeg"))
+
+	allowOnly := ContentPolicy{AllowExtensions: []string{".html"}, DenyMIME: []string{"*/*"}}
+	assert.Equal(t, "Extension .js is not allowed", allowOnly.checkName("game.js"))
+
+	// every extension is checked
+	assert.Equal(t, "Extension .exe is denied", policy.checkName("dist/game.EXE.gz"))
+	assert.Empty(t, policy.checkName("v1.2/notes.txt"))
+	compound := ContentPolicy{DenyExtensions: []string{"tar.gz"}, AllowExtensions: []string{".tar.gz", ".zip"}}
+	assert.Equal(t, "Extension .tar.gz is denied", compound.checkName("src.tar.gz"))
+	assert.Equal(t, "Extension .gz is not allowed", compound.checkName("src.gz"))
+	assert.Empty(t, compound.checkName("game.v2.zip"))
+	assert.Equal(t, "Content type text/html is denied", allowOnly.checkContentType("text/html"))
+
+	loaded, err := loadContentPolicy(url.Values{"deny_extensions": {".exe, .dll"}, "allow_mime": {"image/*"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".exe", ".dll"}, loaded.DenyExtensions)
+	assert.Equal(t, []string{"image/*"}, loaded.AllowMIME)
+	assert.Empty(t, loaded.AllowExtensions)
+
+	_, err = loadContentPolicy(url.Values{"deny_mime": {"executable"}})
+	assert.Error(t, err)
+}
+
+func Test_ExtractContentPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	config := emptyConfig()
+	config.ContentPolicy.DenyExtensions = []string{".exe"}
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"index.html":     []byte("<html></html>"),
+		"game.exe":       []byte("MZ"),
+		"screenshot.png": testPNG(t),
+		// no extension, detected as a png from its contents
+		"assets/sprite": testPNG(t),
+		"data.bin":      {0, 1, 2, 3},
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(data)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "game.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	denied := []DeniedFile{}
+	extracted, err := archiver.ExtractZip(ctx, "game.zip", "game", testLimits(), ExtractOptions{
+		ContentPolicy: ContentPolicy{DenyMIME: []string{"image/*"}},
+		DeniedFiles:   &denied,
+	})
+	require.NoError(t, err)
+
+	keys := []string{}
+	for _, file := range extracted {
+		keys = append(keys, file.Key)
+	}
+	assert.ElementsMatch(t, []string{"game/index.html", "game/data.bin"}, keys)
+	assert.ElementsMatch(t, []DeniedFile{
+		{"game.exe", "Extension .exe is denied"},
+		{"screenshot.png", "Content type image/png is denied"},
+		{"assets/sprite", "Content type image/png is denied"},
+	}, denied)
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "game/game.exe")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+// renameAnalyzer stores the .txt files under the name they contain
+type renameAnalyzer struct{}
+
+func (renameAnalyzer) Accepts(filename string) bool {
+	return strings.HasSuffix(filename, ".txt")
+}
+
+func (renameAnalyzer) Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error) {
+	name, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Rename: string(name)}, nil
+}
+
+func Test_ExtractContentPolicyRenamed(t *testing.T) {
+	ctx := context.Background()
+
+	const renamed ExtractContents = "renamed"
+	RegisterAnalyzer(renamed, renameAnalyzer{})
+	defer delete(contentAnalyzers, renamed)
+
+	config := emptyConfig()
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, renamed := range map[string]string{"1.txt": "readme.md", "2.txt": "game.exe"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(renamed))
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "renamed.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	denied := []DeniedFile{}
+	extracted, err := archiver.ExtractZip(ctx, "renamed.zip", "renamed", testLimits(), ExtractOptions{
+		Contents:      renamed,
+		ContentPolicy: ContentPolicy{DenyExtensions: []string{".exe"}},
+		DeniedFiles:   &denied,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, extracted, 1)
+	assert.Equal(t, "renamed/readme.md", extracted[0].Key)
+	assert.Equal(t, []DeniedFile{{"2.txt", "Extension .exe is denied"}}, denied)
+}
@@ -0,0 +1,196 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ExtractContents restricts an extraction to one kind of file, analyzing each
+// of them along the way with the Analyzer registered for it
+type ExtractContents string
+
+const (
+	// ExtractContentsAll extracts every file
+	ExtractContentsAll ExtractContents = ""
+	// ExtractContentsVideo only extracts the mp4, mov, webm and mkv files whose
+	// metadata can be read, see probeVideo
+	ExtractContentsVideo ExtractContents = "video"
+	// ExtractContentsImages only extracts the png, jpeg, gif and webp files
+	// whose dimensions can be read, see probeImage
+	ExtractContentsImages ExtractContents = "images"
+	// ExtractContentsBook only extracts valid pdf, epub and cbz files, see
+	// probeBook
+	ExtractContentsBook ExtractContents = "book"
+)
+
+// Analyzer decides which files an extraction of its contents keeps and how
+// they're stored. It's registered with RegisterAnalyzer under the value of
+// the contents parameter that selects it.
+type Analyzer interface {
+	// Accepts is false for the files that are skipped without being read,
+	// usually going by their extension
+	Accepts(filename string) bool
+	// Analyze reads an accepted file, size bytes long. Returning an error
+	// skips the file, the same as returning an Analysis with Skip set.
+	Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error)
+}
+
+// tempDirAnalyzer is an Analyzer that copies the files it's streamed to disk,
+// they go to the extraction's temporary directory
+type tempDirAnalyzer interface {
+	analyzeInDir(reader io.Reader, filename string, size uint64, dir string) (*Analysis, error)
+}
+
+// Analysis is what an Analyzer found out about a file
+type Analysis struct {
+	Skip bool // leaves the file out of the extraction
+
+	// replace the content type and encoding detected from the file's name
+	// and first bytes when set
+	ContentType     string
+	ContentEncoding string
+
+	// stores the file under this path in the prefix instead of its name in
+	// the zip, it can't point outside of the prefix
+	Rename string
+
+	// added to the Metadata of the file's ExtractedFile under the name the
+	// analyzer was registered with, it's marshaled to JSON in responses
+	Metadata interface{}
+
+	// the contents the analyzer was registered for
+	name string
+}
+
+// override applies the analysis to a resource about to be uploaded
+func (a *Analysis) override(resource *ResourceSpec) {
+	if a.ContentType != "" {
+		resource.contentType = a.ContentType
+	}
+	if a.ContentEncoding != "" {
+		resource.contentEncoding = a.ContentEncoding
+	}
+	resource.analysis = a
+}
+
+func (a *Analysis) apply(file *ExtractedFile) {
+	if a == nil || a.Metadata == nil {
+		return
+	}
+	file.Metadata = map[string]interface{}{a.name: a.Metadata}
+}
+
+var contentAnalyzers = map[ExtractContents]Analyzer{}
+
+// RegisterAnalyzer makes contents=<contents> extractions use analyzer. It
+// must be called before the server starts, eg. from an init function.
+func RegisterAnalyzer(contents ExtractContents, analyzer Analyzer) {
+	if contents == ExtractContentsAll {
+		panic("zipserver: an analyzer can't be registered for all contents")
+	}
+	contentAnalyzers[contents] = analyzer
+}
+
+func parseExtractContents(value string) (ExtractContents, error) {
+	contents := ExtractContents(value)
+	if contents != ExtractContentsAll && contentAnalyzers[contents] == nil {
+		return "", fmt.Errorf("Invalid contents: %s", value)
+	}
+	return contents, nil
+}
+
+// fileAnalyses holds the analyses of an extraction's files by their name in
+// the zip
+type fileAnalyses map[string]*Analysis
+
+// storedName is the path under the prefix the zip entry named name is
+// stored at
+func (f fileAnalyses) storedName(name string) string {
+	if analysis := f[name]; analysis != nil && analysis.Rename != "" {
+		return analysis.Rename
+	}
+	return name
+}
+
+// analyzeContents leaves out the zip entries that the analyzer for the
+// contents asked for doesn't accept, or that it skips, returning its analyses
+// of the others. The copies of the entries a BufferedAnalyzer read are kept
+// in opts for their upload, within AnalyzerBufferMemory.
+func (a *Archiver) analyzeContents(ctx context.Context, files []*zip.File, opts *ExtractOptions) ([]*zip.File, fileAnalyses) {
+	analyzer := contentAnalyzers[opts.Contents]
+	if analyzer == nil {
+		return files, nil
+	}
+
+	selected := []*zip.File{}
+	analyses := fileAnalyses{}
+	opts.buffers = newBufferedEntries(a.Config.AnalyzerBufferMemory)
+
+	for _, file := range files {
+		if !analyzer.Accepts(file.Name) {
+			logPrintf(ctx, "Skipping %s, it isn't in the %s contents", file.Name, opts.Contents)
+			continue
+		}
+
+		analysis, err := a.analyzeFile(ctx, analyzer, file, opts)
+		if err != nil {
+			logPrintf(ctx, "Skipping unsupported file %s: %v", file.Name, err)
+			continue
+		}
+		if analysis == nil || analysis.Skip {
+			logPrintf(ctx, "Skipping %s, the %s analyzer left it out", file.Name, opts.Contents)
+			opts.buffers.drop(file.Name)
+			continue
+		}
+
+		if analysis.Rename != "" {
+			renamed := path.Clean(analysis.Rename)
+			if path.IsAbs(renamed) || renamed == ".." || strings.HasPrefix(renamed, "../") {
+				logPrintf(ctx, "Skipping %s, it was renamed outside of the prefix: %s", file.Name, analysis.Rename)
+				opts.buffers.drop(file.Name)
+				continue
+			}
+			analysis.Rename = renamed
+		}
+
+		analysis.name = string(opts.Contents)
+		selected = append(selected, file)
+		analyses[file.Name] = analysis
+	}
+
+	return selected, analyses
+}
+
+// analyzeFile runs analyzer on a zip entry, buffering it first when the
+// analyzer asks for it and the entry isn't too large
+func (a *Archiver) analyzeFile(ctx context.Context, analyzer Analyzer, file *zip.File, opts *ExtractOptions) (*Analysis, error) {
+	if buffered, ok := analyzer.(BufferedAnalyzer); ok && file.UncompressedSize64 <= a.Config.MaxAnalyzerBufferSize {
+		entry, err := opts.buffers.buffer(file, opts.Password, a.tempDir(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		analysis, err := buffered.AnalyzeBuffered(entry, file.Name)
+		if err != nil {
+			entry.release()
+			return nil, err
+		}
+		opts.buffers.keep(file.Name, entry)
+		return analysis, nil
+	}
+
+	reader, err := openZipEntry(file, opts.Password)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if inDir, ok := analyzer.(tempDirAnalyzer); ok {
+		return inDir.analyzeInDir(reader, file.Name, file.UncompressedSize64, a.tempDir(ctx))
+	}
+	return analyzer.Analyze(reader, file.Name, file.UncompressedSize64)
+}
@@ -0,0 +1,107 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// levelAnalyzer keeps the .lvl files starting with LVL, storing them as
+// json under levels/
+type levelAnalyzer struct{}
+
+func (levelAnalyzer) Accepts(filename string) bool {
+	return strings.HasSuffix(filename, ".lvl")
+}
+
+func (levelAnalyzer) Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if string(header) != "LVL" {
+		return &Analysis{Skip: true}, nil
+	}
+	if strings.HasPrefix(filename, "escape") {
+		return &Analysis{Rename: "../" + filename}, nil
+	}
+
+	return &Analysis{
+		ContentType: "application/json",
+		Rename:      "levels/" + strings.TrimSuffix(filename, ".lvl") + ".json",
+		Metadata:    map[string]interface{}{"Format": string(header), "Tiles": []int{1, 2}},
+	}, nil
+}
+
+func Test_RegisterAnalyzer(t *testing.T) {
+	ctx := context.Background()
+
+	const levels ExtractContents = "levels"
+	_, err := parseExtractContents("levels")
+	assert.Error(t, err)
+
+	RegisterAnalyzer(levels, levelAnalyzer{})
+	defer delete(contentAnalyzers, levels)
+
+	contents, err := parseExtractContents("levels")
+	require.NoError(t, err)
+	assert.Equal(t, levels, contents)
+
+	config := emptyConfig()
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string]string{
+		"world1.lvl":  "LVL{}",
+		"broken.lvl":  "???",
+		"short.lvl":   "L",
+		"escape.lvl":  "LVL{}",
+		"readme.txt":  "hello",
+		"world2.lvl":  "LVL[]",
+		"world1.json": "{}",
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(data))
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "game.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	extracted, err := archiver.ExtractZip(ctx, "game.zip", "game", testLimits(), ExtractOptions{Contents: levels})
+	require.NoError(t, err)
+
+	keys := []string{}
+	for _, file := range extracted {
+		keys = append(keys, file.Key)
+		assert.Equal(t, "application/json", file.ContentType, file.Key)
+		assert.Equal(t, "LVL", file.Metadata["levels"].(map[string]interface{})["Format"], file.Key)
+	}
+
+	// legacy callbacks flatten the metadata
+	values := url.Values{}
+	addMetadataValues(values, "ExtractedFiles[1][Metadata]", extracted[0].Metadata)
+	assert.Equal(t, url.Values{
+		"ExtractedFiles[1][Metadata][levels][Format]":   {"LVL"},
+		"ExtractedFiles[1][Metadata][levels][Tiles][1]": {"1"},
+		"ExtractedFiles[1][Metadata][levels][Tiles][2]": {"2"},
+	}, values)
+	assert.ElementsMatch(t, []string{"game/levels/world1.json", "game/levels/world2.json"}, keys)
+
+	reader, headers, err := storage.GetFile(ctx, config.Bucket, "game/levels/world1.json")
+	require.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, "application/json", headers.Get("Content-Type"))
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "escape.lvl")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
@@ -1,13 +1,14 @@
 package zipserver
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,45 +27,223 @@ func formatBytes(b float64) string {
 	return fmt.Sprintf("%.2f %cB", b/div, "kMGTPE"[exp])
 }
 
-// notify the callback URL of task completion
-func notifyCallback(callbackURL string, resValues url.Values) error {
-	notifyCtx, notifyCancel := context.WithTimeout(context.Background(), time.Duration(globalConfig.AsyncNotificationTimeout))
-	defer notifyCancel()
+// targetHasKey checks whether the target already holds key
+func targetHasKey(ctx context.Context, target *StorageConfig, key string) (bool, error) {
+	targetStorage, err := target.NewStorageClient()
+	if err != nil {
+		return false, fmt.Errorf("Failed to create target storage: %v", err)
+	}
 
-	outBody := bytes.NewBufferString(resValues.Encode())
-	req, err := http.NewRequestWithContext(notifyCtx, http.MethodPost, callbackURL, outBody)
+	_, err = targetStorage.HeadFile(ctx, target.Bucket, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
 	if err != nil {
-		log.Print("Failed to create callback request: ", err)
-		return err
+		return false, err
+	}
+	return true, nil
+}
+
+// mirrorFromOrigin slurps key from CopyOriginURL into primary storage when
+// it's missing there, and returns whether it did
+func mirrorFromOrigin(ctx context.Context, storage Storage, key string) (bool, error) {
+	if globalConfig.CopyOriginURL == "" {
+		return false, nil
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	response, err := http.DefaultClient.Do(req)
+	_, err := storage.HeadFile(ctx, globalConfig.Bucket, key)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return false, err
+	}
+
+	originURL := strings.TrimSuffix(globalConfig.CopyOriginURL, "/") + "/" + (&url.URL{Path: key}).EscapedPath()
+	logPrint(ctx, "Source missing, mirroring from origin: ", originURL)
+
+	_, err = slurpFile(ctx, storage, key, originURL, slurpOptions{ACL: "public-read"})
 	if err != nil {
-		log.Print("Failed to deliver callback: ", err)
-		return err
+		return false, fmt.Errorf("Failed to mirror %s from origin: %v", key, err)
+	}
+
+	globalMetrics.TotalSlurpedFiles.Add(1)
+	return true, nil
+}
+
+// loadCopyTarget returns the storage target named by the target param, making
+// sure key may be written to it and that it matches the expected bucket
+func loadCopyTarget(params url.Values, key string) (*StorageConfig, error) {
+	targetName, err := getParam(params, "target")
+	if err != nil {
+		return nil, err
+	}
+
+	target := globalConfig.GetStorageTargetByName(targetName)
+	if target == nil {
+		return nil, fmt.Errorf("Invalid target: %s", targetName)
+	}
+
+	if err := target.checkAllowedKey(key); err != nil {
+		return nil, err
 	}
 
-	if response.StatusCode != http.StatusOK {
-		log.Printf("Callback returned unexpected code: %d %s", response.StatusCode, callbackURL)
-		bodyBytes, _ := io.ReadAll(response.Body)
-		bodyString := string(bodyBytes)
-		log.Print(bodyString)
+	expectedBucket, _ := getParam(params, "bucket")
+	if expectedBucket != "" && expectedBucket != target.Bucket {
+		return nil, fmt.Errorf("Expected bucket does not match target bucket: %s != %s", expectedBucket, target.Bucket)
 	}
 
-	response.Body.Close()
+	return target, nil
+}
 
-	return nil
+// transferOptions are what a copy asks for on top of copying the object as is
+type transferOptions struct {
+	ACL string // requested canned ACL, translated for the target
+	// replaces the source's Content-Disposition, already sanitized
+	ContentDisposition string
+	HTMLTransforms     []HTMLTransform
 }
 
-// notify the callback URL that an error happened
-func notifyError(callbackURL string, err error) error {
-	globalMetrics.TotalErrors.Add(1)
+// transferToTarget copies key from primary storage to target, put errors are
+// wrapped in a targetPutError since they're the ones a fallback target can
+// help with
+func transferToTarget(ctx context.Context, storage Storage, target *StorageConfig, key string, opts transferOptions) (*S3UploadStats, int64, error) {
+	acl, err := target.translateACL(opts.ACL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	targetStorage, err := target.NewStorageClient()
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to create target storage: %v", err)
+	}
+
+	reader, headers, err := storage.GetFile(ctx, globalConfig.Bucket, key)
+	if err != nil {
+		logPrint(ctx, "Failed to get file: ", err)
+		return nil, 0, err
+	}
+	defer reader.Close()
+
+	mReader := newMeasuredReader(reader)
+
+	uploadHeaders := http.Header{}
+
+	contentType := headers.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	uploadHeaders.Set("Content-Type", contentType)
+
+	if acl != "" {
+		uploadHeaders.Set("x-amz-acl", acl)
+	}
+
+	contentDisposition := opts.ContentDisposition
+	if contentDisposition == "" {
+		contentDisposition, err = sanitizeContentDisposition(headers.Get("Content-Disposition"))
+		if err != nil {
+			logPrint(ctx, "Dropping Content-Disposition of ", key, ": ", err)
+		}
+	}
+	if contentDisposition != "" {
+		uploadHeaders.Set("Content-Disposition", contentDisposition)
+	}
+
+	contentEncoding := headers.Get("Content-Encoding")
+	if contentEncoding != "" {
+		uploadHeaders.Set("Content-Encoding", contentEncoding)
+	}
+
+	var body io.Reader = mReader
+
+	if len(opts.HTMLTransforms) > 0 && (contentEncoding == "" || contentEncoding == "gzip") && isHTMLContentType(contentType) {
+		transformed, err := transformEncodedHTML(mReader, contentEncoding, opts.HTMLTransforms)
+		if err != nil {
+			logPrint(ctx, "Failed to read HTML file: ", err)
+			return nil, 0, err
+		}
+		defer transformed.Close()
+
+		body = transformed
+	}
+
+	err = checkProtectedKey(globalConfig.ProtectedPrefixes, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	logPrint(ctx, "Starting transfer: [", target.Name, "] ", target.Bucket, "/", key, " ", uploadHeaders)
+	size, _ := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	uploadStart := time.Now()
+	uploadStats, err := targetStorage.PutFile(ctx, target.Bucket, key, body, uploadHeaders, size)
+	targetHealth.record(target.Name, err)
 
-	message := url.Values{}
-	message.Add("Success", "false")
-	message.Add("Error", err.Error())
-	return notifyCallback(callbackURL, message)
+	if err != nil {
+		logPrint(ctx, "Failed to copy file: ", err)
+		return nil, 0, &targetPutError{target.Name, err}
+	}
+	globalMetrics.FileUploadDuration.Observe(time.Since(uploadStart), "copy", target.Name)
+
+	logPrint(ctx, "Transfer complete: [", target.Name, "] ", target.Bucket, "/", key,
+		", bytes read: ", formatBytes(float64(mReader.BytesRead)),
+		", duration: ", mReader.Duration.Seconds(),
+		", speed: ", formatBytes(mReader.TransferSpeed()), "/s")
+
+	return uploadStats, mReader.BytesRead, nil
+}
+
+// tracedTransferToTarget is transferToTarget in its own span
+func tracedTransferToTarget(ctx context.Context, storage Storage, target *StorageConfig, key string, opts transferOptions) (*S3UploadStats, int64, error) {
+	ctx, span := startSpan(ctx, "transfer", "zipserver.key", key, "zipserver.target", target.Name)
+	uploadStats, bytesRead, err := transferToTarget(ctx, storage, target, key, opts)
+	span.finish(err)
+	return uploadStats, bytesRead, err
+}
+
+// copyResult is the callback of a copy
+type copyResult struct {
+	Success bool
+	Key     string
+	// the target already had the key, nothing was copied
+	Skipped  bool `json:",omitempty"`
+	Mirrored bool `json:",omitempty"`
+
+	Duration    string `json:",omitempty"`
+	Size        int64
+	Md5         string
+	PartSize    int64
+	Concurrency int
+	// set when the copy went to the fallback target
+	Fallback bool   `json:",omitempty"`
+	Target   string `json:",omitempty"`
+	Bucket   string `json:",omitempty"`
+}
+
+// values are the legacy callback form of the result
+func (r *copyResult) values() url.Values {
+	values := url.Values{}
+	values.Add("Success", "true")
+	values.Add("Key", r.Key)
+	if r.Skipped {
+		values.Add("Skipped", "true")
+		return values
+	}
+	if r.Mirrored {
+		values.Add("Mirrored", "true")
+	}
+	values.Add("Duration", r.Duration)
+	values.Add("Size", fmt.Sprintf("%d", r.Size))
+	values.Add("Md5", r.Md5)
+	values.Add("PartSize", fmt.Sprintf("%d", r.PartSize))
+	values.Add("Concurrency", fmt.Sprintf("%d", r.Concurrency))
+	if r.Fallback {
+		values.Add("Fallback", "true")
+		values.Add("Target", r.Target)
+		values.Add("Bucket", r.Bucket)
+	}
+	return values
 }
 
 // The copy handler will asynchronously copy a file from primary storage to the
@@ -81,107 +260,159 @@ func copyHandler(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	targetName, err := getParam(params, "target")
+	if err := checkParamLength(params, "callback", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
 	if err != nil {
 		return err
 	}
 
-	storageTargetConfig := globalConfig.GetStorageTargetByName(targetName)
-	if storageTargetConfig == nil {
-		return fmt.Errorf("Invalid target: %s", targetName)
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
 	}
 
-	expectedBucket, _ := getParam(params, "bucket")
-	targetBucket := storageTargetConfig.Bucket
+	storageTargetConfig, err := loadCopyTarget(params, key)
+	if err != nil {
+		return err
+	}
+	targetName := storageTargetConfig.Name
 
-	if expectedBucket != "" && expectedBucket != targetBucket {
-		return fmt.Errorf("Expected bucket does not match target bucket: %s != %s", expectedBucket, targetBucket)
+	acl := params.Get("acl")
+	if _, err := storageTargetConfig.translateACL(acl); err != nil {
+		return err
 	}
 
+	contentDisposition, err := sanitizeContentDisposition(params.Get("content_disposition"))
+	if err != nil {
+		return badRequestf("Invalid content_disposition: %v", err)
+	}
+
+	htmlTransforms, err := loadHTMLTransforms(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	transferOpts := transferOptions{
+		ACL:                acl,
+		ContentDisposition: contentDisposition,
+		HTMLTransforms:     htmlTransforms,
+	}
+
+	priority, err := parseJobPriority(params.Get("priority"))
+	if err != nil {
+		return err
+	}
+
+	// skip the copy when the target already has the key, and fetch sources
+	// missing from primary storage from CopyOriginURL
+	ifNotExists := params.Get("if_not_exists") == "true"
+
 	lockKey := fmt.Sprintf("%s:%s", targetName, key)
 
-	hasLock := copyLockTable.tryLockKey(lockKey)
+	token, hasLock := copyLockTable.tryLockKey(lockKey)
 
 	if !hasLock {
 		// already being extracted in another handler, ask consumer to wait
 		return writeJSONMessage(w, struct{ Processing bool }{true})
 	}
 
-	go (func() {
-		defer copyLockTable.releaseKey(lockKey)
-
-		jobCtx, cancel := context.WithTimeout(context.Background(), time.Duration(globalConfig.JobTimeout))
-		defer cancel()
+	job := jobs.newJob("copy", key, "", callbackURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
 
-		storage, err := NewGcsStorage(globalConfig)
-
-		if storage == nil {
-			notifyError(callbackURL, fmt.Errorf("Failed to create source storage: %v", err))
-			return
+	// copyOnce makes an attempt at the copy, returning its result
+	copyOnce := func(jobCtx context.Context) (*copyResult, error) {
+		err := copyScheduler.Acquire(jobCtx, priority)
+		if err != nil {
+			return nil, fmt.Errorf("Timed out waiting for a copy slot: %v", err)
 		}
+		defer copyScheduler.Release()
+		job.start()
 
-		targetStorage, err := storageTargetConfig.NewStorageClient()
+		storage, err := NewPrimaryStorage(globalConfig)
 
 		if err != nil {
-			notifyError(callbackURL, fmt.Errorf("Failed to create target storage: %v", err))
-			return
+			return nil, fmt.Errorf("Failed to create source storage: %v", err)
 		}
 
 		startTime := time.Now()
 
-		reader, headers, err := storage.GetFile(jobCtx, globalConfig.Bucket, key)
-
-		if err != nil {
-			log.Print("Failed to get file: ", err)
-			notifyError(callbackURL, err)
-			return
+		result := &copyResult{Success: true, Key: key}
+
+		if ifNotExists {
+			exists, err := targetHasKey(jobCtx, storageTargetConfig, key)
+			if err != nil {
+				return nil, err
+			}
+
+			if exists {
+				logPrint(jobCtx, "Skipping copy, target already has: [", targetName, "] ", key)
+				result.Skipped = true
+				return result, nil
+			}
+
+			mirrored, err := mirrorFromOrigin(jobCtx, storage, key)
+			if err != nil {
+				return nil, err
+			}
+			result.Mirrored = mirrored
 		}
 
-		defer reader.Close()
-
-		mReader := newMeasuredReader(reader)
+		target := storageTargetConfig
+		fallback := globalConfig.fallbackTarget(storageTargetConfig, key)
+		if fallback != nil && targetHealth.isFailing(target.Name) {
+			logPrint(jobCtx, "Target ", target.Name, " is failing, copying to fallback ", fallback.Name)
+			target = fallback
+		}
 
-		uploadHeaders := http.Header{}
+		uploadStats, bytesRead, err := tracedTransferToTarget(jobCtx, storage, target, key, transferOpts)
 
-		contentType := headers.Get("Content-Type")
-		if contentType == "" {
-			contentType = "application/octet-stream"
+		var putErr *targetPutError
+		if errors.As(err, &putErr) && fallback != nil && target != fallback {
+			logPrint(jobCtx, "Retrying copy on fallback target ", fallback.Name)
+			target = fallback
+			uploadStats, bytesRead, err = tracedTransferToTarget(jobCtx, storage, target, key, transferOpts)
 		}
 
-		uploadHeaders.Set("Content-Type", contentType)
+		if err != nil {
+			return nil, err
+		}
 
-		contentDisposition := headers.Get("Content-Disposition")
-		if contentDisposition != "" {
-			uploadHeaders.Set("Content-Disposition", contentDisposition)
+		globalMetrics.TotalCopiedFiles.Add(1)
+		globalMetrics.JobDuration.Observe(time.Since(startTime), "copy", target.Name)
+		recordHistory(withJob(jobCtx, job), HistoryEntry{Type: "copy", Keys: []string{key}, Target: target.Name}, nil)
+
+		result.Duration = fmt.Sprintf("%.4fs", time.Since(startTime).Seconds())
+		result.Size = bytesRead
+		result.Md5 = uploadStats.MD5
+		result.PartSize = uploadStats.PartSize
+		result.Concurrency = uploadStats.Concurrency
+		if target != storageTargetConfig {
+			result.Fallback = true
+			result.Target = target.Name
+			result.Bucket = target.Bucket
 		}
 
-		log.Print("Starting transfer: [", targetName, "] ", targetBucket, "/", key, " ", uploadHeaders)
-		checksumMd5, err := targetStorage.PutFile(jobCtx, targetBucket, key, mReader, uploadHeaders)
+		job.addProgress(1, uint64(bytesRead))
+		return result, nil
+	}
+
+	startBackgroundJob(func() {
+		defer copyLockTable.releaseKey(lockKey, token)
 
+		result, err := runJobAttempts(job, copyOnce)
 		if err != nil {
-			log.Print("Failed to copy file: ", err)
-			notifyError(callbackURL, err)
+			recordHistory(job.detachedContext(), HistoryEntry{Type: "copy", Keys: []string{key}, Target: targetName}, err)
+			job.finish(err)
+			notifyError(callbackURL, callbackTimeout, job, err)
 			return
 		}
 
-		globalMetrics.TotalCopiedFiles.Add(1)
-		log.Print("Transfer complete: [", targetName, "] ", targetBucket, "/", key,
-			", bytes read: ", formatBytes(float64(mReader.BytesRead)),
-			", duration: ", mReader.Duration.Seconds(),
-			", speed: ", formatBytes(mReader.TransferSpeed()), "/s")
-
-		resValues := url.Values{}
-		resValues.Add("Success", "true")
-		resValues.Add("Key", key)
-		resValues.Add("Duration", fmt.Sprintf("%.4fs", time.Since(startTime).Seconds()))
-		resValues.Add("Size", fmt.Sprintf("%d", mReader.BytesRead))
-		resValues.Add("Md5", checksumMd5)
-
-		notifyCallback(callbackURL, resValues)
-	})()
-
-	return writeJSONMessage(w, struct {
-		Processing bool
-		Async      bool
-	}{true, true})
+		job.finish(nil)
+		notifyCallback(callbackURL, callbackTimeout, job, result.values(), result)
+	})
+
+	return writeJobStarted(w, job)
 }
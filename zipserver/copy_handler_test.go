@@ -0,0 +1,63 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MirrorFromOrigin(t *testing.T) {
+	ctx := context.Background()
+
+	requested := []string{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if r.URL.Path != "/builds/1/game file.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write([]byte("zip contents"))
+	}))
+	defer origin.Close()
+
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+
+	config := emptyConfig()
+	globalConfig = config
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	// no origin configured
+	mirrored, err := mirrorFromOrigin(ctx, storage, "builds/1/game file.zip")
+	assert.NoError(t, err)
+	assert.False(t, mirrored)
+
+	config.CopyOriginURL = origin.URL + "/"
+
+	mirrored, err = mirrorFromOrigin(ctx, storage, "builds/1/game file.zip")
+	assert.NoError(t, err)
+	assert.True(t, mirrored)
+
+	reader, headers, err := storage.GetFile(ctx, config.Bucket, "builds/1/game file.zip")
+	require.NoError(t, err)
+	contents, _ := io.ReadAll(reader)
+	assert.Equal(t, "zip contents", string(contents))
+	assert.Equal(t, "application/zip", headers.Get("Content-Type"))
+
+	// already in primary storage, the origin isn't asked again
+	mirrored, err = mirrorFromOrigin(ctx, storage, "builds/1/game file.zip")
+	assert.NoError(t, err)
+	assert.False(t, mirrored)
+	assert.Len(t, requested, 1)
+
+	_, err = mirrorFromOrigin(ctx, storage, "builds/2/missing.zip")
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many objects are deleted at once by DeletePrefix
+const deleteBatchSize = 50
+
+var deleteLockTable = NewLockTable()
+
+// DeletePrefix deletes every object under prefix, a batch at a time.
+// onBatch, if set, is called after each batch with the running count.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) DeletePrefix(ctx context.Context, prefix string, onBatch func(deleted, total int)) (int, error) {
+	// make sure foo/ doesn't match foo_bar/
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Deleting %d objects under %s", len(objects), prefix)
+	jobFromContext(ctx).setTotalFiles(len(objects))
+
+	deleted := 0
+	for start := 0; start < len(objects); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(objects) {
+			end = len(objects)
+		}
+		batch := objects[start:end]
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(batch))
+		for i, object := range batch {
+			wg.Add(1)
+			go func(i int, key string) {
+				defer wg.Done()
+				errs[i] = a.Storage.DeleteFile(ctx, a.Bucket, key)
+			}(i, object.Key)
+		}
+		wg.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				return deleted, fmt.Errorf("Failed deleting %s: %s", batch[i].Key, err.Error())
+			}
+			deleted++
+		}
+
+		jobFromContext(ctx).addProgress(len(batch), 0)
+		if onBatch != nil {
+			onBatch(deleted, len(objects))
+		}
+	}
+
+	return deleted, nil
+}
+
+// Deletes everything under an extracted prefix, eg. after a failed or
+// superseded extraction
+func deleteHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	prefixParam, err := getParam(params, "prefix")
+	if err != nil {
+		return err
+	}
+
+	if err := checkParamLength(params, "callback", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	if err := checkParamLength(params, "progress_callback", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := extractedPrefix(prefixParam)
+	if err != nil {
+		return err
+	}
+
+	if err := checkProtectedKey(globalConfig.ProtectedPrefixes, prefix+"/"); err != nil {
+		return err
+	}
+
+	if window := time.Duration(globalConfig.DeleteProtectionWindow); window > 0 && params.Get("force") != "true" {
+		if extraction := history.lastExtraction(prefix+"/", time.Now().Add(-window)); extraction != nil {
+			return badRequestf("Refusing to delete %s, it was extracted %v ago (pass force=true to delete anyway)",
+				prefix, time.Since(extraction.Time).Round(time.Second))
+		}
+	}
+
+	token, hasLock := deleteLockTable.tryLockKey(prefix)
+	if !hasLock {
+		return writeJSONMessage(w, struct{ Processing bool }{true})
+	}
+
+	callbackURL := params.Get("callback")
+	progressURL := params.Get("progress_callback")
+
+	process := func(ctx context.Context, job *Job) (int, error) {
+		defer deleteLockTable.releaseKey(prefix, token)
+
+		var onBatch func(deleted, total int)
+		if progressURL != "" {
+			onBatch = func(deleted, total int) {
+				resValues := url.Values{}
+				resValues.Add("Prefix", prefix)
+				resValues.Add("Deleted", fmt.Sprintf("%d", deleted))
+				resValues.Add("Total", fmt.Sprintf("%d", total))
+				notifyProgress(progressURL, callbackTimeout, job, resValues, struct {
+					Prefix  string
+					Deleted int
+					Total   int
+				}{prefix, deleted, total})
+			}
+		}
+
+		ctx = withJob(ctx, job)
+		archiver := NewArchiver(globalConfig)
+		deleted, err := archiver.DeletePrefix(ctx, prefix, onBatch)
+		recordHistory(ctx, HistoryEntry{Type: "delete", Keys: []string{prefix + "/"}}, err)
+		return deleted, err
+	}
+
+	if callbackURL == "" {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		deleted, err := process(ctx, nil)
+		if err != nil {
+			globalMetrics.TotalErrors.Add(1)
+			return writeJSONError(w, "DeleteError", err)
+		}
+
+		recordSyncResponse(caller)
+		return writeJSONMessage(w, struct {
+			Success bool
+			Deleted int
+		}{true, deleted})
+	}
+
+	job := jobs.newJob("delete", prefix, "", callbackURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
+
+	startBackgroundJob(func() {
+		// This job is expected to outlive the incoming request, so it runs in
+		// the job's detached context.
+		ctx, cancel := context.WithTimeout(job.detachedContext(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		job.start()
+		deleted, err := process(ctx, job)
+		job.finish(err)
+		if err != nil {
+			log.Print("Delete failed ", err)
+			notifyError(callbackURL, callbackTimeout, job, err)
+			return
+		}
+
+		resValues := url.Values{}
+		resValues.Add("Success", "true")
+		resValues.Add("Prefix", prefix)
+		resValues.Add("Deleted", fmt.Sprintf("%d", deleted))
+		notifyCallback(callbackURL, callbackTimeout, job, resValues, struct {
+			Success bool
+			Prefix  string
+			Deleted int
+		}{true, prefix, deleted})
+	})
+
+	return writeJobStarted(w, job)
+}
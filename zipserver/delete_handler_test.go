@@ -0,0 +1,71 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	for i := 0; i < 120; i++ {
+		err := storage.PutFile(ctx, config.Bucket, fmt.Sprintf("games/1/file%d.txt", i), strings.NewReader("hi"), "text/plain")
+		require.NoError(t, err)
+	}
+	err = storage.PutFile(ctx, config.Bucket, "games/10/keep.txt", strings.NewReader("hi"), "text/plain")
+	require.NoError(t, err)
+
+	batches := []int{}
+	archiver := &Archiver{storage, config}
+	deleted, err := archiver.DeletePrefix(ctx, "games/1", func(deleted, total int) {
+		assert.EqualValues(t, 120, total)
+		batches = append(batches, deleted)
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 120, deleted)
+	assert.EqualValues(t, []int{50, 100, 120}, batches)
+
+	objects, err := storage.ListObjects(ctx, config.Bucket, "games/")
+	require.NoError(t, err)
+	assert.EqualValues(t, []ObjectInfo{{"games/10/keep.txt", 2, "49f68a5c8493ec2c0bf489821c21fc3b"}}, objects)
+}
+
+func Test_DeleteProtectionWindow(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	previous := history
+	history = &historyTable{}
+	defer func() { history = previous }()
+
+	config := emptyConfig()
+	config.ExtractPrefix = "games"
+	config.DeleteProtectionWindow = Duration(10 * time.Minute)
+	globalConfig = config
+
+	recordHistory(context.Background(), HistoryEntry{Type: "extract", Keys: []string{"zips/1.zip", "games/1/"}}, nil)
+	recordHistory(context.Background(), HistoryEntry{Type: "extract", Keys: []string{"zips/2.zip", "games/2/"}}, errors.New("oops"))
+
+	err := deleteHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/delete?prefix=1", nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "force=true")
+
+	since := time.Now().Add(-time.Minute)
+	assert.NotNil(t, history.lastExtraction("games/1/", since))
+	assert.NotNil(t, history.lastExtraction("games/", since))
+	assert.NotNil(t, history.lastExtraction("games/1/sub/", since))
+	assert.Nil(t, history.lastExtraction("games/10/", since))
+	assert.Nil(t, history.lastExtraction("games/2/", since), "failed extractions aren't protected")
+	assert.Nil(t, history.lastExtraction("games/1/", time.Now().Add(time.Minute)))
+}
@@ -0,0 +1,136 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outboundDialer opens every outbound connection: storage, slurp, zip
+// listings from URLs and callbacks
+type outboundDialer struct {
+	dialer     *net.Dialer
+	dnsRetries int
+}
+
+var (
+	currentDialer      = newOutboundDialer(&defaultConfig)
+	currentDialerMutex sync.Mutex
+)
+
+// outboundHTTPClient is used for requests that don't go to storage
+var outboundHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialOutbound,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// Version is reported in the User-Agent of outbound requests, it's set when
+// building with -ldflags "-X github.com/itchio/zipserver/zipserver.Version=..."
+var Version = "dev"
+
+// jobHeader carries the ID of the job an outbound request is made for
+const jobHeader = "X-Zipserver-Job"
+
+// setOutboundHeaders identifies zipserver, and the job when there's one, in a
+// request sent with outboundHTTPClient, eg. "zipserver/1.2 (job 42)"
+func setOutboundHeaders(req *http.Request, jobID string) {
+	userAgent := "zipserver/" + Version
+	if globalConfig != nil && globalConfig.UserAgent != "" {
+		userAgent = globalConfig.UserAgent
+	}
+
+	if jobID != "" {
+		userAgent += " (job " + jobID + ")"
+		req.Header.Set(jobHeader, jobID)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	if current := spanFromContext(req.Context()); current != nil {
+		req.Header.Set("traceparent", current.traceparent())
+	}
+}
+
+// validateDNSServers checks DNSServers are host:port addresses
+func validateDNSServers(servers []string) error {
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("Config error: invalid DNS server %q, expected host:port", server)
+		}
+	}
+	return nil
+}
+
+func newOutboundDialer(config *Config) *outboundDialer {
+	dialer := &net.Dialer{
+		Timeout:       time.Duration(config.DialTimeout),
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: time.Duration(config.DialFallbackDelay),
+	}
+
+	if servers := config.DNSServers; len(servers) > 0 {
+		var next atomic.Uint32
+		resolverDialer := &net.Dialer{Timeout: time.Duration(config.DialTimeout)}
+
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			// rotate through the servers, so retries go to another one
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server := servers[int(next.Add(1)-1)%len(servers)]
+				return resolverDialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return &outboundDialer{
+		dialer:     dialer,
+		dnsRetries: config.DNSRetryAttempts,
+	}
+}
+
+func setupOutboundDialer(config *Config) {
+	currentDialerMutex.Lock()
+	defer currentDialerMutex.Unlock()
+	currentDialer = newOutboundDialer(config)
+}
+
+// dialOutbound connects to addr, retrying lookups that fail with a temporary
+// or timeout error
+func dialOutbound(ctx context.Context, network, addr string) (net.Conn, error) {
+	currentDialerMutex.Lock()
+	d := currentDialer
+	currentDialerMutex.Unlock()
+
+	for retry := 1; ; retry++ {
+		conn, err := d.dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		var dnsErr *net.DNSError
+		if retry > d.dnsRetries || !errors.As(err, &dnsErr) || !(dnsErr.IsTemporary || dnsErr.IsTimeout) {
+			return nil, err
+		}
+
+		globalMetrics.TotalDNSRetries.Add(1)
+		log.Printf("Retrying lookup of %s: %s", addr, err.Error())
+
+		select {
+		case <-time.After(time.Duration(retry) * 100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTestDNS answers A queries for names starting with "ok." with
+// 127.0.0.1, says the ones starting with "missing." don't exist and fails
+// every other query with SERVFAIL
+func serveTestDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			if len(query) < 12 {
+				continue
+			}
+
+			// question name, then type and class
+			var labels []string
+			offset := 12
+			for offset < len(query) && query[offset] != 0 {
+				length := int(query[offset])
+				labels = append(labels, string(query[offset+1:offset+1+length]))
+				offset += 1 + length
+			}
+			questionEnd := offset + 5
+			qtype := binary.BigEndian.Uint16(query[offset+1:])
+
+			response := append([]byte{}, query[:questionEnd]...)
+			response[2] = 0x84 // response, authoritative
+			response[3] = 0x00
+			binary.BigEndian.PutUint16(response[6:], 0) // answers
+			binary.BigEndian.PutUint16(response[8:], 0)
+			binary.BigEndian.PutUint16(response[10:], 0)
+
+			switch {
+			case len(labels) > 0 && labels[0] == "missing":
+				response[3] = 0x03 // NXDOMAIN
+			case len(labels) == 0 || labels[0] != "ok":
+				response[3] = 0x02 // SERVFAIL
+			case qtype == 1:
+				binary.BigEndian.PutUint16(response[6:], 1)
+				response = append(response, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+
+			conn.WriteTo(response, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func Test_OutboundDialerDNSServers(t *testing.T) {
+	defer setupOutboundDialer(&defaultConfig)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	config := defaultConfig
+	config.DNSServers = []string{serveTestDNS(t)}
+	config.DNSRetryAttempts = 2
+	setupOutboundDialer(&config)
+
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := dialOutbound(ctx, "tcp", net.JoinHostPort("ok.zipserver.test", port))
+	require.NoError(t, err)
+	conn.Close()
+
+	retries := globalMetrics.TotalDNSRetries.Load()
+	_, err = dialOutbound(ctx, "tcp", net.JoinHostPort("broken.zipserver.test", port))
+	assert.Error(t, err)
+	assert.EqualValues(t, 2, globalMetrics.TotalDNSRetries.Load()-retries)
+
+	// not found isn't retried
+	retries = globalMetrics.TotalDNSRetries.Load()
+	_, err = dialOutbound(ctx, "tcp", net.JoinHostPort("missing.zipserver.test", port))
+	assert.Error(t, err)
+	assert.EqualValues(t, 0, globalMetrics.TotalDNSRetries.Load()-retries)
+}
+
+func Test_ValidateDNSServers(t *testing.T) {
+	assert.NoError(t, validateDNSServers(nil))
+	assert.NoError(t, validateDNSServers([]string{"8.8.8.8:53", "[2001:4860:4860::8888]:53"}))
+	assert.EqualError(t, validateDNSServers([]string{"8.8.8.8"}),
+		fmt.Sprintf("Config error: invalid DNS server %q, expected host:port", "8.8.8.8"))
+}
@@ -0,0 +1,192 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// name of the file listing the changes inside a patch bundle
+const patchManifestName = ".zipserver-patch.json"
+
+// PrefixDiff lists what changed between two extractions of the same game, all
+// paths are relative to the extraction prefixes
+type PrefixDiff struct {
+	Added   []string // only in the new extraction
+	Removed []string // only in the old extraction
+	Changed []string // in both with different contents
+}
+
+// DiffPrefixes compares the objects under oldPrefix and newPrefix by checksum.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) DiffPrefixes(ctx context.Context, oldPrefix, newPrefix string) (*PrefixDiff, error) {
+	oldChecksums, err := a.PrefixChecksums(ctx, oldPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	newChecksums, err := a.PrefixChecksums(ctx, newPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := compareManifests(oldChecksums, newChecksums)
+	return &PrefixDiff{
+		Added:   diff.Unexpected,
+		Removed: diff.Missing,
+		Changed: diff.Mismatched,
+	}, nil
+}
+
+// WritePatch uploads a zip to key holding every added and changed file from
+// newPrefix, along with a patchManifestName listing the whole diff so removed
+// files can be deleted when the patch is applied.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) WritePatch(ctx context.Context, newPrefix string, diff *PrefixDiff, key string) error {
+	newPrefix = strings.TrimSuffix(newPrefix, "/") + "/"
+
+	ctx, cleanup, err := a.withTempDir(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out, err := os.CreateTemp(a.tempDir(ctx), "patch-*.zip")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	err = a.writePatchZip(ctx, out, newPrefix, diff)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return a.Storage.PutFile(ctx, a.Bucket, key, out, "application/zip")
+}
+
+func (a *Archiver) writePatchZip(ctx context.Context, out io.Writer, newPrefix string, diff *PrefixDiff) error {
+	zw := zip.NewWriter(out)
+
+	manifest, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	w, err := zw.Create(patchManifestName)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(manifest)
+	if err != nil {
+		return err
+	}
+
+	names := append(append([]string{}, diff.Added...), diff.Changed...)
+	for _, name := range names {
+		err := a.addPatchFile(ctx, zw, newPrefix+name, name)
+		if err != nil {
+			return fmt.Errorf("Failed adding %s to patch: %s", name, err.Error())
+		}
+	}
+
+	return zw.Close()
+}
+
+func (a *Archiver) addPatchFile(ctx context.Context, zw *zip.Writer, key, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FileGetTimeout))
+	defer cancel()
+
+	reader, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// Reports the files added, removed and changed between two extracted
+// prefixes, and with patch_key uploads a zip of the new and changed files
+func diffHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	from, err := getParam(params, "from")
+	if err != nil {
+		return err
+	}
+
+	to, err := getParam(params, "to")
+	if err != nil {
+		return err
+	}
+
+	fromPrefix, err := extractedPrefix(from)
+	if err != nil {
+		return err
+	}
+
+	toPrefix, err := extractedPrefix(to)
+	if err != nil {
+		return err
+	}
+
+	patchKey := params.Get("patch_key")
+	if patchKey != "" {
+		if err := checkReadOnly(); err != nil {
+			return err
+		}
+
+		err := checkProtectedKey(globalConfig.ProtectedPrefixes, patchKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	archiver := NewArchiver(globalConfig)
+
+	diff, err := archiver.DiffPrefixes(ctx, fromPrefix, toPrefix)
+	if err != nil {
+		return writeJSONError(w, "DiffError", err)
+	}
+
+	if patchKey != "" {
+		log.Printf("Writing patch from %s to %s into %s", fromPrefix, toPrefix, patchKey)
+
+		err := archiver.WritePatch(ctx, toPrefix, diff, patchKey)
+		if err != nil {
+			return writeJSONError(w, "DiffError", err)
+		}
+	}
+
+	return writeJSONMessage(w, struct {
+		Success  bool
+		PatchKey string `json:",omitempty"`
+		*PrefixDiff
+	}{true, patchKey, diff})
+}
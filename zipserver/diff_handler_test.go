@@ -0,0 +1,136 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DiffPrefixes(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	put := func(key, contents string) {
+		err := storage.PutFile(ctx, config.Bucket, key, strings.NewReader(contents), "text/plain")
+		require.NoError(t, err)
+	}
+
+	put("games/1/old/same.txt", "same")
+	put("games/1/old/changed.txt", "before")
+	put("games/1/old/removed.txt", "removed")
+	put("games/1/new/same.txt", "same")
+	put("games/1/new/changed.txt", "after")
+	put("games/1/new/added.txt", "added")
+
+	archiver := &Archiver{storage, config}
+	diff, err := archiver.DiffPrefixes(ctx, "games/1/old", "games/1/new")
+	require.NoError(t, err)
+	assert.EqualValues(t, []string{"added.txt"}, diff.Added)
+	assert.EqualValues(t, []string{"removed.txt"}, diff.Removed)
+	assert.EqualValues(t, []string{"changed.txt"}, diff.Changed)
+
+	err = archiver.WritePatch(ctx, "games/1/new", diff, "patches/1.zip")
+	require.NoError(t, err)
+
+	reader, _, err := storage.GetFile(ctx, config.Bucket, "patches/1.zip")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	contents := map[string]string{}
+	for _, file := range zr.File {
+		r, err := file.Open()
+		require.NoError(t, err)
+		fileData, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		contents[file.Name] = string(fileData)
+	}
+
+	assert.EqualValues(t, "added", contents["added.txt"])
+	assert.EqualValues(t, "after", contents["changed.txt"])
+	assert.NotContains(t, contents, "same.txt")
+
+	var manifest PrefixDiff
+	require.NoError(t, json.Unmarshal([]byte(contents[patchManifestName]), &manifest))
+	assert.EqualValues(t, *diff, manifest)
+}
+
+func Test_DiffHandlerPrefixes(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+	globalConfig.ExtractPrefix = "extracted"
+
+	for _, query := range []string{"from=../secrets&to=games/1", "from=games/1&to=games/../..", "from=.&to=games/1"} {
+		rec := httptest.NewRecorder()
+		err := diffHandler(rec, httptest.NewRequest(http.MethodGet, "/diff?"+query, nil))
+		var badRequest *badRequestError
+		require.ErrorAs(t, err, &badRequest, query)
+	}
+}
+
+func Test_DiffExtractions(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	extract := func(prefix string, files map[string]string) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, contents := range files {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			w.Write([]byte(contents))
+		}
+		require.NoError(t, zw.Close())
+
+		fname := filepath.Join(t.TempDir(), "game.zip")
+		require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+		_, err := archiver.ExtractZipFile(ctx, fname, prefix, testLimits(), ExtractOptions{FileTree: true})
+		require.NoError(t, err)
+	}
+
+	extract("games/1/old", map[string]string{"same.txt": "same", "changed.txt": "before"})
+	extract("games/1/new", map[string]string{"same.txt": "same", "changed.txt": "after"})
+
+	// the extraction manifest and file tree aren't extracted files
+	checksums, err := archiver.PrefixChecksums(ctx, "games/1/old")
+	require.NoError(t, err)
+	assert.True(t, compareManifests(map[string]string{
+		"same.txt":    fmt.Sprintf("%x", sha256.Sum256([]byte("same"))),
+		"changed.txt": fmt.Sprintf("%x", sha256.Sum256([]byte("before"))),
+	}, checksums).Identical())
+
+	diff, err := archiver.DiffPrefixes(ctx, "games/1/old", "games/1/new")
+	require.NoError(t, err)
+	assert.EqualValues(t, &PrefixDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{"changed.txt"},
+	}, diff)
+}
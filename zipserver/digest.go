@@ -0,0 +1,188 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	errors "github.com/go-errors/errors"
+)
+
+// digestManifestName is where a digest is written, relative to the prefix
+const digestManifestName = ".zipserver-digest.json"
+
+// EntryDigest describes a zip entry as it would be extracted, without
+// uploading it
+type EntryDigest struct {
+	Key             string // relative to the extraction prefix
+	Size            uint64
+	SHA256          string
+	CRC32           uint32
+	ContentType     string
+	ContentEncoding string `json:",omitempty"`
+}
+
+// DigestZip downloads the zip at key and computes the checksum, size and type
+// of every entry that would be extracted to prefix, applying the same limits,
+// ignore rules, empty entry policy, password and key template as ExtractZip.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) DigestZip(ctx context.Context, key, prefix string, limits *ExtractLimits, opts *ExtractOptions) ([]EntryDigest, error) {
+	ctx, cleanup, err := a.withTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fname, err := a.fetchZipParts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.digestZipFile(ctx, fname, prefix, limits, opts)
+}
+
+func (a *Archiver) digestZipFile(ctx context.Context, fname, prefix string, limits *ExtractLimits, opts *ExtractOptions) ([]EntryDigest, error) {
+	zipReader, err := a.openArchive(ctx, fname, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	fileList, err := a.selectZipFiles(ctx, zipReader.File, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkTemplatedKeys(prefix, fileList, opts); err != nil {
+		return nil, err
+	}
+
+	digests := make([]EntryDigest, 0, len(fileList))
+
+	for _, file := range fileList {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		key, err := opts.storedKey(prefix, file)
+		if err == nil && key == "" {
+			key, err = opts.contentKey(prefix, file)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		digest, err := digestZipEntry(strings.TrimPrefix(key, prefix+"/"), file, opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, *digest)
+	}
+
+	return digests, nil
+}
+
+// digestZipEntry digests file, stored at key relative to the prefix
+func digestZipEntry(key string, file *zip.File, password string) (*EntryDigest, error) {
+	readerCloser, err := openZipEntry(file, password)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	defer readerCloser.Close()
+
+	resource, reader, err := sniffResource(key, readerCloser)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.release()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return &EntryDigest{
+		Key:             strings.TrimPrefix(resource.key, "/"),
+		Size:            uint64(size),
+		SHA256:          hex.EncodeToString(hasher.Sum(nil)),
+		CRC32:           file.CRC32,
+		ContentType:     resource.contentType,
+		ContentEncoding: resource.contentEncoding,
+	}, nil
+}
+
+// uploads the digest as JSON to prefix, returning the key it was written to
+func (a *Archiver) uploadDigest(ctx context.Context, prefix string, digests []EntryDigest) (string, error) {
+	blob, err := json.Marshal(digests)
+	if err != nil {
+		return "", err
+	}
+
+	resource := &ResourceSpec{
+		key:         path.Join(a.ExtractPrefix, prefix, digestManifestName),
+		size:        uint64(len(blob)),
+		contentType: "application/json",
+	}
+
+	err = a.Storage.PutFileWithSetup(ctx, a.Bucket, resource.key, bytes.NewReader(blob), resource.setupRequest)
+	if err != nil {
+		return "", err
+	}
+
+	return resource.key, nil
+}
+
+// /extract?mode=digest: walks the zip without uploading its contents,
+// optionally writing the result next to where it would be extracted
+func digestHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	key, prefix string,
+	limits *ExtractLimits,
+	opts *ExtractOptions,
+	priority JobPriority,
+	writeManifest bool,
+) error {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	err := extractScheduler.Acquire(ctx, priority)
+	if err != nil {
+		return err
+	}
+	defer extractScheduler.Release()
+
+	archiver := NewArchiver(globalConfig)
+
+	digests, err := archiver.DigestZip(ctx, key, prefix, limits, opts)
+	if err != nil {
+		globalMetrics.TotalErrors.Add(1)
+		return writeJSONError(w, "DigestError", err)
+	}
+
+	manifestKey := ""
+	if writeManifest {
+		putCtx, putCancel := context.WithTimeout(ctx, time.Duration(globalConfig.FilePutTimeout))
+		defer putCancel()
+
+		manifestKey, err = archiver.uploadDigest(putCtx, prefix, digests)
+		if err != nil {
+			return writeJSONError(w, "DigestError", err)
+		}
+	}
+
+	return writeJSONMessage(w, struct {
+		Success     bool
+		Entries     []EntryDigest
+		ManifestKey string `json:",omitempty"`
+	}{true, digests, manifestKey})
+}
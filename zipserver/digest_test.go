@@ -0,0 +1,104 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DigestZipFile(t *testing.T) {
+	zipFile, err := os.CreateTemp("", "zipserver-digest")
+	assert.NoError(t, err)
+	defer os.Remove(zipFile.Name())
+
+	zw := zip.NewWriter(zipFile)
+	for _, name := range []string{"hello.txt", "__MACOSX/junk", "game.jsgz"} {
+		writer, err := zw.Create(name)
+		assert.NoError(t, err)
+		if name == "game.jsgz" {
+			writer.Write([]byte{0x1F, 0x8B, 0x08, 1, 5, 2})
+		} else {
+			writer.Write([]byte("hello"))
+		}
+	}
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, zipFile.Close())
+
+	archiver := &Archiver{nil, emptyConfig()}
+
+	digests, err := archiver.digestZipFile(context.Background(), zipFile.Name(), "games/1", testLimits(), &ExtractOptions{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, len(digests))
+
+	assert.EqualValues(t, EntryDigest{
+		Key:         "hello.txt",
+		Size:        5,
+		SHA256:      "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		CRC32:       crc32.ChecksumIEEE([]byte("hello")),
+		ContentType: "text/plain; charset=utf-8",
+	}, digests[0])
+
+	assert.EqualValues(t, "game.js", digests[1].Key)
+	assert.EqualValues(t, "gzip", digests[1].ContentEncoding)
+
+	limits := testLimits()
+	limits.MaxNumFiles = 1
+	_, err = archiver.digestZipFile(context.Background(), zipFile.Name(), "games/1", limits, &ExtractOptions{})
+	assert.Error(t, err)
+
+	// keys follow the extraction's template
+	template, err := parseKeyTemplate("{{prefix}}/{{crc32}}/{{name|upper}}")
+	assert.NoError(t, err)
+	digests, err = archiver.digestZipFile(context.Background(), zipFile.Name(), "games/1", testLimits(), &ExtractOptions{KeyTemplate: template})
+	assert.NoError(t, err)
+	assert.EqualValues(t, fmt.Sprintf("%08x/HELLO.TXT", crc32.ChecksumIEEE([]byte("hello"))), digests[0].Key)
+
+	// and its ignore rules and empty entry policy
+	digests, err = archiver.digestZipFile(context.Background(), zipFile.Name(), "games/1", testLimits(), &ExtractOptions{IgnorePatterns: []string{"*.txt"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(digests))
+	assert.EqualValues(t, "game.js", digests[0].Key)
+}
+
+func Test_DigestZipFileOptions(t *testing.T) {
+	archiver := &Archiver{nil, emptyConfig()}
+
+	zipFile, err := os.CreateTemp("", "zipserver-digest")
+	assert.NoError(t, err)
+	defer os.Remove(zipFile.Name())
+
+	zw := zip.NewWriter(zipFile)
+	for name, data := range map[string]string{"hello.txt": "hello", "empty.txt": ""} {
+		writer, err := zw.Create(name)
+		assert.NoError(t, err)
+		writer.Write([]byte(data))
+	}
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, zipFile.Close())
+
+	digests, err := archiver.digestZipFile(context.Background(), zipFile.Name(), "games/1", testLimits(), &ExtractOptions{EmptyEntryPolicy: EmptyEntrySkipAll})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(digests))
+	assert.EqualValues(t, "hello.txt", digests[0].Key)
+
+	// encrypted entries are digested decrypted
+	encrypted := filepath.Join("testdata", "zipcrypto.zip")
+	_, err = archiver.digestZipFile(context.Background(), encrypted, "games/1", testLimits(), &ExtractOptions{})
+	assert.Error(t, err)
+
+	digests, err = archiver.digestZipFile(context.Background(), encrypted, "games/1", testLimits(), &ExtractOptions{Password: "hunter2"})
+	assert.NoError(t, err)
+	for _, digest := range digests {
+		if digest.Key == "tiny.txt" {
+			assert.EqualValues(t, 3, digest.Size)
+			assert.EqualValues(t, crc32.ChecksumIEEE([]byte("hi\n")), digest.CRC32)
+		}
+	}
+	assert.EqualValues(t, 2, len(digests))
+}
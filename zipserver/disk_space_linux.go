@@ -0,0 +1,14 @@
+//go:build linux
+
+package zipserver
+
+import "syscall"
+
+// diskFreeBytes is the space left to unprivileged users on the disk holding dir
+func diskFreeBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
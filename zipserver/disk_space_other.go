@@ -0,0 +1,9 @@
+//go:build !linux
+
+package zipserver
+
+import "errors"
+
+func diskFreeBytes(dir string) (uint64, error) {
+	return 0, errors.New("Free disk space is only known on linux")
+}
@@ -0,0 +1,128 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxExistsKeys     = 1000 // per request
+	existsConcurrency = 16   // HEAD requests in flight per request
+)
+
+// headFunc looks up key, failing with ErrObjectNotFound when
+// it doesn't exist
+type headFunc func(ctx context.Context, key string) error
+
+// KeysExist checks in parallel which of keys exist. Any error other than the
+// object not being found fails the whole check.
+func KeysExist(ctx context.Context, keys []string, head headFunc) (map[string]bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var firstErr error
+	exists := make(map[string]bool, len(keys))
+
+	tasks := make(chan string)
+	var wg sync.WaitGroup
+
+	for i := 0; i < existsConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range tasks {
+				err := head(ctx, key)
+
+				mutex.Lock()
+				if err == nil || errors.Is(err, ErrObjectNotFound) {
+					exists[key] = err == nil
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("Failed to check %s: %v", key, err)
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		select {
+		case tasks <- key:
+		case <-ctx.Done():
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return exists, nil
+}
+
+// Checks which keys, POSTed as a JSON array, exist in primary storage or in
+// a target
+func existsHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return badRequestf("Keys must be POSTed")
+	}
+
+	var keys []string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManifestBodySize)).Decode(&keys)
+	if err != nil {
+		return badRequestf("Invalid keys: %s", err.Error())
+	}
+
+	if len(keys) > maxExistsKeys {
+		return badRequestf("Too many keys (%d, max %d)", len(keys), maxExistsKeys)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	var head headFunc
+
+	targetName := r.URL.Query().Get("target")
+	if targetName == "" {
+		storage, err := NewPrimaryStorage(globalConfig)
+		if err != nil {
+			return fmt.Errorf("Failed to create source storage: %v", err)
+		}
+
+		head = func(ctx context.Context, key string) error {
+			_, err := storage.HeadFile(ctx, globalConfig.Bucket, key)
+			return err
+		}
+	} else {
+		storageTargetConfig := globalConfig.GetStorageTargetByName(targetName)
+		if storageTargetConfig == nil {
+			return fmt.Errorf("Invalid target: %s", targetName)
+		}
+
+		storage, err := storageTargetConfig.NewStorageClient()
+		if err != nil {
+			return fmt.Errorf("Failed to create target storage: %v", err)
+		}
+
+		head = func(ctx context.Context, key string) error {
+			_, err := storage.HeadFile(ctx, storageTargetConfig.Bucket, key)
+			return err
+		}
+	}
+
+	exists, err := KeysExist(ctx, keys, head)
+	if err != nil {
+		return writeJSONError(w, "ExistsError", err)
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		Exists  map[string]bool
+	}{true, exists})
+}
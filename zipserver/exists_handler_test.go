@@ -0,0 +1,49 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_KeysExist(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	keys := []string{}
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("builds/%d/index.html", i)
+		keys = append(keys, key)
+		if i%2 == 0 {
+			require.NoError(t, storage.PutFile(ctx, config.Bucket, key, bytes.NewReader([]byte("hi")), "text/html"))
+		}
+	}
+
+	head := func(ctx context.Context, key string) error {
+		_, err := storage.HeadFile(ctx, config.Bucket, key)
+		return err
+	}
+
+	exists, err := KeysExist(ctx, keys, head)
+	require.NoError(t, err)
+	assert.Len(t, exists, 40)
+	assert.True(t, exists["builds/0/index.html"])
+	assert.False(t, exists["builds/1/index.html"])
+
+	failing := func(ctx context.Context, key string) error {
+		if key == "builds/7/index.html" {
+			return fmt.Errorf("connection reset")
+		}
+		return head(ctx, key)
+	}
+
+	_, err = KeysExist(ctx, keys, failing)
+	assert.Error(t, err)
+}
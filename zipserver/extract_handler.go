@@ -3,11 +3,14 @@ package zipserver
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -45,111 +48,424 @@ func loadLimits(params url.Values, config *Config) *ExtractLimits {
 		}
 	}
 
+	{
+		extractionThreads, err := getIntParam(params, "extractionThreads")
+		if err == nil && extractionThreads > 0 {
+			limits.ExtractionThreads = extractionThreads
+		}
+		if config.MaxExtractionThreadsPerJob > 0 && limits.ExtractionThreads > config.MaxExtractionThreadsPerJob {
+			limits.ExtractionThreads = config.MaxExtractionThreadsPerJob
+		}
+	}
+
+	{
+		maxExtractionDuration, err := time.ParseDuration(params.Get("maxExtractionDuration"))
+		if err == nil {
+			limits.MaxExtractionDuration = maxExtractionDuration
+		}
+	}
+
 	return limits
 }
 
+// extractErrorDetails returns the error type reported for a failed
+// extraction, along with any extra fields describing the failure
+func extractErrorDetails(err error) (string, map[string]interface{}) {
+	var durationErr *ExtractionDurationError
+	if errors.As(err, &durationErr) {
+		return "ExtractionDurationError", map[string]interface{}{
+			"FilesCompleted": durationErr.FilesCompleted,
+			"BytesUploaded":  durationErr.BytesUploaded,
+		}
+	}
+
+	var passwordErr *ZipPasswordError
+	if errors.As(err, &passwordErr) {
+		return "ZipPasswordError", map[string]interface{}{
+			"Code": passwordErr.Code,
+		}
+	}
+
+	var failuresErr *UploadFailuresError
+	if errors.As(err, &failuresErr) && len(failuresErr.Failures) > 0 {
+		return "ExtractError", map[string]interface{}{
+			"Failures": failuresErr.Failures,
+		}
+	}
+
+	var prefixErr *PrefixNotEmptyError
+	if errors.As(err, &prefixErr) {
+		return "PrefixNotEmpty", map[string]interface{}{
+			"ExistingKey": prefixErr.Existing,
+		}
+	}
+
+	var malwareErr *MalwareDetectedError
+	if errors.As(err, &malwareErr) {
+		return "MalwareDetected", map[string]interface{}{
+			"Detections": malwareErr.Detections,
+		}
+	}
+
+	var canceledErr *JobCanceledError
+	if errors.As(err, &canceledErr) {
+		return "JobCanceled", nil
+	}
+
+	var diagnosticErr *ZipDiagnosticError
+	if errors.As(err, &diagnosticErr) {
+		return "InvalidZipError", map[string]interface{}{
+			"Code": diagnosticErr.Code,
+		}
+	}
+
+	return "ExtractError", nil
+}
+
+// addMetadataValues adds the callback values of an extracted file's
+// metadata, eg. ExtractedFiles[1][Metadata][video][Width], going by its JSON
+func addMetadataValues(values url.Values, name string, metadata map[string]interface{}) {
+	if len(metadata) == 0 {
+		return
+	}
+	blob, err := json.Marshal(metadata)
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(blob))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return
+	}
+	addJSONValues(values, name, tree)
+}
+
+func addJSONValues(values url.Values, name string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			addJSONValues(values, name+"["+key+"]", child)
+		}
+	case []interface{}:
+		for idx, child := range value {
+			addJSONValues(values, fmt.Sprintf("%s[%d]", name, idx+1), child)
+		}
+	case nil:
+	default:
+		values.Add(name, fmt.Sprintf("%v", value))
+	}
+}
+
+// addDetectionValues adds the files malware was found in to a callback
+func addDetectionValues(values url.Values, detections []MalwareDetection) {
+	for idx, detection := range detections {
+		values.Add(fmt.Sprintf("Detections[%d][Name]", idx+1), detection.Name)
+		values.Add(fmt.Sprintf("Detections[%d][Signature]", idx+1), detection.Signature)
+	}
+}
+
 func extractHandler(w http.ResponseWriter, r *http.Request) error {
 	params := r.URL.Query()
-	key, err := getParam(params, "key")
+
+	prefix, err := getParam(params, "prefix")
 	if err != nil {
 		return err
 	}
 
-	prefix, err := getParam(params, "prefix")
+	if err := checkParamLength(params, "async", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	// async extractions can post their progress as they go
+	progress, err := loadProgressReporter(params, globalConfig, callbackTimeout)
+	if err != nil {
+		return err
+	}
+
+	// the zip and the files of some contents are written to disk
+	if err := checkTempSpace(globalConfig); err != nil {
+		return err
+	}
+
+	// small zips may be POSTed directly instead of being read from storage
+	key := params.Get("key")
+	uploadedZip := ""
+	lockKey := key
+
+	// or fetched from a URL or another bucket
+	source, err := loadExtractSource(params, key)
+	if err != nil {
+		return err
+	}
+
+	if source != nil {
+		lockKey = "source:" + source.String()
+	} else if key == "" && r.Method == http.MethodPost {
+		uploadedZip, err = saveUploadedZip(w, r, globalConfig.MaxExtractUploadSize)
+		if err != nil {
+			return err
+		}
+		lockKey = "upload:" + prefix
+	} else if key == "" {
+		return fmt.Errorf("Missing param key")
+	}
+
+	// the uploaded zip is removed once the request is answered, or by the
+	// async job once it's done
+	removeUpload := true
+	defer func() {
+		if uploadedZip != "" && removeUpload {
+			os.Remove(uploadedZip)
+		}
+	}()
+
+	limits := loadLimits(params, globalConfig)
+
+	htmlTransforms, err := loadHTMLTransforms(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	priority, err := parseJobPriority(params.Get("priority"))
+	if err != nil {
+		return err
+	}
+
+	ignorePatterns, err := loadIgnorePatterns(params)
+	if err != nil {
+		return err
+	}
+
+	contentPolicy, err := loadContentPolicy(params)
 	if err != nil {
 		return err
 	}
 
-	hasLock := extractLockTable.tryLockKey(key)
+	emptyEntryPolicy, err := parseEmptyEntryPolicy(params.Get("empty_entries"))
+	if err != nil {
+		return err
+	}
+
+	contents, err := parseExtractContents(params.Get("contents"))
+	if err != nil {
+		return err
+	}
+
+	// incremental extractions update what's already there
+	incremental := params.Get("mode") == "incremental"
+
+	keyTemplate, err := loadKeyTemplate(params, globalConfig, source)
+	if err != nil {
+		return err
+	}
+	if keyTemplate != nil && incremental {
+		return fmt.Errorf("mode=incremental can't be used with a key template")
+	}
+	requireEmptyPrefix := globalConfig.RequireEmptyExtractPrefix || params.Get("require_empty") == "true"
+
+	opts := ExtractOptions{
+		HTMLTransforms:     htmlTransforms,
+		FileTree:           params.Get("filetree") == "true",
+		IgnorePatterns:     ignorePatterns,
+		ContentPolicy:      contentPolicy,
+		DeniedFiles:        &[]DeniedFile{},
+		EmptyEntryPolicy:   emptyEntryPolicy,
+		RequireEmptyPrefix: requireEmptyPrefix && params.Get("replace") != "true" && !incremental,
+		Password:           params.Get("password"),
+		Incremental:        incremental,
+		Contents:           contents,
+		StripImageMetadata: params.Get("strip_exif") == "true",
+		KeyTemplate:        keyTemplate,
+	}
+
+	if globalConfig.ClamAV.Address != "" {
+		opts.ScanReport = &ScanReport{}
+	}
+
+	if params.Get("mode") == "digest" {
+		if uploadedZip != "" || source != nil {
+			return fmt.Errorf("mode=digest requires a key in the primary bucket")
+		}
+		return digestHandler(w, r, key, prefix, limits, &opts, priority, params.Get("write_manifest") == "true")
+	}
+
+	token, hasLock := extractLockTable.tryLockKey(lockKey)
 	if !hasLock {
 		// already being extracted in another handler, ask consumer to wait
 		return writeJSONMessage(w, struct{ Processing bool }{true})
 	}
 
-	limits := loadLimits(params, globalConfig)
+	maxInlineFiles := globalConfig.MaxInlineExtractedFiles
+	if value, err := getIntParam(params, "max_inline_files"); err == nil {
+		maxInlineFiles = value
+	}
+
+	process := func(ctx context.Context) (*ExtractResult, error) {
+		err := extractScheduler.Acquire(ctx, priority)
+		if err != nil {
+			return nil, err
+		}
+		defer extractScheduler.Release()
+		jobFromContext(ctx).start()
 
-	process := func(ctx context.Context) ([]ExtractedFile, error) {
 		archiver := NewArchiver(globalConfig)
-		files, err := archiver.ExtractZip(ctx, key, prefix, limits)
 
-		return files, err
+		var extracted []ExtractedFile
+		switch {
+		case uploadedZip != "":
+			extracted, err = archiver.ExtractZipFile(ctx, uploadedZip, prefix, limits, opts)
+		case source != nil:
+			extracted, err = archiver.extractFromSource(ctx, source, prefix, limits, opts)
+		default:
+			extracted, err = archiver.ExtractZip(ctx, key, prefix, limits, opts)
+		}
+		touched := []string{path.Join(globalConfig.ExtractPrefix, prefix) + "/"}
+		if key != "" && source == nil {
+			touched = append(touched, key)
+		}
+		recordHistory(ctx, HistoryEntry{Type: "extract", Keys: touched}, err)
+		if err != nil {
+			return nil, err
+		}
+
+		result := archiver.summarizeExtraction(prefix, extracted, maxInlineFiles)
+		result.DeniedFiles = *opts.DeniedFiles
+		result.Scan = opts.ScanReport
+		return result, nil
 	}
 
 	// sync codepath
 	asyncURL := params.Get("async")
 	if asyncURL == "" {
-		defer extractLockTable.releaseKey(key)
+		defer extractLockTable.releaseKey(lockKey, token)
 
 		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
 		defer cancel()
 
-		extracted, err := process(ctx)
+		result, err := process(ctx)
 		if err != nil {
 			globalMetrics.TotalErrors.Add(1)
-			return writeJSONError(w, "ExtractError", err)
+
+			errType, details := extractErrorDetails(err)
+			message := map[string]interface{}{"Type": errType, "Error": err.Error()}
+			for name, value := range details {
+				message[name] = value
+			}
+			return writeJSONMessage(w, message)
 		}
 
+		result.capFiles(globalConfig.MaxSyncResponseFiles)
+
+		recordSyncResponse(caller)
 		return writeJSONMessage(w, struct {
-			Success        bool
-			ExtractedFiles []ExtractedFile
-		}{true, extracted})
+			Success bool
+			*ExtractResult
+		}{true, result})
 	}
 
 	// async codepath
-	go (func() {
-		defer extractLockTable.releaseKey(key)
+	removeUpload = false
+	jobKey := key
+	if source != nil {
+		jobKey = source.String()
+	}
+	job := jobs.newJob("extract", jobKey, prefix, asyncURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
 
-		// This job is expected to outlive the incoming request, so create a detached context.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(globalConfig.JobTimeout))
-		defer cancel()
+	startBackgroundJob(func() {
+		defer extractLockTable.releaseKey(lockKey, token)
+		// kept for every attempt
+		if uploadedZip != "" {
+			defer os.Remove(uploadedZip)
+		}
+
+		// This job is expected to outlive the incoming request, so it runs in
+		// detached contexts, see runJobAttempts
+		ctx := job.detachedContext()
 
-		extracted, err := process(ctx)
+		stopProgress := progress.start(job, prefix)
+		result, err := runJobAttempts(job, process)
+		stopProgress()
+		job.finish(err)
 		resValues := url.Values{}
+		var message interface{}
 
 		if err != nil {
 			errMessage := err.Error()
 
-			if errors.Is(err, context.DeadlineExceeded) {
+			errType, details := extractErrorDetails(err)
+			for name, value := range details {
+				if failures, ok := value.([]UploadFailure); ok {
+					for idx, failure := range failures {
+						resValues.Add(fmt.Sprintf("Failures[%d][Error]", idx+1), failure.Error)
+						resValues.Add(fmt.Sprintf("Failures[%d][Count]", idx+1), fmt.Sprintf("%v", failure.Count))
+						resValues.Add(fmt.Sprintf("Failures[%d][ExampleKeys]", idx+1), strings.Join(failure.ExampleKeys, ","))
+					}
+					continue
+				}
+				if detections, ok := value.([]MalwareDetection); ok {
+					addDetectionValues(resValues, detections)
+					continue
+				}
+				resValues.Add(name, fmt.Sprintf("%v", value))
+			}
+
+			if errType == "ExtractError" && errors.Is(err, context.DeadlineExceeded) {
 				errMessage = "Zip extraction timed out"
 			}
 
 			globalMetrics.TotalErrors.Add(1)
-			resValues.Add("Type", "ExtractError")
+			resValues.Add("Type", errType)
 			resValues.Add("Error", errMessage)
-			log.Print("Extraction failed ", err)
+			logPrint(ctx, "Extraction failed ", err)
+
+			failure := map[string]interface{}{"Type": errType, "Error": errMessage}
+			for name, value := range details {
+				failure[name] = value
+			}
+			message = failure
 		} else {
+			message = struct {
+				Success bool
+				*ExtractResult
+			}{true, result}
+
 			resValues.Add("Success", "true")
-			for idx, extractedFile := range extracted {
+			resValues.Add("TotalExtractedFiles", fmt.Sprintf("%v", result.TotalExtractedFiles))
+			resValues.Add("TotalBytes", fmt.Sprintf("%v", result.TotalBytes))
+			if result.ManifestKey != "" {
+				resValues.Add("ManifestKey", result.ManifestKey)
+			}
+			for idx, denied := range result.DeniedFiles {
+				resValues.Add(fmt.Sprintf("DeniedFiles[%d][Name]", idx+1), denied.Name)
+				resValues.Add(fmt.Sprintf("DeniedFiles[%d][Reason]", idx+1), denied.Reason)
+			}
+			if result.Scan != nil {
+				resValues.Add("ScannedFiles", fmt.Sprintf("%v", result.Scan.ScannedFiles))
+				addDetectionValues(resValues, result.Scan.Detections)
+			}
+			for idx, extractedFile := range result.ExtractedFiles {
 				resValues.Add(fmt.Sprintf("ExtractedFiles[%d][Key])", idx+1),
 					extractedFile.Key)
 				resValues.Add(fmt.Sprintf("ExtractedFiles[%d][Size])", idx+1),
 					fmt.Sprintf("%v", extractedFile.Size))
+				addMetadataValues(resValues, fmt.Sprintf("ExtractedFiles[%d][Metadata]", idx+1), extractedFile.Metadata)
 			}
 		}
 
-		log.Print("Notifying " + asyncURL)
-
-		nofityCtx, nofifyCancel := context.WithTimeout(context.Background(), time.Duration(globalConfig.AsyncNotificationTimeout))
-		defer nofifyCancel()
-
-		outBody := bytes.NewBufferString(resValues.Encode())
-		req, err := http.NewRequestWithContext(nofityCtx, http.MethodPost, asyncURL, outBody)
-		if err != nil {
-			log.Printf("Failed to create callback request: %v", err)
-			return
-		}
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-		asyncResponse, err := http.DefaultClient.Do(req)
-		if err == nil {
-			asyncResponse.Body.Close()
-		} else {
-			log.Print("Failed to deliver callback: " + err.Error())
-		}
-	})()
+		notifyCallback(asyncURL, callbackTimeout, job, resValues, message)
+	})
 
-	return writeJSONMessage(w, struct {
-		Processing bool
-		Async      bool
-	}{true, true})
+	return writeJobStarted(w, job)
 }
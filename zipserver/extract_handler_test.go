@@ -2,7 +2,10 @@ package zipserver
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -21,3 +24,45 @@ func Test_Limits(t *testing.T) {
 	el = loadLimits(values, &defaultConfig)
 	assert.EqualValues(t, el.MaxFileSize, customMaxFileSize)
 }
+
+func Test_ExtractionThreadsLimit(t *testing.T) {
+	config := defaultConfig
+	config.MaxExtractionThreadsPerJob = 16
+
+	el := loadLimits(url.Values{}, &config)
+	assert.Equal(t, config.ExtractionThreads, el.ExtractionThreads)
+
+	el = loadLimits(url.Values{"extractionThreads": {"12"}}, &config)
+	assert.Equal(t, 12, el.ExtractionThreads)
+
+	el = loadLimits(url.Values{"extractionThreads": {"64"}}, &config)
+	assert.Equal(t, 16, el.ExtractionThreads)
+
+	el = loadLimits(url.Values{"extractionThreads": {"0"}}, &config)
+	assert.Equal(t, config.ExtractionThreads, el.ExtractionThreads)
+}
+
+func Test_BadRequestStatus(t *testing.T) {
+	params := url.Values{}
+	params.Set("url", "http://example.com/"+strings.Repeat("a", 100))
+
+	assert.NoError(t, checkParamLength(params, "url", 0))
+	assert.NoError(t, checkParamLength(params, "missing", 10))
+
+	err := checkParamLength(params, "url", 50)
+	assert.Error(t, err)
+
+	handler := wrapErrors(func(w http.ResponseWriter, r *http.Request) error {
+		return err
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slurp", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	handler = wrapErrors(func(w http.ResponseWriter, r *http.Request) error {
+		return fmt.Errorf("something broke")
+	})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slurp", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
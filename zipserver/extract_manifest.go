@@ -0,0 +1,238 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	errors "github.com/go-errors/errors"
+)
+
+// extractManifestName is where the full list of extracted files is written,
+// next to the files themselves
+const extractManifestName = ".zipserver-manifest.json"
+
+// ExtractManifest is written to extractManifestName after every extraction,
+// so extracted files can be verified or cleaned up later
+type ExtractManifest struct {
+	SourceSHA256 string // checksum of the archive the files came from
+	Files        []ExtractedFile
+}
+
+// ExtractResult is what extract responses and callbacks report. When there
+// are more files than the inline limit, ExtractedFiles only holds the first
+// ones, the full list is always in the manifest at ManifestKey.
+type ExtractResult struct {
+	ExtractedFiles      []ExtractedFile
+	TotalExtractedFiles int
+	TotalBytes          uint64 // uncompressed size of every extracted file
+	ManifestKey         string `json:",omitempty"`
+	// set when ExtractedFiles was left out, only the manifest lists them
+	FilesInManifestOnly bool `json:",omitempty"`
+	// the files a content policy kept from being extracted
+	DeniedFiles []DeniedFile `json:",omitempty"`
+	// set when the files were scanned for malware
+	Scan *ScanReport `json:",omitempty"`
+}
+
+// summarizeExtraction builds the result for files extracted to prefix,
+// listing at most maxInline of them (0 means no limit)
+func (a *Archiver) summarizeExtraction(prefix string, files []ExtractedFile, maxInline int) *ExtractResult {
+	result := &ExtractResult{
+		ExtractedFiles:      files,
+		TotalExtractedFiles: len(files),
+		ManifestKey:         path.Join(a.ExtractPrefix, prefix, extractManifestName),
+	}
+
+	for _, file := range files {
+		result.TotalBytes += file.Size
+	}
+
+	if maxInline > 0 && len(files) > maxInline {
+		result.ExtractedFiles = files[:maxInline]
+	}
+
+	return result
+}
+
+// capFiles leaves out ExtractedFiles entirely when there are more than max of
+// them (0 means no limit), they can be read from the manifest instead
+func (r *ExtractResult) capFiles(max int) {
+	if max > 0 && r.TotalExtractedFiles > max {
+		r.ExtractedFiles = nil
+		r.FilesInManifestOnly = true
+	}
+}
+
+// uploadExtractManifest writes the manifest of files extracted from the
+// archive at fname to prefix
+func (a *Archiver) uploadExtractManifest(ctx context.Context, prefix, fname string, files []ExtractedFile, opts *ExtractOptions) (*ResourceSpec, error) {
+	checksum, err := fileSHA256(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := json.Marshal(ExtractManifest{checksum, files})
+	if err != nil {
+		return nil, err
+	}
+
+	resource := &ResourceSpec{
+		key:         path.Join(prefix, extractManifestName),
+		size:        uint64(len(blob)),
+		contentType: "application/json",
+		expiresAt:   opts.ExpiresAt,
+	}
+
+	err = a.Storage.PutFileWithSetup(ctx, a.Bucket, resource.key, bytes.NewReader(blob), resource.setupRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return resource, nil
+}
+
+// fileSHA256 returns the hex encoded sha256 of a local file
+func fileSHA256(fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// PrefixNotEmptyError is returned when extracting to a prefix that already
+// holds files, see ExtractOptions.RequireEmptyPrefix
+type PrefixNotEmptyError struct {
+	Prefix   string
+	Existing string // one of the keys found
+}
+
+func (e *PrefixNotEmptyError) Error() string {
+	return fmt.Sprintf("Prefix %s already contains files (eg. %s), pass replace=true to extract anyway", e.Prefix, e.Existing)
+}
+
+// isZipserverManifest reports whether key is one of the listings zipserver
+// writes next to extracted files, which don't count as prior contents
+func isZipserverManifest(key string) bool {
+	switch path.Base(key) {
+	case extractManifestName, digestManifestName:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkPrefixEmpty fails with a PrefixNotEmptyError if anything other than a
+// manifest is stored under prefix
+func (a *Archiver) checkPrefixEmpty(ctx context.Context, prefix string) error {
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, prefix+"/")
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for _, object := range objects {
+		if !isZipserverManifest(object.Key) {
+			return &PrefixNotEmptyError{prefix, object.Key}
+		}
+	}
+
+	return nil
+}
+
+// loadExtractManifest reads the manifest written by the last extraction to
+// prefix, or returns nil when there's none
+func (a *Archiver) loadExtractManifest(ctx context.Context, prefix string) (*ExtractManifest, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FileGetTimeout))
+	defer cancel()
+
+	key := path.Join(prefix, extractManifestName)
+
+	_, err := a.Storage.HeadFile(ctx, a.Bucket, key)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	reader, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	manifest := &ExtractManifest{}
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s: %s", key, err.Error())
+	}
+
+	return manifest, nil
+}
+
+// reuseExtractedFiles splits the entries about to be extracted to prefix into
+// the ones that must be uploaded and the previously extracted files that can
+// be kept as they are: same CRC32 and same size. Files whose stored size
+// differs from the entry, eg. after HTML transforms, are always uploaded again.
+func reuseExtractedFiles(prefix string, files []*zip.File, previous *ExtractManifest) ([]*zip.File, []ExtractedFile) {
+	if previous == nil {
+		return files, nil
+	}
+
+	previousFiles := make(map[string]ExtractedFile, len(previous.Files))
+	for _, file := range previous.Files {
+		previousFiles[file.Key] = file
+	}
+
+	var upload []*zip.File
+	var reused []ExtractedFile
+
+	for _, file := range files {
+		old, ok := previousFiles[path.Join(prefix, file.Name)]
+		if ok && old.CRC32 != 0 && old.CRC32 == file.CRC32 && old.Size == file.UncompressedSize64 {
+			reused = append(reused, old)
+			continue
+		}
+		upload = append(upload, file)
+	}
+
+	return upload, reused
+}
+
+// deleteRemovedFiles deletes the previously extracted files that aren't in
+// current. Failures are only logged, the new extraction is complete already.
+func (a *Archiver) deleteRemovedFiles(ctx context.Context, previous, current []ExtractedFile) {
+	currentKeys := make(map[string]bool, len(current))
+	for _, file := range current {
+		currentKeys[file.Key] = true
+	}
+
+	for _, file := range previous {
+		if currentKeys[file.Key] {
+			continue
+		}
+
+		err := a.Storage.DeleteFile(ctx, a.Bucket, file.Key)
+		if err != nil {
+			log.Printf("Failed deleting removed file %s: %s", file.Key, err.Error())
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SummarizeExtraction(t *testing.T) {
+	config := emptyConfig()
+	config.ExtractPrefix = "extracted"
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	files := []ExtractedFile{}
+	for i := 0; i < 5; i++ {
+		files = append(files, ExtractedFile{Key: fmt.Sprintf("extracted/game/%d.txt", i), Size: 10})
+	}
+
+	result := archiver.summarizeExtraction("game", files, 0)
+	assert.EqualValues(t, 5, len(result.ExtractedFiles))
+	assert.Equal(t, "extracted/game/"+extractManifestName, result.ManifestKey)
+
+	result = archiver.summarizeExtraction("game", files, 2)
+	assert.EqualValues(t, files[:2], result.ExtractedFiles)
+	assert.EqualValues(t, 5, result.TotalExtractedFiles)
+	assert.EqualValues(t, 50, result.TotalBytes)
+
+	result.capFiles(5)
+	assert.Len(t, result.ExtractedFiles, 2)
+	assert.False(t, result.FilesInManifestOnly)
+
+	result.capFiles(4)
+	assert.Empty(t, result.ExtractedFiles)
+	assert.True(t, result.FilesInManifestOnly)
+	assert.EqualValues(t, 5, result.TotalExtractedFiles)
+	assert.Equal(t, "extracted/game/"+extractManifestName, result.ManifestKey)
+}
+
+func Test_ExtractManifest(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("index.html")
+	require.NoError(t, err)
+	w.Write([]byte("<html></html>"))
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "game.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.EqualValues(t, ExtractedFile{
+		Key:         "game/index.html",
+		Size:        13,
+		MD5:         fmt.Sprintf("%x", md5.Sum([]byte("<html></html>"))),
+		ContentType: "text/html; charset=utf-8",
+		CRC32:       crc32.ChecksumIEEE([]byte("<html></html>")),
+		SHA256:      fmt.Sprintf("%x", sha256.Sum256([]byte("<html></html>"))),
+	}, files[0])
+
+	reader, _, err := storage.GetFile(ctx, config.Bucket, "game/"+extractManifestName)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	blob, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	var manifest ExtractManifest
+	require.NoError(t, json.Unmarshal(blob, &manifest))
+	assert.EqualValues(t, fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())), manifest.SourceSHA256)
+	assert.EqualValues(t, files, manifest.Files)
+}
+
+func Test_RequireEmptyPrefix(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	require.NoError(t, archiver.checkPrefixEmpty(ctx, "games/1"))
+
+	// leftovers from a digest don't count
+	err = storage.PutFile(ctx, config.Bucket, "games/1/"+digestManifestName, strings.NewReader("[]"), "application/json")
+	require.NoError(t, err)
+	require.NoError(t, archiver.checkPrefixEmpty(ctx, "games/1"))
+
+	// neither do files of another prefix sharing the same start
+	err = storage.PutFile(ctx, config.Bucket, "games/10/index.html", strings.NewReader("hi"), "text/html")
+	require.NoError(t, err)
+	require.NoError(t, archiver.checkPrefixEmpty(ctx, "games/1"))
+
+	err = storage.PutFile(ctx, config.Bucket, "games/1/index.html", strings.NewReader("hi"), "text/html")
+	require.NoError(t, err)
+
+	var prefixErr *PrefixNotEmptyError
+	require.ErrorAs(t, archiver.checkPrefixEmpty(ctx, "games/1"), &prefixErr)
+	assert.Equal(t, "games/1/index.html", prefixErr.Existing)
+}
+
+func Test_IncrementalExtract(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	writeZip := func(entries map[string]string) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, contents := range entries {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			w.Write([]byte(contents))
+		}
+		require.NoError(t, zw.Close())
+
+		fname := filepath.Join(t.TempDir(), "game.zip")
+		require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+		return fname
+	}
+
+	readFile := func(key string) string {
+		reader, _, err := storage.GetFile(ctx, config.Bucket, key)
+		require.NoError(t, err)
+		defer reader.Close()
+		blob, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return string(blob)
+	}
+
+	fname := writeZip(map[string]string{
+		"same.txt":    "unchanged",
+		"changed.txt": "old",
+		"removed.txt": "gone soon",
+	})
+	_, err = archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+
+	// tamper with the stored copy to tell whether it gets uploaded again
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "game/same.txt", strings.NewReader("kept"), "text/plain"))
+
+	fname = writeZip(map[string]string{
+		"same.txt":    "unchanged",
+		"changed.txt": "new",
+		"added.txt":   "hello",
+	})
+	files, err := archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{Incremental: true})
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	assert.Equal(t, "kept", readFile("game/same.txt"))
+	assert.Equal(t, "new", readFile("game/changed.txt"))
+	assert.Equal(t, "hello", readFile("game/added.txt"))
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "game/removed.txt")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	var manifest ExtractManifest
+	require.NoError(t, json.Unmarshal([]byte(readFile("game/"+extractManifestName)), &manifest))
+	var keys []string
+	for _, file := range manifest.Files {
+		keys = append(keys, file.Key)
+	}
+	assert.ElementsMatch(t, []string{"game/same.txt", "game/changed.txt", "game/added.txt"}, keys)
+
+	// without a previous manifest, everything is extracted
+	files, err = archiver.ExtractZipFile(ctx, fname, "other", testLimits(), ExtractOptions{Incremental: true})
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+}
@@ -0,0 +1,194 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// extractSource is where /extract reads the archive from when it's not a key
+// in the primary bucket: a URL, fetched like /slurp does, or a key in the
+// bucket of a storage target
+type extractSource struct {
+	URL      string
+	MaxBytes uint64 // largest archive fetched from URL, 0 for no limit
+
+	Target *StorageConfig
+	Key    string
+}
+
+// loadExtractSource returns the source asked for with the url or source
+// params, or nil when the archive is a key in the primary bucket
+func loadExtractSource(params url.Values, key string) (*extractSource, error) {
+	sourceURL := params.Get("url")
+	sourceName := params.Get("source")
+
+	switch {
+	case sourceURL != "" && sourceName != "":
+		return nil, badRequestf("url and source can't be used together")
+	case sourceURL != "":
+		if key != "" {
+			return nil, badRequestf("url and key can't be used together")
+		}
+		if err := checkParamLength(params, "url", globalConfig.MaxSlurpURLLength); err != nil {
+			return nil, err
+		}
+
+		source := &extractSource{URL: sourceURL}
+		if maxBytes := params.Get("max_bytes"); maxBytes != "" {
+			value, err := strconv.ParseUint(maxBytes, 10, 64)
+			if err != nil {
+				return nil, badRequestf("Invalid max_bytes: %v", err)
+			}
+			source.MaxBytes = value
+		}
+		return source, nil
+	case sourceName != "":
+		if key == "" {
+			return nil, fmt.Errorf("Missing param key")
+		}
+
+		target := globalConfig.GetStorageTargetByName(sourceName)
+		if target == nil {
+			return nil, badRequestf("Invalid source: %s", sourceName)
+		}
+
+		expectedBucket := params.Get("bucket")
+		if expectedBucket != "" && expectedBucket != target.Bucket {
+			return nil, badRequestf("Expected bucket does not match source bucket: %s != %s", expectedBucket, target.Bucket)
+		}
+		return &extractSource{Target: target, Key: key}, nil
+	}
+
+	return nil, nil
+}
+
+// String names the archive, for locks, jobs and logs
+func (s *extractSource) String() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return s.Target.Name + ":" + s.Key
+}
+
+// fetch stores the archive in a file in dir
+func (s *extractSource) fetch(ctx context.Context, dir string) (string, error) {
+	ctx, span := startSpan(ctx, "fetchSource", "zipserver.source", s.String())
+
+	var fname string
+	var err error
+	if s.URL != "" {
+		fname = path.Join(dir, fetchZipFilename("url", s.URL))
+		err = s.fetchURL(ctx, fname)
+	} else {
+		fname = path.Join(dir, fetchZipFilename(s.Target.Bucket, s.Key))
+		err = s.fetchTarget(ctx, fname)
+	}
+	span.finish(err)
+
+	if err != nil {
+		os.Remove(fname)
+		return "", err
+	}
+	return fname, nil
+}
+
+func (s *extractSource) fetchURL(ctx context.Context, fname string) error {
+	getCtx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.FileGetTimeout))
+	defer cancel()
+
+	logPrint(ctx, "Fetching URL: ", s.URL)
+
+	req, err := http.NewRequestWithContext(getCtx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	setOutboundHeaders(req, jobFromContext(ctx).jobID())
+
+	res, err := outboundHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Failed to fetch file: %d", res.StatusCode)
+	}
+
+	body := io.Reader(res.Body)
+	if s.MaxBytes > 0 {
+		if res.ContentLength > 0 && uint64(res.ContentLength) > s.MaxBytes {
+			return fmt.Errorf("Content-Length is greater than max bytes (%d > %d)",
+				res.ContentLength, s.MaxBytes)
+		}
+
+		var bytesRead uint64
+		body = limitedReader(body, s.MaxBytes, &bytesRead)
+	}
+
+	return writeSourceFile(fname, body)
+}
+
+func (s *extractSource) fetchTarget(ctx context.Context, fname string) error {
+	storage, err := s.Target.NewStorageClient()
+	if err != nil {
+		return fmt.Errorf("Failed to create source storage: %v", err)
+	}
+
+	getCtx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.FileGetTimeout))
+	defer cancel()
+
+	logPrint(ctx, "Fetching ", s.Key, " from ", s.Target.Name)
+
+	reader, _, err := storage.GetFile(getCtx, s.Target.Bucket, s.Key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return writeSourceFile(fname, reader)
+}
+
+func writeSourceFile(fname string, reader io.Reader) error {
+	dest, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dest, reader)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// extractFromSource fetches the archive from source, then extracts it to
+// prefix like ExtractZip does.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) extractFromSource(
+	ctx context.Context,
+	source *extractSource,
+	prefix string,
+	limits *ExtractLimits,
+	opts ExtractOptions,
+) ([]ExtractedFile, error) {
+	ctx, cleanup, err := a.withTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fname, err := source.fetch(ctx, a.tempDir(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return a.ExtractZipFile(ctx, fname, prefix, limits, opts)
+}
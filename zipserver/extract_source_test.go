@@ -0,0 +1,93 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExtractFromURL(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("index.html")
+	require.NoError(t, err)
+	w.Write([]byte("<html></html>"))
+	require.NoError(t, zw.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/game.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	config := emptyConfig()
+	globalConfig = config
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	source, err := loadExtractSource(url.Values{"url": {server.URL + "/game.zip"}}, "")
+	require.NoError(t, err)
+
+	files, err := archiver.extractFromSource(ctx, source, "games/1", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "games/1/index.html", files[0].Key)
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "games/1/index.html")
+	assert.NoError(t, err)
+
+	source, err = loadExtractSource(url.Values{"url": {server.URL + "/game.zip"}, "max_bytes": {"10"}}, "")
+	require.NoError(t, err)
+	_, err = archiver.extractFromSource(ctx, source, "games/2", testLimits(), ExtractOptions{})
+	assert.ErrorContains(t, err, "max bytes")
+
+	source, err = loadExtractSource(url.Values{"url": {server.URL + "/missing.zip"}}, "")
+	require.NoError(t, err)
+	_, err = archiver.extractFromSource(ctx, source, "games/3", testLimits(), ExtractOptions{})
+	assert.ErrorContains(t, err, "404")
+}
+
+func Test_LoadExtractSource(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+	globalConfig.StorageTargets = []StorageConfig{{Name: "uploads", Type: S3, Bucket: "uploads-bucket", S3Region: "us-east-1"}}
+
+	source, err := loadExtractSource(url.Values{}, "zips/1.zip")
+	require.NoError(t, err)
+	assert.Nil(t, source, "read from the primary bucket")
+
+	source, err = loadExtractSource(url.Values{"source": {"uploads"}, "bucket": {"uploads-bucket"}}, "zips/1.zip")
+	require.NoError(t, err)
+	assert.Equal(t, "uploads-bucket", source.Target.Bucket)
+	assert.Equal(t, "uploads:zips/1.zip", source.String())
+
+	for _, params := range []url.Values{
+		{"source": {"uploads"}, "bucket": {"other-bucket"}},
+		{"source": {"elsewhere"}},
+		{"source": {"uploads"}, "url": {"https://example.com/1.zip"}},
+		{"url": {"https://example.com/1.zip"}},
+	} {
+		_, err := loadExtractSource(params, "zips/1.zip")
+		assert.Error(t, err, params.Encode())
+	}
+
+	_, err = loadExtractSource(url.Values{"source": {"uploads"}}, "")
+	assert.Error(t, err, "source needs a key")
+}
@@ -0,0 +1,94 @@
+package zipserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// consecutive failed puts after which a target with a Fallback is skipped
+	failoverThreshold = 3
+	// how long a failing target is skipped before it's tried again
+	failoverCooldown = time.Minute
+)
+
+// targetPutError is a failure writing to a storage target
+type targetPutError struct {
+	Target string
+	Err    error
+}
+
+func (e *targetPutError) Error() string {
+	return fmt.Sprintf("Failed writing to target %s: %v", e.Target, e.Err)
+}
+
+func (e *targetPutError) Unwrap() error {
+	return e.Err
+}
+
+// targetHealthTable counts consecutive failed puts per storage target
+type targetHealthTable struct {
+	sync.Mutex
+	failures    map[string]int
+	lastFailure map[string]time.Time
+}
+
+var targetHealth = &targetHealthTable{
+	failures:    map[string]int{},
+	lastFailure: map[string]time.Time{},
+}
+
+func (t *targetHealthTable) record(name string, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if err == nil {
+		delete(t.failures, name)
+		delete(t.lastFailure, name)
+		return
+	}
+
+	t.failures[name]++
+	t.lastFailure[name] = time.Now()
+}
+
+// isFailing is true when puts to the target keep failing, until the cooldown
+// has passed and it's worth trying again
+func (t *targetHealthTable) isFailing(name string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.failures[name] >= failoverThreshold &&
+		time.Since(t.lastFailure[name]) < failoverCooldown
+}
+
+// fallbackTarget returns the target to write key to when target fails, or nil
+// if it has none or key isn't allowed there
+func (c *Config) fallbackTarget(target *StorageConfig, key string) *StorageConfig {
+	if target.Fallback == "" {
+		return nil
+	}
+
+	fallback := c.GetStorageTargetByName(target.Fallback)
+	if fallback == nil || fallback.checkAllowedKey(key) != nil {
+		return nil
+	}
+	return fallback
+}
+
+// validateFallbackTargets checks that every Fallback names another target
+func validateFallbackTargets(config *Config) error {
+	for _, target := range config.StorageTargets {
+		if target.Fallback == "" {
+			continue
+		}
+		if target.Fallback == target.Name {
+			return fmt.Errorf("Config error: [Storage %s] can't be its own fallback", target.Name)
+		}
+		if config.GetStorageTargetByName(target.Fallback) == nil {
+			return fmt.Errorf("Config error: [Storage %s] unknown fallback target %s", target.Name, target.Fallback)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package zipserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TargetHealth(t *testing.T) {
+	health := &targetHealthTable{
+		failures:    map[string]int{},
+		lastFailure: map[string]time.Time{},
+	}
+
+	for i := 0; i < failoverThreshold-1; i++ {
+		health.record("s3", fmt.Errorf("503 Slow Down"))
+	}
+	assert.False(t, health.isFailing("s3"))
+
+	health.record("s3", fmt.Errorf("503 Slow Down"))
+	assert.True(t, health.isFailing("s3"))
+
+	health.lastFailure["s3"] = time.Now().Add(-2 * failoverCooldown)
+	assert.False(t, health.isFailing("s3"), "failing target should be retried after the cooldown")
+
+	health.record("s3", fmt.Errorf("503 Slow Down"))
+	assert.True(t, health.isFailing("s3"))
+	health.record("s3", nil)
+	assert.False(t, health.isFailing("s3"))
+}
+
+func Test_FallbackTarget(t *testing.T) {
+	config := &Config{
+		StorageTargets: []StorageConfig{
+			{Name: "us", Fallback: "eu"},
+			{Name: "eu", AllowedPrefixes: []string{"games/"}},
+			{Name: "alone"},
+		},
+	}
+	assert.NoError(t, validateFallbackTargets(config))
+
+	us := config.GetStorageTargetByName("us")
+	assert.Equal(t, "eu", config.fallbackTarget(us, "games/1/index.html").Name)
+	assert.Nil(t, config.fallbackTarget(us, "other/file"), "fallback must allow the key")
+	assert.Nil(t, config.fallbackTarget(config.GetStorageTargetByName("alone"), "games/1"))
+
+	config.StorageTargets[2].Fallback = "nowhere"
+	assert.Error(t, validateFallbackTargets(config))
+
+	config.StorageTargets[2].Fallback = "alone"
+	assert.Error(t, validateFallbackTargets(config))
+}
@@ -0,0 +1,110 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// parseFetchRange reads offset and length from the request, defaulting to
+// the first MaxFetchSize bytes and refusing anything larger
+func parseFetchRange(params url.Values, maxSize uint64) (int64, int64, error) {
+	var offset, length int64
+
+	if offsetStr := params.Get("offset"); offsetStr != "" {
+		parsed, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset: %s", offsetStr)
+		}
+		offset = parsed
+	}
+
+	length = int64(maxSize)
+	if lengthStr := params.Get("length"); lengthStr != "" {
+		parsed, err := strconv.ParseInt(lengthStr, 10, 64)
+		if err != nil || parsed <= 0 {
+			return 0, 0, fmt.Errorf("Invalid length: %s", lengthStr)
+		}
+
+		if uint64(parsed) > maxSize {
+			return 0, 0, fmt.Errorf("Requested length too large (%d > %d)", parsed, maxSize)
+		}
+		length = parsed
+	}
+
+	return offset, length, nil
+}
+
+// Streams a byte range of an object from primary storage, or from a named
+// target, so tooling can peek at file headers without bucket credentials
+func fetchHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	key, err := getParam(params, "key")
+	if err != nil {
+		return err
+	}
+
+	offset, length, err := parseFetchRange(params, globalConfig.MaxFetchSize)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.FileGetTimeout))
+	defer cancel()
+
+	var reader io.ReadCloser
+	var headers http.Header
+
+	targetName := params.Get("target")
+	if targetName == "" {
+		storage, err := NewPrimaryStorage(globalConfig)
+		if err != nil {
+			return fmt.Errorf("Failed to create source storage: %v", err)
+		}
+
+		reader, headers, err = storage.GetFileRange(ctx, globalConfig.Bucket, key, offset, length)
+		if err != nil {
+			return err
+		}
+	} else {
+		storageTargetConfig := globalConfig.GetStorageTargetByName(targetName)
+		if storageTargetConfig == nil {
+			return fmt.Errorf("Invalid target: %s", targetName)
+		}
+
+		storage, err := storageTargetConfig.NewStorageClient()
+		if err != nil {
+			return fmt.Errorf("Failed to create target storage: %v", err)
+		}
+
+		reader, headers, err = storage.GetFileRange(ctx, storageTargetConfig.Bucket, key, offset, length)
+		if err != nil {
+			return err
+		}
+	}
+	defer reader.Close()
+
+	contentType := headers.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if contentRange := headers.Get("Content-Range"); contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+
+	_, err = io.Copy(w, io.LimitReader(reader, length))
+	if err != nil {
+		// headers are already sent, all we can do is log
+		log.Print("Failed streaming fetch: ", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseFetchRange(t *testing.T) {
+	offset, length, err := parseFetchRange(url.Values{}, 1024)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, offset)
+	assert.EqualValues(t, 1024, length)
+
+	offset, length, err = parseFetchRange(url.Values{"offset": {"10"}, "length": {"4"}}, 1024)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 10, offset)
+	assert.EqualValues(t, 4, length)
+
+	_, _, err = parseFetchRange(url.Values{"length": {"2048"}}, 1024)
+	assert.Error(t, err)
+
+	_, _, err = parseFetchRange(url.Values{"offset": {"-1"}}, 1024)
+	assert.Error(t, err)
+}
+
+func Test_MemStorageGetFileRange(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	err = storage.PutFile(ctx, "bucket", "game.wasm", strings.NewReader("\x00asm\x01\x00\x00\x00"), "application/wasm")
+	assert.NoError(t, err)
+
+	reader, _, err := storage.GetFileRange(ctx, "bucket", "game.wasm", 0, 4)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "\x00asm", string(data))
+
+	reader, _, err = storage.GetFileRange(ctx, "bucket", "game.wasm", 6, 100)
+	assert.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "\x00\x00", string(data))
+}
@@ -0,0 +1,105 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+)
+
+// fileTreeName is the name of the file tree artifact, written at the root of
+// the extraction prefix
+const fileTreeName = "filetree.json"
+
+// FileTreeNode is an entry of the hierarchical listing written to filetree.json.
+// Directories have children, files have a content type.
+type FileTreeNode struct {
+	Name        string
+	Type        string // "file" or "directory"
+	Size        uint64
+	ContentType string          `json:",omitempty"`
+	Children    []*FileTreeNode `json:",omitempty"`
+}
+
+type fileTreeEntry struct {
+	Path        string
+	Size        uint64
+	ContentType string
+}
+
+// buildFileTree turns a flat list of files (paths relative to the tree root)
+// into a tree, directory sizes are the sum of everything they contain
+func buildFileTree(entries []fileTreeEntry) *FileTreeNode {
+	root := &FileTreeNode{Type: "directory"}
+
+	for _, entry := range entries {
+		parts := strings.Split(entry.Path, "/")
+		node := root
+
+		for _, dirName := range parts[:len(parts)-1] {
+			node.Size += entry.Size
+			node = node.childDirectory(dirName)
+		}
+
+		node.Size += entry.Size
+		node.Children = append(node.Children, &FileTreeNode{
+			Name:        parts[len(parts)-1],
+			Type:        "file",
+			Size:        entry.Size,
+			ContentType: entry.ContentType,
+		})
+	}
+
+	root.sortChildren()
+	return root
+}
+
+func (n *FileTreeNode) childDirectory(name string) *FileTreeNode {
+	for _, child := range n.Children {
+		if child.Type == "directory" && child.Name == name {
+			return child
+		}
+	}
+
+	child := &FileTreeNode{Name: name, Type: "directory"}
+	n.Children = append(n.Children, child)
+	return child
+}
+
+func (n *FileTreeNode) sortChildren() {
+	sort.Slice(n.Children, func(i, j int) bool {
+		return n.Children[i].Name < n.Children[j].Name
+	})
+
+	for _, child := range n.Children {
+		child.sortChildren()
+	}
+}
+
+// uploads filetree.json describing entries under prefix
+func (a *Archiver) uploadFileTree(ctx context.Context, prefix string, entries []fileTreeEntry, opts *ExtractOptions) (*ResourceSpec, error) {
+	for i := range entries {
+		entries[i].Path = strings.TrimPrefix(entries[i].Path, prefix+"/")
+	}
+
+	blob, err := json.Marshal(buildFileTree(entries))
+	if err != nil {
+		return nil, err
+	}
+
+	resource := &ResourceSpec{
+		key:         path.Join(prefix, fileTreeName),
+		size:        uint64(len(blob)),
+		contentType: "application/json",
+		expiresAt:   opts.ExpiresAt,
+	}
+
+	err = a.Storage.PutFileWithSetup(ctx, a.Bucket, resource.key, bytes.NewReader(blob), resource.setupRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return resource, nil
+}
@@ -0,0 +1,34 @@
+package zipserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BuildFileTree(t *testing.T) {
+	tree := buildFileTree([]fileTreeEntry{
+		{"index.html", 10, "text/html"},
+		{"data/level2.bin", 200, "application/octet-stream"},
+		{"data/level1.bin", 100, "application/octet-stream"},
+		{"data/music/theme.ogg", 1000, "audio/ogg"},
+	})
+
+	assert.EqualValues(t, "directory", tree.Type)
+	assert.EqualValues(t, 1310, tree.Size)
+	assert.EqualValues(t, 2, len(tree.Children))
+
+	data := tree.Children[0]
+	assert.EqualValues(t, "data", data.Name)
+	assert.EqualValues(t, "directory", data.Type)
+	assert.EqualValues(t, 1300, data.Size)
+	assert.EqualValues(t, "level1.bin", data.Children[0].Name)
+	assert.EqualValues(t, "level2.bin", data.Children[1].Name)
+	assert.EqualValues(t, "music", data.Children[2].Name)
+	assert.EqualValues(t, 1000, data.Children[2].Size)
+
+	index := tree.Children[1]
+	assert.EqualValues(t, "index.html", index.Name)
+	assert.EqualValues(t, "file", index.Type)
+	assert.EqualValues(t, "text/html", index.ContentType)
+}
@@ -0,0 +1,338 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GcsSdkStorage is a Storage backed by the official GCS client library.
+// Unlike GcsStorage, uploads are resumable: they're sent in chunks, and a
+// chunk that fails (eg. the connection drops) is retried instead of failing
+// the whole file.
+type GcsSdkStorage struct {
+	client *storage.Client
+	// writes and deletes under these are refused, see checkProtectedKey
+	protectedPrefixes []string
+}
+
+// interface guard
+var _ Storage = (*GcsSdkStorage)(nil)
+
+// NewGcsSdkStorage returns a new GCS storage using the client library, with
+// the same credentials as GcsStorage
+func NewGcsSdkStorage(config *Config) (*GcsSdkStorage, error) {
+	pemBytes, err := os.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtConfig := &jwt.Config{
+		Email:      config.ClientEmail,
+		PrivateKey: pemBytes,
+		TokenURL:   google.JWTTokenURL,
+		Scopes:     []string{scope},
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(gcsHTTPClient(jwtConfig)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GcsSdkStorage{
+		client:            client,
+		protectedPrefixes: config.ProtectedPrefixes,
+	}, nil
+}
+
+func (c *GcsSdkStorage) object(bucket, key string) *storage.ObjectHandle {
+	// every write is a full replacement of the object, so retrying is safe
+	return c.client.Bucket(bucket).Object(key).
+		Retryer(storage.WithPolicy(storage.RetryAlways)).
+		ReadCompressed(true)
+}
+
+// GetFile returns a reader for the contents of resource at bucket/key
+func (c *GcsSdkStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, http.Header, error) {
+	attrs, err := c.object(bucket, key).Attrs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// pin the generation so the contents match the headers
+	reader, err := c.object(bucket, key).Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return metricsReadCloser{reader, &globalMetrics.TotalBytesDownloaded}, gcsAttrsHeaders(attrs), nil
+}
+
+// GetFileRange returns a reader for length bytes of bucket/key starting at offset
+func (c *GcsSdkStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, http.Header, error) {
+	reader, err := c.object(bucket, key).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", reader.Attrs.ContentType)
+	if reader.Attrs.ContentEncoding != "" {
+		headers.Set("Content-Encoding", reader.Attrs.ContentEncoding)
+	}
+	headers.Set("Content-Length", strconv.FormatInt(reader.Remain(), 10))
+
+	return metricsReadCloser{reader, &globalMetrics.TotalBytesDownloaded}, headers, nil
+}
+
+// HeadFile returns the headers of bucket/key without its contents
+func (c *GcsSdkStorage) HeadFile(ctx context.Context, bucket, key string) (http.Header, error) {
+	attrs, err := c.object(bucket, key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return gcsAttrsHeaders(attrs), nil
+}
+
+// PutFile uploads a file to GCS simply
+func (c *GcsSdkStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
+	return c.PutFileWithSetup(ctx, bucket, key, contents, func(req *http.Request) error {
+		req.Header.Add("Content-Type", mimeType)
+		req.Header.Add("x-goog-acl", "public-read")
+		return nil
+	})
+}
+
+// PutFileWithSetup uploads a file to GCS, setup sets headers as it would for
+// GcsStorage and they're turned into object attributes
+func (c *GcsSdkStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	if err := checkProtectedKey(c.protectedPrefixes, key); err != nil {
+		return err
+	}
+
+	attrs, err := setupObjectAttrs(setup)
+	if err != nil {
+		return err
+	}
+
+	// canceling the writer's context aborts the upload, closing it would
+	// commit what was written so far as a truncated object
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := c.object(bucket, key).NewWriter(writeCtx)
+	writer.ObjectAttrs = *attrs
+	writer.ObjectAttrs.Name = key
+
+	_, err = io.Copy(writer, metricsReader(contents, &globalMetrics.TotalBytesUploaded))
+	if err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// DeleteFile removes a file from a GCS bucket
+func (c *GcsSdkStorage) DeleteFile(ctx context.Context, bucket, key string) error {
+	if err := checkProtectedKey(c.protectedPrefixes, key); err != nil {
+		return err
+	}
+
+	err := c.client.Bucket(bucket).Object(key).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	globalMetrics.TotalDeletedFiles.Add(1)
+	return nil
+}
+
+// CopyFile performs a server-side copy of bucket/srcKey to bucket/destKey,
+// preserving the source object's metadata
+func (c *GcsSdkStorage) CopyFile(ctx context.Context, bucket, srcKey, destKey string) error {
+	if err := checkProtectedKey(c.protectedPrefixes, destKey); err != nil {
+		return err
+	}
+
+	copier := c.object(bucket, destKey).CopierFrom(c.object(bucket, srcKey))
+	// ACLs are not carried over by copies
+	copier.PredefinedACL = "publicRead"
+
+	_, err := copier.Run(ctx)
+	return err
+}
+
+// ListObjects returns every object in bucket whose key starts with prefix
+func (c *GcsSdkStorage) ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+
+	it := c.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:  attrs.Name,
+			Size: uint64(attrs.Size),
+			MD5:  hex.EncodeToString(attrs.MD5),
+		})
+	}
+
+	return objects, nil
+}
+
+// ListObjectsPage lists a page of the objects in bucket whose key starts with
+// prefix, see Storage
+func (c *GcsSdkStorage) ListObjectsPage(ctx context.Context, bucket, prefix, after string, limit int) ([]ObjectInfo, string, error) {
+	query := &storage.Query{Prefix: prefix}
+	if after != "" {
+		// StartOffset is inclusive, this is the first key past after
+		query.StartOffset = after + "\x00"
+	}
+
+	it := c.client.Bucket(bucket).Objects(ctx, query)
+	// one more than the page to know whether there are more
+	it.PageInfo().MaxSize = limit + 1
+
+	objects := []ObjectInfo{}
+	for len(objects) <= limit {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:  attrs.Name,
+			Size: uint64(attrs.Size),
+			MD5:  hex.EncodeToString(attrs.MD5),
+		})
+	}
+
+	objects = objects[:limit]
+	return objects, objects[limit-1].Key, nil
+}
+
+// ComposeFile concatenates componentKeys into bucket/key server-side, setup
+// sets the headers (content type, ACL...) of the resulting object
+func (c *GcsSdkStorage) ComposeFile(ctx context.Context, bucket, key string, componentKeys []string, setup StorageSetupFunc) error {
+	if err := checkProtectedKey(c.protectedPrefixes, key); err != nil {
+		return err
+	}
+
+	attrs, err := setupObjectAttrs(setup)
+	if err != nil {
+		return err
+	}
+
+	components := make([]*storage.ObjectHandle, 0, len(componentKeys))
+	for _, componentKey := range componentKeys {
+		components = append(components, c.object(bucket, componentKey))
+	}
+
+	composer := c.object(bucket, key).ComposerFrom(components...)
+	composer.ObjectAttrs = *attrs
+
+	_, err = composer.Run(ctx)
+	return err
+}
+
+// setupObjectAttrs runs a StorageSetupFunc against a dummy request and
+// converts the headers it sets to object attributes
+func setupObjectAttrs(setup StorageSetupFunc) (*storage.ObjectAttrs, error) {
+	req, err := http.NewRequest(http.MethodPut, "http://127.0.0.1/dummy", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if setup != nil {
+		err = setup(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	attrs := &storage.ObjectAttrs{
+		ContentType:        req.Header.Get("Content-Type"),
+		ContentEncoding:    req.Header.Get("Content-Encoding"),
+		ContentDisposition: req.Header.Get("Content-Disposition"),
+		CacheControl:       req.Header.Get("Cache-Control"),
+		PredefinedACL:      predefinedACL(req.Header.Get("x-goog-acl")),
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-goog-meta-") && len(values) > 0 {
+			if attrs.Metadata == nil {
+				attrs.Metadata = map[string]string{}
+			}
+			attrs.Metadata[strings.TrimPrefix(name, "x-goog-meta-")] = values[0]
+		}
+	}
+
+	return attrs, nil
+}
+
+// predefinedACL converts an XML API canned ACL (public-read) to its JSON API
+// name (publicRead)
+func predefinedACL(xmlACL string) string {
+	parts := strings.Split(xmlACL, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// gcsAttrsHeaders describes an object with the headers GcsStorage would return
+func gcsAttrsHeaders(attrs *storage.ObjectAttrs) http.Header {
+	headers := http.Header{}
+	headers.Set("Content-Type", attrs.ContentType)
+	headers.Set("Content-Length", fmt.Sprintf("%d", attrs.Size))
+
+	if attrs.ContentEncoding != "" {
+		headers.Set("Content-Encoding", attrs.ContentEncoding)
+	}
+	if len(attrs.MD5) > 0 {
+		headers.Set("x-goog-hash", "md5="+base64.StdEncoding.EncodeToString(attrs.MD5))
+	}
+	if attrs.ContentDisposition != "" {
+		headers.Set("Content-Disposition", attrs.ContentDisposition)
+	}
+	if attrs.CacheControl != "" {
+		headers.Set("Cache-Control", attrs.CacheControl)
+	}
+	for name, value := range attrs.Metadata {
+		headers.Set("x-goog-meta-"+name, value)
+	}
+
+	return headers
+}
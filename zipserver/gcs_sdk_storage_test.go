@@ -0,0 +1,37 @@
+package zipserver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SetupObjectAttrs(t *testing.T) {
+	resource := &ResourceSpec{
+		key:             "games/1/index.html",
+		contentType:     "text/html",
+		contentEncoding: "gzip",
+		expiresAt:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	attrs, err := setupObjectAttrs(resource.setupRequest)
+	require.NoError(t, err)
+	assert.Equal(t, "text/html", attrs.ContentType)
+	assert.Equal(t, "gzip", attrs.ContentEncoding)
+	assert.Equal(t, "publicRead", attrs.PredefinedACL)
+	assert.Equal(t, "2030-01-02T03:04:05Z", attrs.Metadata["zipserver-expires"])
+
+	attrs, err = setupObjectAttrs(func(req *http.Request) error {
+		req.Header.Add("x-goog-acl", "bucket-owner-full-control")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "bucketOwnerFullControl", attrs.PredefinedACL)
+	assert.Nil(t, attrs.Metadata)
+
+	assert.Equal(t, "", predefinedACL(""))
+	assert.Equal(t, "private", predefinedACL("private"))
+}
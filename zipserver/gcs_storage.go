@@ -1,14 +1,19 @@
 package zipserver
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 )
@@ -25,7 +30,11 @@ var (
 //	storage := NewStorageClient(config)
 //	readCloser, err = storage.GetFile("my_bucket", "my_file")
 type GcsStorage struct {
-	jwtConfig *jwt.Config
+	// authenticated client over the shared storage transport, reused for
+	// every request so the token is only fetched once
+	client *http.Client
+	// writes and deletes under these are refused, see checkProtectedKey
+	protectedPrefixes []string
 }
 
 // interface guard
@@ -47,12 +56,20 @@ func NewGcsStorage(config *Config) (*GcsStorage, error) {
 	}
 
 	return &GcsStorage{
-		jwtConfig: jwtConfig,
+		client:            gcsHTTPClient(jwtConfig),
+		protectedPrefixes: config.ProtectedPrefixes,
 	}, nil
 }
 
+// gcsHTTPClient returns a client authenticated with jwtConfig that sends
+// requests through the shared storage transport
+func gcsHTTPClient(jwtConfig *jwt.Config) *http.Client {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, storageHTTPClient())
+	return oauth2.NewClient(ctx, jwtConfig.TokenSource(ctx))
+}
+
 func (c *GcsStorage) httpClient() (*http.Client, error) {
-	return c.jwtConfig.Client(context.Background()), nil
+	return c.client, nil
 }
 
 func (c *GcsStorage) url(bucket, key, logName string) string {
@@ -90,6 +107,65 @@ func (c *GcsStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadCl
 	return trackedBody, res.Header, nil
 }
 
+// GetFileRange returns a reader for length bytes of bucket/key starting at offset
+func (c *GcsStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, http.Header, error) {
+	httpClient, err := c.httpClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	url := c.url(bucket, key, "GET")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Range", rangeHeader(offset, length))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 206 {
+		res.Body.Close()
+		return nil, res.Header, errors.New(res.Status + " " + url)
+	}
+
+	trackedBody := metricsReadCloser{res.Body, &globalMetrics.TotalBytesDownloaded}
+
+	return trackedBody, res.Header, nil
+}
+
+// HeadFile returns the headers (including metadata) of the resource at bucket/key
+func (c *GcsStorage) HeadFile(ctx context.Context, bucket, key string) (http.Header, error) {
+	httpClient, err := c.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	url := c.url(bucket, key, "HEAD")
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, url)
+	}
+
+	if res.StatusCode != 200 {
+		return nil, &StorageStatusError{res.StatusCode, res.Status + " " + url}
+	}
+
+	return res.Header, nil
+}
+
 // PutFile uploads a file to GCS simply
 func (c *GcsStorage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error {
 	return c.PutFileWithSetup(ctx, bucket, key, contents, func(req *http.Request) error {
@@ -101,6 +177,10 @@ func (c *GcsStorage) PutFile(ctx context.Context, bucket, key string, contents i
 
 // PutFileWithSetup uploads a file to GCS letting the user set up the request first
 func (c *GcsStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	if err := checkProtectedKey(c.protectedPrefixes, key); err != nil {
+		return err
+	}
+
 	httpClient, err := c.httpClient()
 	if err != nil {
 		return err
@@ -130,7 +210,7 @@ func (c *GcsStorage) PutFileWithSetup(ctx context.Context, bucket, key string, c
 		if err != nil {
 			return err
 		}
-		return fmt.Errorf("%s: %s", res.Status, body)
+		return &StorageStatusError{res.StatusCode, fmt.Sprintf("%s: %s", res.Status, body)}
 	}
 
 	return nil
@@ -138,6 +218,10 @@ func (c *GcsStorage) PutFileWithSetup(ctx context.Context, bucket, key string, c
 
 // DeleteFile removes a file from a GCS bucket
 func (c *GcsStorage) DeleteFile(ctx context.Context, bucket, key string) error {
+	if err := checkProtectedKey(c.protectedPrefixes, key); err != nil {
+		return err
+	}
+
 	httpClient, err := c.httpClient()
 	if err != nil {
 		return err
@@ -158,5 +242,144 @@ func (c *GcsStorage) DeleteFile(ctx context.Context, bucket, key string) error {
 		return errors.New(res.Status + " " + url)
 	}
 
+	globalMetrics.TotalDeletedFiles.Add(1)
 	return nil
 }
+
+// CopyFile performs a server-side copy of bucket/srcKey to bucket/destKey,
+// preserving the source object's metadata
+func (c *GcsStorage) CopyFile(ctx context.Context, bucket, srcKey, destKey string) error {
+	return c.PutFileWithSetup(ctx, bucket, destKey, http.NoBody, func(req *http.Request) error {
+		req.Header.Set("x-goog-copy-source", "/"+bucket+"/"+srcKey)
+		req.Header.Set("x-goog-metadata-directive", "COPY")
+		// ACLs are not carried over by copies
+		req.Header.Set("x-goog-acl", "public-read")
+		return nil
+	})
+}
+
+type gcsListBucketResult struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key  string
+		Size uint64
+		ETag string
+	}
+}
+
+// ListObjects returns every object in bucket whose key starts with prefix
+func (c *GcsStorage) ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	marker := ""
+
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		result, err := c.listBucket(ctx, bucket, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range result.Contents {
+			objects = append(objects, ObjectInfo{entry.Key, entry.Size, etagMD5(entry.ETag)})
+		}
+
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return objects, nil
+		}
+
+		marker = result.NextMarker
+		if marker == "" {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+}
+
+// ListObjectsPage lists a page of the objects in bucket whose key starts with
+// prefix, see Storage
+func (c *GcsStorage) ListObjectsPage(ctx context.Context, bucket, prefix, after string, limit int) ([]ObjectInfo, string, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("max-keys", strconv.Itoa(limit))
+	if after != "" {
+		query.Set("marker", after)
+	}
+
+	result, err := c.listBucket(ctx, bucket, query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	objects := []ObjectInfo{}
+	for _, entry := range result.Contents {
+		objects = append(objects, ObjectInfo{entry.Key, entry.Size, etagMD5(entry.ETag)})
+	}
+
+	next := ""
+	if result.IsTruncated && len(objects) > 0 {
+		next = objects[len(objects)-1].Key
+	}
+	return objects, next, nil
+}
+
+// listBucket requests a single page of the objects in bucket
+func (c *GcsStorage) listBucket(ctx context.Context, bucket string, query url.Values) (*gcsListBucketResult, error) {
+	httpClient, err := c.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	listURL := baseURL + bucket + "?" + query.Encode()
+	log.Print("LIST " + listURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, errors.New(res.Status + " " + listURL)
+	}
+
+	var result gcsListBucketResult
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type gcsComposeComponent struct {
+	Name string
+}
+
+type gcsComposeRequest struct {
+	XMLName    xml.Name              `xml:"ComposeRequest"`
+	Components []gcsComposeComponent `xml:"Component"`
+}
+
+// ComposeFile concatenates componentKeys into bucket/key server-side, setup
+// sets the headers (content type, ACL...) of the resulting object
+func (c *GcsStorage) ComposeFile(ctx context.Context, bucket, key string, componentKeys []string, setup StorageSetupFunc) error {
+	composeRequest := gcsComposeRequest{}
+	for _, componentKey := range componentKeys {
+		composeRequest.Components = append(composeRequest.Components, gcsComposeComponent{componentKey})
+	}
+
+	body, err := xml.Marshal(composeRequest)
+	if err != nil {
+		return err
+	}
+
+	return c.PutFileWithSetup(ctx, bucket, key+"?compose", bytes.NewReader(body), setup)
+}
@@ -0,0 +1,292 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// how often a job's progress is checked to stream an update
+var grpcProgressInterval = time.Second
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative zipserver.proto
+
+// grpcService runs its calls through the same guarded handlers as the HTTP
+// routes, so they're subject to the same admission, read-only mode and
+// scopes
+type grpcService struct {
+	UnimplementedZipServerServer
+}
+
+func (s *grpcService) Extract(request *ExtractRequest, stream ZipServer_ExtractServer) error {
+	params := grpcParams(request.Params, "key", request.Key, "prefix", request.Prefix)
+	return s.runJob(stream, queueOperations["extract"], params)
+}
+
+func (s *grpcService) Slurp(request *SlurpRequest, stream ZipServer_SlurpServer) error {
+	params := grpcParams(request.Params, "key", request.Key, "url", request.Url)
+	return s.runJob(stream, queueOperations["slurp"], params)
+}
+
+func (s *grpcService) Copy(request *CopyRequest, stream ZipServer_CopyServer) error {
+	params := grpcParams(request.Params, "key", request.Key, "target", request.Target)
+	return s.runJob(stream, queueOperations["copy"], params)
+}
+
+func (s *grpcService) Delete(request *DeleteRequest, stream ZipServer_DeleteServer) error {
+	params := grpcParams(request.Params, "prefix", request.Prefix)
+	return s.runJob(stream, queueOperations["delete"], params)
+}
+
+func (s *grpcService) List(ctx context.Context, request *ListRequest) (*ListResponse, error) {
+	ctx, err := grpcAuthenticate(ctx, "/list")
+	if err != nil {
+		return nil, err
+	}
+
+	call, err := callRoute(ctx, "/list", "", "", grpcParams(nil, "key", request.Key, "url", request.Url))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer call.done()
+
+	if call.response.status != http.StatusOK {
+		return nil, grpcStatus(&call.response)
+	}
+
+	var files []fileTuple
+	if err := json.Unmarshal(call.response.body.Bytes(), &files); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &ListResponse{}
+	for _, file := range files {
+		response.Files = append(response.Files, &ListedFile{Filename: file.Filename, Size: file.Size})
+	}
+	return response, nil
+}
+
+func (s *grpcService) Info(ctx context.Context, request *InfoRequest) (*JobUpdate, error) {
+	if _, err := grpcAuthenticate(ctx, "/job/"); err != nil {
+		return nil, err
+	}
+
+	job, ok := jobs.get(request.JobId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "No job with ID %s", request.JobId)
+	}
+
+	update := jobUpdate(job)
+	update.Done = job.State == JobDone || job.State == JobFailed
+	update.Success = job.State == JobDone
+	return update, nil
+}
+
+// jobUpdateStream is the server side of the streaming calls
+type jobUpdateStream interface {
+	Send(*JobUpdate) error
+	Context() context.Context
+}
+
+// runJob starts the operation's job, then streams its progress until its
+// callback comes in. The job carries on when the client goes away.
+func (s *grpcService) runJob(stream jobUpdateStream, operation queueOperation, params url.Values) error {
+	ctx, err := grpcAuthenticate(stream.Context(), operation.path)
+	if err != nil {
+		return err
+	}
+
+	call, err := callRoute(ctx, operation.path, operation.callbackParam, "grpc"+operation.path, params)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer call.done()
+
+	if call.response.status != http.StatusOK {
+		return grpcStatus(&call.response)
+	}
+
+	answer := call.answer()
+	if !answer.Async {
+		if answer.Processing {
+			return status.Error(codes.Aborted, "Already being processed for another request")
+		}
+		return stream.Send(&JobUpdate{Done: true, Success: answer.Success})
+	}
+
+	ticker := time.NewTicker(grpcProgressInterval)
+	defer ticker.Stop()
+
+	last := &JobUpdate{}
+	sendProgress := func() error {
+		job, _ := jobs.get(answer.JobID)
+		update := jobUpdate(job)
+		update.JobId = answer.JobID
+		if update.State == last.State && update.TotalFiles == last.TotalFiles &&
+			update.FilesDone == last.FilesDone && update.BytesDone == last.BytesDone {
+			return nil
+		}
+		last = update
+		return stream.Send(update)
+	}
+
+	if err := sendProgress(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case values := <-call.replies:
+			job, _ := jobs.get(answer.JobID)
+			update := jobUpdate(job)
+			update.JobId = answer.JobID
+			update.Done = true
+			update.Success = values.Get("Success") == "true"
+			update.State = string(JobFailed)
+			if update.Success {
+				update.State = string(JobDone)
+			}
+			update.Error = values.Get("Error")
+			update.Result = map[string]string{}
+			for name := range values {
+				update.Result[name] = values.Get(name)
+			}
+			return stream.Send(update)
+		case <-ticker.C:
+			if err := sendProgress(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// jobUpdate is the state and progress of job
+func jobUpdate(job Job) *JobUpdate {
+	return &JobUpdate{
+		JobId:      job.ID,
+		State:      string(job.State),
+		TotalFiles: int64(job.Progress.TotalFiles),
+		FilesDone:  int64(job.Progress.FilesDone),
+		BytesDone:  job.Progress.BytesDone,
+		Error:      job.Error,
+	}
+}
+
+// grpcParams are the query params for a call: params, then the non-empty
+// fields given as name, value pairs
+func grpcParams(params map[string]string, fields ...string) url.Values {
+	values := url.Values{}
+	for name, value := range params {
+		values.Set(name, value)
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] != "" {
+			values.Set(fields[i], fields[i+1])
+		}
+	}
+	return values
+}
+
+// grpcAuthenticate checks the API key sent in the authorization metadata has
+// the scope of the route at path, like requireScope
+func grpcAuthenticate(ctx context.Context, path string) (context.Context, error) {
+	if len(globalConfig.APIKeys) == 0 {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	request := &http.Request{Header: http.Header{"Authorization": md.Get("authorization")}}
+	key := findAPIKey(globalConfig.APIKeys, request)
+	if key == nil {
+		return nil, status.Error(codes.Unauthenticated, "Missing or invalid API key")
+	}
+
+	for _, route := range routes {
+		if route.path == path && !key.hasScope(route.scope) {
+			log.Printf("API key %q denied gRPC %s (missing scope %s)", key.Name, path, route.scope)
+			return nil, status.Errorf(codes.PermissionDenied, "API key lacks the %s scope", route.scope)
+		}
+	}
+
+	return context.WithValue(ctx, apiKeyContextKey{}, key), nil
+}
+
+// grpcStatus is the error status for a handler's error response
+func grpcStatus(response *localResponse) error {
+	code := codes.Internal
+	switch response.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+
+	var message struct{ Error string }
+	json.Unmarshal(response.result(), &message)
+	if message.Error == "" {
+		message.Error = strings.TrimSpace(response.body.String())
+	}
+	return status.Error(code, message.Error)
+}
+
+// newGRPCServer serves zipserver.proto's ZipServer service
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer()
+	RegisterZipServerServer(server, &grpcService{})
+	return server
+}
+
+// serveGRPC starts serving the gRPC API on address in the background
+func serveGRPC(address string) (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := newGRPCServer()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Print("gRPC server stopped: ", err)
+		}
+	}()
+
+	log.Print("gRPC listening on: " + listener.Addr().String())
+	return server, nil
+}
+
+// stopGRPC lets running calls finish until ctx is done, then closes them
+func stopGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
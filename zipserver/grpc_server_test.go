@@ -0,0 +1,112 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialTestGRPC serves the gRPC API in memory and connects to it
+func dialTestGRPC(t *testing.T) ZipServerClient {
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return NewZipServerClient(conn)
+}
+
+// receiveUpdates collects the updates of a streaming call
+func receiveUpdates(stream interface{ Recv() (*JobUpdate, error) }, err error) ([]*JobUpdate, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []*JobUpdate
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			return updates, nil
+		}
+		if err != nil {
+			return updates, err
+		}
+		updates = append(updates, update)
+	}
+}
+
+func Test_GRPCServer(t *testing.T) {
+	oldConfig := globalConfig
+	oldAdmission := admission
+	defer func() {
+		globalConfig = oldConfig
+		admission = oldAdmission
+	}()
+	globalConfig = emptyConfig()
+	globalConfig.AsyncNotificationTimeout = Duration(time.Second)
+	globalConfig.StorageTargets = []StorageConfig{{Name: "mirror", Type: S3, Bucket: "mirror", S3Region: "us-east-1"}}
+	setupAdmission(globalConfig)
+
+	client := dialTestGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the copy job starts, then fails on the primary storage emptyConfig has
+	// no credentials for
+	updates, err := receiveUpdates(client.Copy(ctx, &CopyRequest{Key: "zips/1.zip", Target: "mirror"}))
+	require.NoError(t, err)
+	require.NotEmpty(t, updates)
+	last := updates[len(updates)-1]
+	assert.True(t, last.Done)
+	assert.False(t, last.Success)
+	assert.Equal(t, string(JobFailed), last.State)
+	assert.NotEmpty(t, last.JobId)
+	assert.NotEmpty(t, last.Error)
+	assert.Equal(t, "false", last.Result["Success"])
+	for _, update := range updates {
+		assert.Equal(t, last.JobId, update.JobId)
+	}
+
+	info, err := client.Info(ctx, &InfoRequest{JobId: last.JobId})
+	require.NoError(t, err)
+	assert.Equal(t, last.JobId, info.JobId)
+
+	_, err = client.Info(ctx, &InfoRequest{JobId: "nope"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// the handler's error response
+	_, err = receiveUpdates(client.Copy(ctx, &CopyRequest{Key: "zips/1.zip", Target: "nowhere"}))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "Invalid target")
+
+	// the same API keys and scopes as HTTP requests
+	globalConfig.APIKeys = []APIKeyConfig{{Name: "status", Key: "secret", Scopes: []APIScope{ScopeStatus}}}
+
+	_, err = client.Info(ctx, &InfoRequest{JobId: last.JobId})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	_, err = client.Info(authorized, &InfoRequest{JobId: last.JobId})
+	require.NoError(t, err)
+
+	_, err = receiveUpdates(client.Delete(authorized, &DeleteRequest{Prefix: "games/1"}))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
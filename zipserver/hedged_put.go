@@ -0,0 +1,63 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// hedgedPut uploads data to key, starting a second identical upload if the
+// first one hasn't finished after delay. The first upload to succeed wins and
+// the other is canceled. Failures aren't hedged: an upload that fails before
+// the second one starts fails the put.
+// Caller should set the file put timeout in ctx.
+func (a *Archiver) hedgedPut(ctx context.Context, key string, data []byte, setup StorageSetupFunc, delay time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type putResult struct {
+		hedged bool
+		err    error
+	}
+
+	// buffered so the loser doesn't block once we've returned
+	results := make(chan putResult, 2)
+	put := func(hedged bool) {
+		err := a.Storage.PutFileWithSetup(ctx, a.Bucket, key, bytes.NewReader(data), setup)
+		results <- putResult{hedged, err}
+	}
+
+	go put(false)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	hedging := false
+	var firstErr error
+
+	for {
+		select {
+		case <-timer.C:
+			hedging = true
+			pending++
+			globalMetrics.TotalHedgedPuts.Add(1)
+			go put(true)
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if result.hedged {
+					globalMetrics.TotalHedgedPutWins.Add(1)
+				}
+				return nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if !hedging || pending == 0 {
+				return firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stallingStorage hangs the first stalls uploads until they're canceled
+type stallingStorage struct {
+	*MemStorage
+	mutex    sync.Mutex
+	stalls   int
+	canceled int
+	fail     error
+}
+
+func (s *stallingStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	s.mutex.Lock()
+	stall := s.stalls > 0
+	if stall {
+		s.stalls--
+	}
+	fail := s.fail
+	s.mutex.Unlock()
+
+	if fail != nil {
+		return fail
+	}
+
+	if stall {
+		<-ctx.Done()
+		s.mutex.Lock()
+		s.canceled++
+		s.mutex.Unlock()
+		return ctx.Err()
+	}
+
+	return s.MemStorage.PutFileWithSetup(ctx, bucket, key, contents, setup)
+}
+
+func Test_HedgedPut(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	mem, err := NewMemStorage()
+	require.NoError(t, err)
+	storage := &stallingStorage{MemStorage: mem, stalls: 1}
+	archiver := &Archiver{storage, config}
+
+	noSetup := func(req *http.Request) error { return nil }
+
+	hedged := globalMetrics.TotalHedgedPuts.Load()
+	wins := globalMetrics.TotalHedgedPutWins.Load()
+
+	err = archiver.hedgedPut(ctx, "tiny.txt", []byte("hi"), noSetup, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, globalMetrics.TotalHedgedPuts.Load()-hedged)
+	assert.EqualValues(t, 1, globalMetrics.TotalHedgedPutWins.Load()-wins)
+
+	reader, _, err := mem.GetFile(ctx, config.Bucket, "tiny.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+
+	// the stalled upload was canceled
+	assert.Eventually(t, func() bool {
+		storage.mutex.Lock()
+		defer storage.mutex.Unlock()
+		return storage.canceled == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// fast uploads aren't hedged
+	err = archiver.hedgedPut(ctx, "fast.txt", []byte("hi"), noSetup, time.Minute)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, globalMetrics.TotalHedgedPuts.Load()-hedged)
+
+	// nor are failures
+	storage.fail = errors.New("bucket on fire")
+	err = archiver.hedgedPut(ctx, "failed.txt", []byte("hi"), noSetup, time.Minute)
+	assert.EqualError(t, err, "bucket on fire")
+	assert.EqualValues(t, 1, globalMetrics.TotalHedgedPuts.Load()-hedged)
+}
+
+func Test_HedgedExtraction(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.HedgedPutMaxSize = 1024
+	config.HedgedPutDelay = Duration(10 * time.Millisecond)
+
+	mem, err := NewMemStorage()
+	require.NoError(t, err)
+	storage := &stallingStorage{MemStorage: mem, stalls: 1}
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("index.html")
+	require.NoError(t, err)
+	w.Write([]byte("<html></html>"))
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "game.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "game/index.html", files[0].Key)
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	assert.EqualValues(t, 0, storage.stalls)
+}
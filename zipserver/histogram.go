@@ -0,0 +1,132 @@
+package zipserver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// primaryTargetLabel is the target label of operations on primary storage
+const primaryTargetLabel = "primary"
+
+// upper bounds of the duration histogram buckets, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// upper bounds of the size histogram buckets, in bytes: 1KiB to 16GiB
+var sizeBuckets = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30, 1 << 32, 1 << 34}
+
+// histogram counts observations into buckets, separately for every set of
+// label values. The zero value is ready to use
+type histogram struct {
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []int64 // per bucket, not cumulative
+	sum         float64
+	count       int64
+}
+
+func (h *histogram) observe(bounds []float64, value float64, labelValues []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.series == nil {
+		h.series = map[string]*histogramSeries{}
+	}
+
+	seriesKey := strings.Join(labelValues, "\x00")
+	series := h.series[seriesKey]
+	if series == nil {
+		series = &histogramSeries{labelValues: labelValues, counts: make([]int64, len(bounds))}
+		h.series[seriesKey] = series
+	}
+
+	for i, bound := range bounds {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// render writes the buckets, sum and count of every series, sorted by label
+// values. labels are the ones shared by all metrics
+func (h *histogram) render(metrics *strings.Builder, name, labels string, labelNames []string, bounds []float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+
+		seriesLabels := labels
+		for i, labelName := range labelNames {
+			value := ""
+			if i < len(series.labelValues) {
+				value = series.labelValues[i]
+			}
+			seriesLabels += fmt.Sprintf(",%s=\"%s\"", labelName, metricsLabelEscaper.Replace(value))
+		}
+
+		var cumulative int64
+		for i, bound := range bounds {
+			cumulative += series.counts[i]
+			metrics.WriteString(fmt.Sprintf("%s_bucket{%s,le=\"%s\"} %d\n", name, seriesLabels, formatMetricFloat(bound), cumulative))
+		}
+		metrics.WriteString(fmt.Sprintf("%s_bucket{%s,le=\"+Inf\"} %d\n", name, seriesLabels, series.count))
+		metrics.WriteString(fmt.Sprintf("%s_sum{%s} %s\n", name, seriesLabels, formatMetricFloat(series.sum)))
+		metrics.WriteString(fmt.Sprintf("%s_count{%s} %d\n", name, seriesLabels, series.count))
+	}
+}
+
+func formatMetricFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// histogramMetric is a MetricsCounter field rendered as a prometheus histogram
+type histogramMetric interface {
+	renderHistogram(metrics *strings.Builder, name, labels string, labelNames []string)
+}
+
+// DurationHistogram observes how long things take, in seconds
+type DurationHistogram struct {
+	histogram
+}
+
+// Observe records duration for the given label values, in the order of the
+// field's labels tag
+func (h *DurationHistogram) Observe(duration time.Duration, labelValues ...string) {
+	h.observe(durationBuckets, duration.Seconds(), labelValues)
+}
+
+func (h *DurationHistogram) renderHistogram(metrics *strings.Builder, name, labels string, labelNames []string) {
+	h.render(metrics, name, labels, labelNames, durationBuckets)
+}
+
+// SizeHistogram observes sizes, in bytes
+type SizeHistogram struct {
+	histogram
+}
+
+// Observe records size for the given label values, in the order of the
+// field's labels tag
+func (h *SizeHistogram) Observe(size uint64, labelValues ...string) {
+	h.observe(sizeBuckets, float64(size), labelValues)
+}
+
+func (h *SizeHistogram) renderHistogram(metrics *strings.Builder, name, labels string, labelNames []string) {
+	h.render(metrics, name, labels, labelNames, sizeBuckets)
+}
@@ -0,0 +1,132 @@
+package zipserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHistoryRecords is how many finished operations /history remembers
+const maxHistoryRecords = 10000
+
+const defaultHistoryLimit = 50
+
+// HistoryEntry is a finished operation that wrote, copied or deleted objects
+type HistoryEntry struct {
+	Time time.Time
+	Type string // eg. extract, copy, delete
+	// keys and prefixes (ending with a slash) the operation touched
+	Keys   []string
+	Target string `json:",omitempty"` // storage target written to
+	JobID  string `json:",omitempty"` // for async operations
+	Error  string `json:",omitempty"`
+}
+
+// touches is true when key is one of the entry's keys, is under one of its
+// prefixes, or is one of its prefixes itself
+func (e *HistoryEntry) touches(key string) bool {
+	for _, touched := range e.Keys {
+		if touched == key || touched == key+"/" {
+			return true
+		}
+		if strings.HasSuffix(touched, "/") && strings.HasPrefix(key, touched) {
+			return true
+		}
+	}
+	return false
+}
+
+type historyTable struct {
+	sync.Mutex
+	entries []HistoryEntry
+}
+
+var history = &historyTable{}
+
+// add remembers entry, forgetting the oldest one when the table is full
+func (h *historyTable) add(entry HistoryEntry) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistoryRecords {
+		h.entries = append([]HistoryEntry{}, h.entries[len(h.entries)-maxHistoryRecords:]...)
+	}
+}
+
+// forKey returns up to limit entries touching key, most recent first
+func (h *historyTable) forKey(key string, limit int) []HistoryEntry {
+	h.Lock()
+	defer h.Unlock()
+
+	found := []HistoryEntry{}
+	for i := len(h.entries) - 1; i >= 0 && len(found) < limit; i-- {
+		if h.entries[i].touches(key) {
+			found = append(found, h.entries[i])
+		}
+	}
+	return found
+}
+
+// lastExtraction returns the most recent successful extraction since the given
+// time that wrote to prefix (ending with a slash) or to a prefix under it
+func (h *historyTable) lastExtraction(prefix string, since time.Time) *HistoryEntry {
+	h.Lock()
+	defer h.Unlock()
+
+	for i := len(h.entries) - 1; i >= 0 && !h.entries[i].Time.Before(since); i-- {
+		entry := h.entries[i]
+		if entry.Type != "extract" || entry.Error != "" {
+			continue
+		}
+		for _, touched := range entry.Keys {
+			if strings.HasSuffix(touched, "/") && (strings.HasPrefix(touched, prefix) || strings.HasPrefix(prefix, touched)) {
+				return &entry
+			}
+		}
+	}
+	return nil
+}
+
+// recordHistory adds a finished operation to the history, and to the job
+// store when there's one. The job running in ctx, if any, is recorded along.
+func recordHistory(ctx context.Context, entry HistoryEntry, err error) {
+	entry.Time = time.Now()
+	entry.JobID = jobFromContext(ctx).jobID()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	history.add(entry)
+
+	jobs.Lock()
+	store := jobs.store
+	jobs.Unlock()
+	store.appendHistory(entry)
+}
+
+// Lists the recent operations that touched a key, eg. to find out what
+// happened to a missing file
+func historyHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	key, err := getParam(params, "key")
+	if err != nil {
+		return err
+	}
+
+	limit := defaultHistoryLimit
+	if value, err := getIntParam(params, "limit"); err == nil {
+		if value < 1 || value > maxHistoryRecords {
+			return badRequestf("limit must be between 1 and %d", maxHistoryRecords)
+		}
+		limit = value
+	}
+
+	return writeJSONMessage(w, struct {
+		Key        string
+		Operations []HistoryEntry
+	}{key, history.forKey(key, limit)})
+}
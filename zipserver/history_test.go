@@ -0,0 +1,67 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_History(t *testing.T) {
+	previous := history
+	history = &historyTable{}
+	defer func() { history = previous }()
+
+	ctx := context.Background()
+	recordHistory(ctx, HistoryEntry{Type: "extract", Keys: []string{"zips/game.zip", "games/1/"}}, nil)
+	recordHistory(ctx, HistoryEntry{Type: "copy", Keys: []string{"zips/game.zip"}, Target: "s3"}, nil)
+	recordHistory(ctx, HistoryEntry{Type: "delete", Keys: []string{"games/1/"}}, errors.New("oops"))
+	recordHistory(ctx, HistoryEntry{Type: "delete", Keys: []string{"games/10/"}}, nil)
+
+	found := history.forKey("games/1/index.html", 10)
+	require.Len(t, found, 2)
+	assert.Equal(t, "delete", found[0].Type)
+	assert.Equal(t, "oops", found[0].Error)
+	assert.Equal(t, "extract", found[1].Type)
+
+	assert.Len(t, history.forKey("games/1", 10), 2)
+	assert.Len(t, history.forKey("zips/game.zip", 1), 1)
+	assert.Empty(t, history.forKey("games/2/index.html", 10))
+
+	job := jobs.newJob("copy", "zips/game.zip", "", "", 0, jobCaller{})
+	recordHistory(withJob(ctx, job), HistoryEntry{Type: "copy", Keys: []string{"zips/game.zip"}}, nil)
+	assert.Equal(t, job.ID, history.forKey("zips/game.zip", 1)[0].JobID)
+
+	w := httptest.NewRecorder()
+	err := historyHandler(w, httptest.NewRequest("GET", "/history?key=zips/game.zip&limit=2", nil))
+	require.NoError(t, err)
+
+	var response struct {
+		Key        string
+		Operations []HistoryEntry
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "zips/game.zip", response.Key)
+	assert.Len(t, response.Operations, 2)
+
+	err = historyHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/history?key=a&limit=0", nil))
+	assert.Error(t, err)
+}
+
+func Test_HistoryStore(t *testing.T) {
+	store, err := newJobStore(t.TempDir())
+	require.NoError(t, err)
+
+	store.appendHistory(HistoryEntry{Type: "extract", Keys: []string{"games/1/"}})
+	store.appendHistory(HistoryEntry{Type: "delete", Keys: []string{"games/1/"}})
+
+	loaded, err := store.loadHistory()
+	require.NoError(t, err)
+	require.Len(t, loaded, 2)
+	assert.Equal(t, "extract", loaded[0].Type)
+	assert.Equal(t, "delete", loaded[1].Type)
+}
@@ -0,0 +1,241 @@
+package zipserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// how much of the end of a document is held back while streaming it, Tail
+// transforms only see this part
+const htmlTailWindow = 64 * 1024
+
+// HTMLTransform rewrites the contents of an HTML document before it's stored
+type HTMLTransform struct {
+	Name  string
+	Apply func(doc []byte) []byte
+	// only edits the end of the document, so it can be applied to the last
+	// htmlTailWindow bytes while the rest is streamed
+	Tail bool
+}
+
+// isHTMLContentType returns true for content types HTML transforms apply to
+func isHTMLContentType(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "text/html")
+}
+
+// applyHTMLTransforms runs every transform over doc in order
+func applyHTMLTransforms(doc []byte, transforms []HTMLTransform) []byte {
+	for _, transform := range transforms {
+		doc = transform.Apply(doc)
+	}
+	return doc
+}
+
+// transformHTMLReader applies transforms to the document read from reader.
+// When they're all Tail transforms, only the end of the document is kept in
+// memory, otherwise the whole of it is.
+func transformHTMLReader(reader io.Reader, transforms []HTMLTransform) (io.Reader, error) {
+	for _, transform := range transforms {
+		if !transform.Tail {
+			doc, err := io.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(applyHTMLTransforms(doc, transforms)), nil
+		}
+	}
+
+	return &tailTransformReader{reader: reader, transforms: transforms}, nil
+}
+
+// transformEncodedHTML is transformHTMLReader for documents stored with
+// encoding, gzip streams are decompressed and compressed again on the fly.
+// The returned reader must be closed.
+func transformEncodedHTML(reader io.Reader, encoding string, transforms []HTMLTransform) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		transformed, err := transformHTMLReader(reader, transforms)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(transformed), nil
+	case "gzip":
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		transformed, err := transformHTMLReader(gzipReader, transforms)
+		if err != nil {
+			return nil, err
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			gzipWriter := gzip.NewWriter(pipeWriter)
+			_, err := io.Copy(gzipWriter, transformed)
+			if err == nil {
+				err = gzipWriter.Close()
+			}
+			pipeWriter.CloseWithError(err)
+		}()
+		return pipeReader, nil
+	default:
+		return nil, fmt.Errorf("Can't apply HTML transforms to %s encoded content", encoding)
+	}
+}
+
+// tailTransformReader passes a document through, holding back its last
+// htmlTailWindow bytes until the end is reached, then yields them with the
+// transforms applied
+type tailTransformReader struct {
+	reader     io.Reader
+	transforms []HTMLTransform
+	held       []byte
+	chunk      []byte
+	tail       io.Reader // set once reader is exhausted
+}
+
+func (t *tailTransformReader) Read(p []byte) (int, error) {
+	for {
+		if t.tail != nil {
+			return t.tail.Read(p)
+		}
+
+		if extra := len(t.held) - htmlTailWindow; extra > 0 {
+			n := copy(p, t.held[:extra])
+			t.held = append(t.held[:0], t.held[n:]...)
+			return n, nil
+		}
+
+		if t.chunk == nil {
+			t.chunk = make([]byte, 32*1024)
+		}
+
+		n, err := t.reader.Read(t.chunk)
+		t.held = append(t.held, t.chunk[:n]...)
+		if err == io.EOF {
+			t.tail = bytes.NewReader(applyHTMLTransforms(t.held, t.transforms))
+			t.held = nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// insertAfterHeadOpen inserts snippet right after the opening <head> tag, or
+// at the very start of the document if there isn't one
+func insertAfterHeadOpen(doc []byte, snippet string) []byte {
+	lower := bytes.ToLower(doc)
+
+	idx := bytes.Index(lower, []byte("<head"))
+	for idx != -1 {
+		// make sure we didn't match <header>
+		next := idx + len("<head")
+		if next < len(lower) && (lower[next] == '>' || lower[next] == ' ' || lower[next] == '\t' || lower[next] == '\n' || lower[next] == '\r') {
+			break
+		}
+
+		rest := bytes.Index(lower[next:], []byte("<head"))
+		if rest == -1 {
+			idx = -1
+		} else {
+			idx = next + rest
+		}
+	}
+
+	if idx == -1 {
+		return append([]byte(snippet), doc...)
+	}
+
+	closeIdx := bytes.IndexByte(lower[idx:], '>')
+	if closeIdx == -1 {
+		return append([]byte(snippet), doc...)
+	}
+
+	return insertAt(doc, idx+closeIdx+1, snippet)
+}
+
+// insertBeforeClose inserts snippet before the last occurrence of closeTag,
+// or at the end of the document if there isn't one
+func insertBeforeClose(doc []byte, closeTag string, snippet string) []byte {
+	idx := bytes.LastIndex(bytes.ToLower(doc), []byte(closeTag))
+	if idx == -1 {
+		return append(doc, snippet...)
+	}
+
+	return insertAt(doc, idx, snippet)
+}
+
+func insertAt(doc []byte, idx int, snippet string) []byte {
+	out := make([]byte, 0, len(doc)+len(snippet))
+	out = append(out, doc[:idx]...)
+	out = append(out, snippet...)
+	out = append(out, doc[idx:]...)
+	return out
+}
+
+// loadHTMLTransforms builds the transform pipeline selected by the
+// html_transforms parameter, a comma-separated list of: base, csp, analytics, footer
+func loadHTMLTransforms(params url.Values, config *Config) ([]HTMLTransform, error) {
+	names := params.Get("html_transforms")
+	if names == "" {
+		return nil, nil
+	}
+
+	transforms := []HTMLTransform{}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case "base":
+			baseHref, err := getParam(params, "html_base")
+			if err != nil {
+				return nil, err
+			}
+
+			tag := fmt.Sprintf(`<base href="%s">`, html.EscapeString(baseHref))
+			transforms = append(transforms, HTMLTransform{name, func(doc []byte) []byte {
+				return insertAfterHeadOpen(doc, tag)
+			}, false})
+		case "csp":
+			if config.HTMLContentSecurityPolicy == "" {
+				return nil, fmt.Errorf("HTML transform %s is not configured", name)
+			}
+
+			tag := fmt.Sprintf(`<meta http-equiv="Content-Security-Policy" content="%s">`,
+				html.EscapeString(config.HTMLContentSecurityPolicy))
+			transforms = append(transforms, HTMLTransform{name, func(doc []byte) []byte {
+				return insertAfterHeadOpen(doc, tag)
+			}, false})
+		case "analytics":
+			if config.HTMLAnalyticsSnippet == "" {
+				return nil, fmt.Errorf("HTML transform %s is not configured", name)
+			}
+
+			snippet := config.HTMLAnalyticsSnippet
+			transforms = append(transforms, HTMLTransform{name, func(doc []byte) []byte {
+				return insertBeforeClose(doc, "</head>", snippet)
+			}, false})
+		case "footer":
+			if config.HTMLFooterSnippet == "" {
+				return nil, fmt.Errorf("HTML transform %s is not configured", name)
+			}
+
+			snippet := config.HTMLFooterSnippet
+			transforms = append(transforms, HTMLTransform{name, func(doc []byte) []byte {
+				return insertBeforeClose(doc, "</body>", snippet)
+			}, true})
+		default:
+			return nil, fmt.Errorf("Unknown HTML transform: %s", name)
+		}
+	}
+
+	return transforms, nil
+}
@@ -0,0 +1,150 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HTMLTransforms(t *testing.T) {
+	config := &Config{
+		HTMLContentSecurityPolicy: "default-src 'self'",
+		HTMLFooterSnippet:         "<footer>itch</footer>",
+	}
+
+	transforms, err := loadHTMLTransforms(url.Values{}, config)
+	assert.NoError(t, err)
+	assert.Empty(t, transforms)
+
+	transforms, err = loadHTMLTransforms(url.Values{
+		"html_transforms": {"base,csp,footer"},
+		"html_base":       {"https://example.org/game/"},
+	}, config)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, len(transforms))
+
+	doc := `<html><header></header><HEAD lang="en"><title>x</title></HEAD><body><p>hi</p></body></html>`
+	out := applyHTMLTransforms([]byte(doc), transforms)
+	assert.EqualValues(t,
+		`<html><header></header><HEAD lang="en"><meta http-equiv="Content-Security-Policy" content="default-src &#39;self&#39;"><base href="https://example.org/game/"><title>x</title></HEAD><body><p>hi</p><footer>itch</footer></body></html>`,
+		string(out))
+
+	// fragments without head or body still get everything
+	out = applyHTMLTransforms([]byte("<p>hi</p>"), transforms)
+	assert.EqualValues(t,
+		`<meta http-equiv="Content-Security-Policy" content="default-src &#39;self&#39;"><base href="https://example.org/game/"><p>hi</p><footer>itch</footer>`,
+		string(out))
+
+	_, err = loadHTMLTransforms(url.Values{"html_transforms": {"analytics"}}, config)
+	assert.Error(t, err, "analytics isn't configured")
+
+	_, err = loadHTMLTransforms(url.Values{"html_transforms": {"base"}}, config)
+	assert.Error(t, err, "base requires html_base")
+
+	_, err = loadHTMLTransforms(url.Values{"html_transforms": {"bogus"}}, config)
+	assert.Error(t, err)
+}
+
+func Test_ExtractWithHTMLTransforms(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range map[string]string{
+		"index.html": "<html><body>game</body></html>",
+		"notes.txt":  "<body></body>",
+	} {
+		writer, err := zw.Create(name)
+		assert.NoError(t, err)
+		writer.Write([]byte(contents))
+	}
+	assert.NoError(t, zw.Close())
+
+	err = storage.PutFile(ctx, config.Bucket, "game.zip", bytes.NewReader(buf.Bytes()), "application/zip")
+	assert.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+	files, err := archiver.ExtractZip(ctx, "game.zip", "game", testLimits(), ExtractOptions{
+		HTMLTransforms: []HTMLTransform{
+			{"footer", func(doc []byte) []byte { return insertBeforeClose(doc, "</body>", "<hr>") }, true},
+		},
+	})
+	assert.NoError(t, err)
+
+	for _, file := range files {
+		reader, _, err := storage.GetFile(ctx, config.Bucket, file.Key)
+		assert.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(data), file.Size)
+
+		if file.Key == "game/index.html" {
+			assert.EqualValues(t, "<html><body>game<hr></body></html>", string(data))
+		} else {
+			assert.EqualValues(t, "<body></body>", string(data))
+		}
+	}
+}
+
+func Test_StreamHTMLTransforms(t *testing.T) {
+	config := &Config{
+		HTMLContentSecurityPolicy: "default-src 'self'",
+		HTMLFooterSnippet:         "<footer>itch</footer>",
+	}
+
+	doc := []byte("<html><head></head><body>" + strings.Repeat("<p>inlined asset</p>", 20000) + "</body></html>")
+	assert.Greater(t, len(doc), 2*htmlTailWindow)
+
+	for _, names := range []string{"footer", "csp,footer"} {
+		transforms, err := loadHTMLTransforms(url.Values{"html_transforms": {names}}, config)
+		assert.NoError(t, err)
+
+		expected := applyHTMLTransforms(append([]byte{}, doc...), transforms)
+
+		reader, err := transformHTMLReader(bytes.NewReader(doc), transforms)
+		assert.NoError(t, err)
+		if names == "footer" {
+			assert.IsType(t, &tailTransformReader{}, reader)
+		}
+
+		// small reads to exercise the held back window
+		var out bytes.Buffer
+		_, err = io.CopyBuffer(&out, struct{ io.Reader }{reader}, make([]byte, 1000))
+		assert.NoError(t, err)
+		assert.Equal(t, string(expected), out.String(), names)
+	}
+
+	// gzip encoded documents are transformed too
+	transforms, err := loadHTMLTransforms(url.Values{"html_transforms": {"footer"}}, config)
+	assert.NoError(t, err)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(doc)
+	assert.NoError(t, zw.Close())
+
+	transformed, err := transformEncodedHTML(&compressed, "gzip", transforms)
+	assert.NoError(t, err)
+	defer transformed.Close()
+
+	zr, err := gzip.NewReader(transformed)
+	assert.NoError(t, err)
+	decompressed, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(decompressed, []byte("<footer>itch</footer></body></html>")))
+	assert.Equal(t, len(doc)+len("<footer>itch</footer>"), len(decompressed))
+
+	_, err = transformEncodedHTML(bytes.NewReader(doc), "br", transforms)
+	assert.Error(t, err)
+}
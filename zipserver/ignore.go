@@ -0,0 +1,158 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// junk commonly found in zips, skipped unless Config.IgnorePatterns is set
+var defaultIgnorePatterns = []string{
+	"__MACOSX",
+	".git",
+	".DS_Store",
+	"Thumbs.db",
+}
+
+// ignorePatterns returns the configured ignore patterns, or the defaults if
+// none were configured. An empty list disables the defaults.
+func (c *Config) ignorePatterns() []string {
+	if c.IgnorePatterns == nil {
+		return defaultIgnorePatterns
+	}
+	return c.IgnorePatterns
+}
+
+func validateIgnorePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid ignore pattern %q: %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// loadIgnorePatterns reads the per-request ignore parameter, a comma
+// separated list of patterns added to the configured ones
+func loadIgnorePatterns(params url.Values) ([]string, error) {
+	value := params.Get("ignore")
+	if value == "" {
+		return nil, nil
+	}
+
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	if err := validateIgnorePatterns(patterns); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// matchesIgnorePattern returns true if fname matches any of the patterns
+func matchesIgnorePattern(fname string, patterns []string) bool {
+	components := strings.Split(strings.TrimSuffix(fname, "/"), "/")
+
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			if matched, _ := path.Match(strings.TrimSuffix(pattern, "/"), fname); matched {
+				return true
+			}
+			continue
+		}
+
+		for _, component := range components {
+			if matched, _ := path.Match(pattern, component); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func shouldIgnoreFile(fname string, patterns []string) bool {
+	if strings.HasSuffix(fname, "/") {
+		return true
+	}
+
+	if strings.Contains(fname, "..") {
+		return true
+	}
+
+	if path.IsAbs(fname) {
+		return true
+	}
+
+	return matchesIgnorePattern(fname, patterns)
+}
+
+// EmptyEntryPolicy decides what happens to zero-byte zip entries. Some tools
+// write directory markers as empty files without a trailing slash, which
+// would otherwise be stored as empty objects shadowing the directory.
+type EmptyEntryPolicy string
+
+const (
+	// skip empty entries that look like directory markers (the default)
+	EmptyEntrySkipMarkers EmptyEntryPolicy = "skip-markers"
+	// skip every empty entry
+	EmptyEntrySkipAll EmptyEntryPolicy = "skip-all"
+	// store every empty entry, except explicit directories
+	EmptyEntryKeep EmptyEntryPolicy = "keep"
+)
+
+func parseEmptyEntryPolicy(value string) (EmptyEntryPolicy, error) {
+	switch policy := EmptyEntryPolicy(value); policy {
+	case "", EmptyEntrySkipMarkers, EmptyEntrySkipAll, EmptyEntryKeep:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Invalid empty entry policy: %s", value)
+	}
+}
+
+// zipDirectories returns the set of every directory implied by the zip's entries
+func zipDirectories(files []*zip.File) map[string]struct{} {
+	directories := make(map[string]struct{})
+
+	for _, file := range files {
+		dir := path.Dir(strings.TrimSuffix(file.Name, "/"))
+		for dir != "." && dir != "/" {
+			if _, ok := directories[dir]; ok {
+				break
+			}
+			directories[dir] = struct{}{}
+			dir = path.Dir(dir)
+		}
+	}
+
+	return directories
+}
+
+// shouldSkipEmptyEntry applies policy to a zip entry, directories is the
+// result of zipDirectories
+func shouldSkipEmptyEntry(file *zip.File, directories map[string]struct{}, policy EmptyEntryPolicy) bool {
+	// entries flagged as directories are never files, whatever their name
+	if file.Mode().IsDir() {
+		return true
+	}
+
+	if file.UncompressedSize64 > 0 {
+		return false
+	}
+
+	switch policy {
+	case EmptyEntryKeep:
+		return false
+	case EmptyEntrySkipAll:
+		return true
+	default:
+		_, isDirectory := directories[file.Name]
+		return isDirectory
+	}
+}
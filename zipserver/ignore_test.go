@@ -0,0 +1,86 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"io/fs"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShouldIgnoreFile(t *testing.T) {
+	patterns := defaultIgnorePatterns
+
+	assert.True(t, shouldIgnoreFile("some/dir/", patterns))
+	assert.True(t, shouldIgnoreFile("../../etc/hosts", patterns))
+	assert.True(t, shouldIgnoreFile("/etc/hosts", patterns))
+	assert.True(t, shouldIgnoreFile("__MACOSX/._index.html", patterns))
+	assert.True(t, shouldIgnoreFile("game/.git/HEAD", patterns))
+	assert.True(t, shouldIgnoreFile("game/assets/.DS_Store", patterns))
+	assert.True(t, shouldIgnoreFile("Thumbs.db", patterns))
+
+	assert.False(t, shouldIgnoreFile("index.html", patterns))
+	assert.False(t, shouldIgnoreFile("game/.htaccess", patterns))
+	assert.False(t, shouldIgnoreFile("game/my.git/file", patterns))
+
+	// dotfiles and full-path globs
+	patterns = []string{".*", "docs/*.psd"}
+	assert.True(t, shouldIgnoreFile("game/.htaccess", patterns))
+	assert.True(t, shouldIgnoreFile(".well-known/thing", patterns))
+	assert.True(t, shouldIgnoreFile("docs/cover.psd", patterns))
+	assert.False(t, shouldIgnoreFile("art/docs/cover.psd", patterns))
+	assert.False(t, shouldIgnoreFile("Thumbs.db", patterns))
+
+	// safety rules can't be disabled
+	assert.True(t, shouldIgnoreFile("/etc/hosts", []string{}))
+}
+
+func Test_LoadIgnorePatterns(t *testing.T) {
+	patterns, err := loadIgnorePatterns(url.Values{})
+	assert.NoError(t, err)
+	assert.Empty(t, patterns)
+
+	patterns, err = loadIgnorePatterns(url.Values{"ignore": {"*.psd, src/*,"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"*.psd", "src/*"}, patterns)
+
+	_, err = loadIgnorePatterns(url.Values{"ignore": {"[unclosed"}})
+	assert.Error(t, err)
+
+	config := &Config{}
+	assert.EqualValues(t, defaultIgnorePatterns, config.ignorePatterns())
+	config.IgnorePatterns = []string{}
+	assert.Empty(t, config.ignorePatterns())
+}
+
+func Test_ShouldSkipEmptyEntry(t *testing.T) {
+	entry := func(name string, size uint64) *zip.File {
+		return &zip.File{FileHeader: zip.FileHeader{Name: name, UncompressedSize64: size}}
+	}
+
+	files := []*zip.File{
+		entry("assets", 0),
+		entry("assets/sprite.png", 10),
+		entry("empty.txt", 0),
+		entry("data/levels/1.json", 10),
+		entry("data/levels", 0),
+	}
+	directories := zipDirectories(files)
+	assert.EqualValues(t, 3, len(directories))
+
+	assert.True(t, shouldSkipEmptyEntry(files[0], directories, EmptyEntrySkipMarkers))
+	assert.False(t, shouldSkipEmptyEntry(files[1], directories, EmptyEntrySkipMarkers))
+	assert.False(t, shouldSkipEmptyEntry(files[2], directories, EmptyEntrySkipMarkers))
+	assert.True(t, shouldSkipEmptyEntry(files[4], directories, ""))
+
+	assert.True(t, shouldSkipEmptyEntry(files[2], directories, EmptyEntrySkipAll))
+	assert.False(t, shouldSkipEmptyEntry(files[0], directories, EmptyEntryKeep))
+
+	dir := &zip.File{FileHeader: zip.FileHeader{Name: "folder"}}
+	dir.SetMode(0755 | fs.ModeDir)
+	assert.True(t, shouldSkipEmptyEntry(dir, directories, EmptyEntryKeep))
+
+	_, err := parseEmptyEntryPolicy("bogus")
+	assert.Error(t, err)
+}
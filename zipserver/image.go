@@ -0,0 +1,267 @@
+package zipserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	_ "image/gif"  // registers the gif format for image.DecodeConfig
+	_ "image/jpeg" // registers the jpeg format for image.DecodeConfig
+	_ "image/png"  // registers the png format for image.DecodeConfig
+	"io"
+	"path"
+	"strings"
+
+	errors "github.com/go-errors/errors"
+)
+
+// ImageMetadata describes an extracted image file
+type ImageMetadata struct {
+	Format string // png, jpeg, gif or webp
+	Width  int
+	Height int
+}
+
+var imageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+}
+
+func isImageFile(name string) bool {
+	return imageExtensions[strings.ToLower(path.Ext(name))]
+}
+
+func init() {
+	RegisterAnalyzer(ExtractContentsImages, imageAnalyzer{})
+}
+
+// imageAnalyzer keeps the images probeImage can read, for contents=images
+type imageAnalyzer struct{}
+
+func (imageAnalyzer) Accepts(filename string) bool {
+	return isImageFile(filename)
+}
+
+func (imageAnalyzer) Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error) {
+	metadata, err := probeImage(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Metadata: metadata}, nil
+}
+
+// probeImage reads the format and dimensions of the image stored in reader,
+// only its header is read
+func probeImage(reader io.Reader) (*ImageMetadata, error) {
+	buffered := bufio.NewReader(reader)
+
+	header, _ := buffered.Peek(30)
+	if len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP" {
+		width, height, err := webpDimensions(header[12:])
+		if err != nil {
+			return nil, err
+		}
+		return &ImageMetadata{"webp", width, height}, nil
+	}
+
+	config, format, err := image.DecodeConfig(buffered)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return &ImageMetadata{format, config.Width, config.Height}, nil
+}
+
+// webpDimensions reads the canvas size from the first chunk of a webp file
+func webpDimensions(chunk []byte) (int, int, error) {
+	// the lossless header is the shortest one, the others need 10 bytes
+	if len(chunk) < 8+5 || (string(chunk[:4]) != "VP8L" && len(chunk) < 8+10) {
+		return 0, 0, errors.Errorf("Truncated webp header")
+	}
+
+	data := chunk[8:]
+	switch string(chunk[:4]) {
+	case "VP8 ":
+		// after the frame tag and start code, 14 bit sizes with 2 bits of scale
+		width := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+		return width, height, nil
+	case "VP8L":
+		if data[0] != 0x2f {
+			return 0, 0, errors.Errorf("Invalid webp lossless signature")
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		return int(bits&0x3fff) + 1, int((bits>>14)&0x3fff) + 1, nil
+	case "VP8X":
+		width := int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1
+		height := int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1
+		return width, height, nil
+	default:
+		return 0, 0, errors.Errorf("Unknown webp chunk %q", chunk[:4])
+	}
+}
+
+// canStripImageMetadata is true for the content types stripImageMetadata
+// handles
+func canStripImageMetadata(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// stripImageMetadata removes the EXIF and XMP metadata, which can hold GPS
+// coordinates, from a jpeg, png or webp file. Everything else is kept as is,
+// files it can't parse are an error.
+func stripImageMetadata(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	xmpNamespace   = []byte("http://ns.adobe.com/xap/1.0/")
+)
+
+// stripJPEGMetadata drops the APP1 segments holding EXIF or XMP data
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.Errorf("Not a jpeg file")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	rest := data[2:]
+
+	for {
+		if len(rest) < 2 || rest[0] != 0xFF {
+			return nil, errors.Errorf("Invalid jpeg marker")
+		}
+		marker := rest[1]
+
+		// markers without a length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0xFF {
+			out = append(out, rest[:2]...)
+			rest = rest[2:]
+			continue
+		}
+
+		// the entropy coded data and everything after it are kept as they are
+		if marker == 0xDA || marker == 0xD9 {
+			return append(out, rest...), nil
+		}
+
+		if len(rest) < 4 {
+			return nil, errors.Errorf("Truncated jpeg segment")
+		}
+		length := int(binary.BigEndian.Uint16(rest[2:4]))
+		if length < 2 || len(rest) < 2+length {
+			return nil, errors.Errorf("Truncated jpeg segment")
+		}
+
+		segment := rest[:2+length]
+		body := segment[4:]
+		isMetadata := marker == 0xE1 && (bytes.HasPrefix(body, jpegExifHeader) || bytes.HasPrefix(body, xmpNamespace))
+		if !isMetadata {
+			out = append(out, segment...)
+		}
+		rest = rest[2+length:]
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNGMetadata drops the eXIf chunk and the iTXt chunk holding XMP data
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.Errorf("Not a png file")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	rest := data[len(pngSignature):]
+
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, errors.Errorf("Truncated png chunk")
+		}
+		length := int(binary.BigEndian.Uint32(rest[:4]))
+		if length < 0 || len(rest) < 12+length {
+			return nil, errors.Errorf("Truncated png chunk")
+		}
+
+		chunk := rest[:12+length]
+		chunkType := string(chunk[4:8])
+		body := chunk[8 : 8+length]
+
+		isMetadata := chunkType == "eXIf" || (chunkType == "iTXt" && bytes.HasPrefix(body, []byte("XML:com.adobe.xmp\x00")))
+		if !isMetadata {
+			if crc32.ChecksumIEEE(chunk[4:8+length]) != binary.BigEndian.Uint32(chunk[8+length:]) {
+				return nil, errors.Errorf("Invalid png chunk checksum for %s", chunkType)
+			}
+			out = append(out, chunk...)
+		}
+		rest = rest[12+length:]
+	}
+
+	return out, nil
+}
+
+// webp extended format flags, in the first byte of the VP8X chunk
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+// stripWebPMetadata drops the EXIF and XMP chunks, clearing their flags
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.Errorf("Not a webp file")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	rest := data[12:]
+
+	for len(rest) > 0 {
+		if len(rest) < 8 {
+			return nil, errors.Errorf("Truncated webp chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		padded := size + size%2
+		if size < 0 || len(rest) < 8+size {
+			return nil, errors.Errorf("Truncated webp chunk")
+		}
+		if len(rest) < 8+padded {
+			padded = size
+		}
+
+		chunk := rest[:8+padded]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+			// dropped
+		case "VP8X":
+			start := len(out)
+			out = append(out, chunk...)
+			if size > 0 {
+				out[start+8] &^= webpFlagXMP | webpFlagEXIF
+			}
+		default:
+			out = append(out, chunk...)
+		}
+		rest = rest[8+padded:]
+	}
+
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,185 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGPSExif = "Exif\x00\x00GPS 51.5N 0.12W"
+
+func pngChunk(chunkType string, body []byte) []byte {
+	chunk := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, body...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testPNG is a 40x30 png with an eXIf chunk after its header
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 30))))
+
+	data := buf.Bytes()
+	headerEnd := len(pngSignature) + 12 + 13 // IHDR
+	out := append([]byte{}, data[:headerEnd]...)
+	out = append(out, pngChunk("eXIf", []byte(testGPSExif[6:]))...)
+	return append(out, data[headerEnd:]...)
+}
+
+// testJPEG is a 16x8 jpeg with an EXIF segment
+func testJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 8)), nil))
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(testGPSExif)))
+	segment = append(segment, testGPSExif...)
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func webpChunk(fourcc string, body []byte) []byte {
+	chunk := append([]byte(fourcc), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// testWebP is an extended 300x200 webp with EXIF data, its image chunk isn't
+// valid but isn't read either
+func testWebP() []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF
+	vp8x[4], vp8x[5] = 299&0xff, 299>>8
+	vp8x[7] = 199
+
+	body := append([]byte("WEBP"), webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2f, 0, 0, 0, 0})...)
+	body = append(body, webpChunk("EXIF", []byte(testGPSExif[6:]))...)
+
+	header := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(body)))
+	return append(header, body...)
+}
+
+func Test_ProbeImage(t *testing.T) {
+	var gifBuf bytes.Buffer
+	require.NoError(t, gif.Encode(&gifBuf, image.NewPaletted(image.Rect(0, 0, 7, 3), color.Palette{color.Black, color.White}), nil))
+
+	for _, tc := range []struct {
+		data     []byte
+		expected ImageMetadata
+	}{
+		{testPNG(t), ImageMetadata{"png", 40, 30}},
+		{testJPEG(t), ImageMetadata{"jpeg", 16, 8}},
+		{gifBuf.Bytes(), ImageMetadata{"gif", 7, 3}},
+		{testWebP(), ImageMetadata{"webp", 300, 200}},
+	} {
+		metadata, err := probeImage(bytes.NewReader(tc.data))
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, *metadata)
+	}
+
+	lossless := append([]byte("RIFF\x00\x00\x00\x00WEBP"), webpChunk("VP8L", []byte{0x2f, 0x3f, 0xc0, 0x0f, 0})...)
+	metadata, err := probeImage(bytes.NewReader(lossless))
+	require.NoError(t, err)
+	assert.Equal(t, ImageMetadata{"webp", 64, 64}, *metadata)
+
+	_, err = probeImage(bytes.NewReader([]byte("not an image")))
+	assert.Error(t, err)
+}
+
+func Test_StripImageMetadata(t *testing.T) {
+	for contentType, data := range map[string][]byte{
+		"image/png":  testPNG(t),
+		"image/jpeg": testJPEG(t),
+		"image/webp": testWebP(),
+	} {
+		require.Contains(t, string(data), "GPS")
+
+		stripped, err := stripImageMetadata(contentType, data)
+		require.NoError(t, err, contentType)
+		assert.NotContains(t, string(stripped), "GPS", contentType)
+
+		metadata, err := probeImage(bytes.NewReader(stripped))
+		require.NoError(t, err, contentType)
+		assert.NotZero(t, metadata.Width, contentType)
+	}
+
+	stripped, err := stripImageMetadata("image/webp", testWebP())
+	require.NoError(t, err)
+	assert.EqualValues(t, len(stripped)-8, binary.LittleEndian.Uint32(stripped[4:8]))
+	assert.Zero(t, stripped[20]&webpFlagEXIF)
+
+	stripped, err = stripImageMetadata("image/png", testPNG(t))
+	require.NoError(t, err)
+	_, err = png.Decode(bytes.NewReader(stripped))
+	assert.NoError(t, err)
+
+	_, err = stripImageMetadata("image/png", []byte("not a png"))
+	assert.Error(t, err)
+}
+
+func Test_ExtractImageContents(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"screenshots/1.png": testPNG(t),
+		"screenshots/2.jpg": testJPEG(t),
+		"broken.png":        []byte("nope"),
+		"readme.txt":        []byte("hello"),
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(data)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "assets.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	extracted, err := archiver.ExtractZip(ctx, "assets.zip", "assets", testLimits(), ExtractOptions{
+		Contents:           ExtractContentsImages,
+		StripImageMetadata: true,
+	})
+	require.NoError(t, err)
+	require.Len(t, extracted, 2)
+
+	for _, file := range extracted {
+		require.IsType(t, &ImageMetadata{}, file.Metadata["images"], file.Key)
+
+		reader, _, err := storage.GetFile(ctx, config.Bucket, file.Key)
+		require.NoError(t, err)
+		stored, err := io.ReadAll(reader)
+		reader.Close()
+		require.NoError(t, err)
+
+		assert.NotContains(t, string(stored), "GPS", file.Key)
+		assert.EqualValues(t, len(stored), file.Size, file.Key)
+	}
+}
@@ -0,0 +1,114 @@
+package zipserver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrJobNotFound is returned by CancelJob for an unknown or forgotten job
+var ErrJobNotFound = errors.New("No such job")
+
+// JobCanceledError is the error of a job stopped with CancelJob
+type JobCanceledError struct {
+	Reason string
+}
+
+func (e *JobCanceledError) Error() string {
+	if e.Reason == "" {
+		return "Job was canceled"
+	}
+	return "Job was canceled: " + e.Reason
+}
+
+// CancelJob cancels the context of a queued, running or retrying job, so it
+// stops waiting for a slot, its storage calls and uploads are interrupted and
+// it isn't attempted again. The job then fails with a JobCanceledError, which
+// is sent to its callback, and an extraction deletes the files it uploaded.
+// reason is reported along, it may be empty.
+func CancelJob(id, reason string) error {
+	_, err := jobs.cancel(id, reason)
+	return err
+}
+
+// cancel marks the job as canceled and cancels its context, it returns a copy
+// of the job
+func (t *jobTable) cancel(id, reason string) (Job, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	job, ok := t.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	if job.State == JobDone || job.State == JobFailed {
+		return *job, badRequestf("Job %s is already %s", id, job.State)
+	}
+
+	job.Canceled = true
+	job.CancelReason = reason
+	t.store.save(job)
+	if job.cancel != nil {
+		job.cancel()
+	}
+	return *job, nil
+}
+
+// canceledError is a JobCanceledError in place of err when the job failed
+// because it was canceled, rather than the context error it ran into
+func (j *Job) canceledError(err error) error {
+	if err == nil || j == nil {
+		return err
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	if !j.Canceled {
+		return err
+	}
+	return &JobCanceledError{j.CancelReason}
+}
+
+// isCanceled is true once CancelJob was called for the job
+func (j *Job) isCanceled() bool {
+	if j == nil {
+		return false
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	return j.Canceled
+}
+
+// cancelJobHandler cancels the job given by job=, see CancelJob
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return badRequestf("Canceling a job requires POST")
+	}
+
+	params := r.URL.Query()
+	id, err := getParam(params, "job")
+	if err != nil {
+		return badRequestf("%v", err)
+	}
+	reason := params.Get("reason")
+
+	job, err := jobs.cancel(id, reason)
+	if errors.Is(err, ErrJobNotFound) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		return writeJSONMessage(w, struct {
+			Type  string
+			Error string
+		}{"JobNotFound", "No job with ID " + id})
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Canceled %s job %s (reason: %q)", job.Type, job.ID, reason)
+	return writeJSONMessage(w, struct {
+		Success bool
+		Job     Job
+	}{true, job})
+}
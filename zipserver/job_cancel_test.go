@@ -0,0 +1,137 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CancelJob(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	job := jobs.newJob("extract", "zips/game.zip", "", "", time.Second, jobCaller{AutoRetry: 3})
+
+	started := make(chan struct{})
+	attempts := 0
+	errs := make(chan error, 1)
+	go func() {
+		_, err := runJobAttempts(job, func(ctx context.Context) (string, error) {
+			attempts++
+			close(started)
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+		errs <- err
+	}()
+
+	<-started
+	require.NoError(t, CancelJob(job.ID, "superseded by a new upload"))
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job wasn't interrupted")
+	}
+
+	var canceled *JobCanceledError
+	require.True(t, errors.As(err, &canceled))
+	assert.Equal(t, "superseded by a new upload", canceled.Reason)
+	// not retried
+	assert.Equal(t, 1, attempts)
+
+	job.finish(err)
+	snapshot, _ := jobs.get(job.ID)
+	assert.Equal(t, JobFailed, snapshot.State)
+	assert.True(t, snapshot.Canceled)
+	assert.Equal(t, "Job was canceled: superseded by a new upload", snapshot.Error)
+
+	// finished jobs can't be canceled
+	err = CancelJob(job.ID, "")
+	var badRequest *badRequestError
+	assert.True(t, errors.As(err, &badRequest))
+
+	assert.Equal(t, ErrJobNotFound, CancelJob("0000000000000000", ""))
+}
+
+func Test_CancelJobDuringBackoff(t *testing.T) {
+	oldConfig := globalConfig
+	oldRetries := jobRetries
+	defer func() {
+		globalConfig = oldConfig
+		jobRetries = oldRetries
+	}()
+	globalConfig = emptyConfig()
+	jobRetries = retryPolicy{Backoff: time.Hour}
+
+	job := jobs.newJob("slurp", "uploads/1", "", "", time.Second, jobCaller{AutoRetry: 3})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := runJobAttempts(job, func(ctx context.Context) (string, error) {
+			return "", errors.New("storage is down")
+		})
+		errs <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		snapshot, _ := jobs.get(job.ID)
+		return snapshot.State == JobRetrying
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, CancelJob(job.ID, ""))
+
+	select {
+	case err := <-errs:
+		assert.EqualError(t, err, "Job was canceled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff wasn't interrupted")
+	}
+}
+
+func Test_CancelJobHandler(t *testing.T) {
+	job := jobs.newJob("delete", "games/1", "", "", 0, jobCaller{})
+	ctx := job.detachedContext()
+	assert.Equal(t, job, jobFromContext(ctx))
+
+	handler := wrapErrors(cancelJobHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/cancel?job="+job.ID, nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NoError(t, ctx.Err())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs/cancel?job="+job.ID+"&reason=oops", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	var result struct {
+		Success bool
+		Job     Job
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.True(t, result.Success)
+	assert.True(t, result.Job.Canceled)
+	assert.Equal(t, "oops", result.Job.CancelReason)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs/cancel?job=0000000000000000", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// no progress updates once canceled
+	progress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("progress update sent for a canceled job")
+	}))
+	defer progress.Close()
+	notifyProgress(progress.URL, time.Second, job, url.Values{"Deleted": {"50"}}, nil)
+}
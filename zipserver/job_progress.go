@@ -0,0 +1,144 @@
+package zipserver
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// how often progress is posted to a progress_callback without
+// progress_interval, and how often it can be asked for
+const (
+	defaultProgressInterval = 10 * time.Second
+	minProgressInterval     = time.Second
+)
+
+// progressReporter posts a job's progress to a progress_callback every
+// `every` files and every interval, whichever comes first. Updates are sent
+// from a goroutine of their own so uploads don't wait on the callback.
+type progressReporter struct {
+	url     string
+	timeout time.Duration
+	// files between updates, 0 to only send them on interval
+	every    int
+	interval time.Duration
+}
+
+// loadProgressReporter reads progress_callback, progress_every and
+// progress_interval, it returns nil when no progress updates are wanted
+func loadProgressReporter(params url.Values, config *Config, timeout time.Duration) (*progressReporter, error) {
+	progressURL := params.Get("progress_callback")
+	if progressURL == "" {
+		return nil, nil
+	}
+	if err := checkParamLength(params, "progress_callback", config.MaxCallbackURLLength); err != nil {
+		return nil, err
+	}
+
+	reporter := &progressReporter{
+		url:      progressURL,
+		timeout:  timeout,
+		interval: defaultProgressInterval,
+	}
+
+	if value := params.Get("progress_every"); value != "" {
+		every, err := strconv.Atoi(value)
+		if err != nil || every <= 0 {
+			return nil, badRequestf("Invalid progress_every: %s", value)
+		}
+		reporter.every = every
+	}
+
+	if value := params.Get("progress_interval"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < minProgressInterval {
+			return nil, badRequestf("Invalid progress_interval: %s (at least %v)", value, minProgressInterval)
+		}
+		reporter.interval = interval
+	}
+
+	return reporter, nil
+}
+
+// start posts the job's progress while it's running, along with the prefix
+// being extracted, until the returned function is called. That should be
+// before the job's final callback. It does nothing for a nil reporter.
+func (p *progressReporter) start(job *Job, prefix string) (stop func()) {
+	if p == nil || job == nil {
+		return func() {}
+	}
+
+	due := make(chan struct{}, 1)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	if p.every > 0 {
+		job.update(func(j *Job) {
+			j.progressHook = func(files int, progress JobProgress) {
+				if (progress.FilesDone-files)/p.every == progress.FilesDone/p.every {
+					return
+				}
+				select {
+				case due <- struct{}{}:
+				default:
+					// an update is already on its way
+				}
+			}
+		})
+	}
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		var last JobProgress
+		for {
+			select {
+			case <-due:
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			snapshot, ok := jobs.get(job.ID)
+			if !ok || snapshot.State != JobRunning || snapshot.Progress == last {
+				continue
+			}
+			last = snapshot.Progress
+			update := progressUpdate{prefix, last}
+			notifyProgress(p.url, p.timeout, job, update.values(), update)
+		}
+	}()
+
+	return func() {
+		job.update(func(j *Job) {
+			j.progressHook = nil
+		})
+		close(done)
+		<-finished
+	}
+}
+
+// progressUpdate is the body of a progress update
+type progressUpdate struct {
+	Prefix string `json:",omitempty"`
+	JobProgress
+}
+
+// values are the legacy form of the update
+func (u progressUpdate) values() url.Values {
+	progress := u.JobProgress
+	values := url.Values{}
+	if u.Prefix != "" {
+		values.Set("Prefix", u.Prefix)
+	}
+	values.Set("FilesDone", fmt.Sprintf("%d", progress.FilesDone))
+	values.Set("BytesDone", fmt.Sprintf("%d", progress.BytesDone))
+	if progress.TotalFiles > 0 {
+		values.Set("TotalFiles", fmt.Sprintf("%d", progress.TotalFiles))
+	}
+	return values
+}
@@ -0,0 +1,92 @@
+package zipserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadProgressReporter(t *testing.T) {
+	config := emptyConfig()
+
+	reporter, err := loadProgressReporter(url.Values{}, config, time.Second)
+	require.NoError(t, err)
+	assert.Nil(t, reporter)
+
+	reporter, err = loadProgressReporter(url.Values{"progress_callback": {"http://localhost/progress"}}, config, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, defaultProgressInterval, reporter.interval)
+	assert.Equal(t, 0, reporter.every)
+
+	reporter, err = loadProgressReporter(url.Values{
+		"progress_callback": {"http://localhost/progress"},
+		"progress_every":    {"100"},
+		"progress_interval": {"30s"},
+	}, config, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 100, reporter.every)
+	assert.Equal(t, 30*time.Second, reporter.interval)
+
+	for _, params := range []url.Values{
+		{"progress_callback": {"http://localhost/progress"}, "progress_every": {"0"}},
+		{"progress_callback": {"http://localhost/progress"}, "progress_every": {"many"}},
+		{"progress_callback": {"http://localhost/progress"}, "progress_interval": {"10ms"}},
+	} {
+		_, err := loadProgressReporter(params, config, time.Second)
+		var badRequest *badRequestError
+		assert.ErrorAs(t, err, &badRequest, "%v", params)
+	}
+}
+
+func Test_ProgressReporter(t *testing.T) {
+	updates := make(chan url.Values, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		updates <- r.PostForm
+	}))
+	defer server.Close()
+
+	job := jobs.newJob("extract", "zips/game.zip", "games/1", "", time.Second, jobCaller{})
+	job.start()
+	job.setTotalFiles(5)
+
+	reporter := &progressReporter{url: server.URL, timeout: time.Second, every: 2, interval: time.Hour}
+	stop := reporter.start(job, "games/1")
+
+	job.addProgress(1, 100)
+	select {
+	case values := <-updates:
+		t.Fatalf("unexpected update %v", values)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	job.addProgress(1, 50)
+	select {
+	case values := <-updates:
+		assert.Equal(t, "games/1", values.Get("Prefix"))
+		assert.Equal(t, job.ID, values.Get("JobID"))
+		assert.Equal(t, "2", values.Get("FilesDone"))
+		assert.Equal(t, "5", values.Get("TotalFiles"))
+		assert.Equal(t, "150", values.Get("BytesDone"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no progress update after 2 files")
+	}
+
+	// nothing once stopped, the final callback comes next
+	stop()
+	job.addProgress(2, 10)
+	select {
+	case values := <-updates:
+		t.Fatalf("update after stop %v", values)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a nil reporter is a no-op
+	var noReporter *progressReporter
+	noReporter.start(job, "")()
+}
@@ -0,0 +1,83 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// waits between the attempts of a job started with auto_retry, until
+// setupJobRetries is called
+var jobRetries = retryPolicy{Backoff: 10 * time.Second, MaxBackoff: 5 * time.Minute}
+
+func setupJobRetries(config *Config) {
+	jobRetries = retryPolicy{
+		Backoff:    time.Duration(config.JobRetryBackoff),
+		MaxBackoff: time.Duration(config.JobRetryMaxBackoff),
+	}
+}
+
+// retryableJobError is false for failures another attempt would run into
+// again, eg. an invalid zip or one over the limits, or that it's not meant to
+// get, eg. a canceled job
+func retryableJobError(err error) bool {
+	var badRequest *badRequestError
+	var password *ZipPasswordError
+	var prefixNotEmpty *PrefixNotEmptyError
+	var malware *MalwareDetectedError
+	var diagnostic *ZipDiagnosticError
+	var limit *LimitError
+	var readOnly *readOnlyError
+	var canceled *JobCanceledError
+
+	return !errors.As(err, &badRequest) &&
+		!errors.As(err, &password) &&
+		!errors.As(err, &prefixNotEmpty) &&
+		!errors.As(err, &malware) &&
+		!errors.As(err, &diagnostic) &&
+		!errors.As(err, &limit) &&
+		!errors.As(err, &readOnly) &&
+		!errors.As(err, &canceled)
+}
+
+// runJobAttempts runs attempt, each time with a context of its own that
+// times out after JobTimeout, and is canceled along with the job. A failed
+// attempt is made again after a backoff, up to the job's AutoRetry times,
+// unless retrying can't help or the job was canceled.
+func runJobAttempts[T any](job *Job, attempt func(ctx context.Context) (T, error)) (T, error) {
+	jobCtx := job.detachedContext()
+
+	for number := 1; ; number++ {
+		job.updateState(func(j *Job) {
+			j.Attempt = number
+			j.Progress = JobProgress{}
+			j.Error = ""
+		})
+
+		ctx, cancel := context.WithTimeout(jobCtx, time.Duration(globalConfig.JobTimeout))
+		result, err := attempt(ctx)
+		cancel()
+
+		err = job.canceledError(err)
+		if err == nil || number > job.AutoRetry || !retryableJobError(err) {
+			return result, err
+		}
+
+		wait := jobRetries.wait(number)
+		logPrintf(ctx, "Attempt %d failed, trying again in %s: %v", number, wait, err)
+		globalMetrics.TotalJobRetries.Add(1)
+
+		job.updateState(func(j *Job) {
+			j.State = JobRetrying
+			j.Error = err.Error()
+		})
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-jobCtx.Done():
+			timer.Stop()
+			return result, job.canceledError(err)
+		}
+	}
+}
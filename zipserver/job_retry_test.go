@@ -0,0 +1,105 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RunJobAttempts(t *testing.T) {
+	oldConfig := globalConfig
+	oldRetries := jobRetries
+	defer func() {
+		globalConfig = oldConfig
+		jobRetries = oldRetries
+	}()
+	globalConfig = emptyConfig()
+	jobRetries = retryPolicy{Backoff: time.Millisecond}
+
+	job := jobs.newJob("slurp", "uploads/1", "", "", time.Second, jobCaller{AutoRetry: 3})
+	retries := globalMetrics.TotalJobRetries.Load()
+
+	attempts := 0
+	result, err := runJobAttempts(job, func(ctx context.Context) (string, error) {
+		attempts++
+		assert.Equal(t, job, jobFromContext(ctx))
+		if attempts < 3 {
+			return "", errors.New("storage is down")
+		}
+		return "done", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "done", result)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, retries+2, globalMetrics.TotalJobRetries.Load())
+
+	snapshot, _ := jobs.get(job.ID)
+	assert.Equal(t, 3, snapshot.Attempt)
+	assert.Empty(t, snapshot.Error)
+
+	// retries run out
+	attempts = 0
+	_, err = runJobAttempts(job, func(ctx context.Context) (string, error) {
+		attempts++
+		return "", errors.New("storage is down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 4, attempts)
+
+	// failures another attempt won't fix
+	attempts = 0
+	_, err = runJobAttempts(job, func(ctx context.Context) (string, error) {
+		attempts++
+		return "", &ZipPasswordError{Code: ZipPasswordMissing}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func Test_RetryableJobError(t *testing.T) {
+	assert.True(t, retryableJobError(errors.New("storage is down")))
+
+	// a zip over the limits is still over them next time
+	archiver := &Archiver{nil, emptyConfig()}
+	limits := testLimits()
+	limits.MaxNumFiles = 1
+
+	_, err := archiver.selectZipFiles(context.Background(), []*zip.File{{}, {}}, limits, &ExtractOptions{})
+	require.Error(t, err)
+	assert.False(t, retryableJobError(err))
+	assert.False(t, retryableJobError(&LimitError{LimitViolation{Limit: "MaxTotalSize"}}))
+}
+
+func Test_AutoRetryParam(t *testing.T) {
+	config := emptyConfig()
+	config.MaxJobAutoRetry = 3
+
+	caller, err := loadJobCaller(url.Values{"auto_retry": {"2"}}, config)
+	require.NoError(t, err)
+	assert.Equal(t, 2, caller.AutoRetry)
+
+	for _, value := range []string{"4", "-1", "often"} {
+		_, err = loadJobCaller(url.Values{"auto_retry": {value}}, config)
+		assert.Error(t, err, value)
+	}
+
+	var received url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r.PostForm
+	}))
+	defer server.Close()
+
+	job := jobs.newJob("extract", "zips/game.zip", "games/1", server.URL, time.Second, caller)
+	job.updateState(func(j *Job) { j.Attempt = 2 })
+	require.NoError(t, notifyCallback(server.URL, time.Second, job, url.Values{"Success": {"true"}}, nil))
+	assert.Equal(t, "2", received.Get("Attempt"))
+}
@@ -0,0 +1,239 @@
+package zipserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// historyFileName holds the operation history in the store, one JSON entry
+// per line
+const historyFileName = "history.jsonl"
+
+// jobStore keeps a JSON file per unfinished job in a directory. Jobs can't be
+// resumed, but the ones a restart interrupted are found on startup and
+// reported as failed, so callers aren't left waiting for a callback.
+type jobStore struct {
+	dir string
+}
+
+// savedJob is a job as written to the store
+type savedJob struct {
+	Job
+	CallbackURL     string   `json:",omitempty"`
+	CallbackTimeout Duration `json:",omitempty"`
+}
+
+func newJobStore(dir string) (*jobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &jobStore{dir: dir}, nil
+}
+
+func (s *jobStore) jobPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// save writes the job, replacing the previous version atomically
+func (s *jobStore) save(job *Job) {
+	if s == nil {
+		return
+	}
+
+	blob, err := json.Marshal(savedJob{
+		Job:             *job,
+		CallbackURL:     job.callbackURL,
+		CallbackTimeout: Duration(job.callbackTimeout),
+	})
+	if err != nil {
+		log.Printf("Failed to encode job %s: %v", job.ID, err)
+		return
+	}
+
+	tmpPath := s.jobPath(job.ID) + ".tmp"
+	err = os.WriteFile(tmpPath, blob, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, s.jobPath(job.ID))
+	}
+	if err != nil {
+		log.Printf("Failed to save job %s: %v", job.ID, err)
+	}
+}
+
+func (s *jobStore) remove(job *Job) {
+	if s == nil {
+		return
+	}
+
+	err := os.Remove(s.jobPath(job.ID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove saved job %s: %v", job.ID, err)
+	}
+}
+
+// load returns every job in the store
+func (s *jobStore) load() ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := []*Job{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		blob, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var saved savedJob
+		err = json.Unmarshal(blob, &saved)
+		if err != nil || saved.ID == "" {
+			log.Printf("Skipping unreadable saved job %s: %v", entry.Name(), err)
+			continue
+		}
+
+		job := saved.Job
+		job.callbackURL = saved.CallbackURL
+		job.callbackTimeout = time.Duration(saved.CallbackTimeout)
+		loaded = append(loaded, &job)
+	}
+
+	return loaded, nil
+}
+
+// appendHistory adds a finished operation to the history file
+func (s *jobStore) appendHistory(entry HistoryEntry) {
+	if s == nil {
+		return
+	}
+
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode history entry: %v", err)
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dir, historyFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = file.Write(append(blob, '\n'))
+		file.Close()
+	}
+	if err != nil {
+		log.Printf("Failed to save history entry: %v", err)
+	}
+}
+
+// loadHistory returns the last maxHistoryRecords entries of the history file,
+// which is rewritten with only them so it doesn't grow forever
+func (s *jobStore) loadHistory() ([]HistoryEntry, error) {
+	fname := filepath.Join(s.dir, historyFileName)
+
+	file, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []HistoryEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping unreadable history entry: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(entries) > maxHistoryRecords {
+		entries = entries[len(entries)-maxHistoryRecords:]
+	}
+
+	var compacted bytes.Buffer
+	for _, entry := range entries {
+		blob, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		compacted.Write(append(blob, '\n'))
+	}
+
+	err = os.WriteFile(fname+".tmp", compacted.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(fname+".tmp", fname)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// setupJobStore enables saving jobs to JobStateDir, and fails the jobs that a
+// previous process left unfinished
+func setupJobStore(config *Config) error {
+	if config.JobStateDir == "" {
+		return nil
+	}
+
+	store, err := newJobStore(config.JobStateDir)
+	if err != nil {
+		return err
+	}
+
+	interrupted, err := store.load()
+	if err != nil {
+		return err
+	}
+
+	pastHistory, err := store.loadHistory()
+	if err != nil {
+		return err
+	}
+
+	history.Lock()
+	history.entries = pastHistory
+	history.Unlock()
+
+	jobs.Lock()
+	jobs.store = store
+	for _, job := range interrupted {
+		jobs.add(job)
+	}
+	jobs.Unlock()
+
+	for _, job := range interrupted {
+		log.Printf("Job %s (%s %s) was interrupted by a restart", job.ID, job.Type, job.Key)
+
+		err := fmt.Errorf("Job was interrupted by a zipserver restart while %s", job.State)
+		job.finish(err)
+
+		if job.callbackURL != "" {
+			job := job
+			startBackgroundJob(func() {
+				notifyError(job.callbackURL, job.callbackTimeout, job, err)
+			})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package zipserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_JobStore(t *testing.T) {
+	store, err := newJobStore(t.TempDir())
+	require.NoError(t, err)
+
+	job := &Job{
+		ID:              "0123456789abcdef",
+		Type:            "extract",
+		Key:             "zips/game.zip",
+		Prefix:          "games/1",
+		State:           JobRunning,
+		callbackURL:     "http://example.com/callback",
+		callbackTimeout: 10 * time.Second,
+	}
+	store.save(job)
+
+	loaded, err := store.load()
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	assert.Equal(t, job.Prefix, loaded[0].Prefix)
+	assert.Equal(t, JobRunning, loaded[0].State)
+	assert.Equal(t, job.callbackURL, loaded[0].callbackURL)
+	assert.Equal(t, job.callbackTimeout, loaded[0].callbackTimeout)
+
+	store.remove(job)
+	loaded, err = store.load()
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+}
+
+func Test_SetupJobStoreFailsInterruptedJobs(t *testing.T) {
+	notified := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		notified <- r.PostForm.Get("Error")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	store, err := newJobStore(dir)
+	require.NoError(t, err)
+	store.save(&Job{ID: "interrupted", Type: "copy", State: JobQueued, callbackURL: server.URL, callbackTimeout: time.Second})
+
+	defer func() {
+		jobs.Lock()
+		jobs.store = nil
+		jobs.Unlock()
+	}()
+	require.NoError(t, setupJobStore(&Config{JobStateDir: dir}))
+
+	job, ok := jobs.get("interrupted")
+	require.True(t, ok)
+	assert.Equal(t, JobFailed, job.State)
+
+	select {
+	case message := <-notified:
+		assert.Contains(t, message, "interrupted by a zipserver restart")
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback wasn't sent")
+	}
+
+	_, err = os.Stat(store.jobPath("interrupted"))
+	assert.True(t, os.IsNotExist(err))
+}
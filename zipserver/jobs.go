@@ -0,0 +1,338 @@
+package zipserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJobRecords is how many jobs jobTable remembers, the oldest finished ones
+// are forgotten first
+const maxJobRecords = 1000
+
+// JobState is where an async job is in its lifetime
+type JobState string
+
+const (
+	JobQueued  JobState = "queued"  // waiting for a slot in its scheduler
+	JobRunning JobState = "running" // started, see Progress
+	// waiting to make another attempt, see runJobAttempts
+	JobRetrying JobState = "retrying"
+	JobDone     JobState = "done"
+	JobFailed   JobState = "failed"
+)
+
+// JobProgress counts the work done so far by a job
+type JobProgress struct {
+	TotalFiles int `json:",omitempty"` // once known
+	FilesDone  int
+	BytesDone  uint64
+}
+
+// Job is an async extract, copy, slurp or rename, polled with /job/{id}
+type Job struct {
+	ID         string
+	Type       string
+	Key        string
+	Prefix     string `json:",omitempty"`
+	State      JobState
+	Progress   JobProgress
+	Error      string `json:",omitempty"`
+	CreatedAt  time.Time
+	StartedAt  time.Time `json:",omitempty"`
+	FinishedAt time.Time `json:",omitempty"`
+	// callbacks aren't sent again once one with this key was acknowledged
+	IdempotencyKey string `json:",omitempty"`
+	// passed by the caller, eg. to find the database row the job is for
+	Context string `json:",omitempty"`
+	// of the request that started the job, logged along with the job ID
+	RequestID string `json:",omitempty"`
+	// failed attempts are made again up to AutoRetry times, Attempt counts
+	// them from 1
+	AutoRetry int `json:",omitempty"`
+	Attempt   int `json:",omitempty"`
+	// 2 for jobs started from /v2, their callbacks are posted as JSON
+	APIVersion int `json:",omitempty"`
+	// set by CancelJob, the job then fails with a JobCanceledError
+	Canceled     bool   `json:",omitempty"`
+	CancelReason string `json:",omitempty"`
+
+	// where the result is sent, not shown in /job since it may hold secrets
+	callbackURL     string
+	callbackTimeout time.Duration
+	// spans the job's lifetime when tracing is on
+	span *span
+	// the admission slot of the request that started the job, freed once
+	// the job is over
+	admission *admissionTicket
+	// the API key of the request that started the job, for fair scheduling
+	apiKey *APIKeyConfig
+	// the job's work runs in ctx, see detachedContext, cancel is called by
+	// CancelJob
+	ctx    context.Context
+	cancel context.CancelFunc
+	// called with the files just done and the progress so far, see
+	// progressReporter
+	progressHook func(files int, progress JobProgress)
+}
+
+type jobTable struct {
+	sync.Mutex
+	jobs  map[string]*Job
+	order []string
+	// saves unfinished jobs, nil when JobStateDir isn't set
+	store *jobStore
+}
+
+var jobs = &jobTable{jobs: map[string]*Job{}}
+
+type jobContextKey struct{}
+
+// newJob registers a queued job and returns it, its result is to be sent to
+// callbackURL
+func (t *jobTable) newJob(jobType, key, prefix, callbackURL string, callbackTimeout time.Duration, caller jobCaller) *Job {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	job := &Job{
+		ID:              hex.EncodeToString(idBytes),
+		Type:            jobType,
+		Key:             key,
+		Prefix:          prefix,
+		State:           JobQueued,
+		CreatedAt:       time.Now(),
+		IdempotencyKey:  caller.IdempotencyKey,
+		Context:         caller.Context,
+		AutoRetry:       caller.AutoRetry,
+		callbackURL:     callbackURL,
+		callbackTimeout: callbackTimeout,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.add(job)
+	t.store.save(job)
+
+	return job
+}
+
+// add puts job in the table, forgetting an old finished job if it's full.
+// Caller holds the lock.
+func (t *jobTable) add(job *Job) {
+	t.jobs[job.ID] = job
+	t.order = append(t.order, job.ID)
+
+	if len(t.order) > maxJobRecords {
+		for i, id := range t.order {
+			if state := t.jobs[id].State; state == JobDone || state == JobFailed {
+				delete(t.jobs, id)
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// get returns a copy of the job with the given ID
+func (t *jobTable) get(id string) (Job, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	job, ok := t.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// The following methods may be called on a nil job, for the sync codepaths
+
+func (j *Job) update(fn func(*Job)) {
+	if j == nil {
+		return
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	fn(j)
+}
+
+// updateState is update for state changes, which are saved to the store
+func (j *Job) updateState(fn func(*Job)) {
+	if j == nil {
+		return
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	fn(j)
+
+	if j.State == JobDone || j.State == JobFailed {
+		jobs.store.remove(j)
+	} else {
+		jobs.store.save(j)
+	}
+}
+
+// start marks the job as running, once it got a slot
+func (j *Job) start() {
+	j.updateState(func(j *Job) {
+		j.State = JobRunning
+		j.StartedAt = time.Now()
+	})
+}
+
+func (j *Job) setTotalFiles(total int) {
+	j.update(func(j *Job) {
+		j.Progress.TotalFiles = total
+	})
+}
+
+func (j *Job) addProgress(files int, bytes uint64) {
+	var progress JobProgress
+	var hook func(files int, progress JobProgress)
+	j.update(func(j *Job) {
+		j.Progress.FilesDone += files
+		j.Progress.BytesDone += bytes
+		progress, hook = j.Progress, j.progressHook
+	})
+	if hook != nil {
+		hook(files, progress)
+	}
+}
+
+// finish marks the job as done, or failed when err is set
+func (j *Job) finish(err error) {
+	var ticket *admissionTicket
+	j.updateState(func(j *Job) {
+		j.State = JobDone
+		if err != nil && j.Canceled {
+			err = &JobCanceledError{j.CancelReason}
+		}
+		if err != nil {
+			j.State = JobFailed
+			j.Error = err.Error()
+		}
+		j.FinishedAt = time.Now()
+		ticket, j.admission = j.admission, nil
+	})
+	j.traceSpan().finish(err)
+	ticket.release()
+}
+
+// linkRequest records the request that started the job: its ID and API
+// version, its span as the parent of the job's span, its admission slot, held
+// until the job finishes, and its API key
+func (j *Job) linkRequest(ctx context.Context) {
+	if j == nil {
+		return
+	}
+
+	var current *span
+	if tracer != nil {
+		current = newSpan(spanFromContext(ctx), spanKindInternal, j.Type+" job",
+			[]string{"zipserver.job", j.ID, "zipserver.key", j.Key})
+	}
+
+	key := apiKeyFromContext(ctx)
+	j.updateState(func(j *Job) {
+		j.RequestID = requestIDFromContext(ctx)
+		j.APIVersion = apiVersionFromContext(ctx)
+		j.span = current
+		j.admission = admissionFromContext(ctx).hold()
+		j.apiKey = key
+	})
+}
+
+// traceSpan is the job's span, nil when there's no job or tracing is off
+func (j *Job) traceSpan() *span {
+	if j == nil {
+		return nil
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	return j.span
+}
+
+// requestAPIKey is the API key of the request that started the job, nil when
+// there's no job or no key
+func (j *Job) requestAPIKey() *APIKeyConfig {
+	if j == nil {
+		return nil
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	return j.apiKey
+}
+
+// detachedContext is the context the job's work runs in: it outlives the
+// request that started the job, and is canceled by CancelJob. Without a job
+// it's a background context.
+func (j *Job) detachedContext() context.Context {
+	if j == nil || j.ctx == nil {
+		return withJob(context.Background(), j)
+	}
+	return withJob(j.ctx, j)
+}
+
+// jsonCallbacks is true when the job's callbacks are posted as JSON
+func (j *Job) jsonCallbacks() bool {
+	return j != nil && j.APIVersion >= 2
+}
+
+// jobID is "" for a nil job
+func (j *Job) jobID() string {
+	if j == nil {
+		return ""
+	}
+	return j.ID
+}
+
+func withJob(ctx context.Context, job *Job) context.Context {
+	return context.WithValue(ctx, jobContextKey{}, job)
+}
+
+// jobFromContext returns the job running in ctx, or nil for a sync request
+func jobFromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobContextKey{}).(*Job)
+	return job
+}
+
+// writeJobStarted is the response to a request that started an async job
+func writeJobStarted(w http.ResponseWriter, job *Job) error {
+	return writeJSONMessage(w, struct {
+		Processing bool
+		Async      bool
+		JobID      string
+	}{true, true, job.ID})
+}
+
+// jobHandler returns the state of the job at /job/{id}
+func jobHandler(w http.ResponseWriter, r *http.Request) error {
+	id := strings.TrimPrefix(r.URL.Path, "/job/")
+	if id == "" {
+		return badRequestf("Missing job ID")
+	}
+
+	job, ok := jobs.get(id)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		return writeJSONMessage(w, struct {
+			Type  string
+			Error string
+		}{"JobNotFound", "No job with ID " + id})
+	}
+
+	return writeJSONMessage(w, job)
+}
@@ -0,0 +1,66 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_JobLifecycle(t *testing.T) {
+	job := jobs.newJob("extract", "zips/game.zip", "", "", 0, jobCaller{})
+	assert.Len(t, job.ID, 16)
+	assert.Equal(t, JobQueued, job.State)
+
+	ctx := withJob(context.Background(), job)
+	assert.Equal(t, job, jobFromContext(ctx))
+	assert.Nil(t, jobFromContext(context.Background()))
+
+	job.start()
+	job.setTotalFiles(3)
+	job.addProgress(1, 100)
+	job.addProgress(1, 50)
+
+	snapshot, ok := jobs.get(job.ID)
+	require.True(t, ok)
+	assert.Equal(t, JobRunning, snapshot.State)
+	assert.Equal(t, JobProgress{TotalFiles: 3, FilesDone: 2, BytesDone: 150}, snapshot.Progress)
+
+	job.finish(errors.New("upload failed"))
+	snapshot, _ = jobs.get(job.ID)
+	assert.Equal(t, JobFailed, snapshot.State)
+	assert.Equal(t, "upload failed", snapshot.Error)
+
+	// sync requests have no job
+	var noJob *Job
+	noJob.start()
+	noJob.finish(nil)
+	assert.Equal(t, "", noJob.jobID())
+}
+
+func Test_JobHandler(t *testing.T) {
+	job := jobs.newJob("copy", "zips/game.zip", "", "", 0, jobCaller{})
+	job.start()
+	job.finish(nil)
+
+	handler := wrapErrors(jobHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/job/"+job.ID, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var result Job
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, job.ID, result.ID)
+	assert.Equal(t, JobDone, result.State)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/job/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+}
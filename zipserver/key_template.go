@@ -0,0 +1,233 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	errors "github.com/go-errors/errors"
+)
+
+// keyTemplateVars are the variables a key template can use, for an entry
+// stored as eg. "Assets/Logo.PNG" under "games/1":
+//
+//	prefix: games/1
+//	name:   Assets/Logo.PNG, the path in the zip
+//	dir:    Assets
+//	base:   Logo.PNG
+//	stem:   Logo
+//	ext:    .PNG
+//	crc32:  checksum from the zip header, 8 hex digits
+//	sha1:   checksum of the contents, which are read once more to compute it
+var keyTemplateVars = map[string]bool{
+	"prefix": true, "name": true, "dir": true, "base": true, "stem": true,
+	"ext": true, "crc32": true, "sha1": true,
+}
+
+// keyTemplateFilters transform a variable's value, eg. {{name|lower}}
+var keyTemplateFilters = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// KeyTemplate lays out the keys extracted files are stored at, eg.
+// "{{prefix}}/{{sha1}}/{{name}}" instead of prefix/name
+type KeyTemplate struct {
+	source string
+	parts  []keyTemplatePart
+}
+
+type keyTemplatePart struct {
+	literal  string
+	variable string // empty for literals
+	filters  []func(string) string
+}
+
+// parseKeyTemplate checks every variable and filter exists, and that keys
+// stay under the prefix
+func parseKeyTemplate(source string) (*KeyTemplate, error) {
+	if !strings.HasPrefix(source, "{{prefix}}/") {
+		return nil, fmt.Errorf("Invalid key template %q: must start with {{prefix}}/", source)
+	}
+
+	template := &KeyTemplate{source: source}
+	rest := source
+	unique := false
+
+	for rest != "" {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			template.parts = append(template.parts, keyTemplatePart{literal: rest})
+			break
+		}
+		if start > 0 {
+			template.parts = append(template.parts, keyTemplatePart{literal: rest[:start]})
+		}
+
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("Invalid key template %q: unclosed {{", source)
+		}
+
+		fields := strings.Split(rest[start+2:start+end], "|")
+		part := keyTemplatePart{variable: strings.TrimSpace(fields[0])}
+		if !keyTemplateVars[part.variable] {
+			return nil, fmt.Errorf("Invalid key template %q: unknown variable %q", source, part.variable)
+		}
+		for _, name := range fields[1:] {
+			filter, ok := keyTemplateFilters[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("Invalid key template %q: unknown filter %q", source, name)
+			}
+			part.filters = append(part.filters, filter)
+		}
+
+		switch part.variable {
+		case "name", "base", "stem", "sha1", "crc32":
+			unique = true
+		}
+
+		template.parts = append(template.parts, part)
+		rest = rest[start+end+2:]
+	}
+
+	if !unique {
+		return nil, fmt.Errorf("Invalid key template %q: needs one of {{name}}, {{base}}, {{stem}}, {{sha1}} or {{crc32}} to tell files apart", source)
+	}
+
+	return template, nil
+}
+
+// loadKeyTemplate is the template of an extraction, whichever way it was
+// requested: the key_template param, then the KeyTemplate of the storage
+// target the archive is read from, if any, then ExtractKeyTemplate. It's nil
+// when none is set.
+func loadKeyTemplate(params url.Values, config *Config, source *extractSource) (*KeyTemplate, error) {
+	template := params.Get("key_template")
+	if template == "" && source != nil && source.Target != nil {
+		template = source.Target.KeyTemplate
+	}
+	if template == "" {
+		template = config.ExtractKeyTemplate
+	}
+	if template == "" {
+		return nil, nil
+	}
+	return parseKeyTemplate(template)
+}
+
+func (t *KeyTemplate) String() string {
+	return t.source
+}
+
+// needsContents is true when the template uses {{sha1}}
+func (t *KeyTemplate) needsContents() bool {
+	for _, part := range t.parts {
+		if part.variable == "sha1" {
+			return true
+		}
+	}
+	return false
+}
+
+// key renders the template for the entry stored as name under prefix, sha1
+// is only used by templates that need the contents
+func (t *KeyTemplate) key(prefix, name string, file *zip.File, sha1 string) (string, error) {
+	base := path.Base(name)
+	ext := path.Ext(base)
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+
+	values := map[string]string{
+		"prefix": prefix,
+		"name":   name,
+		"dir":    dir,
+		"base":   base,
+		"stem":   strings.TrimSuffix(base, ext),
+		"ext":    ext,
+		"crc32":  fmt.Sprintf("%08x", file.CRC32),
+		"sha1":   sha1,
+	}
+
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.variable == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		value := values[part.variable]
+		for _, filter := range part.filters {
+			value = filter(value)
+		}
+		b.WriteString(value)
+	}
+
+	key := path.Clean(b.String())
+	if !strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/") {
+		return "", fmt.Errorf("Key template %q puts %s outside of the prefix", t.source, name)
+	}
+	return key, nil
+}
+
+// storedKey is the key the zip entry file is uploaded to under prefix, or ""
+// when it depends on the contents and has to be worked out by contentKey
+func (opts *ExtractOptions) storedKey(prefix string, file *zip.File) (string, error) {
+	name := opts.analyses.storedName(file.Name)
+	if opts.KeyTemplate == nil {
+		return path.Join(prefix, name), nil
+	}
+	if opts.KeyTemplate.needsContents() {
+		return "", nil
+	}
+	return opts.KeyTemplate.key(prefix, name, file, "")
+}
+
+// contentKey reads file to render a key template that needs its contents
+func (opts *ExtractOptions) contentKey(prefix string, file *zip.File) (string, error) {
+	reader := opts.buffers.reader(file.Name)
+	if reader == nil {
+		entry, err := openZipEntry(file, opts.Password)
+		if err != nil {
+			return "", errors.Wrap(err, 0)
+		}
+		defer entry.Close()
+		reader = entry
+	}
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	return opts.KeyTemplate.key(prefix, opts.analyses.storedName(file.Name), file, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// checkTemplatedKeys fails if two entries would be stored at the same key,
+// eg. with a {{name|lower}} template. Keys depending on the contents are
+// only the same for identical files, so they're not checked.
+func checkTemplatedKeys(prefix string, files []*zip.File, opts *ExtractOptions) error {
+	if opts.KeyTemplate == nil || opts.KeyTemplate.needsContents() {
+		return nil
+	}
+
+	seen := make(map[string]string, len(files))
+	for _, file := range files {
+		key, err := opts.storedKey(prefix, file)
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("Key template %q stores both %s and %s at %s", opts.KeyTemplate, other, file.Name, key)
+		}
+		seen[key] = file.Name
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseKeyTemplate(t *testing.T) {
+	file := &zip.File{FileHeader: zip.FileHeader{Name: "Assets/Logo.PNG", CRC32: 0xbeef}}
+
+	for source, expected := range map[string]string{
+		"{{prefix}}/{{name}}":                   "games/1/Assets/Logo.PNG",
+		"{{prefix}}/{{name|lower}}":             "games/1/assets/logo.png",
+		"{{prefix}}/{{crc32}}{{ext | lower}}":   "games/1/0000beef.png",
+		"{{prefix}}/{{dir}}/{{stem}}-v2{{ext}}": "games/1/Assets/Logo-v2.PNG",
+		"{{prefix}}/files/{{base|upper|lower}}": "games/1/files/logo.png",
+	} {
+		template, err := parseKeyTemplate(source)
+		require.NoError(t, err, source)
+		assert.False(t, template.needsContents())
+
+		key, err := template.key("games/1", file.Name, file, "")
+		require.NoError(t, err, source)
+		assert.Equal(t, expected, key, source)
+	}
+
+	for _, invalid := range []string{
+		"{{name}}",
+		"files/{{prefix}}/{{name}}",
+		"{{prefix}}/{{size}}",
+		"{{prefix}}/{{name|reverse}}",
+		"{{prefix}}/{{name",
+		"{{prefix}}/{{ext}}",
+	} {
+		_, err := parseKeyTemplate(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	template, err := parseKeyTemplate("{{prefix}}/{{sha1}}/{{base}}")
+	require.NoError(t, err)
+	assert.True(t, template.needsContents())
+
+	template, err = parseKeyTemplate("{{prefix}}/{{base}}")
+	require.NoError(t, err)
+	_, err = template.key("games/1", "../../Logo.PNG", file, "")
+	assert.NoError(t, err, "base has no slashes")
+
+	template, err = parseKeyTemplate("{{prefix}}/{{dir}}/../../{{base}}")
+	require.NoError(t, err)
+	_, err = template.key("games/1", "Assets/Logo.PNG", file, "")
+	assert.Error(t, err, "outside of the prefix")
+
+	config := emptyConfig()
+	config.ExtractKeyTemplate = "{{prefix}}/{{name|lower}}"
+	template, err = loadKeyTemplate(url.Values{}, config, nil)
+	require.NoError(t, err)
+	assert.Equal(t, config.ExtractKeyTemplate, template.String())
+
+	template, err = loadKeyTemplate(url.Values{"key_template": {"{{prefix}}/{{crc32}}"}}, config, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "{{prefix}}/{{crc32}}", template.String())
+
+	// the template of the target the archive comes from
+	source := &extractSource{Target: &StorageConfig{Name: "uploads", KeyTemplate: "{{prefix}}/{{sha1}}/{{base}}"}, Key: "game.zip"}
+	template, err = loadKeyTemplate(url.Values{}, config, source)
+	require.NoError(t, err)
+	assert.Equal(t, "{{prefix}}/{{sha1}}/{{base}}", template.String())
+
+	template, err = loadKeyTemplate(url.Values{"key_template": {"{{prefix}}/{{crc32}}"}}, config, source)
+	require.NoError(t, err)
+	assert.Equal(t, "{{prefix}}/{{crc32}}", template.String())
+
+	template, err = loadKeyTemplate(url.Values{}, config, &extractSource{URL: "https://example.com/game.zip"})
+	require.NoError(t, err)
+	assert.Equal(t, config.ExtractKeyTemplate, template.String())
+
+	invalid := StorageConfig{Name: "uploads", Type: S3, Bucket: "uploads", S3Endpoint: "s3.amazonaws.com", S3Region: "us-east-1", KeyTemplate: "{{nope}}"}
+	assert.Error(t, invalid.Validate())
+}
+
+func Test_ExtractWithKeyTemplate(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	writeZip := func(files map[string]string) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, contents := range files {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			w.Write([]byte(contents))
+		}
+		require.NoError(t, zw.Close())
+
+		fname := filepath.Join(t.TempDir(), "game.zip")
+		require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+		return fname
+	}
+
+	fname := writeZip(map[string]string{"Index.HTML": "<html></html>", "Data/Level1.bin": "level one"})
+
+	template, err := parseKeyTemplate("{{prefix}}/{{sha1}}/{{name|lower}}")
+	require.NoError(t, err)
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "games/1", testLimits(), ExtractOptions{KeyTemplate: template})
+	require.NoError(t, err)
+
+	sum := func(contents string) string {
+		hash := sha1.Sum([]byte(contents))
+		return hex.EncodeToString(hash[:])
+	}
+
+	keys := []string{}
+	for _, file := range files {
+		keys = append(keys, file.Key)
+	}
+	assert.ElementsMatch(t, []string{
+		"games/1/" + sum("<html></html>") + "/index.html",
+		"games/1/" + sum("level one") + "/data/level1.bin",
+	}, keys)
+
+	_, headers, err := storage.GetFile(ctx, config.Bucket, "games/1/"+sum("<html></html>")+"/index.html")
+	require.NoError(t, err)
+	assert.Equal(t, "text/html; charset=utf-8", headers.Get("Content-Type"))
+
+	// both would be stored at games/2/readme.txt
+	fname = writeZip(map[string]string{"README.txt": "a", "readme.txt": "b"})
+	template, err = parseKeyTemplate("{{prefix}}/{{name|lower}}")
+	require.NoError(t, err)
+
+	_, err = archiver.ExtractZipFile(ctx, fname, "games/2", testLimits(), ExtractOptions{KeyTemplate: template})
+	assert.ErrorContains(t, err, "stores both")
+}
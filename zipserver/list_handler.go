@@ -19,7 +19,7 @@ func listZip(body []byte, w http.ResponseWriter, r *http.Request) error {
 	zipFile, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
 
 	if err != nil {
-		return err
+		return diagnoseZip(bytes.NewReader(body), int64(len(body)), err)
 	}
 
 	var filesOut []fileTuple
@@ -34,8 +34,8 @@ func listZip(body []byte, w http.ResponseWriter, r *http.Request) error {
 }
 
 func listFromBucket(ctx context.Context, key string, w http.ResponseWriter, r *http.Request) error {
-	storage, err := NewGcsStorage(globalConfig)
-	if storage == nil {
+	storage, err := NewPrimaryStorage(globalConfig)
+	if err != nil {
 		return err
 	}
 
@@ -60,7 +60,9 @@ func listFromUrl(ctx context.Context, url string, w http.ResponseWriter, r *http
 		return err
 	}
 
-	response, err := http.DefaultClient.Do(req)
+	setOutboundHeaders(req, jobFromContext(ctx).jobID())
+
+	response, err := outboundHTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,96 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	defaultListObjectsLimit = 1000
+	maxListObjectsLimit     = 10000
+)
+
+// pageObjects returns up to limit objects with keys after the given one, in
+// key order, along with the key to continue from when there are more. It's
+// for storage that lists everything at once.
+func pageObjects(objects []ObjectInfo, after string, limit int) ([]ObjectInfo, string) {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	start := sort.Search(len(objects), func(i int) bool {
+		return objects[i].Key > after
+	})
+	objects = objects[start:]
+
+	if len(objects) <= limit {
+		return objects, ""
+	}
+
+	objects = objects[:limit]
+	return objects, objects[limit-1].Key
+}
+
+// Lists the objects under a prefix in primary storage or in a storage target,
+// a page at a time
+func listObjectsHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	prefix, err := getParam(params, "prefix")
+	if err != nil {
+		return err
+	}
+
+	limit := defaultListObjectsLimit
+	if params.Get("limit") != "" {
+		value, err := getIntParam(params, "limit")
+		if err != nil || value < 1 || value > maxListObjectsLimit {
+			return badRequestf("limit must be between 1 and %d", maxListObjectsLimit)
+		}
+		limit = value
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	after := params.Get("after")
+	var page []ObjectInfo
+	var next string
+
+	targetName := params.Get("target")
+	if targetName == "" {
+		storage, err := NewPrimaryStorage(globalConfig)
+		if err != nil {
+			return fmt.Errorf("Failed to create source storage: %v", err)
+		}
+
+		page, next, err = storage.ListObjectsPage(ctx, globalConfig.Bucket, prefix, after, limit)
+		if err != nil {
+			return writeJSONError(w, "ListObjectsError", err)
+		}
+	} else {
+		storageTargetConfig := globalConfig.GetStorageTargetByName(targetName)
+		if storageTargetConfig == nil {
+			return fmt.Errorf("Invalid target: %s", targetName)
+		}
+
+		storage, err := storageTargetConfig.NewStorageClient()
+		if err != nil {
+			return fmt.Errorf("Failed to create target storage: %v", err)
+		}
+
+		page, next, err = storage.ListObjectsPage(ctx, storageTargetConfig.Bucket, prefix, after, limit)
+		if err != nil {
+			return writeJSONError(w, "ListObjectsError", err)
+		}
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		Objects []ObjectInfo
+		Next    string `json:",omitempty"`
+	}{true, page, next})
+}
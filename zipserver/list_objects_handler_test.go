@@ -0,0 +1,60 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PageObjects(t *testing.T) {
+	objects := []ObjectInfo{{Key: "c"}, {Key: "a"}, {Key: "d"}, {Key: "b"}}
+
+	page, next := pageObjects(objects, "", 2)
+	assert.EqualValues(t, []ObjectInfo{{Key: "a"}, {Key: "b"}}, page)
+	assert.EqualValues(t, "b", next)
+
+	page, next = pageObjects(objects, next, 2)
+	assert.EqualValues(t, []ObjectInfo{{Key: "c"}, {Key: "d"}}, page)
+	assert.EqualValues(t, "", next)
+
+	page, next = pageObjects(objects, "d", 2)
+	assert.Empty(t, page)
+	assert.EqualValues(t, "", next)
+}
+
+func Test_ListObjectsPage(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	for _, key := range []string{"games/1/c", "games/1/a", "games/1/b", "games/2/a"} {
+		require.NoError(t, storage.PutFile(ctx, "bucket", key, bytes.NewReader([]byte(key)), "text/plain"))
+	}
+
+	page, next, err := storage.ListObjectsPage(ctx, "bucket", "games/1/", "", 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, "games/1/a", page[0].Key)
+	assert.Equal(t, "games/1/b", next)
+
+	page, next, err = storage.ListObjectsPage(ctx, "bucket", "games/1/", next, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, "games/1/c", page[0].Key)
+	assert.Equal(t, "", next)
+}
+
+func Test_ListObjectsHandlerLimit(t *testing.T) {
+	handler := wrapErrors(listObjectsHandler)
+
+	for _, limit := range []string{"abc", "0", "10001"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/list_objects?prefix=games/1/&limit="+limit, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, limit)
+	}
+}
@@ -0,0 +1,98 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// file descriptor of the first socket passed with systemd socket activation
+const listenFdsStart = 3
+
+// in-flight async jobs, waited on before the process exits
+var backgroundJobs sync.WaitGroup
+
+// shutdownContext is canceled once the process starts draining, so waits
+// like callback retries don't hold it up
+var shutdownContext, beginShutdown = context.WithCancel(context.Background())
+
+// startBackgroundJob runs fn in a goroutine that a graceful shutdown waits for
+func startBackgroundJob(fn func()) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		fn()
+	}()
+}
+
+// waitForBackgroundJobs blocks until all async jobs are finished or ctx is done
+func waitForBackgroundJobs(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// activatedListener returns the socket passed by systemd socket activation,
+// or nil if we weren't started that way
+func activatedListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFds < 1 {
+		return nil, nil
+	}
+
+	// don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to use activated socket: %s", err.Error())
+	}
+
+	return listener, nil
+}
+
+// listen picks where the HTTP server accepts connections from: an activated
+// socket if there is one, otherwise listenTo, shared with other processes when
+// ReusePort is enabled so a new binary can start before the old one drains
+func listen(listenTo string, config *Config) (net.Listener, error) {
+	listener, err := activatedListener()
+	if err != nil || listener != nil {
+		return listener, err
+	}
+
+	if config.ReusePort {
+		return listenReusePort(listenTo)
+	}
+
+	return net.Listen("tcp", listenTo)
+}
+
+// shutdownTimeout is how long a draining process waits for async jobs
+func shutdownTimeout(config *Config) time.Duration {
+	if config.ShutdownTimeout > 0 {
+		return time.Duration(config.ShutdownTimeout)
+	}
+	return time.Duration(config.JobTimeout)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package zipserver
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(listenTo string) (net.Listener, error) {
+	return nil, errors.New("ReusePort is only supported on linux")
+}
@@ -0,0 +1,38 @@
+package zipserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WaitForBackgroundJobs(t *testing.T) {
+	release := make(chan struct{})
+	startBackgroundJob(func() {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, waitForBackgroundJobs(ctx))
+
+	close(release)
+	assert.NoError(t, waitForBackgroundJobs(context.Background()))
+}
+
+func Test_ListenReusePort(t *testing.T) {
+	config := &Config{ReusePort: true}
+
+	first, err := listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Skipf("ReusePort unavailable: %s", err.Error())
+	}
+	defer first.Close()
+
+	// a second process (here, listener) can bind the same address
+	second, err := listen(first.Addr().String(), config)
+	assert.NoError(t, err)
+	second.Close()
+}
@@ -0,0 +1,157 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// localCallbackScheme starts the callback URLs of jobs started from within
+// zipserver, by the queue worker or the gRPC server. Their callbacks are
+// handed to whoever waits for them instead of being posted
+const localCallbackScheme = "local:"
+
+var localReplies = struct {
+	sync.Mutex
+	next    int64
+	waiting map[string]chan url.Values
+}{waiting: map[string]chan url.Values{}}
+
+// waitLocalReply returns a callback URL for a job, the channel its callback
+// is sent to, and a function to call once done waiting
+func waitLocalReply(id string) (string, <-chan url.Values, func()) {
+	localReplies.Lock()
+	defer localReplies.Unlock()
+
+	localReplies.next++
+	callbackURL := fmt.Sprintf("%s%s/%d", localCallbackScheme, url.PathEscape(id), localReplies.next)
+	replies := make(chan url.Values, 1)
+	localReplies.waiting[callbackURL] = replies
+
+	return callbackURL, replies, func() {
+		localReplies.Lock()
+		defer localReplies.Unlock()
+		delete(localReplies.waiting, callbackURL)
+	}
+}
+
+// deliverLocalReply hands the callback body of a job started from within
+// zipserver to whoever waits for it
+func deliverLocalReply(callbackURL, body string) error {
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return err
+	}
+
+	localReplies.Lock()
+	defer localReplies.Unlock()
+
+	replies, ok := localReplies.waiting[callbackURL]
+	if !ok {
+		return fmt.Errorf("Nothing is waiting for %s", callbackURL)
+	}
+
+	select {
+	case replies <- values:
+	default:
+		// already got one, eg. the callback was replayed
+	}
+	return nil
+}
+
+// localResponse records the response of a handler called from within
+// zipserver
+type localResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *localResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *localResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *localResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// result is the response as JSON, plain text errors are wrapped in an object
+func (r *localResponse) result() json.RawMessage {
+	if json.Valid(r.body.Bytes()) {
+		return json.RawMessage(r.body.Bytes())
+	}
+	blob, _ := json.Marshal(struct{ Error string }{strings.TrimSpace(r.body.String())})
+	return blob
+}
+
+// localAnswer is the part of a handler's response telling whether it started
+// a job
+type localAnswer struct {
+	// without Async, the same work is already being done for another request
+	Processing bool
+	Async      bool
+	Success    bool
+	JobID      string
+}
+
+// localCall is a request to a route's handler made from within zipserver
+type localCall struct {
+	response localResponse
+	// the callback of the job the handler started
+	replies <-chan url.Values
+	// stops waiting for the callback
+	done func()
+}
+
+// callRoute runs the guarded handler of the route at path with params, like
+// a POST would. When callbackParam is set, it's given a callback URL whose
+// callback is sent to call.replies. call.done must be called once the caller
+// stops waiting for it.
+func callRoute(ctx context.Context, path, callbackParam, id string, params url.Values) (*localCall, error) {
+	call := &localCall{
+		response: localResponse{header: http.Header{}},
+		done:     func() {},
+	}
+
+	if callbackParam != "" {
+		var callbackURL string
+		callbackURL, call.replies, call.done = waitLocalReply(id)
+		params.Set(callbackParam, callbackURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path+"?"+params.Encode(), nil)
+	if err != nil {
+		call.done()
+		return nil, err
+	}
+
+	routeHandler(path).ServeHTTP(&call.response, req)
+	if call.response.status == 0 {
+		call.response.status = http.StatusOK
+	}
+	return call, nil
+}
+
+// answer is whether the handler started a job, it's empty for an error
+// response
+func (c *localCall) answer() localAnswer {
+	var answer localAnswer
+	if c.response.status == http.StatusOK {
+		json.Unmarshal(c.response.body.Bytes(), &answer)
+	}
+	return answer
+}
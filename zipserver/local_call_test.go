@@ -0,0 +1,21 @@
+package zipserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DeliverLocalReply(t *testing.T) {
+	callbackURL, replies, done := waitLocalReply("job/1")
+	assert.Contains(t, callbackURL, localCallbackScheme)
+
+	require.NoError(t, deliverLocalReply(callbackURL, "Success=true&Key=a.zip"))
+	// a replayed callback doesn't block
+	require.NoError(t, deliverLocalReply(callbackURL, "Success=true&Key=a.zip"))
+	assert.Equal(t, "a.zip", (<-replies).Get("Key"))
+
+	done()
+	assert.Error(t, deliverLocalReply(callbackURL, "Success=true"))
+}
@@ -1,6 +1,9 @@
 package zipserver
 
 import (
+	"log"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
@@ -8,38 +11,126 @@ import (
 type LockTable struct {
 	// maps aren't thread-safe in golang, this protects openKeys
 	sync.Mutex
-	// We're using the map to store the time at which a lock is obtained for a key
-	openKeys map[string]time.Time
+	// the holder of each locked key
+	openKeys map[string]heldLock
+	// locks held longer than this are assumed abandoned, eg. by a goroutine
+	// that panicked, and expire. 0 keeps them forever
+	ttl time.Duration
+	// the token of the last lock taken
+	lastToken lockToken
+}
+
+// lockToken tells apart the successive holders of a key, so a holder whose
+// lock expired can't release the lock of whoever took the key next
+type lockToken uint64
+
+type heldLock struct {
+	token    lockToken
+	lockedAt time.Time
 }
 
 func NewLockTable() *LockTable {
 	return &LockTable{
-		openKeys: make(map[string]time.Time),
+		openKeys: make(map[string]heldLock),
+	}
+}
+
+// lockTables are the tables /locks/release can release keys from, by name
+var lockTables = map[string]*LockTable{
+	"extract": extractLockTable,
+	"copy":    copyLockTable,
+	"slurp":   slurpLockTable,
+	"delete":  deleteLockTable,
+	"rename":  renameLockTable,
+}
+
+// lockTTL is LockTTL, or when unset how long no job holding a lock can run
+// for: twice JobTimeout for each of its attempts, plus the longest backoffs
+// between them
+func lockTTL(config *Config) time.Duration {
+	if config.LockTTL > 0 {
+		return time.Duration(config.LockTTL)
+	}
+
+	retries := config.MaxJobAutoRetry
+	if retries < 0 {
+		retries = 0
+	}
+	attempts := time.Duration(retries + 1)
+	return 2*attempts*time.Duration(config.JobTimeout) + time.Duration(retries)*time.Duration(config.JobRetryMaxBackoff)
+}
+
+func setupLockTables(config *Config) {
+	ttl := lockTTL(config)
+	for _, lt := range lockTables {
+		lt.setTTL(ttl)
+	}
+}
+
+func (lt *LockTable) setTTL(ttl time.Duration) {
+	lt.Lock()
+	defer lt.Unlock()
+	lt.ttl = ttl
+}
+
+// expireStale drops the locks held longer than the TTL, lt must be locked
+func (lt *LockTable) expireStale() {
+	if lt.ttl <= 0 {
+		return
+	}
+
+	for key, held := range lt.openKeys {
+		if time.Since(held.lockedAt) > lt.ttl {
+			log.Printf("Expiring lock on %s, held since %s", key, held.lockedAt.Format(time.RFC3339))
+			delete(lt.openKeys, key)
+			globalMetrics.TotalExpiredLocks.Add(1)
+		}
 	}
 }
 
 // tryLockKey tries acquiring the lock for a given key
-// it returns true if we successfully acquired the lock,
-// false if the key is locked by someone else
-func (lt *LockTable) tryLockKey(key string) bool {
+// it returns true and the token to release it with if we successfully
+// acquired the lock, false if the key is locked by someone else
+func (lt *LockTable) tryLockKey(key string) (lockToken, bool) {
 	lt.Lock()
 	defer lt.Unlock()
 
+	lt.expireStale()
+
 	// test for key existence
 	if _, ok := lt.openKeys[key]; ok {
 		// locked by someone else
-		return false
+		return 0, false
+	}
+	lt.lastToken++
+	lt.openKeys[key] = heldLock{lt.lastToken, time.Now()}
+	return lt.lastToken, true
+}
+
+// releaseKey releases the lock taken with token. It does nothing when the
+// lock expired or was force-released since, and the key may be someone
+// else's now.
+func (lt *LockTable) releaseKey(key string, token lockToken) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	if held, ok := lt.openKeys[key]; ok && held.token == token {
+		// delete key from map so the map doesn't keep growing
+		delete(lt.openKeys, key)
 	}
-	lt.openKeys[key] = time.Now()
-	return true
 }
 
-func (lt *LockTable) releaseKey(key string) {
+// forceRelease releases key whoever holds it, it returns false if it wasn't
+// locked
+func (lt *LockTable) forceRelease(key string) bool {
 	lt.Lock()
 	defer lt.Unlock()
 
-	// delete key from map so the map doesn't keep growing
+	if _, ok := lt.openKeys[key]; !ok {
+		return false
+	}
 	delete(lt.openKeys, key)
+	return true
 }
 
 type KeyInfo struct {
@@ -53,13 +144,58 @@ func (lt *LockTable) GetLocks() []KeyInfo {
 	lt.Lock()
 	defer lt.Unlock()
 
+	lt.expireStale()
+
 	keys := make([]KeyInfo, 0, len(lt.openKeys))
-	for key, lockedAt := range lt.openKeys {
+	for key, held := range lt.openKeys {
 		keys = append(keys, KeyInfo{
 			Key:           key,
-			LockedAt:      lockedAt,
-			LockedSeconds: time.Since(lockedAt).Seconds(),
+			LockedAt:      held.lockedAt,
+			LockedSeconds: time.Since(held.lockedAt).Seconds(),
 		})
 	}
 	return keys
 }
+
+// releaseLockHandler force-releases key, in the table given with table or in
+// every table, for locks left behind by a job that won't release them
+func releaseLockHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return badRequestf("Releasing a lock requires POST")
+	}
+
+	params := r.URL.Query()
+	key, err := getParam(params, "key")
+	if err != nil {
+		return badRequestf("%v", err)
+	}
+
+	names := []string{}
+	if name := params.Get("table"); name != "" {
+		if _, ok := lockTables[name]; !ok {
+			return badRequestf("Invalid table %q", name)
+		}
+		names = append(names, name)
+	} else {
+		for name := range lockTables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	released := []string{}
+	for _, name := range names {
+		if lockTables[name].forceRelease(key) {
+			released = append(released, name)
+		}
+	}
+
+	if len(released) > 0 {
+		log.Printf("Force-released lock on %s in %v", key, released)
+	}
+
+	return writeJSONMessage(w, struct {
+		Success  bool
+		Released []string
+	}{len(released) > 0, released})
+}
@@ -1,9 +1,14 @@
 package zipserver
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_LockTable(t *testing.T) {
@@ -11,20 +16,103 @@ func Test_LockTable(t *testing.T) {
 	lt := NewLockTable()
 
 	// not the best test, more like a basic sanity check
-	hasLock := lt.tryLockKey("foo")
+	fooToken, hasLock := lt.tryLockKey("foo")
 
 	assert.True(t, hasLock, "should acquire foo")
 
-	hasLock = lt.tryLockKey("foo")
+	_, hasLock = lt.tryLockKey("foo")
 	assert.False(t, hasLock, "should not acquire foo again")
 
-	hasLock = lt.tryLockKey("bar")
+	_, hasLock = lt.tryLockKey("bar")
 	assert.True(t, hasLock, "should acquire bar")
 
-	lt.releaseKey("foo")
-	hasLock = lt.tryLockKey("bar")
+	lt.releaseKey("foo", fooToken)
+	_, hasLock = lt.tryLockKey("bar")
 	assert.False(t, hasLock, "should not acquire bar again")
 
-	hasLock = lt.tryLockKey("foo")
+	_, hasLock = lt.tryLockKey("foo")
 	assert.True(t, hasLock, "should acquire foo again")
+
+	// the first holder's token doesn't release the new holder's lock
+	lt.releaseKey("foo", fooToken)
+	_, hasLock = lt.tryLockKey("foo")
+	assert.False(t, hasLock, "should not release foo with a stale token")
+}
+
+func Test_LockTableTTL(t *testing.T) {
+	lt := NewLockTable()
+	lt.setTTL(50 * time.Millisecond)
+
+	expired := globalMetrics.TotalExpiredLocks.Load()
+
+	staleToken, hasLock := lt.tryLockKey("foo")
+	assert.True(t, hasLock)
+	_, hasLock = lt.tryLockKey("foo")
+	assert.False(t, hasLock, "still held")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(t, lt.GetLocks(), "stale lock should have expired")
+	_, hasLock = lt.tryLockKey("foo")
+	assert.True(t, hasLock, "should acquire foo once expired")
+	assert.Equal(t, expired+1, globalMetrics.TotalExpiredLocks.Load())
+
+	// the job whose lock expired finishing doesn't release the new lock
+	lt.releaseKey("foo", staleToken)
+	assert.Len(t, lt.GetLocks(), 1)
+
+	assert.Equal(t, 2*time.Minute, lockTTL(&Config{JobTimeout: Duration(time.Minute)}))
+	assert.Equal(t, time.Hour, lockTTL(&Config{JobTimeout: Duration(time.Minute), LockTTL: Duration(time.Hour)}))
+	// every attempt of a job with auto_retry, and the backoffs between them
+	assert.Equal(t, 12*time.Minute+25*time.Minute, lockTTL(&Config{
+		JobTimeout:         Duration(time.Minute),
+		MaxJobAutoRetry:    5,
+		JobRetryMaxBackoff: Duration(5 * time.Minute),
+	}))
+}
+
+func Test_ReleaseLockHandler(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, ""))
+
+	release := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	extractToken, hasLock := extractLockTable.tryLockKey("zips/stuck.zip")
+	require.True(t, hasLock)
+	copyToken, hasLock := copyLockTable.tryLockKey("zips/stuck.zip")
+	require.True(t, hasLock)
+	defer extractLockTable.releaseKey("zips/stuck.zip", extractToken)
+	defer copyLockTable.releaseKey("zips/stuck.zip", copyToken)
+
+	assert.Equal(t, http.StatusBadRequest, release(http.MethodGet, "/locks/release?key=zips/stuck.zip").Code)
+	assert.Equal(t, http.StatusBadRequest, release(http.MethodPost, "/locks/release?key=zips/stuck.zip&table=unzip").Code)
+
+	var body struct {
+		Success  bool
+		Released []string
+	}
+
+	rec := release(http.MethodPost, "/locks/release?key=zips/stuck.zip&table=extract")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, []string{"extract"}, body.Released)
+	_, hasLock = extractLockTable.tryLockKey("zips/stuck.zip")
+	assert.True(t, hasLock)
+
+	rec = release(http.MethodPost, "/locks/release?key=zips/stuck.zip")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.True(t, body.Success)
+	assert.Equal(t, []string{"copy", "extract"}, body.Released)
+
+	rec = release(http.MethodPost, "/locks/release?key=zips/stuck.zip")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.False(t, body.Success)
+	assert.Empty(t, body.Released)
 }
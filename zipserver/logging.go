@@ -0,0 +1,148 @@
+package zipserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// requestIDHeader carries the request ID in responses, and is reused from
+// requests that already have one, eg. set by a load balancer
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,64}$`)
+
+func validateLogFormat(format string) error {
+	switch format {
+	case "", logFormatText, logFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("Config error: invalid LogFormat %q, expected text or json", format)
+	}
+}
+
+// setupLogging switches the standard logger to JSON lines when LogFormat is json
+func setupLogging(config *Config) {
+	if config.LogFormat == logFormatJSON {
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: os.Stderr})
+	}
+}
+
+// jsonLogWriter turns every line written by the standard logger into a JSON
+// object with a time and a msg
+type jsonLogWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+type jsonLogEntry struct {
+	Time      string `json:"time"`
+	Message   string `json:"msg"`
+	RequestID string `json:"request_id,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.writeEntry(string(p), "", ""); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) writeEntry(message, requestID, jobID string) error {
+	blob, err := json.Marshal(jsonLogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Message:   strings.TrimSuffix(message, "\n"),
+		RequestID: requestID,
+		JobID:     jobID,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.out.Write(append(blob, '\n'))
+	return err
+}
+
+type requestIDContextKey struct{}
+
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// requestIDFromContext returns the ID of the request running in ctx, or of
+// the request that started the job running in it
+func requestIDFromContext(ctx context.Context) string {
+	if requestID, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		return requestID
+	}
+	if job := jobFromContext(ctx); job != nil {
+		return job.RequestID
+	}
+	return ""
+}
+
+// assignRequestID gives the request an ID, the one in its X-Request-ID header
+// if it's reasonable, and echoes it in the response
+func assignRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	requestID := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(requestID) {
+		idBytes := make([]byte, 8)
+		rand.Read(idBytes)
+		requestID = hex.EncodeToString(idBytes)
+	}
+
+	w.Header().Set(requestIDHeader, requestID)
+	return r.WithContext(withRequestID(r.Context(), requestID))
+}
+
+// logPrintf logs with the request and job IDs of ctx, as fields in JSON
+// logs, as a prefix otherwise
+func logPrintf(ctx context.Context, format string, args ...interface{}) {
+	logMessage(ctx, fmt.Sprintf(format, args...))
+}
+
+// logPrint is logPrintf formatting its arguments like log.Print
+func logPrint(ctx context.Context, args ...interface{}) {
+	logMessage(ctx, fmt.Sprint(args...))
+}
+
+func logMessage(ctx context.Context, message string) {
+	requestID := requestIDFromContext(ctx)
+	jobID := jobFromContext(ctx).jobID()
+
+	if writer, ok := log.Writer().(*jsonLogWriter); ok {
+		writer.writeEntry(message, requestID, jobID)
+		return
+	}
+
+	prefix := []string{}
+	if requestID != "" {
+		prefix = append(prefix, "request "+requestID)
+	}
+	if jobID != "" {
+		prefix = append(prefix, "job "+jobID)
+	}
+	if len(prefix) > 0 {
+		message = "[" + strings.Join(prefix, " ") + "] " + message
+	}
+	log.Output(3, message)
+}
@@ -0,0 +1,74 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_JSONLogging(t *testing.T) {
+	oldWriter, oldFlags := log.Writer(), log.Flags()
+	defer func() {
+		log.SetOutput(oldWriter)
+		log.SetFlags(oldFlags)
+	}()
+
+	var buf bytes.Buffer
+	log.SetFlags(0)
+	log.SetOutput(&jsonLogWriter{out: &buf})
+
+	job := jobs.newJob("extract", "zips/game.zip", "games/1", "", 0, jobCaller{})
+	job.linkRequest(withRequestID(context.Background(), "req-1"))
+	assert.Equal(t, "req-1", job.RequestID)
+
+	logPrintf(withJob(context.Background(), job), "Sent %d files", 3)
+	log.Print("Listening on: 127.0.0.1:8090")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var entry jsonLogEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "Sent 3 files", entry.Message)
+	assert.Equal(t, "req-1", entry.RequestID)
+	assert.Equal(t, job.ID, entry.JobID)
+	assert.NotEmpty(t, entry.Time)
+
+	entry = jsonLogEntry{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "Listening on: 127.0.0.1:8090", entry.Message)
+	assert.Empty(t, entry.JobID)
+
+	// text logs get the IDs as a prefix
+	buf.Reset()
+	log.SetOutput(&buf)
+	logPrint(withRequestID(context.Background(), "req-2"), "Fetching URL: ", "http://example.com")
+	assert.Equal(t, "[request req-2] Fetching URL: http://example.com\n", buf.String())
+
+	assert.NoError(t, validateLogFormat("json"))
+	assert.Error(t, validateLogFormat("logfmt"))
+}
+
+func Test_AssignRequestID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set(requestIDHeader, "lb-1234")
+	req = assignRequestID(rec, req)
+	assert.Equal(t, "lb-1234", requestIDFromContext(req.Context()))
+	assert.Equal(t, "lb-1234", rec.Header().Get(requestIDHeader))
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set(requestIDHeader, "has spaces\nand newlines")
+	req = assignRequestID(rec, req)
+	assert.Len(t, requestIDFromContext(req.Context()), 16)
+	assert.Equal(t, requestIDFromContext(req.Context()), rec.Header().Get(requestIDHeader))
+}
@@ -0,0 +1,228 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recurring maintenance tasks are configured in MaintenanceSchedule, which maps
+// a task name to a schedule:
+//   - "@every <duration>", eg. "@every 10m"
+//   - "@hourly" or "@daily", run at the top of the hour or at midnight (UTC)
+
+// maintenanceTasks are the tasks that can be scheduled, by name
+var maintenanceTasks = map[string]func(ctx context.Context, config *Config) error{
+	// remove leftover files in the temporary directory, eg. from a crash
+	"temp-janitor": cleanTempDir,
+	// delete expired temporary extractions, like /purge
+	"temp-purge": func(ctx context.Context, config *Config) error {
+		if checkReadOnly() != nil {
+			log.Print("Skipping temp-purge in read-only mode")
+			return nil
+		}
+		_, err := NewArchiver(config).PurgeExpiredExtractions(ctx, time.Now())
+		return err
+	},
+	// try delivering callbacks that failed again
+	"callback-retry": func(ctx context.Context, config *Config) error {
+		return retryPendingCallbacks(ctx)
+	},
+}
+
+// maintenanceSchedule says when a task runs next
+type maintenanceSchedule struct {
+	every time.Duration // for @every
+	align time.Duration // for @hourly and @daily, runs are aligned to multiples of it
+}
+
+func parseMaintenanceSchedule(value string) (maintenanceSchedule, error) {
+	switch {
+	case value == "@hourly":
+		return maintenanceSchedule{align: time.Hour}, nil
+	case value == "@daily":
+		return maintenanceSchedule{align: 24 * time.Hour}, nil
+	case strings.HasPrefix(value, "@every "):
+		every, err := time.ParseDuration(strings.TrimPrefix(value, "@every "))
+		if err != nil || every <= 0 {
+			return maintenanceSchedule{}, fmt.Errorf("Invalid maintenance schedule: %s", value)
+		}
+		return maintenanceSchedule{every: every}, nil
+	default:
+		return maintenanceSchedule{}, fmt.Errorf("Invalid maintenance schedule: %s", value)
+	}
+}
+
+func (s maintenanceSchedule) next(now time.Time) time.Time {
+	if s.align > 0 {
+		return now.UTC().Truncate(s.align).Add(s.align)
+	}
+	return now.Add(s.every)
+}
+
+func validateMaintenanceSchedule(schedule map[string]string) error {
+	for name, value := range schedule {
+		if _, ok := maintenanceTasks[name]; !ok {
+			return fmt.Errorf("Config error: unknown maintenance task %s", name)
+		}
+		if _, err := parseMaintenanceSchedule(value); err != nil {
+			return fmt.Errorf("Config error: %v", err)
+		}
+	}
+	return nil
+}
+
+// MaintenanceTaskStatus reports the runs of a scheduled task in /status
+type MaintenanceTaskStatus struct {
+	Name         string
+	Schedule     string
+	Runs         int
+	Failures     int
+	LastRun      time.Time `json:",omitempty"`
+	LastDuration string    `json:",omitempty"`
+	LastError    string    `json:",omitempty"`
+	NextRun      time.Time
+}
+
+var maintenanceStatus = struct {
+	sync.Mutex
+	tasks map[string]*MaintenanceTaskStatus
+}{tasks: map[string]*MaintenanceTaskStatus{}}
+
+// getMaintenanceStatus returns the status of every scheduled task, by name
+func getMaintenanceStatus() []MaintenanceTaskStatus {
+	maintenanceStatus.Lock()
+	defer maintenanceStatus.Unlock()
+
+	statuses := []MaintenanceTaskStatus{}
+	for _, status := range maintenanceStatus.tasks {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// startMaintenance runs every task of MaintenanceSchedule on its schedule,
+// forever. TempPurgeInterval and TempJanitorInterval are shortcuts for
+// scheduling temp-purge and temp-janitor.
+func startMaintenance(config *Config) {
+	schedule := map[string]string{}
+	if config.TempPurgeInterval > 0 {
+		schedule["temp-purge"] = "@every " + time.Duration(config.TempPurgeInterval).String()
+	}
+	if config.TempJanitorInterval > 0 {
+		schedule["temp-janitor"] = "@every " + time.Duration(config.TempJanitorInterval).String()
+	}
+	for name, value := range config.MaintenanceSchedule {
+		schedule[name] = value
+	}
+
+	for name, value := range schedule {
+		parsed, err := parseMaintenanceSchedule(value)
+		if err != nil {
+			// checked by LoadConfig
+			log.Print("Skipping maintenance task ", name, ": ", err)
+			continue
+		}
+
+		status := &MaintenanceTaskStatus{Name: name, Schedule: value, NextRun: parsed.next(time.Now())}
+		maintenanceStatus.Lock()
+		maintenanceStatus.tasks[name] = status
+		maintenanceStatus.Unlock()
+
+		go runMaintenanceTask(config, status, parsed, maintenanceTasks[name])
+	}
+}
+
+func runMaintenanceTask(config *Config, status *MaintenanceTaskStatus, schedule maintenanceSchedule, task func(context.Context, *Config) error) {
+	for {
+		maintenanceStatus.Lock()
+		nextRun := status.NextRun
+		maintenanceStatus.Unlock()
+
+		time.Sleep(time.Until(nextRun))
+
+		startTime := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.JobTimeout))
+		err := task(ctx, config)
+		cancel()
+
+		globalMetrics.TotalMaintenanceRuns.Add(1)
+		if err != nil {
+			globalMetrics.TotalMaintenanceFailures.Add(1)
+			log.Printf("Maintenance task %s failed: %v", status.Name, err)
+		}
+
+		maintenanceStatus.Lock()
+		status.Runs++
+		status.LastRun = startTime
+		status.LastDuration = fmt.Sprintf("%.4fs", time.Since(startTime).Seconds())
+		status.LastError = ""
+		if err != nil {
+			status.Failures++
+			status.LastError = err.Error()
+		}
+		status.NextRun = schedule.next(time.Now())
+		maintenanceStatus.Unlock()
+	}
+}
+
+// cleanTempDir removes files and job directories from the temporary directory
+// that are older than any running job could be, eg. left over by a crash
+func cleanTempDir(ctx context.Context, config *Config) error {
+	dir := config.tempDir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-2 * time.Duration(config.JobTimeout))
+	removed := 0
+	var removedBytes uint64
+	defer func() { recordTempCleanup(removed, removedBytes) }()
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		name := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if !strings.HasPrefix(entry.Name(), "job-") {
+				continue
+			}
+			files, bytes := countTempFiles(name)
+			err = os.RemoveAll(name)
+			if err != nil {
+				return err
+			}
+			removed += files
+			removedBytes += bytes
+			continue
+		}
+
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		removedBytes += uint64(info.Size())
+	}
+
+	log.Printf("Removed %d stale temporary files", removed)
+	return nil
+}
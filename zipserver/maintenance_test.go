@@ -0,0 +1,59 @@
+package zipserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MaintenanceSchedule(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 25, 0, 0, time.UTC)
+
+	schedule, err := parseMaintenanceSchedule("@every 10m")
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(10*time.Minute), schedule.next(now))
+
+	schedule, err = parseMaintenanceSchedule("@hourly")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC), schedule.next(now))
+
+	schedule, err = parseMaintenanceSchedule("@daily")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), schedule.next(now))
+
+	for _, invalid := range []string{"", "*/5 * * * *", "@every", "@every -1m", "@weekly"} {
+		_, err := parseMaintenanceSchedule(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	assert.NoError(t, validateMaintenanceSchedule(map[string]string{"temp-janitor": "@hourly"}))
+	assert.Error(t, validateMaintenanceSchedule(map[string]string{"orphan-gc": "@hourly"}))
+}
+
+func Test_CleanTempDir(t *testing.T) {
+	config := emptyConfig()
+	config.JobTimeout = Duration(time.Minute)
+
+	require.NoError(t, os.MkdirAll(defaultTmpDir, 0777))
+
+	stale := filepath.Join(defaultTmpDir, "stale-test.zip")
+	fresh := filepath.Join(defaultTmpDir, "fresh-test.zip")
+	require.NoError(t, os.WriteFile(stale, []byte("old"), 0644))
+	require.NoError(t, os.WriteFile(fresh, []byte("new"), 0644))
+	defer os.Remove(fresh)
+
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	require.NoError(t, cleanTempDir(context.Background(), config))
+
+	_, err := os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(fresh)
+	assert.NoError(t, err)
+}
@@ -7,9 +7,13 @@ package zipserver
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -59,6 +63,32 @@ func (fs *MemStorage) GetFile(ctx context.Context, bucket, key string) (io.ReadC
 	return nil, nil, errors.Wrap(err, 0)
 }
 
+func (fs *MemStorage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, http.Header, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	objectPath := fs.objectPath(bucket, key)
+
+	if obj, ok := fs.objects[objectPath]; ok {
+		size := int64(len(obj.data))
+		if offset > size {
+			offset = size
+		}
+		end := offset + length
+		if end > size {
+			end = size
+		}
+		return io.NopCloser(bytes.NewReader(obj.data[offset:end])), obj.headers, nil
+	}
+
+	err := fmt.Errorf("%s: object not found", objectPath)
+	return nil, nil, errors.Wrap(err, 0)
+}
+
+func (fs *MemStorage) HeadFile(ctx context.Context, bucket, key string) (http.Header, error) {
+	return fs.getHeaders(bucket, key)
+}
+
 func (fs *MemStorage) getHeaders(bucket, key string) (http.Header, error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
@@ -69,7 +99,7 @@ func (fs *MemStorage) getHeaders(bucket, key string) (http.Header, error) {
 		return obj.headers, nil
 	}
 
-	err := fmt.Errorf("%s: object not found", objectPath)
+	err := fmt.Errorf("%w: %s", ErrObjectNotFound, objectPath)
 	return nil, errors.Wrap(err, 0)
 }
 
@@ -106,6 +136,11 @@ func (fs *MemStorage) PutFileWithSetup(ctx context.Context, bucket, key string,
 		return errors.Wrap(err, 0)
 	}
 
+	// like GCS, so uploads can be verified
+	sum := md5.Sum(data)
+	req.Header.Set("x-goog-hash", "md5="+base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+
 	fs.objects[objectPath] = memObject{
 		data,
 		req.Header,
@@ -122,6 +157,83 @@ func (fs *MemStorage) DeleteFile(ctx context.Context, bucket, key string) error
 	return nil
 }
 
+func (fs *MemStorage) CopyFile(ctx context.Context, bucket, srcKey, destKey string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	srcPath := fs.objectPath(bucket, srcKey)
+	obj, ok := fs.objects[srcPath]
+	if !ok {
+		err := fmt.Errorf("%s: object not found", srcPath)
+		return errors.Wrap(err, 0)
+	}
+
+	destPath := fs.objectPath(bucket, destKey)
+	if _, ok := fs.failingPaths[destPath]; ok {
+		return errors.Wrap(errors.New("intentional failure"), 0)
+	}
+
+	fs.objects[destPath] = memObject{
+		obj.data,
+		obj.headers.Clone(),
+	}
+
+	return nil
+}
+
+func (fs *MemStorage) ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	bucketPrefix := fs.objectPath(bucket, "")
+	objects := []ObjectInfo{}
+
+	for objectPath, obj := range fs.objects {
+		if !strings.HasPrefix(objectPath, bucketPrefix) {
+			continue
+		}
+
+		key := strings.TrimPrefix(objectPath, bucketPrefix)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{key, uint64(len(obj.data)), fmt.Sprintf("%x", md5.Sum(obj.data))})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+func (fs *MemStorage) ListObjectsPage(ctx context.Context, bucket, prefix, after string, limit int) ([]ObjectInfo, string, error) {
+	objects, err := fs.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page, next := pageObjects(objects, after, limit)
+	return page, next, nil
+}
+
+func (fs *MemStorage) ComposeFile(ctx context.Context, bucket, key string, componentKeys []string, setup StorageSetupFunc) error {
+	fs.mutex.Lock()
+	var data []byte
+	for _, componentKey := range componentKeys {
+		componentPath := fs.objectPath(bucket, componentKey)
+		obj, ok := fs.objects[componentPath]
+		if !ok {
+			fs.mutex.Unlock()
+			err := fmt.Errorf("%s: object not found", componentPath)
+			return errors.Wrap(err, 0)
+		}
+		data = append(data, obj.data...)
+	}
+	fs.mutex.Unlock()
+
+	return fs.PutFileWithSetup(ctx, bucket, key, bytes.NewReader(data), setup)
+}
+
 func (fs *MemStorage) planForFailure(bucket, key string) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
@@ -0,0 +1,134 @@
+package zipserver
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// memSnapshotIndex lists the objects of a snapshot, their contents are in
+// the objects directory next to it
+const memSnapshotIndex = "index.json"
+
+// ErrNoSnapshot is returned by LoadSnapshot when the directory has none
+var ErrNoSnapshot = fmt.Errorf("No MemStorage snapshot")
+
+// memSnapshot is a MemStorage as saved to a directory
+type memSnapshot struct {
+	// what the objects were made from, eg. the zip given to -serve, so
+	// a stale snapshot can be told apart
+	Source  string `json:",omitempty"`
+	Objects []memSnapshotObject
+}
+
+type memSnapshotObject struct {
+	// bucket/key
+	Path    string
+	Headers http.Header
+	// file under objects/, named after the MD5 of the contents so identical
+	// objects are stored once
+	Data string
+}
+
+// SaveSnapshot writes every object to dir, replacing the snapshot there, so
+// that LoadSnapshot can bring them back after a restart. source is saved
+// along, eg. to tell which archive the objects were extracted from.
+func (fs *MemStorage) SaveSnapshot(dir, source string) error {
+	fs.mutex.Lock()
+	objects := make(map[string]memObject, len(fs.objects))
+	for objectPath, obj := range fs.objects {
+		objects[objectPath] = obj
+	}
+	fs.mutex.Unlock()
+
+	objectsDir := filepath.Join(dir, "objects")
+	if err := os.MkdirAll(objectsDir, 0755); err != nil {
+		return err
+	}
+
+	snapshot := memSnapshot{Source: source}
+	written := map[string]bool{}
+	for objectPath, obj := range objects {
+		name := fmt.Sprintf("%x", md5.Sum(obj.data))
+		snapshot.Objects = append(snapshot.Objects, memSnapshotObject{objectPath, obj.headers, name})
+
+		if written[name] {
+			continue
+		}
+		written[name] = true
+
+		dataPath := filepath.Join(objectsDir, name)
+		if _, err := os.Stat(dataPath); err == nil {
+			continue
+		}
+		if err := writeFileAtomically(dataPath, obj.data); err != nil {
+			return err
+		}
+	}
+
+	blob, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(filepath.Join(dir, memSnapshotIndex), blob); err != nil {
+		return err
+	}
+
+	// contents of objects that are gone since the last snapshot
+	entries, err := os.ReadDir(objectsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !written[entry.Name()] {
+			os.Remove(filepath.Join(objectsDir, entry.Name()))
+		}
+	}
+
+	return nil
+}
+
+// LoadSnapshot replaces the objects with the ones saved to dir by
+// SaveSnapshot, and returns the source saved along. It fails with
+// ErrNoSnapshot when there's nothing in dir.
+func (fs *MemStorage) LoadSnapshot(dir string) (string, error) {
+	blob, err := os.ReadFile(filepath.Join(dir, memSnapshotIndex))
+	if os.IsNotExist(err) {
+		return "", ErrNoSnapshot
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var snapshot memSnapshot
+	if err := json.Unmarshal(blob, &snapshot); err != nil {
+		return "", fmt.Errorf("Invalid snapshot index in %s: %v", dir, err)
+	}
+
+	objects := make(map[string]memObject, len(snapshot.Objects))
+	for _, saved := range snapshot.Objects {
+		data, err := os.ReadFile(filepath.Join(dir, "objects", filepath.Base(saved.Data)))
+		if err != nil {
+			return "", fmt.Errorf("Missing contents of %s in snapshot: %v", saved.Path, err)
+		}
+		objects[saved.Path] = memObject{data, saved.Headers}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.objects = objects
+	return snapshot.Source, nil
+}
+
+// writeFileAtomically writes a temporary file then renames it to path, so a
+// crash never leaves a partial file behind
+func writeFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
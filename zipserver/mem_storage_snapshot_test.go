@@ -0,0 +1,64 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MemStorageSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	empty, err := NewMemStorage()
+	require.NoError(t, err)
+	_, err = empty.LoadSnapshot(dir)
+	assert.Equal(t, ErrNoSnapshot, err)
+
+	require.NoError(t, storage.PutFile(ctx, "local", "extracted/index.html", strings.NewReader("<html>"), "text/html"))
+	require.NoError(t, storage.PutFile(ctx, "local", "extracted/copy.html", strings.NewReader("<html>"), "text/html"))
+	require.NoError(t, storage.PutFile(ctx, "local", "extracted/game.js", strings.NewReader("run()"), "application/javascript"))
+	require.NoError(t, storage.SaveSnapshot(dir, "game.zip 1"))
+
+	objects, err := os.ReadDir(filepath.Join(dir, "objects"))
+	require.NoError(t, err)
+	assert.Len(t, objects, 2, "identical contents are stored once")
+
+	restored, err := NewMemStorage()
+	require.NoError(t, err)
+	source, err := restored.LoadSnapshot(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "game.zip 1", source)
+
+	reader, headers, err := restored.GetFile(ctx, "local", "extracted/index.html")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(reader)
+	assert.Equal(t, "<html>", string(data))
+	assert.Equal(t, "text/html", headers.Get("Content-Type"))
+
+	listed, err := restored.ListObjects(ctx, "local", "extracted/")
+	require.NoError(t, err)
+	assert.Len(t, listed, 3)
+
+	// a later snapshot drops the contents of deleted objects
+	require.NoError(t, storage.DeleteFile(ctx, "local", "extracted/game.js"))
+	require.NoError(t, storage.SaveSnapshot(dir, "game.zip 2"))
+	objects, err = os.ReadDir(filepath.Join(dir, "objects"))
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+
+	source, err = restored.LoadSnapshot(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "game.zip 2", source)
+	_, err = restored.HeadFile(ctx, "local", "extracted/game.js")
+	assert.Error(t, err)
+}
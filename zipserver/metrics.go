@@ -6,19 +6,90 @@ import (
 	"net/http"
 	"os"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"sync/atomic"
 )
 
 var globalMetrics = &MetricsCounter{}
 
+// MetricsCounter holds the counters served by /metrics. Each field's metric
+// tag is its name, help is its description, type is counter unless set.
+// Histogram fields list the names of their own labels in a labels tag.
 type MetricsCounter struct {
-	TotalRequests        atomic.Int64 `metric:"zipserver_requests_total""`
-	TotalErrors          atomic.Int64 `metric:"zipserver_errors_total""`
-	TotalExtractedFiles  atomic.Int64 `metric:"zipserver_extracted_files_total"`
-	TotalCopiedFiles     atomic.Int64 `metric:"zipserver_copied_files_total"`
-	TotalBytesDownloaded atomic.Int64 `metric:"zipserver_downloaded_bytes_total"`
-	TotalBytesUploaded   atomic.Int64 `metric:"zipserver_uploaded_bytes_total"`
+	TotalRequests            atomic.Int64 `metric:"zipserver_requests_total" help:"Requests handled"`
+	TotalErrors              atomic.Int64 `metric:"zipserver_errors_total" help:"Requests and jobs that failed"`
+	TotalRejectedRequests    atomic.Int64 `metric:"zipserver_rejected_requests_total" help:"Requests refused with a 429 because too many were running"`
+	TotalExtractedFiles      atomic.Int64 `metric:"zipserver_extracted_files_total" help:"Files extracted from archives"`
+	TotalCopiedFiles         atomic.Int64 `metric:"zipserver_copied_files_total" help:"Files copied to storage targets"`
+	TotalSlurpedFiles        atomic.Int64 `metric:"zipserver_slurped_files_total" help:"Files downloaded from URLs"`
+	TotalDeletedFiles        atomic.Int64 `metric:"zipserver_deleted_files_total" help:"Objects deleted from storage"`
+	TotalCallbackRetries     atomic.Int64 `metric:"zipserver_callback_retries_total" help:"Callback deliveries retried after a failed attempt"`
+	TotalJobRetries          atomic.Int64 `metric:"zipserver_job_retries_total" help:"Failed async jobs attempted again because of auto_retry"`
+	TotalCallbackFailures    atomic.Int64 `metric:"zipserver_callback_failures_total" help:"Callbacks that couldn't be delivered after every retry"`
+	TotalSuppressedCallbacks atomic.Int64 `metric:"zipserver_suppressed_callbacks_total" help:"Callbacks skipped because their idempotency key was already acknowledged"`
+	TotalMaintenanceRuns     atomic.Int64 `metric:"zipserver_maintenance_runs_total" help:"Scheduled maintenance task runs"`
+	TotalMaintenanceFailures atomic.Int64 `metric:"zipserver_maintenance_failures_total" help:"Scheduled maintenance task runs that failed"`
+	TotalBytesDownloaded     atomic.Int64 `metric:"zipserver_downloaded_bytes_total" help:"Bytes read from storage"`
+	TotalBytesUploaded       atomic.Int64 `metric:"zipserver_uploaded_bytes_total" help:"Bytes written to storage"`
+	TotalUploadRetries       atomic.Int64 `metric:"zipserver_upload_retries_total" help:"Uploads of extracted files retried after a transient failure"`
+	TotalHedgedPuts          atomic.Int64 `metric:"zipserver_hedged_puts_total" help:"Second uploads started for slow small files"`
+	TotalHedgedPutWins       atomic.Int64 `metric:"zipserver_hedged_put_wins_total" help:"Second uploads that finished before the first"`
+	TotalChecksumMismatches  atomic.Int64 `metric:"zipserver_checksum_mismatches_total" help:"Extracted files uploaded again because storage reported a different MD5"`
+	TotalScannedFiles        atomic.Int64 `metric:"zipserver_scanned_files_total" help:"Extracted files scanned for malware by clamd"`
+	TotalMalwareDetections   atomic.Int64 `metric:"zipserver_malware_detections_total" help:"Extracted files clamd found malware in"`
+	TotalTempFilesRemoved    atomic.Int64 `metric:"zipserver_temp_files_removed_total" help:"Stale local temporary files removed by the janitor"`
+	TotalLowDiskRejections   atomic.Int64 `metric:"zipserver_low_disk_rejections_total" help:"Extractions refused because the temporary directory's disk was almost full"`
+	TotalExpiredLocks        atomic.Int64 `metric:"zipserver_expired_locks_total" help:"Locks released because they were held longer than LockTTL"`
+	TotalQueueMessages       atomic.Int64 `metric:"zipserver_queue_messages_total" help:"Job requests received from the queue"`
+	TotalQueueRetries        atomic.Int64 `metric:"zipserver_queue_retries_total" help:"Queue messages left to be delivered again because the job couldn't start"`
+
+	TotalDNSRetries               atomic.Int64 `metric:"zipserver_dns_retries_total" help:"Outbound connections retried after a temporary lookup failure"`
+	TotalStorageConnections       atomic.Int64 `metric:"zipserver_storage_connections_total" help:"Connections opened to storage backends"`
+	TotalReusedStorageConnections atomic.Int64 `metric:"zipserver_storage_connections_reused_total" help:"Storage requests sent over an already open connection"`
+	OpenStorageConnections        atomic.Int64 `metric:"zipserver_storage_connections_open" help:"Connections to storage backends currently open" type:"gauge"`
+	TempFreeBytes                 atomic.Int64 `metric:"zipserver_temp_free_bytes" help:"Free space on the disk holding the temporary directory, as of the last check" type:"gauge"`
+
+	JobDuration        DurationHistogram `metric:"zipserver_job_duration_seconds" help:"Time taken by successful extractions, copies and slurps" labels:"operation,target"`
+	FileUploadDuration DurationHistogram `metric:"zipserver_file_upload_duration_seconds" help:"Time taken to upload a single extracted or copied file" labels:"operation,target"`
+	CallbackDuration   DurationHistogram `metric:"zipserver_callback_duration_seconds" help:"Time taken by callback delivery attempts"`
+	ZipSize            SizeHistogram     `metric:"zipserver_zip_size_bytes" help:"Size of the archives extracted" labels:"operation"`
+	ExtractedBytes     SizeHistogram     `metric:"zipserver_extracted_bytes" help:"Bytes uploaded by each extraction" labels:"operation"`
+}
+
+var metricsLabelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateMetricsLabels checks that MetricsLabels are valid prometheus label
+// names, host is always set so it can't be overridden
+func validateMetricsLabels(labels map[string]string) error {
+	for name := range labels {
+		if !metricsLabelPattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("Config error: invalid metrics label name %q", name)
+		}
+		if name == "host" {
+			return fmt.Errorf("Config error: metrics label host is set from MetricsHost")
+		}
+	}
+	return nil
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderMetricsLabels formats host and the extra labels, sorted by name
+func renderMetricsLabels(hostname string, extra map[string]string) string {
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := []string{fmt.Sprintf("host=\"%s\"", metricsLabelEscaper.Replace(hostname))}
+	for _, name := range names {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", name, metricsLabelEscaper.Replace(extra[name])))
+	}
+
+	return strings.Join(labels, ",")
 }
 
 // render the metrics in a prometheus compatible format
@@ -31,16 +102,36 @@ func (m *MetricsCounter) RenderMetrics(config *Config) string {
 	if hostname == "" {
 		hostname, _ = os.Hostname()
 	}
+	labels := renderMetricsLabels(hostname, config.MetricsLabels)
 
 	for i := 0; i < valueOfMetrics.NumField(); i++ {
-		metricTag := valueOfMetrics.Type().Field(i).Tag.Get("metric")
+		field := valueOfMetrics.Type().Field(i)
+		metricTag := field.Tag.Get("metric")
 		if metricTag == "" {
 			continue
 		}
-		fieldValue := valueOfMetrics.Field(i).Addr().Interface().(*atomic.Int64).Load()
 
-		metrics.WriteString(fmt.Sprintf("%s{host=\"%s\"} %v\n", metricTag, hostname, fieldValue))
+		if help := field.Tag.Get("help"); help != "" {
+			metrics.WriteString(fmt.Sprintf("# HELP %s %s\n", metricTag, help))
+		}
 
+		if histogram, ok := valueOfMetrics.Field(i).Addr().Interface().(histogramMetric); ok {
+			labelNames := []string{}
+			if tag := field.Tag.Get("labels"); tag != "" {
+				labelNames = strings.Split(tag, ",")
+			}
+			metrics.WriteString(fmt.Sprintf("# TYPE %s histogram\n", metricTag))
+			histogram.renderHistogram(&metrics, metricTag, labels, labelNames)
+			continue
+		}
+
+		fieldValue := valueOfMetrics.Field(i).Addr().Interface().(*atomic.Int64).Load()
+		metricType := field.Tag.Get("type")
+		if metricType == "" {
+			metricType = "counter"
+		}
+		metrics.WriteString(fmt.Sprintf("# TYPE %s %s\n", metricTag, metricType))
+		metrics.WriteString(fmt.Sprintf("%s{%s} %v\n", metricTag, labels, fieldValue))
 	}
 
 	return metrics.String()
@@ -74,7 +165,7 @@ func (mrc metricsReadCloser) Close() error {
 
 // http endpoint to render the global metrics
 func metricsHandler(w http.ResponseWriter, r *http.Request) error {
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 	w.Write([]byte(globalMetrics.RenderMetrics(globalConfig)))
 	return nil
 }
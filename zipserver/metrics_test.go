@@ -3,7 +3,9 @@ package zipserver
 import (
 	"bytes"
 	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -32,12 +34,162 @@ func Test_Metrics(t *testing.T) {
 		MetricsHost: "localhost",
 	}
 
-	expectedMetrics := `zipserver_requests_total{host="localhost"} 1
+	expectedMetrics := `# HELP zipserver_requests_total Requests handled
+# TYPE zipserver_requests_total counter
+zipserver_requests_total{host="localhost"} 1
+# HELP zipserver_errors_total Requests and jobs that failed
+# TYPE zipserver_errors_total counter
 zipserver_errors_total{host="localhost"} 0
+# HELP zipserver_rejected_requests_total Requests refused with a 429 because too many were running
+# TYPE zipserver_rejected_requests_total counter
+zipserver_rejected_requests_total{host="localhost"} 0
+# HELP zipserver_extracted_files_total Files extracted from archives
+# TYPE zipserver_extracted_files_total counter
 zipserver_extracted_files_total{host="localhost"} 1
+# HELP zipserver_copied_files_total Files copied to storage targets
+# TYPE zipserver_copied_files_total counter
 zipserver_copied_files_total{host="localhost"} 0
+# HELP zipserver_slurped_files_total Files downloaded from URLs
+# TYPE zipserver_slurped_files_total counter
+zipserver_slurped_files_total{host="localhost"} 0
+# HELP zipserver_deleted_files_total Objects deleted from storage
+# TYPE zipserver_deleted_files_total counter
+zipserver_deleted_files_total{host="localhost"} 0
+# HELP zipserver_callback_retries_total Callback deliveries retried after a failed attempt
+# TYPE zipserver_callback_retries_total counter
+zipserver_callback_retries_total{host="localhost"} 0
+# HELP zipserver_job_retries_total Failed async jobs attempted again because of auto_retry
+# TYPE zipserver_job_retries_total counter
+zipserver_job_retries_total{host="localhost"} 0
+# HELP zipserver_callback_failures_total Callbacks that couldn't be delivered after every retry
+# TYPE zipserver_callback_failures_total counter
+zipserver_callback_failures_total{host="localhost"} 0
+# HELP zipserver_suppressed_callbacks_total Callbacks skipped because their idempotency key was already acknowledged
+# TYPE zipserver_suppressed_callbacks_total counter
+zipserver_suppressed_callbacks_total{host="localhost"} 0
+# HELP zipserver_maintenance_runs_total Scheduled maintenance task runs
+# TYPE zipserver_maintenance_runs_total counter
+zipserver_maintenance_runs_total{host="localhost"} 0
+# HELP zipserver_maintenance_failures_total Scheduled maintenance task runs that failed
+# TYPE zipserver_maintenance_failures_total counter
+zipserver_maintenance_failures_total{host="localhost"} 0
+# HELP zipserver_downloaded_bytes_total Bytes read from storage
+# TYPE zipserver_downloaded_bytes_total counter
 zipserver_downloaded_bytes_total{host="localhost"} 7
+# HELP zipserver_uploaded_bytes_total Bytes written to storage
+# TYPE zipserver_uploaded_bytes_total counter
 zipserver_uploaded_bytes_total{host="localhost"} 0
+# HELP zipserver_upload_retries_total Uploads of extracted files retried after a transient failure
+# TYPE zipserver_upload_retries_total counter
+zipserver_upload_retries_total{host="localhost"} 0
+# HELP zipserver_hedged_puts_total Second uploads started for slow small files
+# TYPE zipserver_hedged_puts_total counter
+zipserver_hedged_puts_total{host="localhost"} 0
+# HELP zipserver_hedged_put_wins_total Second uploads that finished before the first
+# TYPE zipserver_hedged_put_wins_total counter
+zipserver_hedged_put_wins_total{host="localhost"} 0
+# HELP zipserver_checksum_mismatches_total Extracted files uploaded again because storage reported a different MD5
+# TYPE zipserver_checksum_mismatches_total counter
+zipserver_checksum_mismatches_total{host="localhost"} 0
+# HELP zipserver_scanned_files_total Extracted files scanned for malware by clamd
+# TYPE zipserver_scanned_files_total counter
+zipserver_scanned_files_total{host="localhost"} 0
+# HELP zipserver_malware_detections_total Extracted files clamd found malware in
+# TYPE zipserver_malware_detections_total counter
+zipserver_malware_detections_total{host="localhost"} 0
+# HELP zipserver_temp_files_removed_total Stale local temporary files removed by the janitor
+# TYPE zipserver_temp_files_removed_total counter
+zipserver_temp_files_removed_total{host="localhost"} 0
+# HELP zipserver_low_disk_rejections_total Extractions refused because the temporary directory's disk was almost full
+# TYPE zipserver_low_disk_rejections_total counter
+zipserver_low_disk_rejections_total{host="localhost"} 0
+# HELP zipserver_expired_locks_total Locks released because they were held longer than LockTTL
+# TYPE zipserver_expired_locks_total counter
+zipserver_expired_locks_total{host="localhost"} 0
+# HELP zipserver_queue_messages_total Job requests received from the queue
+# TYPE zipserver_queue_messages_total counter
+zipserver_queue_messages_total{host="localhost"} 0
+# HELP zipserver_queue_retries_total Queue messages left to be delivered again because the job couldn't start
+# TYPE zipserver_queue_retries_total counter
+zipserver_queue_retries_total{host="localhost"} 0
+# HELP zipserver_dns_retries_total Outbound connections retried after a temporary lookup failure
+# TYPE zipserver_dns_retries_total counter
+zipserver_dns_retries_total{host="localhost"} 0
+# HELP zipserver_storage_connections_total Connections opened to storage backends
+# TYPE zipserver_storage_connections_total counter
+zipserver_storage_connections_total{host="localhost"} 0
+# HELP zipserver_storage_connections_reused_total Storage requests sent over an already open connection
+# TYPE zipserver_storage_connections_reused_total counter
+zipserver_storage_connections_reused_total{host="localhost"} 0
+# HELP zipserver_storage_connections_open Connections to storage backends currently open
+# TYPE zipserver_storage_connections_open gauge
+zipserver_storage_connections_open{host="localhost"} 0
+# HELP zipserver_temp_free_bytes Free space on the disk holding the temporary directory, as of the last check
+# TYPE zipserver_temp_free_bytes gauge
+zipserver_temp_free_bytes{host="localhost"} 0
+# HELP zipserver_job_duration_seconds Time taken by successful extractions, copies and slurps
+# TYPE zipserver_job_duration_seconds histogram
+# HELP zipserver_file_upload_duration_seconds Time taken to upload a single extracted or copied file
+# TYPE zipserver_file_upload_duration_seconds histogram
+# HELP zipserver_callback_duration_seconds Time taken by callback delivery attempts
+# TYPE zipserver_callback_duration_seconds histogram
+# HELP zipserver_zip_size_bytes Size of the archives extracted
+# TYPE zipserver_zip_size_bytes histogram
+# HELP zipserver_extracted_bytes Bytes uploaded by each extraction
+# TYPE zipserver_extracted_bytes histogram
 `
 	assert.Equal(t, expectedMetrics, metrics.RenderMetrics(config))
 }
+
+func Test_MetricsHistograms(t *testing.T) {
+	metrics := &MetricsCounter{}
+	metrics.JobDuration.Observe(300*time.Millisecond, "copy", "s3")
+	metrics.JobDuration.Observe(2*time.Second, "copy", "s3")
+	metrics.JobDuration.Observe(20*time.Minute, "copy", "s3")
+	metrics.JobDuration.Observe(time.Second, "extract", "primary")
+	metrics.CallbackDuration.Observe(20 * time.Millisecond)
+	metrics.ZipSize.Observe(3000, "extract")
+
+	rendered := metrics.RenderMetrics(&Config{MetricsHost: "zip-1"})
+
+	for _, line := range []string{
+		`zipserver_job_duration_seconds_bucket{host="zip-1",operation="copy",target="s3",le="0.25"} 0`,
+		`zipserver_job_duration_seconds_bucket{host="zip-1",operation="copy",target="s3",le="0.5"} 1`,
+		`zipserver_job_duration_seconds_bucket{host="zip-1",operation="copy",target="s3",le="2.5"} 2`,
+		`zipserver_job_duration_seconds_bucket{host="zip-1",operation="copy",target="s3",le="600"} 2`,
+		`zipserver_job_duration_seconds_bucket{host="zip-1",operation="copy",target="s3",le="+Inf"} 3`,
+		`zipserver_job_duration_seconds_sum{host="zip-1",operation="copy",target="s3"} 1202.3`,
+		`zipserver_job_duration_seconds_count{host="zip-1",operation="copy",target="s3"} 3`,
+		`zipserver_job_duration_seconds_count{host="zip-1",operation="extract",target="primary"} 1`,
+		`zipserver_callback_duration_seconds_bucket{host="zip-1",le="0.025"} 1`,
+		`zipserver_zip_size_bytes_bucket{host="zip-1",operation="extract",le="1024"} 0`,
+		`zipserver_zip_size_bytes_bucket{host="zip-1",operation="extract",le="4096"} 1`,
+		`zipserver_zip_size_bytes_sum{host="zip-1",operation="extract"} 3000`,
+	} {
+		assert.Contains(t, rendered, line+"\n")
+	}
+
+	// series are sorted by their label values
+	assert.Less(t, strings.Index(rendered, `operation="copy"`), strings.Index(rendered, `operation="extract"`))
+}
+
+func Test_MetricsLabels(t *testing.T) {
+	metrics := &MetricsCounter{}
+	metrics.TotalRequests.Add(2)
+
+	config := &Config{
+		MetricsHost: "zip-1",
+		MetricsLabels: map[string]string{
+			"region":      "us-east1",
+			"environment": `prod "blue"`,
+		},
+	}
+
+	rendered := metrics.RenderMetrics(config)
+	assert.Contains(t, rendered, `zipserver_requests_total{host="zip-1",environment="prod \"blue\"",region="us-east1"} 2`+"\n")
+
+	assert.NoError(t, validateMetricsLabels(config.MetricsLabels))
+	assert.Error(t, validateMetricsLabels(map[string]string{"host": "other"}))
+	assert.Error(t, validateMetricsLabels(map[string]string{"instance-group": "a"}))
+	assert.Error(t, validateMetricsLabels(map[string]string{"__name__": "a"}))
+}
@@ -0,0 +1,170 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// checkCopiedSize makes sure the object described by the target's head values
+// holds all size bytes that were read from the source
+func checkCopiedSize(values url.Values, size int64) error {
+	targetSize, err := strconv.ParseInt(values.Get("ContentLength"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Target did not report a size: %v", err)
+	}
+
+	if targetSize != size {
+		return fmt.Errorf("Target size does not match source (%d != %d)", targetSize, size)
+	}
+
+	return nil
+}
+
+// verifyTargetCopy checks that key landed on target with the expected size
+func verifyTargetCopy(ctx context.Context, target *StorageConfig, key string, size int64) error {
+	targetStorage, err := target.NewStorageClient()
+	if err != nil {
+		return fmt.Errorf("Failed to create target storage: %v", err)
+	}
+
+	values, err := targetStorage.HeadFile(ctx, target.Bucket, key)
+	if err != nil {
+		return fmt.Errorf("Failed to verify copy: %v", err)
+	}
+
+	return checkCopiedSize(values, size)
+}
+
+// The move handler copies a file from primary storage to the storage specified
+// by target like /copy, then deletes the source once the copy is verified
+func moveHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	key, err := getParam(params, "key")
+	if err != nil {
+		return err
+	}
+
+	callbackURL, err := getParam(params, "callback")
+	if err != nil {
+		return err
+	}
+
+	if err := checkParamLength(params, "callback", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	target, err := loadCopyTarget(params, key)
+	if err != nil {
+		return err
+	}
+
+	// refuse before copying anything rather than failing on the delete
+	if err := checkProtectedKey(globalConfig.ProtectedPrefixes, key); err != nil {
+		return err
+	}
+
+	priority, err := parseJobPriority(params.Get("priority"))
+	if err != nil {
+		return err
+	}
+
+	// shares the copy locks so a copy and a move of the same key can't overlap
+	lockKey := fmt.Sprintf("%s:%s", target.Name, key)
+
+	token, hasLock := copyLockTable.tryLockKey(lockKey)
+	if !hasLock {
+		return writeJSONMessage(w, struct{ Processing bool }{true})
+	}
+
+	job := jobs.newJob("move", key, "", callbackURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
+
+	// fail reports an error that ends the job
+	fail := func(err error) {
+		recordHistory(job.detachedContext(), HistoryEntry{Type: "move", Keys: []string{key}, Target: target.Name}, err)
+		job.finish(err)
+		notifyError(callbackURL, callbackTimeout, job, err)
+	}
+
+	startBackgroundJob(func() {
+		defer copyLockTable.releaseKey(lockKey, token)
+
+		jobCtx, cancel := context.WithTimeout(job.detachedContext(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		err := copyScheduler.Acquire(jobCtx, priority)
+		if err != nil {
+			fail(fmt.Errorf("Timed out waiting for a copy slot: %v", err))
+			return
+		}
+		defer copyScheduler.Release()
+		job.start()
+
+		storage, err := NewPrimaryStorage(globalConfig)
+		if err != nil {
+			fail(fmt.Errorf("Failed to create source storage: %v", err))
+			return
+		}
+
+		startTime := time.Now()
+
+		uploadStats, bytesRead, err := transferToTarget(jobCtx, storage, target, key, transferOptions{})
+		if err != nil {
+			fail(err)
+			return
+		}
+		globalMetrics.TotalCopiedFiles.Add(1)
+
+		err = verifyTargetCopy(jobCtx, target, key, bytesRead)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		err = storage.DeleteFile(jobCtx, globalConfig.Bucket, key)
+		if err != nil {
+			fail(fmt.Errorf("Copied to %s but failed to delete source: %v", target.Name, err))
+			return
+		}
+
+		log.Print("Move complete: [", target.Name, "] ", target.Bucket, "/", key)
+		recordHistory(withJob(jobCtx, job), HistoryEntry{Type: "move", Keys: []string{key}, Target: target.Name}, nil)
+
+		duration := fmt.Sprintf("%.4fs", time.Since(startTime).Seconds())
+		resValues := url.Values{}
+		resValues.Add("Success", "true")
+		resValues.Add("Key", key)
+		resValues.Add("Duration", duration)
+		resValues.Add("Size", fmt.Sprintf("%d", bytesRead))
+		resValues.Add("Md5", uploadStats.MD5)
+		resValues.Add("Deleted", "true")
+
+		job.addProgress(1, uint64(bytesRead))
+		job.finish(nil)
+		notifyCallback(callbackURL, callbackTimeout, job, resValues, struct {
+			Success  bool
+			Key      string
+			Duration string
+			Size     int64
+			Md5      string
+			Deleted  bool
+		}{true, key, duration, bytesRead, uploadStats.MD5, true})
+	})
+
+	return writeJobStarted(w, job)
+}
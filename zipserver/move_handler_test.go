@@ -0,0 +1,41 @@
+package zipserver
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckCopiedSize(t *testing.T) {
+	assert.NoError(t, checkCopiedSize(url.Values{"ContentLength": {"1024"}}, 1024))
+	assert.Error(t, checkCopiedSize(url.Values{"ContentLength": {"1000"}}, 1024))
+	assert.Error(t, checkCopiedSize(url.Values{}, 1024))
+}
+
+func Test_LoadCopyTarget(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+
+	config := emptyConfig()
+	config.StorageTargets = []StorageConfig{{
+		Name:            "s3",
+		Type:            S3,
+		Bucket:          "mirror",
+		AllowedPrefixes: []string{"games/"},
+	}}
+	globalConfig = config
+
+	target, err := loadCopyTarget(url.Values{"target": {"s3"}}, "games/1.zip")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "mirror", target.Bucket)
+
+	_, err = loadCopyTarget(url.Values{"target": {"gcs"}}, "games/1.zip")
+	assert.Error(t, err)
+
+	_, err = loadCopyTarget(url.Values{"target": {"s3"}}, "other/1.zip")
+	assert.Error(t, err)
+
+	_, err = loadCopyTarget(url.Values{"target": {"s3"}, "bucket": {"elsewhere"}}, "games/1.zip")
+	assert.Error(t, err)
+}
@@ -0,0 +1,341 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	errors "github.com/go-errors/errors"
+)
+
+// Archives can come in two multi-part flavours:
+//   - split: game.zip.001, game.zip.002... are a zip cut into pieces, they
+//     only need to be concatenated
+//   - spanned: game.z01, game.z02... game.zip, where each part is a "disk"
+//     and the central directory (in game.zip) refers to entries by disk
+//     number and offset within that disk
+
+// maxZipParts caps how many sibling parts are fetched for one archive
+const maxZipParts = 1000
+
+var splitPartPattern = regexp.MustCompile(`(?i)^(.+\.zip)\.(\d{3})$`)
+
+// fetchZipParts downloads the zip at key to a temporary file. When key is a
+// part of a split or spanned archive, the other parts are fetched from the
+// same prefix and joined into a single zip.
+func (a *Archiver) fetchZipParts(ctx context.Context, key string) (string, error) {
+	if matches := splitPartPattern.FindStringSubmatch(key); matches != nil {
+		return a.fetchSplitZip(ctx, matches[1])
+	}
+
+	fname, err := a.fetchZip(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	lastDisk, err := spannedDiskNumber(fname)
+	if err != nil || lastDisk == 0 {
+		// not spanned, or not a zip at all, which is for the caller to report
+		return fname, nil
+	}
+
+	joined, err := a.fetchSpannedZip(ctx, key, fname, lastDisk)
+	os.Remove(fname)
+	if err != nil {
+		return "", err
+	}
+
+	return joined, nil
+}
+
+// fetchSplitZip fetches every base.NNN part and concatenates them
+func (a *Archiver) fetchSplitZip(ctx context.Context, base string) (string, error) {
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, base+".")
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	partKeys := map[int]string{}
+	for _, object := range objects {
+		matches := splitPartPattern.FindStringSubmatch(object.Key)
+		if matches == nil || matches[1] != base {
+			continue
+		}
+		number, _ := strconv.Atoi(matches[2])
+		partKeys[number] = object.Key
+	}
+
+	if len(partKeys) > maxZipParts {
+		return "", fmt.Errorf("Too many parts in split zip %s (%d, max %d)", base, len(partKeys), maxZipParts)
+	}
+
+	numbers := make([]int, 0, len(partKeys))
+	for number := range partKeys {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	keys := make([]string, 0, len(numbers))
+	for i, number := range numbers {
+		if number != i+1 {
+			return "", fmt.Errorf("Missing part %03d of split zip %s", i+1, base)
+		}
+		keys = append(keys, partKeys[number])
+	}
+
+	if len(keys) == 0 {
+		return "", fmt.Errorf("No parts found for split zip %s", base)
+	}
+
+	log.Printf("Joining %d parts of split zip %s", len(keys), base)
+
+	joined := path.Join(a.tempDir(ctx), fetchZipFilename(a.Bucket, base+":split"))
+	_, err = a.fetchAndJoinParts(ctx, keys, joined)
+	if err != nil {
+		return "", err
+	}
+
+	return joined, nil
+}
+
+// fetchSpannedZip fetches the .z01 to .zNN parts that go before the last
+// part, which is already in lastPart, and joins them into a regular zip
+func (a *Archiver) fetchSpannedZip(ctx context.Context, key string, lastPart string, lastDisk int) (string, error) {
+	if lastDisk > maxZipParts {
+		return "", fmt.Errorf("Too many parts in spanned zip %s (%d, max %d)", key, lastDisk+1, maxZipParts)
+	}
+
+	// keep the extension's case: game.ZIP goes with game.Z01
+	ext := path.Ext(key)
+	if len(ext) < 2 {
+		return "", fmt.Errorf("Can't find the parts of spanned zip %s", key)
+	}
+	base := key[:len(key)-len(ext)]
+
+	keys := make([]string, 0, lastDisk)
+	for disk := 1; disk <= lastDisk; disk++ {
+		keys = append(keys, fmt.Sprintf("%s%s%02d", base, ext[:2], disk))
+	}
+
+	log.Printf("Joining %d parts of spanned zip %s", lastDisk+1, key)
+
+	joined := path.Join(a.tempDir(ctx), fetchZipFilename(a.Bucket, key+":spanned"))
+	diskOffsets, err := a.fetchAndJoinParts(ctx, keys, joined)
+	if err != nil {
+		return "", err
+	}
+
+	err = appendFile(joined, lastPart)
+	if err == nil {
+		err = rewriteSpannedZip(joined, diskOffsets)
+	}
+	if err != nil {
+		os.Remove(joined)
+		return "", err
+	}
+
+	return joined, nil
+}
+
+// fetchAndJoinParts concatenates the objects at keys into dest, and returns
+// the offset each one starts at, followed by the size of the whole
+func (a *Archiver) fetchAndJoinParts(ctx context.Context, keys []string, dest string) ([]int64, error) {
+	out, err := os.Create(dest)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	offsets := []int64{0}
+	err = func() error {
+		defer out.Close()
+
+		var written int64
+		for _, key := range keys {
+			reader, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
+			if err != nil {
+				return fmt.Errorf("Failed to fetch zip part %s: %v", key, err)
+			}
+
+			n, err := io.Copy(out, reader)
+			reader.Close()
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+
+			written += n
+			offsets = append(offsets, written)
+		}
+		return nil
+	}()
+
+	if err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+
+	return offsets, nil
+}
+
+func appendFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+// findEndOfDirectory returns the contents and position of the end of central
+// directory record of a zip, or -1 if there's none
+func findEndOfDirectory(file *os.File) ([]byte, int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, -1, errors.Wrap(err, 0)
+	}
+
+	tailSize := int64(maxEndOfDirSearch)
+	if tailSize > stat.Size() {
+		tailSize = stat.Size()
+	}
+
+	tail := make([]byte, tailSize)
+	_, err = file.ReadAt(tail, stat.Size()-tailSize)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, 0)
+	}
+
+	idx := bytes.LastIndex(tail, endOfDirSignature)
+	if idx < 0 || idx+22 > len(tail) {
+		return nil, -1, nil
+	}
+
+	return tail[idx : idx+22], stat.Size() - tailSize + int64(idx), nil
+}
+
+// spannedDiskNumber returns the disk number of a zip, anything but 0 means
+// it's the last part of a spanned archive
+func spannedDiskNumber(fname string) (int, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return 0, errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	record, _, err := findEndOfDirectory(file)
+	if err != nil || record == nil {
+		return 0, err
+	}
+
+	return int(binary.LittleEndian.Uint16(record[4:])), nil
+}
+
+// rewriteSpannedZip turns the joined disks of a spanned zip into a single
+// disk zip, by making the central directory's disk-relative offsets absolute.
+// diskOffsets holds where each disk starts in the joined file.
+func rewriteSpannedZip(fname string, diskOffsets []int64) error {
+	file, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	record, recordPos, err := findEndOfDirectory(file)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("Spanned zip has no central directory")
+	}
+
+	diskOffset := func(disk uint16) (int64, error) {
+		if int(disk) >= len(diskOffsets) {
+			return 0, fmt.Errorf("Spanned zip refers to missing disk %d", disk)
+		}
+		return diskOffsets[disk], nil
+	}
+
+	directoryDisk := binary.LittleEndian.Uint16(record[6:])
+	totalEntries := binary.LittleEndian.Uint16(record[10:])
+	directorySize := binary.LittleEndian.Uint32(record[12:])
+	directoryOffset := binary.LittleEndian.Uint32(record[16:])
+
+	if totalEntries == 0xffff || directorySize == 0xffffffff || directoryOffset == 0xffffffff {
+		return fmt.Errorf("Spanned zip64 archives are not supported")
+	}
+
+	base, err := diskOffset(directoryDisk)
+	if err != nil {
+		return err
+	}
+	directoryPos := base + int64(directoryOffset)
+
+	directory := make([]byte, directorySize)
+	_, err = file.ReadAt(directory, directoryPos)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for pos := 0; pos < len(directory); {
+		if pos+46 > len(directory) || !bytes.Equal(directory[pos:pos+4], []byte("PK\x01\x02")) {
+			return fmt.Errorf("Spanned zip has a corrupted central directory")
+		}
+		header := directory[pos:]
+
+		base, err := diskOffset(binary.LittleEndian.Uint16(header[34:]))
+		if err != nil {
+			return err
+		}
+		offset := base + int64(binary.LittleEndian.Uint32(header[42:]))
+		if offset >= 0xffffffff {
+			return fmt.Errorf("Spanned zip64 archives are not supported")
+		}
+
+		binary.LittleEndian.PutUint16(header[34:], 0)
+		binary.LittleEndian.PutUint32(header[42:], uint32(offset))
+
+		nameLength := int(binary.LittleEndian.Uint16(header[28:]))
+		extraLength := int(binary.LittleEndian.Uint16(header[30:]))
+		commentLength := int(binary.LittleEndian.Uint16(header[32:]))
+		pos += 46 + nameLength + extraLength + commentLength
+	}
+
+	if directoryPos >= 0xffffffff {
+		return fmt.Errorf("Spanned zip64 archives are not supported")
+	}
+
+	binary.LittleEndian.PutUint16(record[4:], 0)
+	binary.LittleEndian.PutUint16(record[6:], 0)
+	binary.LittleEndian.PutUint16(record[8:], totalEntries)
+	binary.LittleEndian.PutUint32(record[16:], uint32(directoryPos))
+
+	_, err = file.WriteAt(directory, directoryPos)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	_, err = file.WriteAt(record, recordPos)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
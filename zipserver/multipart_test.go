@@ -0,0 +1,118 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func multipartTestZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, name := range []string{"index.html", "data/level.txt"} {
+		writer, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		require.NoError(t, err)
+		_, err = writer.Write(bytes.Repeat([]byte(name+" contents\n"), 20))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// spanZip cuts a zip in two disks the way a spanning archiver would, with
+// disk-relative offsets in the central directory
+func spanZip(t *testing.T, data []byte) ([]byte, []byte) {
+	split := bytes.Index(data[1:], localFileSignature) + 1
+	require.True(t, split > 0)
+
+	disk0 := append([]byte("PK\x07\x08"), data[:split]...)
+	disk1 := append([]byte{}, data[split:]...)
+
+	eocd := bytes.LastIndex(disk1, endOfDirSignature)
+	directoryOffset := int(binary.LittleEndian.Uint32(disk1[eocd+16:])) - split
+
+	for pos := directoryOffset; pos < eocd; {
+		header := disk1[pos:]
+		offset := int(binary.LittleEndian.Uint32(header[42:]))
+		if offset < split {
+			binary.LittleEndian.PutUint32(header[42:], uint32(offset+4))
+		} else {
+			binary.LittleEndian.PutUint16(header[34:], 1)
+			binary.LittleEndian.PutUint32(header[42:], uint32(offset-split))
+		}
+		pos += 46 + int(binary.LittleEndian.Uint16(header[28:])) +
+			int(binary.LittleEndian.Uint16(header[30:])) + int(binary.LittleEndian.Uint16(header[32:]))
+	}
+
+	binary.LittleEndian.PutUint16(disk1[eocd+4:], 1)
+	binary.LittleEndian.PutUint16(disk1[eocd+6:], 1)
+	binary.LittleEndian.PutUint16(disk1[eocd+8:], 1)
+	binary.LittleEndian.PutUint32(disk1[eocd+16:], uint32(directoryOffset))
+
+	return disk0, disk1
+}
+
+func Test_ExtractMultipartZip(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	data := multipartTestZip(t)
+
+	checkExtracted := func(storage *MemStorage, prefix string) {
+		reader, _, err := storage.GetFile(ctx, config.Bucket, prefix+"/data/level.txt")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		contents, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.EqualValues(t, bytes.Repeat([]byte("data/level.txt contents\n"), 20), contents)
+	}
+
+	t.Run("split", func(t *testing.T) {
+		storage, err := NewMemStorage()
+		require.NoError(t, err)
+		archiver := &Archiver{storage, config}
+
+		third := len(data) / 3
+		parts := map[string][]byte{
+			"uploads/game.zip.001": data[:third],
+			"uploads/game.zip.002": data[third : 2*third],
+			"uploads/game.zip.003": data[2*third:],
+		}
+		for key, part := range parts {
+			require.NoError(t, storage.PutFile(ctx, config.Bucket, key, bytes.NewReader(part), "application/octet-stream"))
+		}
+
+		extracted, err := archiver.ExtractZip(ctx, "uploads/game.zip.001", "split", testLimits(), ExtractOptions{})
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, len(extracted))
+		checkExtracted(storage, "split")
+
+		// a gap in the set is reported
+		require.NoError(t, storage.DeleteFile(ctx, config.Bucket, "uploads/game.zip.002"))
+		_, err = archiver.ExtractZip(ctx, "uploads/game.zip.001", "split", testLimits(), ExtractOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("spanned", func(t *testing.T) {
+		storage, err := NewMemStorage()
+		require.NoError(t, err)
+		archiver := &Archiver{storage, config}
+
+		disk0, disk1 := spanZip(t, data)
+		require.NoError(t, storage.PutFile(ctx, config.Bucket, "uploads/game.z01", bytes.NewReader(disk0), "application/octet-stream"))
+		require.NoError(t, storage.PutFile(ctx, config.Bucket, "uploads/game.zip", bytes.NewReader(disk1), "application/octet-stream"))
+
+		extracted, err := archiver.ExtractZip(ctx, "uploads/game.zip", "spanned", testLimits(), ExtractOptions{})
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, len(extracted))
+		checkExtracted(storage, "spanned")
+	})
+}
@@ -0,0 +1,240 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	errors "github.com/go-errors/errors"
+)
+
+// upper half of code page 437, which zips without the UTF-8 flag use for names
+const cp437 = "ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0"
+
+var cp437Runes = []rune(cp437)
+
+// extensions of formats that are already compressed, stored rather than
+// deflated in normalized zips
+var storedExtensions = map[string]bool{
+	".7z": true, ".br": true, ".bz2": true, ".gz": true, ".jpeg": true,
+	".jpg": true, ".m4a": true, ".mp3": true, ".mp4": true, ".ogg": true,
+	".png": true, ".rar": true, ".unityweb": true, ".webm": true, ".webp": true,
+	".woff": true, ".woff2": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// every normalized entry gets the same time so the output only depends on
+// the contents
+var normalizedModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// NormalizeResult describes a normalized zip
+type NormalizeResult struct {
+	Key     string
+	Files   int // entries in the normalized zip
+	Removed int // junk, empty and directory entries left out
+	Renamed int // names that were re-encoded or cleaned up
+}
+
+// decodeZipName returns name as UTF-8, decoding it from code page 437 when it
+// isn't valid UTF-8 already
+func decodeZipName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x80 {
+			b.WriteByte(c)
+		} else {
+			b.WriteRune(cp437Runes[c-0x80])
+		}
+	}
+	return b.String()
+}
+
+// normalizeZipName returns the UTF-8, forward-slashed, relative form of an
+// entry name, or an empty string for names that escape the archive
+func normalizeZipName(name string) string {
+	name = strings.ReplaceAll(decodeZipName(name), "\\", "/")
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if name == "" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// NormalizeZip re-packs the archive at key into a canonical zip stored at
+// destKey: UTF-8 names, no junk or directory entries, sorted entries with a
+// fixed modification time, and already-compressed files stored as-is.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) NormalizeZip(ctx context.Context, key, destKey string, limits *ExtractLimits) (*NormalizeResult, error) {
+	ctx, cleanup, err := a.withTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fname, err := a.fetchZipParts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &ExtractOptions{}
+	zipReader, err := a.openArchive(ctx, fname, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	fileList, err := a.selectZipFiles(ctx, zipReader.File, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &NormalizeResult{Key: destKey}
+
+	entries := map[string]*zip.File{}
+	for _, file := range fileList {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+
+		name := normalizeZipName(file.Name)
+		if name == "" {
+			return nil, errors.Wrap(fmt.Errorf("Zip entry %s has an invalid path", file.Name), 0)
+		}
+
+		if _, ok := entries[name]; ok {
+			return nil, errors.Wrap(fmt.Errorf("Zip has several entries named %s", name), 0)
+		}
+
+		if name != file.Name {
+			result.Renamed++
+		}
+		entries[name] = file
+	}
+
+	result.Files = len(entries)
+	result.Removed = len(zipReader.File) - len(entries)
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out, err := os.CreateTemp(a.tempDir(ctx), "normalized-*.zip")
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, name := range names {
+		err := writeNormalizedEntry(zw, name, entries[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	_, err = out.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	log.Printf("Uploading normalized zip of %s to %s (%d files)", key, destKey, result.Files)
+
+	err = a.Storage.PutFile(ctx, a.Bucket, destKey, out, "application/zip")
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func writeNormalizedEntry(zw *zip.Writer, name string, file *zip.File) error {
+	method := zip.Deflate
+	if storedExtensions[strings.ToLower(path.Ext(name))] {
+		method = zip.Store
+	}
+
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: normalizedModTime,
+	}
+	header.SetMode(file.Mode() &^ os.ModeType)
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	reader, err := openZipEntry(file, "")
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+// Re-packs an uploaded archive into a normalized zip, stored at dest
+func normalizeHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	key, err := getParam(params, "key")
+	if err != nil {
+		return err
+	}
+
+	destKey, err := getParam(params, "dest")
+	if err != nil {
+		return err
+	}
+
+	if destKey == key {
+		return fmt.Errorf("key and dest must differ")
+	}
+
+	if err := checkProtectedKey(globalConfig.ProtectedPrefixes, destKey); err != nil {
+		return err
+	}
+
+	limits := loadLimits(params, globalConfig)
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	archiver := NewArchiver(globalConfig)
+	result, err := archiver.NormalizeZip(ctx, key, destKey, limits)
+	if err != nil {
+		return writeJSONError(w, "NormalizeError", err)
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		*NormalizeResult
+	}{true, result})
+}
@@ -0,0 +1,79 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NormalizeZipName(t *testing.T) {
+	assert.Len(t, cp437Runes, 128)
+
+	assert.EqualValues(t, "dir/file.txt", normalizeZipName("dir\\file.txt"))
+	assert.EqualValues(t, "file.txt", normalizeZipName("/../file.txt"))
+	assert.EqualValues(t, "a/b.txt", normalizeZipName("./a//b.txt"))
+	assert.EqualValues(t, "café.txt", normalizeZipName("caf\x82.txt"))
+	assert.EqualValues(t, "café.txt", normalizeZipName("café.txt"))
+	assert.EqualValues(t, "", normalizeZipName(".."))
+}
+
+func Test_NormalizeZip(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"zeta.txt", "assets/", "assets/logo.png", "__MACOSX/._zeta.txt", "Alpha\\readme.txt"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		if name != "assets/" {
+			w.Write([]byte("contents of " + name))
+		}
+	}
+	require.NoError(t, zw.Close())
+
+	err = storage.PutFile(ctx, config.Bucket, "upload.zip", bytes.NewReader(buf.Bytes()), "application/zip")
+	require.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+	result, err := archiver.NormalizeZip(ctx, "upload.zip", "normalized.zip", testLimits())
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, result.Files)
+	assert.EqualValues(t, 2, result.Removed)
+	assert.EqualValues(t, 1, result.Renamed)
+
+	reader, _, err := storage.GetFile(ctx, config.Bucket, "normalized.zip")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+		assert.True(t, file.Modified.Equal(normalizedModTime), file.Name)
+	}
+	assert.EqualValues(t, []string{"Alpha/readme.txt", "assets/logo.png", "zeta.txt"}, names)
+	assert.EqualValues(t, zip.Store, zr.File[1].Method)
+	assert.EqualValues(t, zip.Deflate, zr.File[2].Method)
+
+	// normalizing is deterministic
+	_, err = archiver.NormalizeZip(ctx, "upload.zip", "normalized2.zip", testLimits())
+	require.NoError(t, err)
+	reader, _, err = storage.GetFile(ctx, config.Bucket, "normalized2.zip")
+	require.NoError(t, err)
+	data2, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, data, data2)
+}
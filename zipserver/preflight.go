@@ -0,0 +1,216 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BucketCheck is the outcome of checking one bucket during preflight
+type BucketCheck struct {
+	Name     string // "primary" or the name of the storage target
+	Bucket   string
+	Duration string
+	Error    string `json:",omitempty"`
+}
+
+// PreflightError lists the buckets that failed preflight
+type PreflightError struct {
+	Checks []BucketCheck
+}
+
+func (e *PreflightError) Error() string {
+	var failures []string
+	for _, check := range e.Checks {
+		if check.Error != "" {
+			failures = append(failures, fmt.Sprintf("%s (%s): %s", check.Bucket, check.Name, check.Error))
+		}
+	}
+	return "Preflight failed for " + strings.Join(failures, "; ")
+}
+
+// preflightBucket is a bucket checked by preflight, with the operations used
+// to probe it
+type preflightBucket struct {
+	name   string
+	bucket string
+	prefix string // probes are written under it, for targets with AllowedPrefixes
+	err    error  // the storage client couldn't be created
+
+	list   func(ctx context.Context, prefix string) error
+	put    func(ctx context.Context, key string, contents []byte) error
+	remove func(ctx context.Context, key string) error
+}
+
+// storageBucket probes bucket through storage
+func storageBucket(name, bucket string, storage Storage) preflightBucket {
+	return preflightBucket{
+		name:   name,
+		bucket: bucket,
+		list: func(ctx context.Context, prefix string) error {
+			_, err := storage.ListObjects(ctx, bucket, prefix)
+			return err
+		},
+		put: func(ctx context.Context, key string, contents []byte) error {
+			return storage.PutFile(ctx, bucket, key, bytes.NewReader(contents), "text/plain")
+		},
+		remove: func(ctx context.Context, key string) error {
+			return storage.DeleteFile(ctx, bucket, key)
+		},
+	}
+}
+
+// targetBucket probes the bucket of a storage target
+func targetBucket(target *StorageConfig) preflightBucket {
+	storage, err := target.NewStorageClient()
+	if err != nil {
+		return preflightBucket{name: target.Name, bucket: target.Bucket, err: err}
+	}
+
+	bucket := preflightBucket{
+		name:   target.Name,
+		bucket: target.Bucket,
+		list: func(ctx context.Context, prefix string) error {
+			_, err := storage.ListObjects(ctx, target.Bucket, prefix)
+			return err
+		},
+		put: func(ctx context.Context, key string, contents []byte) error {
+			_, err := storage.PutFile(ctx, target.Bucket, key, bytes.NewReader(contents), http.Header{}, int64(len(contents)))
+			return err
+		},
+		remove: func(ctx context.Context, key string) error {
+			return storage.DeleteFile(ctx, target.Bucket, key)
+		},
+	}
+	if len(target.AllowedPrefixes) > 0 {
+		bucket.prefix = strings.Trim(target.AllowedPrefixes[0], "/")
+	}
+	return bucket
+}
+
+// preflightBuckets is the primary bucket followed by every storage target
+func preflightBuckets(config *Config) []preflightBucket {
+	var buckets []preflightBucket
+
+	storage, err := NewPrimaryStorage(config)
+	if err != nil {
+		buckets = append(buckets, preflightBucket{name: "primary", bucket: config.Bucket, err: err})
+	} else {
+		buckets = append(buckets, storageBucket("primary", config.Bucket, storage))
+	}
+
+	for i := range config.StorageTargets {
+		buckets = append(buckets, targetBucket(&config.StorageTargets[i]))
+	}
+	return buckets
+}
+
+// checkBucket lists bucket to make sure it exists and can be read, then
+// writes and deletes a probe object unless write is false
+func checkBucket(ctx context.Context, b preflightBucket, write bool) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	dir := path.Join(b.prefix, tempExtractPrefix, "preflight")
+	if err := b.list(ctx, dir+"/"); err != nil {
+		return fmt.Errorf("Can't list the bucket, it may not exist: %v", err)
+	}
+
+	if !write {
+		return nil
+	}
+
+	key := path.Join(dir, "probe")
+	if err := b.put(ctx, key, []byte("zipserver preflight")); err != nil {
+		return fmt.Errorf("Can't write %s: %v", key, err)
+	}
+
+	if err := b.remove(ctx, key); err != nil {
+		return fmt.Errorf("Can't delete %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// runPreflight checks every bucket, all of them even when one fails so the
+// error names each one that's misconfigured
+func runPreflight(ctx context.Context, buckets []preflightBucket, write bool) ([]BucketCheck, error) {
+	checks := make([]BucketCheck, len(buckets))
+	failed := false
+
+	for i, b := range buckets {
+		startTime := time.Now()
+		err := checkBucket(ctx, b, write)
+
+		checks[i] = BucketCheck{
+			Name:     b.name,
+			Bucket:   b.bucket,
+			Duration: fmt.Sprintf("%.4fs", time.Since(startTime).Seconds()),
+		}
+		if err != nil {
+			checks[i].Error = err.Error()
+			failed = true
+		}
+	}
+
+	if failed {
+		return checks, &PreflightError{Checks: checks}
+	}
+	return checks, nil
+}
+
+// preflight checks that the primary bucket and every target exist and can be
+// written to, only that they can be listed in read-only mode
+func preflight(ctx context.Context, config *Config) ([]BucketCheck, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.FilePutTimeout))
+	defer cancel()
+
+	return runPreflight(ctx, preflightBuckets(config), !getReadOnly().Enabled)
+}
+
+// the last /readyz result, reused for ReadyzInterval
+var readyzResult struct {
+	sync.Mutex
+	at     time.Time
+	checks []BucketCheck
+	err    error
+}
+
+func cachedPreflight(ctx context.Context, config *Config) ([]BucketCheck, error) {
+	readyzResult.Lock()
+	defer readyzResult.Unlock()
+
+	if !readyzResult.at.IsZero() && time.Since(readyzResult.at) < time.Duration(config.ReadyzInterval) {
+		return readyzResult.checks, readyzResult.err
+	}
+
+	readyzResult.checks, readyzResult.err = preflight(ctx, config)
+	readyzResult.at = time.Now()
+	return readyzResult.checks, readyzResult.err
+}
+
+// Reports whether every bucket is reachable and writable, for readiness probes
+func readyzHandler(w http.ResponseWriter, r *http.Request) error {
+	checks, err := cachedPreflight(r.Context(), globalConfig)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return writeJSONMessage(w, struct {
+			Success bool
+			Type    string
+			Error   string
+			Buckets []BucketCheck
+		}{false, "PreflightError", err.Error(), checks})
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		Buckets []BucketCheck
+	}{true, checks})
+}
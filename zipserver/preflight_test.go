@@ -0,0 +1,81 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Preflight(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	buckets := []preflightBucket{
+		storageBucket("primary", "games", storage),
+		storageBucket("cdn", "cdn-bucket", storage),
+	}
+
+	checks, err := runPreflight(ctx, buckets, true)
+	require.NoError(t, err)
+	require.Len(t, checks, 2)
+	assert.Equal(t, "cdn", checks[1].Name)
+	assert.Empty(t, checks[1].Error)
+
+	// the probe doesn't stay behind
+	objects, err := storage.ListObjects(ctx, "games", tempExtractPrefix+"/")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	// no permission to write to the target
+	storage.planForFailure("cdn-bucket", path.Join(tempExtractPrefix, "preflight", "probe"))
+	checks, err = runPreflight(ctx, buckets, true)
+	var preflightErr *PreflightError
+	require.ErrorAs(t, err, &preflightErr)
+	assert.Empty(t, checks[0].Error)
+	assert.Contains(t, checks[1].Error, "Can't write")
+	assert.Contains(t, err.Error(), "cdn-bucket (cdn)")
+
+	// read-only mode only lists
+	_, err = runPreflight(ctx, buckets, false)
+	assert.NoError(t, err)
+
+	target := &StorageConfig{Name: "broken", Type: GCS, Bucket: "nowhere", AllowedPrefixes: []string{"/games/"}}
+	checks, err = runPreflight(ctx, []preflightBucket{targetBucket(target)}, true)
+	assert.Error(t, err)
+	assert.Equal(t, "nowhere", checks[0].Bucket)
+	assert.NotEmpty(t, checks[0].Error)
+}
+
+func Test_ReadyzHandler(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, ""))
+
+	// emptyConfig has no credentials for the primary bucket
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var body struct {
+		Success bool
+		Type    string
+		Buckets []BucketCheck
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.False(t, body.Success)
+	assert.Equal(t, "PreflightError", body.Type)
+	require.Len(t, body.Buckets, 1)
+	assert.Equal(t, "primary", body.Buckets[0].Name)
+	assert.NotEmpty(t, body.Buckets[0].Error)
+}
@@ -0,0 +1,63 @@
+package zipserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtectedKeyError is returned by storage writes and deletes that target one
+// of the configured ProtectedPrefixes
+type ProtectedKeyError struct {
+	Key    string
+	Prefix string
+}
+
+func (e *ProtectedKeyError) Error() string {
+	return fmt.Sprintf("Refusing to modify %s, %s is a protected prefix", e.Key, e.Prefix)
+}
+
+func validateProtectedPrefixes(prefixes []string) error {
+	for _, prefix := range prefixes {
+		if strings.Trim(prefix, "/") == "" {
+			return fmt.Errorf("Invalid protected prefix %q, it would protect everything", prefix)
+		}
+	}
+	return nil
+}
+
+// checkAllowedKey fails if the target restricts keys with AllowedPrefixes
+// and key isn't under any of them
+func (sc *StorageConfig) checkAllowedKey(key string) error {
+	if len(sc.AllowedPrefixes) == 0 {
+		return nil
+	}
+
+	if _, ok := matchKeyPrefix(sc.AllowedPrefixes, key); !ok {
+		return fmt.Errorf("Key %s is outside the allowed prefixes of storage target %s", key, sc.Name)
+	}
+
+	return nil
+}
+
+// matchKeyPrefix returns the first of prefixes that key is in (or is)
+func matchKeyPrefix(prefixes []string, key string) (string, bool) {
+	key = strings.TrimLeft(key, "/")
+
+	for _, prefix := range prefixes {
+		dir := strings.Trim(prefix, "/")
+		if key == dir || strings.HasPrefix(key, dir+"/") {
+			return prefix, true
+		}
+	}
+
+	return "", false
+}
+
+// checkProtectedKey fails if key is in, or is, one of the protected prefixes
+func checkProtectedKey(prefixes []string, key string) error {
+	if prefix, ok := matchKeyPrefix(prefixes, key); ok {
+		return &ProtectedKeyError{strings.TrimLeft(key, "/"), prefix}
+	}
+
+	return nil
+}
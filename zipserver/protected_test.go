@@ -0,0 +1,58 @@
+package zipserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckProtectedKey(t *testing.T) {
+	prefixes := []string{"system/", "tenants/other"}
+
+	assert.NoError(t, checkProtectedKey(prefixes, "games/1/index.html"))
+	assert.NoError(t, checkProtectedKey(prefixes, "systemic/file"))
+	assert.NoError(t, checkProtectedKey(nil, "system/file"))
+
+	var protectedErr *ProtectedKeyError
+	assert.ErrorAs(t, checkProtectedKey(prefixes, "system/config.json"), &protectedErr)
+	assert.Equal(t, "system/", protectedErr.Prefix)
+	assert.Error(t, checkProtectedKey(prefixes, "/tenants/other/game/index.html"))
+	assert.Error(t, checkProtectedKey(prefixes, "tenants/other"))
+
+	assert.Error(t, validateProtectedPrefixes([]string{"ok/", "/"}))
+	assert.NoError(t, validateProtectedPrefixes(prefixes))
+}
+
+func Test_GcsStorageProtectedPrefixes(t *testing.T) {
+	// refused before any request is made, so no credentials are needed
+	storage := &GcsStorage{protectedPrefixes: []string{"system/"}}
+	ctx := context.Background()
+
+	var protectedErr *ProtectedKeyError
+	assert.ErrorAs(t, storage.PutFile(ctx, "bucket", "system/a.txt", strings.NewReader("hi"), "text/plain"), &protectedErr)
+	assert.ErrorAs(t, storage.CopyFile(ctx, "bucket", "games/a.txt", "system/a.txt"), &protectedErr)
+	assert.ErrorAs(t, storage.DeleteFile(ctx, "bucket", "system/a.txt"), &protectedErr)
+	assert.ErrorAs(t, storage.ComposeFile(ctx, "bucket", "system/big.bin", []string{"games/part"}, nil), &protectedErr)
+}
+
+func Test_StorageTargetAllowedPrefixes(t *testing.T) {
+	target := &StorageConfig{Name: "shared", Type: S3, S3Endpoint: "x", S3Region: "x", Bucket: "shared"}
+	assert.NoError(t, target.checkAllowedKey("anything/at/all"))
+
+	target.AllowedPrefixes = []string{"zipserver/", "builds"}
+	assert.NoError(t, target.checkAllowedKey("zipserver/game/1.zip"))
+	assert.NoError(t, target.checkAllowedKey("builds/2.zip"))
+	assert.Error(t, target.checkAllowedKey("other-app/data.db"))
+	assert.Error(t, target.checkAllowedKey("buildsfoo/2.zip"))
+	assert.NoError(t, target.Validate())
+
+	target.AllowedPrefixes = []string{""}
+	assert.Error(t, target.Validate())
+
+	// enforced by the client too, before reaching the network
+	target.AllowedPrefixes = []string{"zipserver/"}
+	storage := &S3Storage{config: target}
+	assert.Error(t, storage.DeleteFile(context.Background(), "shared", "other-app/data.db"))
+}
@@ -0,0 +1,74 @@
+package zipserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// PurgeResult summarizes a pass over the temporary extraction prefix
+type PurgeResult struct {
+	Scanned int
+	Purged  int
+	// objects without an expiry tag, left untouched
+	Untagged int
+}
+
+// PurgeExpiredExtractions deletes every object under the temporary extraction
+// prefix whose expiry tag is before now.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) PurgeExpiredExtractions(ctx context.Context, now time.Time) (*PurgeResult, error) {
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, tempExtractPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PurgeResult{}
+
+	for _, object := range objects {
+		result.Scanned++
+
+		headers, err := a.Storage.HeadFile(ctx, a.Bucket, object.Key)
+		if err != nil {
+			return result, err
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, headers.Get(expiresHeader))
+		if err != nil {
+			result.Untagged++
+			continue
+		}
+
+		if expiresAt.After(now) {
+			continue
+		}
+
+		err = a.Storage.DeleteFile(ctx, a.Bucket, object.Key)
+		if err != nil {
+			return result, err
+		}
+		result.Purged++
+	}
+
+	log.Printf("Purged %d of %d temporary objects (%d untagged)",
+		result.Purged, result.Scanned, result.Untagged)
+
+	return result, nil
+}
+
+// Removes expired temporary extractions immediately
+func purgeHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	result, err := NewArchiver(globalConfig).PurgeExpiredExtractions(ctx, time.Now())
+	if err != nil {
+		return writeJSONError(w, "PurgeError", err)
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		*PurgeResult
+	}{true, result})
+}
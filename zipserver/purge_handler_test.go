@@ -0,0 +1,60 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PurgeExpiredExtractions(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.TempExtractionTTL = Duration(time.Hour)
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+
+	zipFile, err := os.CreateTemp("", "zipserver-purge")
+	assert.NoError(t, err)
+	defer os.Remove(zipFile.Name())
+
+	zw := zip.NewWriter(zipFile)
+	writer, err := zw.Create("hello.txt")
+	assert.NoError(t, err)
+	writer.Write([]byte("hello"))
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, zipFile.Close())
+
+	files, err := archiver.UploadZipFromFile(ctx, zipFile.Name(), "purge_test", testLimits())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(files))
+
+	h, err := storage.getHeaders(config.Bucket, files[0].Key)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, h.Get(expiresHeader))
+
+	// a regular extraction under the temp prefix without expiry is left alone
+	err = storage.PutFile(ctx, config.Bucket, "_zipserver/legacy/file.txt", strings.NewReader("legacy"), "text/plain")
+	assert.NoError(t, err)
+
+	result, err := archiver.PurgeExpiredExtractions(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, result.Purged)
+	assert.EqualValues(t, 1, result.Untagged)
+
+	result, err = archiver.PurgeExpiredExtractions(ctx, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	// the extracted file and its manifest
+	assert.EqualValues(t, 3, result.Scanned)
+	assert.EqualValues(t, 2, result.Purged)
+
+	_, err = storage.getHeaders(config.Bucket, files[0].Key)
+	assert.Error(t, err)
+}
@@ -0,0 +1,418 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// QueueConfig sets up the worker mode, where job requests are received from
+// a Pub/Sub subscription or an SQS queue instead of over HTTP
+type QueueConfig struct {
+	// pubsub or sqs
+	Type QueueType `json:",omitempty"`
+	// pubsub: projects/<project>/subscriptions/<name>, sqs: the queue URL
+	Subscription string `json:",omitempty"`
+	// Where results are published. pubsub: projects/<project>/topics/<name>,
+	// sqs: an SNS topic ARN. Empty to not publish them
+	ResponseTopic string `json:",omitempty"`
+	// AWS region of the queue and topic, credentials are read from the
+	// environment. Pub/Sub uses the PrivateKeyPath and ClientEmail of the bucket
+	Region string `json:",omitempty"`
+
+	// Messages handled at once, defaults to 4
+	Concurrency int `json:",omitempty"`
+	// How long a received message is hidden from other workers. It's extended
+	// while the job runs, so it only matters when a worker dies. Defaults to 60s
+	AckDeadline Duration `json:",omitempty"`
+	// A message zipserver couldn't take on, eg. because it was overloaded, is
+	// delivered again after this long. Defaults to 30s
+	RetryDelay Duration `json:",omitempty"`
+	// Failures are published as the result, instead of being delivered again,
+	// once a message was received this many times. Defaults to 5
+	MaxDeliveries int `json:",omitempty"`
+}
+
+type QueueType string
+
+const (
+	PubSubQueue QueueType = "pubsub"
+	SQSQueue    QueueType = "sqs"
+)
+
+const (
+	defaultQueueConcurrency   = 4
+	defaultQueueAckDeadline   = 60 * time.Second
+	defaultQueueRetryDelay    = 30 * time.Second
+	defaultQueueMaxDeliveries = 5
+)
+
+func validateQueue(config QueueConfig) error {
+	switch config.Type {
+	case "":
+		return nil
+	case PubSubQueue, SQSQueue:
+	default:
+		return fmt.Errorf("Invalid queue type %q, expected pubsub or sqs", config.Type)
+	}
+
+	if config.Subscription == "" {
+		return fmt.Errorf("Queue.Subscription is required for a %s queue", config.Type)
+	}
+	if config.Concurrency < 0 || config.MaxDeliveries < 0 {
+		return fmt.Errorf("Queue.Concurrency and Queue.MaxDeliveries can't be negative")
+	}
+	return nil
+}
+
+// QueueRequest is a job request received from the queue, eg.
+// {"Operation": "extract", "Params": {"key": "zips/1.zip", "prefix": "games/1"}}
+type QueueRequest struct {
+	// echoed in the result, defaults to the ID of the message
+	ID string
+	// extract, slurp, copy or delete
+	Operation string
+	// the same as the query params of the HTTP endpoint
+	Params map[string]string
+}
+
+// QueueResult is published to the response topic once a request is done
+type QueueResult struct {
+	ID        string
+	Operation string
+	Success   bool
+	// the callback values of the job, or the response when it couldn't start
+	Result json.RawMessage `json:",omitempty"`
+}
+
+// queueOperation is an endpoint that can be called from the queue, and the
+// param it takes a callback URL with
+type queueOperation struct {
+	path          string
+	callbackParam string
+}
+
+var queueOperations = map[string]queueOperation{
+	"extract": {"/extract", "async"},
+	"slurp":   {"/slurp", "async"},
+	"copy":    {"/copy", "callback"},
+	"delete":  {"/delete", "callback"},
+}
+
+// queueMessage is a message received from a jobQueue
+type queueMessage struct {
+	id   string
+	body []byte
+	// times it was received, 0 when the queue doesn't say
+	deliveries int
+
+	ack func(ctx context.Context) error
+	// hides the message from other workers for d more, or makes it available
+	// again after d when it's not acknowledged
+	extend func(ctx context.Context, d time.Duration) error
+}
+
+// jobQueue is where a QueueWorker receives requests from and publishes
+// results to
+type jobQueue interface {
+	receive(ctx context.Context, max int) ([]*queueMessage, error)
+	publish(ctx context.Context, body []byte) error
+}
+
+// QueueWorker takes job requests from a queue and runs them like the HTTP
+// endpoints would
+type QueueWorker struct {
+	queue  jobQueue
+	config *Config
+
+	// times each message was received, for queues that don't count them
+	deliveriesMutex sync.Mutex
+	deliveries      map[string]*queueDelivery
+}
+
+// queueDelivery is how many times a message was received, and when last
+type queueDelivery struct {
+	count int
+	seen  time.Time
+}
+
+func newQueueWorker(queue jobQueue, config *Config) *QueueWorker {
+	return &QueueWorker{queue: queue, config: config, deliveries: map[string]*queueDelivery{}}
+}
+
+func (qw *QueueWorker) concurrency() int {
+	if qw.config.Queue.Concurrency > 0 {
+		return qw.config.Queue.Concurrency
+	}
+	return defaultQueueConcurrency
+}
+
+func (qw *QueueWorker) ackDeadline() time.Duration {
+	if qw.config.Queue.AckDeadline > 0 {
+		return time.Duration(qw.config.Queue.AckDeadline)
+	}
+	return defaultQueueAckDeadline
+}
+
+func (qw *QueueWorker) retryDelay() time.Duration {
+	if qw.config.Queue.RetryDelay > 0 {
+		return time.Duration(qw.config.Queue.RetryDelay)
+	}
+	return defaultQueueRetryDelay
+}
+
+func (qw *QueueWorker) maxDeliveries() int {
+	if qw.config.Queue.MaxDeliveries > 0 {
+		return qw.config.Queue.MaxDeliveries
+	}
+	return defaultQueueMaxDeliveries
+}
+
+// run receives messages until ctx is done, then waits for the ones being
+// handled
+func (qw *QueueWorker) run(ctx context.Context) {
+	slots := make(chan struct{}, qw.concurrency())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		// wait for a free slot before asking for more
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		messages, err := qw.queue.receive(ctx, 1+cap(slots)-len(slots))
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				return
+			}
+			log.Print("Failed to receive from the queue: ", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for i, message := range messages {
+			if i > 0 {
+				slots <- struct{}{}
+			}
+
+			wg.Add(1)
+			go func(message *queueMessage) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				qw.handle(message)
+			}(message)
+		}
+
+		if len(messages) == 0 {
+			<-slots
+		}
+	}
+}
+
+// handle runs the request in message, then publishes its result and
+// acknowledges it, or leaves it to be delivered again
+func (qw *QueueWorker) handle(message *queueMessage) {
+	globalMetrics.TotalQueueMessages.Add(1)
+
+	ctx := context.Background()
+	deliveries := message.deliveries
+	if seen := qw.countDelivery(message.id); seen > deliveries {
+		deliveries = seen
+	}
+
+	// hide the message from other workers while its job runs
+	stop := qw.keepHidden(message)
+	result, retry := qw.process(ctx, message)
+	stop()
+
+	if retry && deliveries < qw.maxDeliveries() {
+		globalMetrics.TotalQueueRetries.Add(1)
+		log.Printf("Leaving queue message %s for later: %s", message.id, result.Result)
+		if err := message.extend(ctx, qw.retryDelay()); err != nil {
+			log.Printf("Failed to delay queue message %s: %v", message.id, err)
+		}
+		return
+	}
+
+	blob, _ := json.Marshal(result)
+	if err := qw.queue.publish(ctx, blob); err != nil {
+		// delivered again later, the result may be published twice
+		log.Printf("Failed to publish the result of queue message %s: %v", message.id, err)
+		return
+	}
+
+	if err := message.ack(ctx); err != nil {
+		log.Printf("Failed to acknowledge queue message %s: %v", message.id, err)
+		return
+	}
+	qw.forgetDelivery(message.id)
+}
+
+// countDelivery records that the message was received once more and returns
+// how many times it was. Messages that weren't seen for longer than all
+// their deliveries could take were done by other workers and are forgotten
+func (qw *QueueWorker) countDelivery(id string) int {
+	qw.deliveriesMutex.Lock()
+	defer qw.deliveriesMutex.Unlock()
+
+	now := time.Now()
+	forgetAfter := time.Duration(qw.maxDeliveries()) * (qw.ackDeadline() + qw.retryDelay())
+	for existing, delivery := range qw.deliveries {
+		if now.Sub(delivery.seen) > forgetAfter {
+			delete(qw.deliveries, existing)
+		}
+	}
+
+	delivery, ok := qw.deliveries[id]
+	if !ok {
+		delivery = &queueDelivery{}
+		qw.deliveries[id] = delivery
+	}
+	delivery.count++
+	delivery.seen = now
+	return delivery.count
+}
+
+func (qw *QueueWorker) forgetDelivery(id string) {
+	qw.deliveriesMutex.Lock()
+	defer qw.deliveriesMutex.Unlock()
+	delete(qw.deliveries, id)
+}
+
+// keepHidden extends the message's deadline until the returned function is
+// called
+func (qw *QueueWorker) keepHidden(message *queueMessage) func() {
+	deadline := qw.ackDeadline()
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(deadline / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := message.extend(context.Background(), deadline); err != nil {
+					log.Printf("Failed to extend the deadline of queue message %s: %v", message.id, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// process runs the request in message, retry is true when it should be
+// delivered again rather than failing, eg. because zipserver was overloaded
+func (qw *QueueWorker) process(ctx context.Context, message *queueMessage) (result QueueResult, retry bool) {
+	var request QueueRequest
+	if err := json.Unmarshal(message.body, &request); err != nil {
+		return queueFailure(message.id, "", fmt.Errorf("Invalid queue message: %v", err)), false
+	}
+	if request.ID == "" {
+		request.ID = message.id
+	}
+
+	operation, ok := queueOperations[request.Operation]
+	if !ok {
+		return queueFailure(request.ID, request.Operation, fmt.Errorf("Invalid operation %q", request.Operation)), false
+	}
+
+	result = QueueResult{ID: request.ID, Operation: request.Operation}
+
+	params := url.Values{}
+	for name, value := range request.Params {
+		params.Set(name, value)
+	}
+
+	call, err := callRoute(ctx, operation.path, operation.callbackParam, request.ID, params)
+	if err != nil {
+		return queueFailure(request.ID, request.Operation, err), false
+	}
+	defer call.done()
+	result.Result = call.response.result()
+
+	if status := call.response.status; status != http.StatusOK {
+		// overloaded, read-only, low on disk space or failing: another
+		// worker, or this one later, may do better
+		retry := status == http.StatusTooManyRequests || status >= 500
+		return result, retry
+	}
+
+	answer := call.answer()
+	if !answer.Async {
+		// Processing means it's already being done for another request
+		result.Success = answer.Success
+		return result, answer.Processing
+	}
+
+	// the job always ends with a callback, its timeout and retries bound how
+	// long that takes. The message stays hidden until then, so it isn't
+	// delivered again while the job runs
+	values := <-call.replies
+	reply := map[string]string{}
+	for name := range values {
+		reply[name] = values.Get(name)
+	}
+	result.Success = values.Get("Success") == "true"
+	result.Result, _ = json.Marshal(reply)
+	return result, false
+}
+
+func queueFailure(id, operation string, err error) QueueResult {
+	blob, _ := json.Marshal(struct{ Error string }{err.Error()})
+	return QueueResult{ID: id, Operation: operation, Result: blob}
+}
+
+// newJobQueue connects to the queue in config
+func newJobQueue(config *Config) (jobQueue, error) {
+	switch config.Queue.Type {
+	case PubSubQueue:
+		return newPubSubQueue(config)
+	case SQSQueue:
+		return newSQSQueue(config)
+	default:
+		return nil, fmt.Errorf("No queue configured, set Queue.Type to pubsub or sqs")
+	}
+}
+
+// StartQueueWorker runs jobs requested on the configured queue until the
+// process is asked to stop, then waits for the running ones
+func StartQueueWorker(_config *Config) error {
+	err := SetupZipServer(_config)
+	if err != nil {
+		return err
+	}
+
+	queue, err := newJobQueue(globalConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	log.Printf("Receiving jobs from %s queue %s", globalConfig.Queue.Type, globalConfig.Queue.Subscription)
+	newQueueWorker(queue, globalConfig).run(ctx)
+
+	log.Print("Stopped receiving jobs")
+	return nil
+}
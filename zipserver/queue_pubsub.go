@@ -0,0 +1,111 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const pubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+// Pub/Sub refuses longer ack deadlines
+const maxPubSubAckDeadline = 600 * time.Second
+
+// pubSubQueue pulls requests from a Pub/Sub subscription, and publishes
+// results to a topic
+type pubSubQueue struct {
+	service      *pubsub.Service
+	subscription string
+	topic        string
+}
+
+// interface guard
+var _ jobQueue = (*pubSubQueue)(nil)
+
+// newPubSubQueue connects with the same credentials as the bucket
+func newPubSubQueue(config *Config) (*pubSubQueue, error) {
+	pemBytes, err := os.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtConfig := &jwt.Config{
+		Email:      config.ClientEmail,
+		PrivateKey: pemBytes,
+		TokenURL:   google.JWTTokenURL,
+		Scopes:     []string{pubsubScope},
+	}
+
+	service, err := pubsub.NewService(context.Background(), option.WithHTTPClient(gcsHTTPClient(jwtConfig)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pubSubQueue{
+		service:      service,
+		subscription: config.Queue.Subscription,
+		topic:        config.Queue.ResponseTopic,
+	}, nil
+}
+
+func (q *pubSubQueue) receive(ctx context.Context, max int) ([]*queueMessage, error) {
+	res, err := q.service.Projects.Subscriptions.Pull(q.subscription, &pubsub.PullRequest{
+		MaxMessages: int64(max),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []*queueMessage{}
+	for _, received := range res.ReceivedMessages {
+		if received.Message == nil {
+			continue
+		}
+
+		body, err := base64.StdEncoding.DecodeString(received.Message.Data)
+		if err != nil {
+			body = []byte(received.Message.Data)
+		}
+
+		ackID := received.AckId
+		messages = append(messages, &queueMessage{
+			id:         received.Message.MessageId,
+			body:       body,
+			deliveries: int(received.DeliveryAttempt),
+			ack: func(ctx context.Context) error {
+				_, err := q.service.Projects.Subscriptions.Acknowledge(q.subscription, &pubsub.AcknowledgeRequest{
+					AckIds: []string{ackID},
+				}).Context(ctx).Do()
+				return err
+			},
+			extend: func(ctx context.Context, d time.Duration) error {
+				if d > maxPubSubAckDeadline {
+					d = maxPubSubAckDeadline
+				}
+				_, err := q.service.Projects.Subscriptions.ModifyAckDeadline(q.subscription, &pubsub.ModifyAckDeadlineRequest{
+					AckIds:             []string{ackID},
+					AckDeadlineSeconds: int64(d / time.Second),
+				}).Context(ctx).Do()
+				return err
+			},
+		})
+	}
+	return messages, nil
+}
+
+func (q *pubSubQueue) publish(ctx context.Context, body []byte) error {
+	if q.topic == "" {
+		return nil
+	}
+
+	_, err := q.service.Projects.Topics.Publish(q.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{Data: base64.StdEncoding.EncodeToString(body)}},
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,113 @@
+package zipserver
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SQS refuses longer visibility timeouts
+const maxSQSVisibilityTimeout = 12 * time.Hour
+
+// sqsQueue receives requests from an SQS queue, and publishes results to an
+// SNS topic
+type sqsQueue struct {
+	sqs         *sqs.SQS
+	sns         *sns.SNS
+	queueURL    string
+	topicARN    string
+	ackDeadline time.Duration
+}
+
+// interface guard
+var _ jobQueue = (*sqsQueue)(nil)
+
+// newSQSQueue connects with the credentials found in the environment
+func newSQSQueue(config *Config) (*sqsQueue, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:     aws.String(config.Queue.Region),
+		HTTPClient: storageHTTPClient(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ackDeadline := time.Duration(config.Queue.AckDeadline)
+	if ackDeadline <= 0 {
+		ackDeadline = defaultQueueAckDeadline
+	}
+
+	return &sqsQueue{
+		sqs:         sqs.New(sess),
+		sns:         sns.New(sess),
+		queueURL:    config.Queue.Subscription,
+		topicARN:    config.Queue.ResponseTopic,
+		ackDeadline: ackDeadline,
+	}, nil
+}
+
+func (q *sqsQueue) receive(ctx context.Context, max int) ([]*queueMessage, error) {
+	// SQS returns at most 10 at a time
+	if max > 10 {
+		max = 10
+	}
+
+	res, err := q.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.queueURL),
+		MaxNumberOfMessages: aws.Int64(int64(max)),
+		WaitTimeSeconds:     aws.Int64(20),
+		VisibilityTimeout:   aws.Int64(int64(q.ackDeadline / time.Second)),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []*queueMessage{}
+	for _, received := range res.Messages {
+		receiptHandle := received.ReceiptHandle
+		deliveries, _ := strconv.Atoi(aws.StringValue(received.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+		messages = append(messages, &queueMessage{
+			id:         aws.StringValue(received.MessageId),
+			body:       []byte(aws.StringValue(received.Body)),
+			deliveries: deliveries,
+			ack: func(ctx context.Context) error {
+				_, err := q.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(q.queueURL),
+					ReceiptHandle: receiptHandle,
+				})
+				return err
+			},
+			extend: func(ctx context.Context, d time.Duration) error {
+				if d > maxSQSVisibilityTimeout {
+					d = maxSQSVisibilityTimeout
+				}
+				_, err := q.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(q.queueURL),
+					ReceiptHandle:     receiptHandle,
+					VisibilityTimeout: aws.Int64(int64(d / time.Second)),
+				})
+				return err
+			},
+		})
+	}
+	return messages, nil
+}
+
+func (q *sqsQueue) publish(ctx context.Context, body []byte) error {
+	if q.topicARN == "" {
+		return nil
+	}
+
+	_, err := q.sns.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(q.topicARN),
+		Message:  aws.String(string(body)),
+	})
+	return err
+}
@@ -0,0 +1,202 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQueue hands out its messages once and records what happens to them
+type fakeQueue struct {
+	sync.Mutex
+	pending   []*queueMessage
+	published []QueueResult
+	acked     map[string]bool
+	delayed   map[string]time.Duration
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{acked: map[string]bool{}, delayed: map[string]time.Duration{}}
+}
+
+func (q *fakeQueue) add(id string, request interface{}) *queueMessage {
+	body, ok := request.([]byte)
+	if !ok {
+		body, _ = json.Marshal(request)
+	}
+	message := &queueMessage{
+		id:   id,
+		body: body,
+		ack: func(ctx context.Context) error {
+			q.Lock()
+			defer q.Unlock()
+			q.acked[id] = true
+			return nil
+		},
+		extend: func(ctx context.Context, d time.Duration) error {
+			q.Lock()
+			defer q.Unlock()
+			q.delayed[id] = d
+			return nil
+		},
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	q.pending = append(q.pending, message)
+	return message
+}
+
+func (q *fakeQueue) receive(ctx context.Context, max int) ([]*queueMessage, error) {
+	q.Lock()
+	if len(q.pending) > 0 {
+		if max > len(q.pending) {
+			max = len(q.pending)
+		}
+		messages := q.pending[:max]
+		q.pending = q.pending[max:]
+		q.Unlock()
+		return messages, nil
+	}
+	q.Unlock()
+
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+	}
+	return nil, ctx.Err()
+}
+
+func (q *fakeQueue) publish(ctx context.Context, body []byte) error {
+	var result QueueResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	q.published = append(q.published, result)
+	return nil
+}
+
+func (q *fakeQueue) result(id string) (QueueResult, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for _, result := range q.published {
+		if result.ID == id {
+			return result, true
+		}
+	}
+	return QueueResult{}, false
+}
+
+func Test_QueueWorker(t *testing.T) {
+	oldConfig := globalConfig
+	oldAdmission := admission
+	defer func() {
+		globalConfig = oldConfig
+		admission = oldAdmission
+	}()
+	globalConfig = emptyConfig()
+	globalConfig.AsyncNotificationTimeout = Duration(time.Second)
+	globalConfig.StorageTargets = []StorageConfig{{Name: "mirror", Type: S3, Bucket: "mirror", S3Region: "us-east-1"}}
+	globalConfig.MaxConcurrentRequestsByEndpoint = map[string]int{"/delete": 1}
+	globalConfig.Queue.RetryDelay = Duration(time.Minute)
+	setupAdmission(globalConfig)
+
+	queue := newFakeQueue()
+	worker := newQueueWorker(queue, globalConfig)
+
+	// the copy job starts, then fails on the primary storage emptyConfig has
+	// no credentials for
+	queue.add("m1", QueueRequest{ID: "copy-1", Operation: "copy", Params: map[string]string{"key": "zips/1.zip", "target": "mirror"}})
+	queue.add("m2", QueueRequest{Operation: "unzip"})
+	queue.add("m3", []byte("{not json"))
+
+	// too many deletes running
+	ticket, err := admission.admit("/delete")
+	require.NoError(t, err)
+	defer ticket.release()
+	queue.add("m4", QueueRequest{Operation: "delete", Params: map[string]string{"prefix": "games/1"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		worker.run(ctx)
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool {
+		queue.Lock()
+		defer queue.Unlock()
+		return len(queue.published) == 3 && len(queue.delayed) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-stopped
+
+	result, ok := queue.result("copy-1")
+	require.True(t, ok)
+	assert.Equal(t, "copy", result.Operation)
+	assert.False(t, result.Success)
+	var reply map[string]string
+	require.NoError(t, json.Unmarshal(result.Result, &reply))
+	assert.Equal(t, "false", reply["Success"])
+	assert.NotEmpty(t, reply["JobID"])
+	assert.NotEmpty(t, reply["Error"])
+
+	result, ok = queue.result("m2")
+	require.True(t, ok, "the ID defaults to the message's")
+	assert.Contains(t, string(result.Result), "Invalid operation")
+
+	result, ok = queue.result("m3")
+	require.True(t, ok)
+	assert.Contains(t, string(result.Result), "Invalid queue message")
+
+	queue.Lock()
+	assert.True(t, queue.acked["m1"])
+	assert.True(t, queue.acked["m2"])
+	assert.True(t, queue.acked["m3"])
+	assert.False(t, queue.acked["m4"], "left to be delivered again")
+	assert.Equal(t, time.Minute, queue.delayed["m4"])
+	queue.Unlock()
+
+	// gives up once it was delivered too many times
+	message := queue.add("m4", QueueRequest{Operation: "delete", Params: map[string]string{"prefix": "games/1"}})
+	message.deliveries = defaultQueueMaxDeliveries
+	worker.handle(message)
+
+	result, ok = queue.result("m4")
+	require.True(t, ok)
+	assert.False(t, result.Success)
+	assert.Contains(t, string(result.Result), "Overloaded")
+}
+
+func Test_QueueWorkerDeliveries(t *testing.T) {
+	config := emptyConfig()
+	config.Queue.AckDeadline = Duration(time.Minute)
+	config.Queue.RetryDelay = Duration(time.Minute)
+	worker := newQueueWorker(newFakeQueue(), config)
+
+	assert.Equal(t, 1, worker.countDelivery("m1"))
+	assert.Equal(t, 2, worker.countDelivery("m1"))
+
+	// m1 was done by another worker long ago
+	worker.deliveries["m1"].seen = time.Now().Add(-time.Hour)
+	assert.Equal(t, 1, worker.countDelivery("m2"))
+	assert.NotContains(t, worker.deliveries, "m1")
+
+	worker.forgetDelivery("m2")
+	assert.Empty(t, worker.deliveries)
+}
+
+func Test_ValidateQueue(t *testing.T) {
+	assert.NoError(t, validateQueue(QueueConfig{}))
+	assert.NoError(t, validateQueue(QueueConfig{Type: SQSQueue, Subscription: "https://sqs.us-east-1.amazonaws.com/1/jobs"}))
+	assert.Error(t, validateQueue(QueueConfig{Type: SQSQueue}))
+	assert.Error(t, validateQueue(QueueConfig{Type: "kafka", Subscription: "jobs"}))
+}
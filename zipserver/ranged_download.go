@@ -0,0 +1,127 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	errors "github.com/go-errors/errors"
+)
+
+// errRangesUnavailable means an object can't be downloaded in ranges, eg.
+// because its size is unknown, and should be fetched as a single stream
+var errRangesUnavailable = errors.Errorf("ranged download unavailable")
+
+// offsetWriter writes sequentially to a file starting at offset
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// downloadRanged fetches key into dest as DownloadChunkSize ranges,
+// DownloadThreads at a time. It fails with errRangesUnavailable when the
+// object is too small to split, its size is unknown or storage ignores ranges.
+func (a *Archiver) downloadRanged(ctx context.Context, key string, dest *os.File) error {
+	headers, err := a.Storage.HeadFile(ctx, a.Bucket, key)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	// ranges of encoded objects are ranges of the encoded bytes
+	if headers.Get("Content-Encoding") != "" {
+		return errRangesUnavailable
+	}
+
+	size, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	chunkSize := int64(a.Config.DownloadChunkSize)
+	if err != nil || chunkSize <= 0 || size <= chunkSize {
+		return errRangesUnavailable
+	}
+
+	err = dest.Truncate(size)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	chunks := int((size + chunkSize - 1) / chunkSize)
+	log.Printf("Downloading %s as %d chunks", key, chunks)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	offsets := make(chan int64)
+	go func() {
+		defer close(offsets)
+		for offset := int64(0); offset < size; offset += chunkSize {
+			select {
+			case offsets <- offset:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+
+	threads := a.Config.DownloadThreads
+	if threads > chunks {
+		threads = chunks
+	}
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				length := chunkSize
+				if offset+length > size {
+					length = size - offset
+				}
+
+				err := a.downloadRange(ctx, key, dest, offset, length)
+				if err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMutex.Unlock()
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+func (a *Archiver) downloadRange(ctx context.Context, key string, dest *os.File, offset, length int64) error {
+	reader, _, err := a.Storage.GetFileRange(ctx, a.Bucket, key, offset, length)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer reader.Close()
+
+	// one byte more than asked for, to catch storage sending the whole object
+	written, err := io.Copy(&offsetWriter{dest, offset}, io.LimitReader(reader, length+1))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	if written != length {
+		return errRangesUnavailable
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeIgnoringStorage answers range requests with the whole object
+type rangeIgnoringStorage struct {
+	*MemStorage
+}
+
+func (r *rangeIgnoringStorage) GetFileRange(ctx context.Context, bucket, key string, _, _ int64) (io.ReadCloser, http.Header, error) {
+	return r.MemStorage.GetFile(ctx, bucket, key)
+}
+
+func Test_FetchZipRanged(t *testing.T) {
+	ctx := context.Background()
+
+	data := make([]byte, 100*1024+17)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	mem, err := NewMemStorage()
+	require.NoError(t, err)
+
+	config := emptyConfig()
+	require.NoError(t, mem.PutFile(ctx, config.Bucket, "game.zip", bytes.NewReader(data), "application/zip"))
+
+	for _, test := range []struct {
+		name      string
+		storage   Storage
+		threads   int
+		chunkSize uint64
+	}{
+		{"single stream", mem, 1, 4096},
+		{"ranged", mem, 4, 4096},
+		{"more threads than chunks", mem, 64, 64 * 1024},
+		{"smaller than a chunk", mem, 4, 1024 * 1024},
+		{"ranges ignored", &rangeIgnoringStorage{mem}, 4, 4096},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := emptyConfig()
+			config.DownloadThreads = test.threads
+			config.DownloadChunkSize = test.chunkSize
+			archiver := &Archiver{test.storage, config}
+
+			fname, err := archiver.fetchZip(ctx, "game.zip")
+			require.NoError(t, err)
+			defer os.Remove(fname)
+
+			downloaded, err := os.ReadFile(fname)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, downloaded))
+		})
+	}
+
+	config.DownloadThreads = 4
+	config.DownloadChunkSize = 4096
+	archiver := &Archiver{mem, config}
+	_, err = archiver.fetchZip(ctx, "missing.zip")
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package zipserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReadOnlyState is whether requests that write to or delete from storage are
+// refused, eg. during a storage migration
+type ReadOnlyState struct {
+	Enabled bool
+	Reason  string    `json:",omitempty"`
+	Since   time.Time `json:",omitempty"`
+}
+
+var readOnlyMode struct {
+	sync.Mutex
+	state ReadOnlyState
+}
+
+func setReadOnly(enabled bool, reason string) ReadOnlyState {
+	readOnlyMode.Lock()
+	defer readOnlyMode.Unlock()
+
+	if !enabled {
+		readOnlyMode.state = ReadOnlyState{}
+		return readOnlyMode.state
+	}
+
+	if !readOnlyMode.state.Enabled {
+		readOnlyMode.state.Since = time.Now()
+	}
+	readOnlyMode.state.Enabled = true
+	readOnlyMode.state.Reason = reason
+	return readOnlyMode.state
+}
+
+func getReadOnly() ReadOnlyState {
+	readOnlyMode.Lock()
+	defer readOnlyMode.Unlock()
+	return readOnlyMode.state
+}
+
+// readOnlyError is a mutating request made in read-only mode, reported with a
+// 503 and a JSON body
+type readOnlyError struct {
+	reason string
+}
+
+func (e *readOnlyError) Error() string {
+	if e.reason != "" {
+		return "zipserver is read-only: " + e.reason
+	}
+	return "zipserver is read-only"
+}
+
+func (e *readOnlyError) writeTo(w http.ResponseWriter) {
+	blob, _ := json.Marshal(struct {
+		Type   string
+		Error  string
+		Reason string `json:",omitempty"`
+	}{"ReadOnly", e.Error(), e.reason})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(blob)
+}
+
+// checkReadOnly fails when read-only mode is on
+func checkReadOnly() error {
+	state := getReadOnly()
+	if state.Enabled {
+		return &readOnlyError{state.Reason}
+	}
+	return nil
+}
+
+// rejectWhenReadOnly refuses requests to fn while read-only mode is on
+func rejectWhenReadOnly(fn wrapErrors) wrapErrors {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := checkReadOnly(); err != nil {
+			return err
+		}
+		return fn(w, r)
+	}
+}
+
+// readOnlyHandler shows read-only mode, or with enabled=true|false (and an
+// optional reason) in a POST switches it
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	if value := params.Get("enabled"); value != "" {
+		if r.Method != http.MethodPost {
+			return badRequestf("Switching read-only mode requires POST")
+		}
+
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return badRequestf("Invalid enabled param %q", value)
+		}
+
+		state := setReadOnly(enabled, params.Get("reason"))
+		if enabled {
+			log.Printf("Read-only mode enabled: %s", state.Reason)
+		} else {
+			log.Print("Read-only mode disabled")
+		}
+	}
+
+	return writeJSONMessage(w, getReadOnly())
+}
@@ -0,0 +1,62 @@
+package zipserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReadOnlyMode(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+	globalConfig.ExtractPrefix = "extracted"
+	defer setReadOnly(false, "")
+
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, ""))
+
+	request := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		return rec
+	}
+
+	// GETs only show it
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readonly?enabled=true", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.False(t, getReadOnly().Enabled)
+
+	rec = request("/readonly?enabled=true&reason=storage+migration")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var state ReadOnlyState
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	assert.True(t, state.Enabled)
+	assert.Equal(t, "storage migration", state.Reason)
+	assert.False(t, state.Since.IsZero())
+
+	for _, target := range []string{"/delete?prefix=games/1", "/extract?key=a.zip&prefix=b", "/diff?from=a&to=b&patch_key=p.zip"} {
+		rec = request(target)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, target)
+
+		var body struct{ Type, Error, Reason string }
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, "ReadOnly", body.Type)
+		assert.Equal(t, "storage migration", body.Reason)
+	}
+
+	assert.Equal(t, http.StatusOK, request("/metrics").Code)
+
+	rec = request("/readonly?enabled=false")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, getReadOnly().Enabled)
+	assert.NotEqual(t, http.StatusServiceUnavailable, request("/delete").Code)
+
+	assert.Equal(t, http.StatusBadRequest, request("/readonly?enabled=maybe").Code)
+}
@@ -0,0 +1,222 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var renameLockTable = NewLockTable()
+
+// RenameProgress tracks how far along a prefix rename is
+type RenameProgress struct {
+	From    string
+	To      string
+	Total   atomic.Int64
+	Copied  atomic.Int64
+	Deleted atomic.Int64
+}
+
+// RenameProgressInfo is a point-in-time snapshot of a RenameProgress
+type RenameProgressInfo struct {
+	From    string
+	To      string
+	Total   int64
+	Copied  int64
+	Deleted int64
+}
+
+// renames currently in flight, keyed by source prefix
+var renameProgressTable sync.Map
+
+func getRenameProgress() []RenameProgressInfo {
+	infos := []RenameProgressInfo{}
+	renameProgressTable.Range(func(_, value interface{}) bool {
+		progress := value.(*RenameProgress)
+		infos = append(infos, RenameProgressInfo{
+			From:    progress.From,
+			To:      progress.To,
+			Total:   progress.Total.Load(),
+			Copied:  progress.Copied.Load(),
+			Deleted: progress.Deleted.Load(),
+		})
+		return true
+	})
+	return infos
+}
+
+// RenamePrefix server-side copies every object under fromPrefix to the same
+// relative key under toPrefix, then deletes the originals. Originals are only
+// deleted once every copy has succeeded, so a failed rename never loses data.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) RenamePrefix(ctx context.Context, fromPrefix, toPrefix string, progress *RenameProgress) (int, error) {
+	// make sure foo/ doesn't match foo_bar/
+	fromPrefix = strings.TrimSuffix(fromPrefix, "/") + "/"
+	toPrefix = strings.TrimSuffix(toPrefix, "/") + "/"
+
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, fromPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	progress.Total.Store(int64(len(objects)))
+	log.Printf("Renaming %d objects from %s to %s", len(objects), fromPrefix, toPrefix)
+
+	for _, object := range objects {
+		destKey := toPrefix + strings.TrimPrefix(object.Key, fromPrefix)
+
+		putCtx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FilePutTimeout))
+		err := a.Storage.CopyFile(putCtx, a.Bucket, object.Key, destKey)
+		cancel()
+
+		if err != nil {
+			return int(progress.Copied.Load()), fmt.Errorf("Failed copying %s: %s", object.Key, err.Error())
+		}
+		progress.Copied.Add(1)
+	}
+
+	for _, object := range objects {
+		err := a.Storage.DeleteFile(ctx, a.Bucket, object.Key)
+		if err != nil {
+			return len(objects), fmt.Errorf("Failed deleting %s: %s", object.Key, err.Error())
+		}
+		progress.Deleted.Add(1)
+	}
+
+	return len(objects), nil
+}
+
+// Copies all objects under one extracted prefix to another, then removes the
+// old ones. Used when a game changes its canonical ID.
+func renamePrefixHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	from, err := getParam(params, "from")
+	if err != nil {
+		return err
+	}
+
+	to, err := getParam(params, "to")
+	if err != nil {
+		return err
+	}
+
+	if err := checkParamLength(params, "callback", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	fromPrefix, err := extractedPrefix(from)
+	if err != nil {
+		return err
+	}
+
+	toPrefix, err := extractedPrefix(to)
+	if err != nil {
+		return err
+	}
+
+	if fromPrefix == toPrefix {
+		return badRequestf("from and to must differ")
+	}
+
+	// renaming a prefix into itself, or out of itself, would move the copies
+	// along with the originals
+	if strings.HasPrefix(toPrefix+"/", fromPrefix+"/") || strings.HasPrefix(fromPrefix+"/", toPrefix+"/") {
+		return badRequestf("from and to can't be nested in each other")
+	}
+
+	fromToken, hasLock := renameLockTable.tryLockKey(fromPrefix)
+	if !hasLock {
+		return writeJSONMessage(w, struct{ Processing bool }{true})
+	}
+
+	toToken, hasLock := renameLockTable.tryLockKey(toPrefix)
+	if !hasLock {
+		renameLockTable.releaseKey(fromPrefix, fromToken)
+		return writeJSONMessage(w, struct{ Processing bool }{true})
+	}
+
+	progress := &RenameProgress{From: fromPrefix, To: toPrefix}
+
+	process := func(ctx context.Context) (int, error) {
+		defer renameLockTable.releaseKey(fromPrefix, fromToken)
+		defer renameLockTable.releaseKey(toPrefix, toToken)
+
+		renameProgressTable.Store(fromPrefix, progress)
+		defer renameProgressTable.Delete(fromPrefix)
+
+		archiver := NewArchiver(globalConfig)
+		renamed, err := archiver.RenamePrefix(ctx, fromPrefix, toPrefix, progress)
+		recordHistory(ctx, HistoryEntry{Type: "rename", Keys: []string{fromPrefix + "/", toPrefix + "/"}}, err)
+		return renamed, err
+	}
+
+	callbackURL := params.Get("callback")
+	if callbackURL == "" {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		renamed, err := process(ctx)
+		if err != nil {
+			globalMetrics.TotalErrors.Add(1)
+			return writeJSONError(w, "RenameError", err)
+		}
+
+		recordSyncResponse(caller)
+		return writeJSONMessage(w, struct {
+			Success bool
+			Renamed int
+		}{true, renamed})
+	}
+
+	job := jobs.newJob("rename", fromPrefix, toPrefix, callbackURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
+
+	startBackgroundJob(func() {
+		// This job is expected to outlive the incoming request, so it runs in
+		// the job's detached context.
+		ctx, cancel := context.WithTimeout(job.detachedContext(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		job.start()
+		renamed, err := process(ctx)
+		if err != nil {
+			log.Print("Rename failed ", err)
+			job.finish(err)
+			notifyError(callbackURL, callbackTimeout, job, err)
+			return
+		}
+		job.addProgress(renamed, 0)
+		job.finish(nil)
+
+		resValues := url.Values{}
+		resValues.Add("Success", "true")
+		resValues.Add("From", fromPrefix)
+		resValues.Add("To", toPrefix)
+		resValues.Add("Renamed", fmt.Sprintf("%d", renamed))
+		notifyCallback(callbackURL, callbackTimeout, job, resValues, struct {
+			Success bool
+			From    string
+			To      string
+			Renamed int
+		}{true, fromPrefix, toPrefix, renamed})
+	})
+
+	return writeJobStarted(w, job)
+}
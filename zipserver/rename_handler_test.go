@@ -0,0 +1,79 @@
+package zipserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RenamePrefix(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	assert.NoError(t, err)
+
+	for _, key := range []string{"games/1/index.html", "games/1/data/a.bin", "games/10/index.html"} {
+		err = storage.PutFile(ctx, config.Bucket, key, strings.NewReader(key), "text/plain")
+		assert.NoError(t, err)
+	}
+
+	archiver := &Archiver{storage, config}
+	progress := &RenameProgress{}
+
+	renamed, err := archiver.RenamePrefix(ctx, "games/1", "games/2", progress)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, renamed)
+	assert.EqualValues(t, 2, progress.Copied.Load())
+	assert.EqualValues(t, 2, progress.Deleted.Load())
+
+	objects, err := storage.ListObjects(ctx, config.Bucket, "games/")
+	assert.NoError(t, err)
+
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	assert.EqualValues(t, []string{"games/10/index.html", "games/2/data/a.bin", "games/2/index.html"}, keys)
+
+	h, err := storage.getHeaders(config.Bucket, "games/2/index.html")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "text/plain", h.Get("content-type"))
+
+	// a failed copy must leave the originals in place
+	storage.planForFailure(config.Bucket, "games/3/index.html")
+	_, err = archiver.RenamePrefix(ctx, "games/2", "games/3", &RenameProgress{})
+	assert.Error(t, err)
+
+	objects, err = storage.ListObjects(ctx, config.Bucket, "games/2/")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, len(objects))
+}
+
+func Test_RenamePrefixHandlerPrefixes(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+	globalConfig.ExtractPrefix = "extracted"
+
+	for _, query := range []string{
+		"from=.&to=games/2",
+		"from=/&to=games/2",
+		"from=games/1&to=.",
+		"from=../other&to=games/2",
+		"from=games/1&to=games/../../other",
+		"from=games/1&to=games/1/",
+		"from=games/1&to=games/1/old",
+		"from=games/1/old&to=games/1",
+	} {
+		rec := httptest.NewRecorder()
+		err := renamePrefixHandler(rec, httptest.NewRequest(http.MethodPost, "/rename_prefix?"+query, nil))
+		var badRequest *badRequestError
+		require.ErrorAs(t, err, &badRequest, query)
+	}
+}
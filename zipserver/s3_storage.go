@@ -3,6 +3,7 @@ package zipserver
 import (
 	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -34,6 +36,7 @@ func NewS3Storage(config *StorageConfig) (*S3Storage, error) {
 		Credentials: creds,
 		Endpoint:    aws.String(config.S3Endpoint),
 		Region:      aws.String(config.S3Region),
+		HTTPClient:  storageHTTPClient(),
 	})
 
 	if err != nil {
@@ -46,18 +49,40 @@ func NewS3Storage(config *StorageConfig) (*S3Storage, error) {
 	}, nil
 }
 
-// upload file and return md5 checksum of transferred bytes
-func (c *S3Storage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, uploadHeaders http.Header) (string, error) {
+// S3UploadStats describes a finished upload
+type S3UploadStats struct {
+	MD5 string // checksum of transferred bytes
+	S3UploadTuning
+}
+
+// upload file and return md5 checksum of transferred bytes. size is used to
+// pick multipart settings and may be 0 if unknown.
+func (c *S3Storage) PutFile(ctx context.Context, bucket, key string, contents io.Reader, uploadHeaders http.Header, size int64) (*S3UploadStats, error) {
+	if err := c.config.checkAllowedKey(key); err != nil {
+		return nil, err
+	}
+
+	memory := c.config.S3UploadMemory
+	if memory <= 0 {
+		memory = defaultS3UploadMemory
+	}
+	tuning := tuneMultipartUpload(size, measuredUploadThroughput(c.config.S3Endpoint), c.config.S3UploadMaxConcurrency, memory)
+	if c.config.S3UploadPartSize > 0 {
+		tuning.PartSize = c.config.S3UploadPartSize
+		tuning.limitMemory(memory)
+	}
+
 	uploader := s3manager.NewUploaderWithClient(s3.New(c.Session), func(u *s3manager.Uploader) {
-		u.PartSize = 1024 * 1024 * 50 // 50Mb per part to avoid excess API calls
+		u.PartSize = tuning.PartSize
+		u.Concurrency = tuning.Concurrency
 	})
 
-	contents = metricsReader(contents, &globalMetrics.TotalBytesUploaded)
+	mReader := newMeasuredReader(metricsReader(contents, &globalMetrics.TotalBytesUploaded))
 
 	hash := md5.New()
 
 	// duplicate reads into the md5 hasher
-	multi := io.TeeReader(contents, hash)
+	multi := io.TeeReader(mReader, hash)
 
 	uploadInput := &s3manager.UploadInput{
 		Bucket: aws.String(bucket),
@@ -73,19 +98,79 @@ func (c *S3Storage) PutFile(ctx context.Context, bucket, key string, contents io
 		uploadInput.ContentDisposition = aws.String(contentDisposition)
 	}
 
+	if contentEncoding := uploadHeaders.Get("Content-Encoding"); contentEncoding != "" {
+		uploadInput.ContentEncoding = aws.String(contentEncoding)
+	}
+
+	if acl := uploadHeaders.Get("x-amz-acl"); acl != "" {
+		uploadInput.ACL = aws.String(acl)
+	}
+
 	_, err := uploader.UploadWithContext(ctx, uploadInput)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	recordUploadThroughput(c.config.S3Endpoint, mReader.BytesRead, mReader.Duration, tuning.Concurrency)
+
 	// Compute the checksum from the hash.
 	checksum := hash.Sum(nil)
 
-	// Convert the checksum to a hexadecimal string.
-	checksumStr := fmt.Sprintf("%x", checksum)
+	return &S3UploadStats{
+		// Convert the checksum to a hexadecimal string.
+		MD5:            fmt.Sprintf("%x", checksum),
+		S3UploadTuning: tuning,
+	}, nil
+}
+
+// GetFile returns a reader for the whole of bucket/key
+func (c *S3Storage) GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, http.Header, error) {
+	svc := s3.New(c.Session)
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := http.Header{}
+	if result.ContentType != nil {
+		headers.Set("Content-Type", *result.ContentType)
+	}
+
+	trackedBody := metricsReadCloser{result.Body, &globalMetrics.TotalBytesDownloaded}
+
+	return trackedBody, headers, nil
+}
+
+// GetFileRange returns a reader for length bytes of bucket/key starting at offset
+func (c *S3Storage) GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, http.Header, error) {
+	svc := s3.New(c.Session)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rangeHeader(offset, length)),
+	}
+
+	result, err := svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := http.Header{}
+	if result.ContentType != nil {
+		headers.Set("Content-Type", *result.ContentType)
+	}
 
-	return checksumStr, nil
+	if result.ContentRange != nil {
+		headers.Set("Content-Range", *result.ContentRange)
+	}
+
+	trackedBody := metricsReadCloser{result.Body, &globalMetrics.TotalBytesDownloaded}
+
+	return trackedBody, headers, nil
 }
 
 // get some specific metadata for file
@@ -97,6 +182,10 @@ func (c *S3Storage) HeadFile(ctx context.Context, bucket, key string) (url.Value
 	}
 
 	result, err := svc.HeadObjectWithContext(ctx, input)
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && requestErr.StatusCode() == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s/%s", ErrObjectNotFound, bucket, key)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -114,10 +203,18 @@ func (c *S3Storage) HeadFile(ctx context.Context, bucket, key string) (url.Value
 		out.Add("ContentLength", strconv.FormatInt(*result.ContentLength, 10))
 	}
 
+	if result.ETag != nil {
+		out.Add("ETag", *result.ETag)
+	}
+
 	return out, nil
 }
 
 func (c *S3Storage) DeleteFile(ctx context.Context, bucket, key string) error {
+	if err := c.config.checkAllowedKey(key); err != nil {
+		return err
+	}
+
 	svc := s3.New(c.Session)
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
@@ -129,5 +226,66 @@ func (c *S3Storage) DeleteFile(ctx context.Context, bucket, key string) error {
 		return err
 	}
 
+	globalMetrics.TotalDeletedFiles.Add(1)
 	return nil
 }
+
+// ListObjects returns every object in bucket whose key starts with prefix
+func (c *S3Storage) ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	svc := s3.New(c.Session)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	objects := []ObjectInfo{}
+	err := svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:  aws.StringValue(object.Key),
+				Size: uint64(aws.Int64Value(object.Size)),
+				MD5:  etagMD5(aws.StringValue(object.ETag)),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// ListObjectsPage lists a page of the objects in bucket whose key starts with
+// prefix, see Storage
+func (c *S3Storage) ListObjectsPage(ctx context.Context, bucket, prefix, after string, limit int) ([]ObjectInfo, string, error) {
+	svc := s3.New(c.Session)
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if after != "" {
+		input.StartAfter = aws.String(after)
+	}
+
+	output, err := svc.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	objects := []ObjectInfo{}
+	for _, object := range output.Contents {
+		objects = append(objects, ObjectInfo{
+			Key:  aws.StringValue(object.Key),
+			Size: uint64(aws.Int64Value(object.Size)),
+			MD5:  etagMD5(aws.StringValue(object.ETag)),
+		})
+	}
+
+	next := ""
+	if aws.BoolValue(output.IsTruncated) && len(objects) > 0 {
+		next = objects[len(objects)-1].Key
+	}
+	return objects, next, nil
+}
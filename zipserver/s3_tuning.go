@@ -0,0 +1,129 @@
+package zipserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	s3MinPartSize     = 5 * 1024 * 1024   // smallest part S3 accepts
+	s3DefaultPartSize = 50 * 1024 * 1024  // used when the object size isn't known
+	s3MaxPartSize     = 512 * 1024 * 1024 // largest part picked, S3 accepts up to 5GB
+	s3MaxParts        = 10000
+
+	// parts are buffered in memory while they're sent, see S3UploadMemory
+	defaultS3UploadMemory = 512 * 1024 * 1024
+
+	// weight of the newest sample in the throughput moving average
+	throughputSmoothing = 0.3
+	// a part should take at least this long to send at the measured throughput,
+	// otherwise request overhead dominates
+	minPartDuration = 2 * time.Second
+)
+
+// S3UploadTuning is the multipart configuration chosen for an upload
+type S3UploadTuning struct {
+	PartSize    int64
+	Concurrency int
+}
+
+// throughput of recent uploads per S3 endpoint, in bytes per second per part stream
+var uploadThroughput = struct {
+	sync.Mutex
+	byEndpoint map[string]float64
+}{byEndpoint: make(map[string]float64)}
+
+// recordUploadThroughput feeds a finished upload into the moving average for endpoint
+func recordUploadThroughput(endpoint string, bytes int64, duration time.Duration, concurrency int) {
+	if bytes <= 0 || duration <= 0 || concurrency <= 0 {
+		return
+	}
+
+	sample := float64(bytes) / duration.Seconds() / float64(concurrency)
+
+	uploadThroughput.Lock()
+	defer uploadThroughput.Unlock()
+
+	previous, ok := uploadThroughput.byEndpoint[endpoint]
+	if !ok {
+		uploadThroughput.byEndpoint[endpoint] = sample
+		return
+	}
+	uploadThroughput.byEndpoint[endpoint] = previous*(1-throughputSmoothing) + sample*throughputSmoothing
+}
+
+func measuredUploadThroughput(endpoint string) float64 {
+	uploadThroughput.Lock()
+	defer uploadThroughput.Unlock()
+
+	return uploadThroughput.byEndpoint[endpoint]
+}
+
+// tuneMultipartUpload picks a part size and concurrency for an object of size
+// bytes (or unknown, if size <= 0). The object is spread across up to
+// maxConcurrency parallel parts, as long as each part is big enough to be
+// worth a request at the measured per-stream throughput, and the parts sent
+// at once fit in memory bytes.
+func tuneMultipartUpload(size int64, throughput float64, maxConcurrency int, memory int64) S3UploadTuning {
+	if maxConcurrency <= 0 {
+		maxConcurrency = s3manager.DefaultUploadConcurrency
+	}
+	if memory <= 0 {
+		memory = defaultS3UploadMemory
+	}
+
+	if size <= 0 {
+		tuning := S3UploadTuning{s3DefaultPartSize, maxConcurrency}
+		tuning.limitMemory(memory)
+		return tuning
+	}
+
+	minPart := int64(s3MinPartSize)
+	if throughput > 0 {
+		if worthwhile := int64(throughput * minPartDuration.Seconds()); worthwhile > minPart {
+			minPart = worthwhile
+		}
+	}
+
+	partSize := (size + int64(maxConcurrency) - 1) / int64(maxConcurrency)
+	if partSize < minPart {
+		partSize = minPart
+	}
+	if partSize > s3MaxPartSize {
+		partSize = s3MaxPartSize
+	}
+	if partSize > memory {
+		partSize = memory
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	if minForCount := (size + s3MaxParts - 1) / s3MaxParts; partSize < minForCount {
+		partSize = minForCount
+	}
+
+	concurrency := int((size + partSize - 1) / partSize)
+	if concurrency > maxConcurrency {
+		concurrency = maxConcurrency
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	tuning := S3UploadTuning{partSize, concurrency}
+	tuning.limitMemory(memory)
+	return tuning
+}
+
+// limitMemory lowers the concurrency so that the parts sent at once fit in
+// memory bytes, one part is always sent
+func (t *S3UploadTuning) limitMemory(memory int64) {
+	if fits := int(memory / t.PartSize); t.Concurrency > fits {
+		t.Concurrency = fits
+	}
+	if t.Concurrency < 1 {
+		t.Concurrency = 1
+	}
+}
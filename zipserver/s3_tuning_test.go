@@ -0,0 +1,55 @@
+package zipserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TuneMultipartUpload(t *testing.T) {
+	const mb = 1024 * 1024
+
+	// unknown size
+	tuning := tuneMultipartUpload(0, 0, 8, 8*1024*mb)
+	assert.EqualValues(t, S3UploadTuning{50 * mb, 8}, tuning)
+
+	// small files go up in a single minimum-sized part
+	tuning = tuneMultipartUpload(1*mb, 0, 8, 8*1024*mb)
+	assert.EqualValues(t, S3UploadTuning{5 * mb, 1}, tuning)
+
+	// large files are spread across all workers
+	tuning = tuneMultipartUpload(800*mb, 0, 8, 8*1024*mb)
+	assert.EqualValues(t, S3UploadTuning{100 * mb, 8}, tuning)
+
+	// fast links get bigger parts, using fewer workers for medium files
+	tuning = tuneMultipartUpload(80*mb, 20*mb, 8, 8*1024*mb)
+	assert.EqualValues(t, S3UploadTuning{40 * mb, 2}, tuning)
+
+	// part size is capped
+	tuning = tuneMultipartUpload(100*1024*mb, 0, 8, 8*1024*mb)
+	assert.EqualValues(t, S3UploadTuning{512 * mb, 8}, tuning)
+
+	// fewer parts are sent at once to fit in memory
+	tuning = tuneMultipartUpload(800*mb, 0, 8, 256*mb)
+	assert.EqualValues(t, S3UploadTuning{100 * mb, 2}, tuning)
+	tuning = tuneMultipartUpload(0, 0, 8, 0)
+	assert.EqualValues(t, S3UploadTuning{50 * mb, 8}, tuning)
+	tuning = tuneMultipartUpload(0, 0, 8, 120*mb)
+	assert.EqualValues(t, S3UploadTuning{50 * mb, 2}, tuning)
+
+	// and parts shrink to fit, one at a time
+	tuning = tuneMultipartUpload(100*1024*mb, 0, 8, 64*mb)
+	assert.EqualValues(t, S3UploadTuning{64 * mb, 1}, tuning)
+}
+
+func Test_RecordUploadThroughput(t *testing.T) {
+	endpoint := "test-endpoint"
+	assert.EqualValues(t, 0, measuredUploadThroughput(endpoint))
+
+	recordUploadThroughput(endpoint, 100, time.Second, 1)
+	assert.EqualValues(t, 100, measuredUploadThroughput(endpoint))
+
+	recordUploadThroughput(endpoint, 200, time.Second, 1)
+	assert.InDelta(t, 130, measuredUploadThroughput(endpoint), 0.001)
+}
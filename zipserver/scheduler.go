@@ -0,0 +1,335 @@
+package zipserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Each operation type gets its own pool of slots so that one can't starve the
+// others, see setupJobSchedulers
+var (
+	extractScheduler = NewJobScheduler(0)
+	copyScheduler    = NewJobScheduler(0)
+	slurpScheduler   = NewJobScheduler(0)
+
+	// shared by the upload threads of every extraction
+	extractionThreadBudget = NewThreadBudget(0)
+)
+
+// setupJobSchedulers sizes the per-operation pools from config
+func setupJobSchedulers(config *Config) {
+	extractScheduler = NewJobScheduler(config.MaxConcurrentExtractions)
+	copyScheduler = NewJobScheduler(config.MaxConcurrentCopies)
+	slurpScheduler = NewJobScheduler(config.MaxConcurrentSlurps)
+	extractionThreadBudget = NewThreadBudget(config.ExtractionThreadBudget)
+}
+
+// JobPriority decides which waiting job gets the next free slot of a
+// JobScheduler
+type JobPriority int
+
+const (
+	PriorityInteractive JobPriority = iota // user-facing, eg. publishing a build
+	PriorityBulk                           // background work, eg. backfills
+	numPriorities
+)
+
+var jobPriorityString = map[string]JobPriority{
+	"interactive": PriorityInteractive,
+	"bulk":        PriorityBulk,
+}
+
+// parseJobPriority reads the priority request parameter, defaulting to interactive
+func parseJobPriority(value string) (JobPriority, error) {
+	if value == "" {
+		return PriorityInteractive, nil
+	}
+
+	priority, ok := jobPriorityString[value]
+	if !ok {
+		return 0, fmt.Errorf("Invalid priority: %s", value)
+	}
+	return priority, nil
+}
+
+// JobScheduler limits how many jobs run at once. When every slot is taken,
+// waiting jobs are started in priority order. Within a priority the API keys
+// of the jobs take turns, see fairQueue, and each key's jobs start in arrival
+// order.
+type JobScheduler struct {
+	mutex   sync.Mutex
+	limit   int
+	running int
+	waiting [numPriorities]fairQueue
+}
+
+// SchedulerStats is a snapshot of a JobScheduler for /status
+type SchedulerStats struct {
+	Limit   int
+	Running int
+	Waiting map[string]int
+	// waiting jobs by the name of their API key, when keys are configured
+	WaitingByAPIKey map[string]int `json:",omitempty"`
+}
+
+// fairQueue holds the jobs waiting at one priority. The API keys with
+// waiting jobs take turns in weighted round-robin: a key starts up to its
+// Weight jobs in a row before the next key's turn, so a key with a long
+// backlog doesn't hold up the others.
+type fairQueue struct {
+	tenants []*tenantQueue // in turn order
+	turn    int            // index in tenants of the key whose turn it is
+	started int            // jobs started in the current turn
+}
+
+// tenantQueue holds the waiting jobs of one API key, "" for requests made
+// without one
+type tenantQueue struct {
+	name    string
+	weight  int
+	waiting []chan struct{}
+}
+
+func (q *fairQueue) push(key *APIKeyConfig, ready chan struct{}) {
+	name, weight := "", 1
+	if key != nil {
+		name = key.Name
+		if key.Weight > 0 {
+			weight = key.Weight
+		}
+	}
+
+	for _, tenant := range q.tenants {
+		if tenant.name == name {
+			tenant.waiting = append(tenant.waiting, ready)
+			return
+		}
+	}
+	q.tenants = append(q.tenants, &tenantQueue{name: name, weight: weight, waiting: []chan struct{}{ready}})
+}
+
+// pop takes the next job to start, or nil when none is waiting
+func (q *fairQueue) pop() chan struct{} {
+	if len(q.tenants) == 0 {
+		return nil
+	}
+
+	tenant := q.tenants[q.turn]
+	ready := tenant.waiting[0]
+	tenant.waiting = tenant.waiting[1:]
+	q.started++
+
+	if len(tenant.waiting) == 0 {
+		q.removeTenant(q.turn)
+	} else if q.started >= tenant.weight {
+		q.turn = (q.turn + 1) % len(q.tenants)
+		q.started = 0
+	}
+	return ready
+}
+
+// remove takes a job that gave up out of the queue, false if it's not in it
+func (q *fairQueue) remove(ready chan struct{}) bool {
+	for i, tenant := range q.tenants {
+		for j, ch := range tenant.waiting {
+			if ch != ready {
+				continue
+			}
+			tenant.waiting = append(tenant.waiting[:j], tenant.waiting[j+1:]...)
+			if len(tenant.waiting) == 0 {
+				q.removeTenant(i)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (q *fairQueue) removeTenant(i int) {
+	q.tenants = append(q.tenants[:i], q.tenants[i+1:]...)
+	if i < q.turn {
+		q.turn--
+	} else if i == q.turn {
+		q.started = 0
+	}
+	if q.turn >= len(q.tenants) {
+		q.turn = 0
+	}
+}
+
+func (q *fairQueue) len() int {
+	total := 0
+	for _, tenant := range q.tenants {
+		total += len(tenant.waiting)
+	}
+	return total
+}
+
+// NewJobScheduler creates a scheduler running at most limit jobs at once, a
+// limit of 0 means no limit
+func NewJobScheduler(limit int) *JobScheduler {
+	return &JobScheduler{limit: limit}
+}
+
+// Acquire blocks until the job may run, or ctx is done. The job waits its
+// API key's turn, taken from ctx. Every successful Acquire must be followed
+// by a Release.
+func (s *JobScheduler) Acquire(ctx context.Context, priority JobPriority) error {
+	s.mutex.Lock()
+
+	if s.limit <= 0 || (s.running < s.limit && s.numWaiting() == 0) {
+		s.running++
+		s.mutex.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	s.waiting[priority].push(apiKeyFromContext(ctx), ready)
+	s.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.waiting[priority].remove(ready) {
+			return ctx.Err()
+		}
+
+		// we were handed a slot right as we gave up, pass it on
+		s.releaseLocked()
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot of a job, handing it to the next waiting job if any
+func (s *JobScheduler) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.releaseLocked()
+}
+
+func (s *JobScheduler) releaseLocked() {
+	for priority := range s.waiting {
+		if ready := s.waiting[priority].pop(); ready != nil {
+			// the slot is handed over as-is, running stays the same
+			close(ready)
+			return
+		}
+	}
+
+	s.running--
+}
+
+func (s *JobScheduler) numWaiting() int {
+	total := 0
+	for priority := range s.waiting {
+		total += s.waiting[priority].len()
+	}
+	return total
+}
+
+// Stats returns the current state of the scheduler
+func (s *JobScheduler) Stats() SchedulerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	waiting := map[string]int{}
+	for name, priority := range jobPriorityString {
+		waiting[name] = s.waiting[priority].len()
+	}
+
+	var byAPIKey map[string]int
+	for priority := range s.waiting {
+		for _, tenant := range s.waiting[priority].tenants {
+			if tenant.name == "" {
+				continue
+			}
+			if byAPIKey == nil {
+				byAPIKey = map[string]int{}
+			}
+			byAPIKey[tenant.name] += len(tenant.waiting)
+		}
+	}
+
+	return SchedulerStats{
+		Limit:           s.limit,
+		Running:         s.running,
+		Waiting:         waiting,
+		WaitingByAPIKey: byAPIKey,
+	}
+}
+
+// ThreadBudget caps the threads used by all the jobs running at once. A job
+// waits for one thread, then takes as many of the ones it asked for as are
+// free, so a big job doesn't hold up the others.
+type ThreadBudget struct {
+	limit int
+	slots chan struct{}
+}
+
+// ThreadBudgetStats is a snapshot of a ThreadBudget for /status
+type ThreadBudgetStats struct {
+	Limit int
+	InUse int
+}
+
+// NewThreadBudget creates a budget of limit threads, a limit of 0 means no
+// limit
+func NewThreadBudget(limit int) *ThreadBudget {
+	budget := &ThreadBudget{limit: limit}
+	if limit > 0 {
+		budget.slots = make(chan struct{}, limit)
+	}
+	return budget
+}
+
+// Acquire blocks until at least one thread is free, or ctx is done, and
+// returns how many of the wanted threads were taken. They must be handed back
+// with Release.
+func (b *ThreadBudget) Acquire(ctx context.Context, want int) (int, error) {
+	if want < 1 {
+		want = 1
+	}
+	if b.slots == nil {
+		return want, nil
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	taken := 1
+	for taken < want {
+		select {
+		case b.slots <- struct{}{}:
+			taken++
+		default:
+			return taken, nil
+		}
+	}
+	return taken, nil
+}
+
+// Release hands back threads taken by Acquire
+func (b *ThreadBudget) Release(threads int) {
+	if b.slots == nil {
+		return
+	}
+	for i := 0; i < threads; i++ {
+		<-b.slots
+	}
+}
+
+func (b *ThreadBudget) Stats() ThreadBudgetStats {
+	if b.slots == nil {
+		return ThreadBudgetStats{}
+	}
+	return ThreadBudgetStats{Limit: b.limit, InUse: len(b.slots)}
+}
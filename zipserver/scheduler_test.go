@@ -0,0 +1,164 @@
+package zipserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseJobPriority(t *testing.T) {
+	priority, err := parseJobPriority("")
+	assert.NoError(t, err)
+	assert.EqualValues(t, PriorityInteractive, priority)
+
+	priority, err = parseJobPriority("bulk")
+	assert.NoError(t, err)
+	assert.EqualValues(t, PriorityBulk, priority)
+
+	_, err = parseJobPriority("urgent")
+	assert.Error(t, err)
+}
+
+func Test_JobScheduler(t *testing.T) {
+	ctx := context.Background()
+	s := NewJobScheduler(1)
+
+	assert.NoError(t, s.Acquire(ctx, PriorityBulk))
+
+	order := make(chan string, 2)
+
+	go func() {
+		assert.NoError(t, s.Acquire(ctx, PriorityBulk))
+		order <- "bulk"
+		s.Release()
+	}()
+
+	// make sure the bulk job is queued first
+	for s.Stats().Waiting["bulk"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		assert.NoError(t, s.Acquire(ctx, PriorityInteractive))
+		order <- "interactive"
+		s.Release()
+	}()
+
+	for s.Stats().Waiting["interactive"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Release()
+
+	assert.EqualValues(t, "interactive", <-order)
+	assert.EqualValues(t, "bulk", <-order)
+
+	// canceled waiters give up their place in line
+	assert.NoError(t, s.Acquire(ctx, PriorityInteractive))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, s.Acquire(timeoutCtx, PriorityInteractive))
+
+	stats := s.Stats()
+	assert.EqualValues(t, 1, stats.Running)
+	assert.EqualValues(t, 0, stats.Waiting["interactive"])
+
+	s.Release()
+	assert.EqualValues(t, 0, s.Stats().Running)
+
+	// no limit
+	unlimited := NewJobScheduler(0)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, unlimited.Acquire(ctx, PriorityBulk))
+	}
+}
+
+func Test_JobSchedulerFairness(t *testing.T) {
+	ctx := context.Background()
+	s := NewJobScheduler(1)
+	assert.NoError(t, s.Acquire(ctx, PriorityInteractive))
+
+	backfill := &APIKeyConfig{Name: "backfill", Weight: 2}
+	publish := &APIKeyConfig{Name: "publish"}
+
+	order := make(chan string, 6)
+	queue := func(key *APIKeyConfig, name string) {
+		waiting := s.Stats().Waiting["interactive"]
+		go func() {
+			assert.NoError(t, s.Acquire(context.WithValue(ctx, apiKeyContextKey{}, key), PriorityInteractive))
+			order <- name
+		}()
+		for s.Stats().Waiting["interactive"] == waiting {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// backfill queued first, but publish doesn't wait for all of it
+	for _, name := range []string{"a1", "a2", "a3", "a4"} {
+		queue(backfill, name)
+	}
+	queue(publish, "b1")
+	queue(publish, "b2")
+
+	assert.Equal(t, map[string]int{"backfill": 4, "publish": 2}, s.Stats().WaitingByAPIKey)
+
+	started := []string{}
+	for i := 0; i < 6; i++ {
+		s.Release()
+		started = append(started, <-order)
+	}
+	assert.Equal(t, []string{"a1", "a2", "b1", "a3", "a4", "b2"}, started)
+
+	s.Release()
+	assert.EqualValues(t, 0, s.Stats().Running)
+
+	// async jobs keep the key of the request that started them
+	job := jobs.newJob("extract", "zips/game.zip", "games/1", "", time.Second, jobCaller{})
+	job.linkRequest(context.WithValue(ctx, apiKeyContextKey{}, publish))
+	assert.Equal(t, publish, apiKeyFromContext(withJob(ctx, job)))
+	job.finish(nil)
+}
+
+func Test_ThreadBudget(t *testing.T) {
+	ctx := context.Background()
+
+	unlimited := NewThreadBudget(0)
+	threads, err := unlimited.Acquire(ctx, 32)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, threads)
+	unlimited.Release(threads)
+
+	budget := NewThreadBudget(8)
+
+	first, err := budget.Acquire(ctx, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, first)
+
+	// only gets what's left
+	second, err := budget.Acquire(ctx, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, second)
+	assert.Equal(t, ThreadBudgetStats{Limit: 8, InUse: 8}, budget.Stats())
+
+	// waits for a free thread
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = budget.Acquire(timeoutCtx, 1)
+	assert.Error(t, err)
+
+	acquired := make(chan int)
+	go func() {
+		threads, _ := budget.Acquire(ctx, 1)
+		acquired <- threads
+	}()
+
+	budget.Release(second)
+	assert.Equal(t, 1, <-acquired)
+
+	budget.Release(first)
+	budget.Release(1)
+	assert.Equal(t, 0, budget.Stats().InUse)
+}
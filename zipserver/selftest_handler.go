@@ -0,0 +1,295 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SelfTestStep is the outcome of one operation of a self test
+type SelfTestStep struct {
+	Name     string
+	Duration string
+	Error    string `json:",omitempty"`
+	Skipped  bool   `json:",omitempty"` // eg. copy when no target was given
+}
+
+// selfTestRunner times each step of a self test and records its outcome
+type selfTestRunner struct {
+	steps []SelfTestStep
+}
+
+func (r *selfTestRunner) run(name string, fn func() error) error {
+	startTime := time.Now()
+	err := fn()
+
+	step := SelfTestStep{Name: name, Duration: fmt.Sprintf("%.4fs", time.Since(startTime).Seconds())}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	r.steps = append(r.steps, step)
+	return err
+}
+
+func (r *selfTestRunner) skip(name string) {
+	r.steps = append(r.steps, SelfTestStep{Name: name, Duration: "0.0000s", Skipped: true})
+}
+
+// SelfTest writes a small object under the temporary prefix, reads it back
+// and deletes it, to check that the storage is reachable and writable
+func (a *Archiver) SelfTest(ctx context.Context) ([]SelfTestStep, error) {
+	key := path.Join(tempExtractPrefix, "selftest", strconv.FormatInt(time.Now().UnixNano(), 36))
+	contents := []byte("zipserver self test " + key)
+
+	runner := &selfTestRunner{steps: []SelfTestStep{}}
+	run := runner.run
+
+	err := run("put", func() error {
+		return a.Storage.PutFile(ctx, a.Bucket, key, bytes.NewReader(contents), "text/plain")
+	})
+	if err != nil {
+		return runner.steps, err
+	}
+
+	err = run("get", func() error {
+		reader, _, err := a.Storage.GetFile(ctx, a.Bucket, key)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		read, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(read, contents) {
+			return fmt.Errorf("Read back %d bytes that don't match what was written", len(read))
+		}
+		return nil
+	})
+
+	// clean up even when reading failed
+	deleteErr := run("delete", func() error {
+		return a.Storage.DeleteFile(ctx, a.Bucket, key)
+	})
+	if err == nil {
+		err = deleteErr
+	}
+
+	return runner.steps, err
+}
+
+// the files in the zip extracted by EndToEndSelfTest, by name
+var selfTestFiles = map[string]string{
+	"index.html":       "<!DOCTYPE html><html><body>zipserver self test</body></html>",
+	"assets/data.json": `{"selftest": true}`,
+}
+
+// EndToEndSelfTest runs a whole extraction under a disposable prefix in the
+// temporary area: it uploads a small zip, extracts it, checks the extracted
+// files, copies one to target (skipped when target is nil) and deletes
+// everything again. Whatever is left behind after a failure expires like any
+// temporary extraction.
+func (a *Archiver) EndToEndSelfTest(ctx context.Context, target *StorageConfig) ([]SelfTestStep, error) {
+	root := path.Join(tempExtractPrefix, "selftest", strconv.FormatInt(time.Now().UnixNano(), 36))
+	zipKey := path.Join(root, "source.zip")
+	prefix := path.Join(root, "files")
+
+	runner := &selfTestRunner{steps: []SelfTestStep{}}
+
+	err := runner.run("put zip", func() error {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, contents := range selfTestFiles {
+			w, err := zw.Create(name)
+			if err != nil {
+				return err
+			}
+			w.Write([]byte(contents))
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return a.Storage.PutFile(ctx, a.Bucket, zipKey, bytes.NewReader(buf.Bytes()), "application/zip")
+	})
+
+	var extracted []ExtractedFile
+	if err == nil {
+		err = runner.run("extract", func() error {
+			ctx, cleanup, err := a.withTempDir(ctx)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+
+			fname, err := a.fetchZipParts(ctx, zipKey)
+			if err != nil {
+				return err
+			}
+
+			extracted, err = a.sendZipExtracted(ctx, prefix, fname, DefaultExtractLimits(a.Config), &ExtractOptions{
+				ExpiresAt: time.Now().Add(time.Duration(a.Config.TempExtractionTTL)),
+			})
+			return err
+		})
+	}
+
+	if err == nil {
+		err = runner.run("verify", func() error {
+			return a.verifySelfTestFiles(ctx, prefix, extracted)
+		})
+	}
+
+	if err == nil {
+		if target == nil {
+			runner.skip("copy")
+		} else {
+			err = runner.run("copy", func() error {
+				return copySelfTestFile(ctx, a.Storage, target, path.Join(prefix, "index.html"))
+			})
+		}
+	}
+
+	// clean up even when something failed
+	deleteErr := runner.run("delete", func() error {
+		if _, err := a.DeletePrefix(ctx, root, nil); err != nil {
+			return err
+		}
+
+		left, err := a.Storage.ListObjects(ctx, a.Bucket, root+"/")
+		if err != nil {
+			return err
+		}
+		if len(left) > 0 {
+			return fmt.Errorf("%d objects left under %s after deleting it", len(left), root)
+		}
+		return nil
+	})
+	if err == nil {
+		err = deleteErr
+	}
+
+	return runner.steps, err
+}
+
+// verifySelfTestFiles checks every file of the self test zip was extracted
+// and stored as it should be
+func (a *Archiver) verifySelfTestFiles(ctx context.Context, prefix string, extracted []ExtractedFile) error {
+	if len(extracted) != len(selfTestFiles) {
+		return fmt.Errorf("Extracted %d files, expected %d", len(extracted), len(selfTestFiles))
+	}
+
+	for name, contents := range selfTestFiles {
+		key := path.Join(prefix, name)
+
+		reader, headers, err := a.Storage.GetFile(ctx, a.Bucket, key)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %v", key, err)
+		}
+		read, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %v", key, err)
+		}
+
+		if string(read) != contents {
+			return fmt.Errorf("%s doesn't match what was in the zip", key)
+		}
+		if strings.HasSuffix(name, ".html") && !isHTMLContentType(headers.Get("Content-Type")) {
+			return fmt.Errorf("%s was stored as %s", key, headers.Get("Content-Type"))
+		}
+	}
+	return nil
+}
+
+// copySelfTestFile copies key to target, checks it's there and deletes it
+// from target again
+func copySelfTestFile(ctx context.Context, storage Storage, target *StorageConfig, key string) error {
+	_, _, err := transferToTarget(ctx, storage, target, key, transferOptions{})
+	if err != nil {
+		return err
+	}
+
+	targetStorage, err := target.NewStorageClient()
+	if err != nil {
+		return err
+	}
+	defer targetStorage.DeleteFile(ctx, target.Bucket, key)
+
+	_, err = targetStorage.HeadFile(ctx, target.Bucket, key)
+	return err
+}
+
+// RunSelfTest runs EndToEndSelfTest from the command line, against the
+// primary storage, or an in-memory one with useMemory. targetName is the
+// storage target copied to, if any.
+func RunSelfTest(config *Config, useMemory bool, targetName string) ([]SelfTestStep, error) {
+	globalConfig = config
+	setupOutboundDialer(config)
+	setupStorageTransport(config)
+
+	var target *StorageConfig
+	if targetName != "" {
+		target = config.GetStorageTargetByName(targetName)
+		if target == nil {
+			return nil, fmt.Errorf("Invalid target: %s", targetName)
+		}
+	}
+
+	var storage Storage
+	if useMemory {
+		memStorage, err := NewMemStorage()
+		if err != nil {
+			return nil, err
+		}
+		storage = memStorage
+	} else {
+		primary, err := NewPrimaryStorage(config)
+		if err != nil {
+			return nil, err
+		}
+		storage = primary
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.JobTimeout))
+	defer cancel()
+
+	archiver := &Archiver{storage, config}
+	return archiver.EndToEndSelfTest(ctx, target)
+}
+
+// Checks that primary storage works, for deploys and health checks
+func selfTestHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.FilePutTimeout))
+	defer cancel()
+
+	storage, err := NewPrimaryStorage(globalConfig)
+	if err != nil {
+		return err
+	}
+
+	archiver := &Archiver{storage, globalConfig}
+	steps, err := archiver.SelfTest(ctx)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return writeJSONMessage(w, struct {
+			Success bool
+			Type    string
+			Error   string
+			Steps   []SelfTestStep
+		}{false, "SelfTestError", err.Error(), steps})
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		Steps   []SelfTestStep
+	}{true, steps})
+}
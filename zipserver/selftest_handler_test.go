@@ -0,0 +1,58 @@
+package zipserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SelfTest(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+
+	steps, err := archiver.SelfTest(ctx)
+	assert.NoError(t, err)
+	require.Len(t, steps, 3)
+	assert.Equal(t, "put", steps[0].Name)
+	assert.Equal(t, "delete", steps[2].Name)
+
+	objects, err := storage.ListObjects(ctx, config.Bucket, tempExtractPrefix+"/")
+	require.NoError(t, err)
+	assert.Empty(t, objects, "self test object should be removed")
+}
+
+func Test_EndToEndSelfTest(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.MaxNumFiles = 10
+	config.MaxFileSize = 1024
+	config.MaxTotalSize = 1024
+	config.MaxFileNameLength = 100
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	archiver := &Archiver{storage, config}
+
+	steps, err := archiver.EndToEndSelfTest(ctx, nil)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, step := range steps {
+		names = append(names, step.Name)
+		assert.Empty(t, step.Error, step.Name)
+	}
+	assert.Equal(t, []string{"put zip", "extract", "verify", "copy", "delete"}, names)
+	assert.True(t, steps[3].Skipped, "there's no target to copy to")
+
+	objects, err := storage.ListObjects(ctx, config.Bucket, "")
+	require.NoError(t, err)
+	assert.Empty(t, objects, "everything should be removed")
+}
@@ -83,29 +83,45 @@ func ServeZip(config *Config, serve string) error {
 		return errors.Wrap(err, 0)
 	}
 
-	reader, err := os.Open(serve)
-	if err != nil {
-		return errors.Wrap(err, 0)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.JobTimeout))
-	defer cancel()
-
-	putCtx, putCtxCancel := context.WithTimeout(ctx, time.Duration(config.FilePutTimeout))
-	defer putCtxCancel()
+	prefix := "extracted"
 
-	key := "serve.zip"
-	err = storage.PutFile(putCtx, config.Bucket, key, reader, "application/zip")
+	stat, err := os.Stat(serve)
 	if err != nil {
 		return errors.Wrap(err, 0)
 	}
+	// the snapshot is reused as long as the zip is the same
+	source := fmt.Sprintf("%s %d %d", serve, stat.Size(), stat.ModTime().UnixNano())
+
+	restored := false
+	if config.ServeSnapshotDir != "" {
+		// loaded on the side, a stale snapshot must not mix with a new extraction
+		snapshot, _ := NewMemStorage()
+		snapshotSource, err := snapshot.LoadSnapshot(config.ServeSnapshotDir)
+		switch {
+		case err == ErrNoSnapshot:
+		case err != nil:
+			log.Printf("Ignoring snapshot in %s: %v", config.ServeSnapshotDir, err)
+		case snapshotSource != source:
+			log.Printf("Snapshot in %s is of another zip, extracting again", config.ServeSnapshotDir)
+		default:
+			log.Printf("Restored %s from snapshot in %s", serve, config.ServeSnapshotDir)
+			storage = snapshot
+			restored = true
+		}
+	}
 
-	archiver := &Archiver{storage, config}
+	if !restored {
+		err = extractServedZip(config, storage, serve, prefix)
+		if err != nil {
+			return err
+		}
 
-	prefix := "extracted"
-	_, err = archiver.ExtractZip(ctx, key, prefix, DefaultExtractLimits(config))
-	if err != nil {
-		return errors.Wrap(err, 0)
+		if config.ServeSnapshotDir != "" {
+			err = storage.SaveSnapshot(config.ServeSnapshotDir, source)
+			if err != nil {
+				log.Printf("Failed to save snapshot to %s: %v", config.ServeSnapshotDir, err)
+			}
+		}
 	}
 
 	handler := &memoryHttpHandler{
@@ -122,3 +138,32 @@ func ServeZip(config *Config, serve string) error {
 	log.Printf("Listening on %s...", s.Addr)
 	return s.ListenAndServe()
 }
+
+// extractServedZip puts the zip at path in storage and extracts it to prefix
+func extractServedZip(config *Config, storage *MemStorage, path, prefix string) error {
+	reader, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.JobTimeout))
+	defer cancel()
+
+	putCtx, putCtxCancel := context.WithTimeout(ctx, time.Duration(config.FilePutTimeout))
+	defer putCtxCancel()
+
+	key := "serve.zip"
+	err = storage.PutFile(putCtx, config.Bucket, key, reader, "application/zip")
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	archiver := &Archiver{storage, config}
+
+	_, err = archiver.ExtractZip(ctx, key, prefix, DefaultExtractLimits(config), ExtractOptions{})
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
@@ -1,13 +1,22 @@
 package zipserver
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"fmt"
+
+	"google.golang.org/grpc"
 )
 
 var globalConfig *Config
@@ -17,11 +26,70 @@ type wrapErrors func(http.ResponseWriter, *http.Request) error
 func (fn wrapErrors) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	globalMetrics.TotalRequests.Add(1)
 
-	if err := fn(w, r); err != nil {
+	if globalConfig != nil && globalConfig.CompressResponses && acceptsGzip(r) {
+		gzw := &gzipResponseWriter{ResponseWriter: w}
+		defer gzw.Close()
+		w = gzw
+	}
+
+	r = assignRequestID(w, r)
+	r = startRequestSpan(r)
+	err := fn(w, r)
+	spanFromContext(r.Context()).finish(err)
+
+	if err != nil {
 		globalMetrics.TotalErrors.Add(1)
-		log.Println("Error", r.Method, r.URL.Path, err)
-		http.Error(w, err.Error(), 500)
+		logPrint(r.Context(), "Error ", r.Method, " ", r.URL.Path, " ", err)
+
+		var custom responseError
+		if errors.As(err, &custom) {
+			custom.writeTo(w)
+			return
+		}
+
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// errorStatus is the status an error without a response of its own is
+// reported with
+func errorStatus(err error) int {
+	var badRequest *badRequestError
+	var unauthorized *authError
+	if errors.As(err, &badRequest) {
+		return http.StatusBadRequest
+	} else if errors.As(err, &unauthorized) {
+		return unauthorized.status
+	}
+	return http.StatusInternalServerError
+}
+
+// responseError is an error with a response of its own, eg. a 503 with a
+// JSON body for readOnlyError
+type responseError interface {
+	error
+	writeTo(w http.ResponseWriter)
+}
+
+// badRequestError is a problem with the request itself, reported with a 400
+type badRequestError struct {
+	message string
+}
+
+func (e *badRequestError) Error() string {
+	return e.message
+}
+
+func badRequestf(format string, args ...interface{}) error {
+	return &badRequestError{fmt.Sprintf(format, args...)}
+}
+
+// checkParamLength fails with a bad request if param's value is longer than max (0 means no limit)
+func checkParamLength(params url.Values, name string, max int) error {
+	if max > 0 && len(params.Get(name)) > max {
+		return badRequestf("Param %s is too long (%d bytes, max %d)", name, len(params.Get(name)), max)
 	}
+	return nil
 }
 
 // get the first value of param or error
@@ -35,6 +103,16 @@ func getParam(params url.Values, name string) (string, error) {
 	return val, nil
 }
 
+// extractedPrefix joins a prefix param to the extract prefix, failing with a
+// bad request when it points at or outside of it, eg. with ..
+func extractedPrefix(param string) (string, error) {
+	prefix := path.Join(globalConfig.ExtractPrefix, param)
+	if prefix == globalConfig.ExtractPrefix || !strings.HasPrefix(prefix+"/", globalConfig.ExtractPrefix+"/") {
+		return "", badRequestf("Prefix must be within the extract prefix")
+	}
+	return prefix, nil
+}
+
 func getUint64Param(params url.Values, name string) (uint64, error) {
 	valStr, err := getParam(params, name)
 	if err != nil {
@@ -85,33 +163,312 @@ func statusHandler(w http.ResponseWriter, r *http.Request) error {
 	extractKeys := extractLockTable.GetLocks()
 
 	return writeJSONMessage(w, struct {
-		CopyLocks    []KeyInfo `json:"copy_locks"`
-		ExtractLocks []KeyInfo `json:"extract_locks"`
+		CopyLocks    []KeyInfo               `json:"copy_locks"`
+		ExtractLocks []KeyInfo               `json:"extract_locks"`
+		Renames      []RenameProgressInfo    `json:"renames"`
+		Extractions  SchedulerStats          `json:"extractions"`
+		Copies       SchedulerStats          `json:"copies"`
+		Slurps       SchedulerStats          `json:"slurps"`
+		Threads      ThreadBudgetStats       `json:"extraction_threads"`
+		Maintenance  []MaintenanceTaskStatus `json:"maintenance"`
+		ReadOnly     ReadOnlyState           `json:"read_only"`
+		Admission    AdmissionStats          `json:"admission"`
+		TempDir      TempDirStatus           `json:"temp_dir"`
 	}{
 		CopyLocks:    copyKeys,
 		ExtractLocks: extractKeys,
+		Renames:      getRenameProgress(),
+		Extractions:  extractScheduler.Stats(),
+		Copies:       copyScheduler.Stats(),
+		Slurps:       slurpScheduler.Stats(),
+		Threads:      extractionThreadBudget.Stats(),
+		Maintenance:  getMaintenanceStatus(),
+		ReadOnly:     getReadOnly(),
+		Admission:    admission.Stats(),
+		TempDir:      getTempDirStatus(globalConfig),
 	})
 }
 
-// StartZipServer starts listening for extract and slurp requests
-func StartZipServer(listenTo string, _config *Config) error {
-	globalConfig = _config
+// Router is anything handlers can be registered on, eg. an *http.ServeMux
+type Router interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+type route struct {
+	path    string
+	scope   APIScope
+	handler wrapErrors
+	// refused in read-only mode, it writes to or deletes from storage
+	mutating bool
+}
 
+var routes = []route{
 	// Extract a .zip file (downloaded from GCS), stores each
 	// individual file on GCS in a given bucket/prefix
-	http.Handle("/extract", wrapErrors(extractHandler))
+	{"/extract", ScopeExtract, extractHandler, true},
+
+	{"/copy", ScopeCopy, copyHandler, true},
+
+	// Copy everything under a prefix to a target, skipping what's already there
+	{"/syncprefix", ScopeCopy, syncPrefixHandler, true},
+
+	// Copy to a target then delete the source from primary storage
+	{"/move", ScopeDelete, moveHandler, true},
+
+	// Delete everything under an extracted prefix
+	{"/delete", ScopeDelete, deleteHandler, true},
+
+	// Move everything under an extracted prefix to a new prefix
+	{"/renameprefix", ScopeDelete, renamePrefixHandler, true},
+
+	// Compare a client-computed manifest against an extracted prefix
+	{"/compare_manifest", ScopeExtract, compareManifestHandler, false},
+
+	// Predict the outcome of an extraction without uploading anything
+	{"/simulate", ScopeExtract, simulateHandler, false},
 
-	http.Handle("/copy", wrapErrors(copyHandler))
+	// Re-pack an archive into a canonical zip
+	{"/normalize", ScopeExtract, normalizeHandler, true},
+
+	// Report the changes between two extracted prefixes, optionally as a patch zip
+	{"/diff", ScopeExtract, diffHandler, false},
+
+	// Stream a byte range of an object from primary storage or a target
+	{"/fetch", ScopeExtract, fetchHandler, false},
+
+	// List the objects under a prefix, a page at a time
+	{"/list_objects", ScopeExtract, listObjectsHandler, false},
+
+	// Check which of a list of keys exist
+	{"/exists", ScopeExtract, existsHandler, false},
 
 	// show the files in the zip
-	http.Handle("/list", wrapErrors(listHandler))
+	{"/list", ScopeExtract, listHandler, false},
 
 	// Download a file from an http{,s} URL and store it on GCS
-	http.Handle("/slurp", wrapErrors(slurpHandler))
+	{"/slurp", ScopeExtract, slurpHandler, true},
+
+	// Remove expired temporary (_zipserver/) extractions
+	{"/purge", ScopeDelete, purgeHandler, true},
+
+	// Poll the state of an async job
+	{"/job/", ScopeStatus, jobHandler, false},
+
+	// Stop a queued or running async job
+	{"/jobs/cancel", ScopeAdmin, cancelJobHandler, false},
+
+	// List the recent operations that touched a key
+	{"/history", ScopeStatus, historyHandler, false},
+
+	// List undelivered async callbacks and send them again
+	{"/callbacks/pending", ScopeAdmin, pendingCallbacksHandler, false},
+	{"/callbacks/replay", ScopeAdmin, replayCallbackHandler, false},
+
+	// Force-release a key left locked by a job that never finished
+	{"/locks/release", ScopeAdmin, releaseLockHandler, false},
+
+	// Show or switch read-only mode
+	{"/readonly", ScopeAdmin, readOnlyHandler, false},
+
+	{"/status", ScopeStatus, statusHandler, false},
+	{"/metrics", ScopeStatus, metricsHandler, false},
+	// Round trip a small object through primary storage
+	{"/selftest", ScopeStatus, selfTestHandler, true},
+	// Check every bucket exists and can be written to, for readiness probes
+	{"/readyz", ScopeStatus, readyzHandler, false},
+}
+
+// guarded is the route's handler behind the read-only and admission checks
+// it's subject to
+func (route route) guarded() wrapErrors {
+	fn := route.handler
+	if route.mutating {
+		fn = rejectWhenReadOnly(fn)
+	}
+	// status and admin requests are always let in, to see what's going on
+	if route.scope != ScopeStatus && route.scope != ScopeAdmin {
+		fn = admitRequests(route.path, fn)
+	}
+	return fn
+}
+
+// routeHandler is the guarded handler of the route at path, without
+// authentication, for requests that don't come over HTTP
+func routeHandler(path string) wrapErrors {
+	for _, route := range routes {
+		if route.path == path {
+			return route.guarded()
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		return fmt.Errorf("No route for %s", path)
+	}
+}
+
+// SetupZipServer prepares the schedulers, job store and maintenance tasks the
+// handlers rely on. StartZipServer calls it, services embedding zipserver with
+// RegisterHandlers call it once themselves.
+func SetupZipServer(_config *Config) error {
+	globalConfig = _config
+	setupLogging(globalConfig)
+	setupJobSchedulers(globalConfig)
+	setupAdmission(globalConfig)
+	setupCallbackRetries(globalConfig)
+	setupJobRetries(globalConfig)
+	setupLockTables(globalConfig)
+	setupOutboundDialer(globalConfig)
+	setupStorageTransport(globalConfig)
+	setupTracing(globalConfig)
+
+	err := setupJobStore(globalConfig)
+	if err != nil {
+		return err
+	}
+
+	if len(globalConfig.APIKeys) == 0 {
+		log.Print("Warning: no APIKeys configured, requests are not authenticated")
+	}
+
+	if globalConfig.ReadOnly {
+		setReadOnly(true, globalConfig.ReadOnlyReason)
+		log.Print("Starting in read-only mode")
+	}
+
+	startMaintenance(globalConfig)
+	return nil
+}
+
+// RegisterHandlers adds every zipserver route to router under prefix (eg.
+// "/zipserver", or "" for the root), along with its /v2 version. Routes
+// already registered on an *http.ServeMux are reported as an error rather
+// than a panic, and nothing is registered in that case.
+func RegisterHandlers(router Router, prefix string) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("Invalid route prefix %q, expected eg. /zipserver", prefix)
+	}
+
+	if mux, ok := router.(*http.ServeMux); ok {
+		for _, route := range routes {
+			for _, pattern := range []string{prefix + route.path, prefix + v2Prefix + route.path} {
+				probe := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: pattern}}
+				if _, registered := mux.Handler(probe); registered == pattern {
+					return fmt.Errorf("Route %s is already registered", pattern)
+				}
+			}
+		}
+	}
+
+	for _, route := range routes {
+		var handler http.Handler = wrapErrors(requireScope(route.scope, route.guarded()))
+		if prefix != "" {
+			handler = http.StripPrefix(prefix, handler)
+		}
+
+		if err := handleRoute(router, prefix+route.path, handler); err != nil {
+			return err
+		}
+
+		v2Handler := http.StripPrefix(prefix+v2Prefix, wrapErrors(v2Handler(requireScope(route.scope, route.guarded()))))
+		if err := handleRoute(router, prefix+v2Prefix+route.path, v2Handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleRoute registers a single route, turning a router's panic on a
+// conflicting pattern into an error
+func handleRoute(router Router, pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("Failed to register route %s: %v", pattern, recovered)
+		}
+	}()
+
+	router.Handle(pattern, handler)
+	return nil
+}
+
+// StartZipServer starts listening for extract and slurp requests
+func StartZipServer(listenTo string, _config *Config) error {
+	err := SetupZipServer(_config)
+	if err != nil {
+		return err
+	}
+
+	// fail now rather than on the first request with a bad bucket or credentials
+	if !globalConfig.SkipPreflight {
+		checks, err := preflight(context.Background(), globalConfig)
+		if err != nil {
+			return err
+		}
+		log.Printf("Preflight passed for %d buckets", len(checks))
+	}
+
+	mux := http.NewServeMux()
+	if err := RegisterHandlers(mux, ""); err != nil {
+		return err
+	}
+
+	listener, err := listen(listenTo, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	listener, err = listenTLS(listener, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: mux}
+
+	var grpcServer *grpc.Server
+	if globalConfig.GRPCListen != "" {
+		grpcServer, err = serveGRPC(globalConfig.GRPCListen)
+		if err != nil {
+			return err
+		}
+	}
+
+	// On SIGTERM stop accepting connections and let running jobs finish, the
+	// next process may already be accepting on the same socket
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		<-signals
+
+		log.Print("Shutting down, draining jobs...")
+		beginShutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(globalConfig))
+		defer cancel()
 
-	http.Handle("/status", wrapErrors(statusHandler))
-	http.Handle("/metrics", wrapErrors(metricsHandler))
+		if err := server.Shutdown(ctx); err != nil {
+			log.Print("Failed to close listener: ", err)
+		}
 
-	log.Print("Listening on: " + listenTo)
-	return http.ListenAndServe(listenTo, nil)
+		if grpcServer != nil {
+			stopGRPC(ctx, grpcServer)
+		}
+
+		if err := waitForBackgroundJobs(ctx); err != nil {
+			log.Print("Gave up waiting for jobs: ", err)
+		}
+
+		flushTraces(ctx)
+	}()
+
+	log.Print("Listening on: " + listener.Addr().String())
+	err = server.Serve(listener)
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	<-stopped
+	return nil
 }
@@ -0,0 +1,54 @@
+package zipserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RegisterHandlersWithPrefix(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	job := jobs.newJob("copy", "zips/game.zip", "", "", 0, jobCaller{})
+	job.start()
+	job.finish(nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	require.NoError(t, RegisterHandlers(mux, "/zipserver/"))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/zipserver/job/"+job.ID, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var result Job
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, job.ID, result.ID)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/job/"+job.ID, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "routes only exist under the prefix")
+
+	// registering twice is an error rather than a panic
+	err := RegisterHandlers(mux, "/zipserver")
+	assert.EqualError(t, err, "Route /zipserver/extract is already registered")
+
+	// as is a conflict on a router that panics
+	err = RegisterHandlers(panickingRouter{}, "/zipserver")
+	assert.Error(t, err)
+
+	assert.Error(t, RegisterHandlers(http.NewServeMux(), "zipserver"))
+	assert.NoError(t, RegisterHandlers(http.NewServeMux(), ""))
+}
+
+type panickingRouter struct{}
+
+func (panickingRouter) Handle(pattern string, handler http.Handler) {
+	panic("conflicting pattern")
+}
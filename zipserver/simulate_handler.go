@@ -0,0 +1,160 @@
+package zipserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throughput of recent extractions, fed by sendZipExtracted
+var extractThroughput = struct {
+	sync.Mutex
+	bytesPerSecond float64
+	filesPerSecond float64
+}{}
+
+// recordExtractThroughput feeds a finished extraction into the moving averages
+func recordExtractThroughput(bytes uint64, files int, duration time.Duration) {
+	if files <= 0 || duration <= 0 {
+		return
+	}
+
+	bytesSample := float64(bytes) / duration.Seconds()
+	filesSample := float64(files) / duration.Seconds()
+
+	extractThroughput.Lock()
+	defer extractThroughput.Unlock()
+
+	if extractThroughput.filesPerSecond == 0 {
+		extractThroughput.bytesPerSecond = bytesSample
+		extractThroughput.filesPerSecond = filesSample
+		return
+	}
+
+	extractThroughput.bytesPerSecond = extractThroughput.bytesPerSecond*(1-throughputSmoothing) + bytesSample*throughputSmoothing
+	extractThroughput.filesPerSecond = extractThroughput.filesPerSecond*(1-throughputSmoothing) + filesSample*throughputSmoothing
+}
+
+// estimateExtractDuration predicts how long extracting files totalling bytes
+// takes at the recent throughput, whichever of size or file count is slower.
+// It returns false until an extraction has been measured.
+func estimateExtractDuration(bytes uint64, files int) (time.Duration, bool) {
+	extractThroughput.Lock()
+	defer extractThroughput.Unlock()
+
+	if extractThroughput.filesPerSecond == 0 {
+		return 0, false
+	}
+
+	seconds := float64(files) / extractThroughput.filesPerSecond
+	if extractThroughput.bytesPerSecond > 0 {
+		if bySize := float64(bytes) / extractThroughput.bytesPerSecond; bySize > seconds {
+			seconds = bySize
+		}
+	}
+
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// ExtractSimulation is the predicted outcome of extracting a zip
+type ExtractSimulation struct {
+	WouldSucceed bool
+	Files        int    // entries that would be extracted
+	TotalBytes   uint64 // their uncompressed size
+	Ignored      int    // junk and empty entries that would be skipped
+	// at the recent extraction throughput, left out when nothing was measured yet
+	EstimatedSeconds float64 `json:",omitempty"`
+	Violations       []LimitViolation
+}
+
+// SimulateExtract reads the zip at key and reports what extracting it with
+// limits and opts would do, without uploading anything.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) SimulateExtract(ctx context.Context, key string, limits *ExtractLimits, opts *ExtractOptions) (*ExtractSimulation, error) {
+	ctx, cleanup, err := a.withTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fname, err := a.fetchZipParts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	zipReader, err := a.openArchive(ctx, fname, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	fileList, violations := a.checkZipFiles(ctx, zipReader.File, limits, opts, false)
+
+	err = checkZipPassword(fileList, opts.Password)
+	if err != nil {
+		violations = append(violations, LimitViolation{Limit: "Password", Message: err.Error()})
+	}
+
+	simulation := &ExtractSimulation{
+		WouldSucceed: len(violations) == 0,
+		Files:        len(fileList),
+		Ignored:      len(zipReader.File) - len(fileList),
+		Violations:   violations,
+	}
+
+	for _, file := range fileList {
+		simulation.TotalBytes += file.UncompressedSize64
+	}
+
+	if estimate, ok := estimateExtractDuration(simulation.TotalBytes, simulation.Files); ok {
+		simulation.EstimatedSeconds = estimate.Seconds()
+	}
+
+	return simulation, nil
+}
+
+// Predicts the outcome of an extraction so users can be warned before
+// publishing, takes the same parameters as /extract
+func simulateHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	key, err := getParam(params, "key")
+	if err != nil {
+		return err
+	}
+
+	limits := loadLimits(params, globalConfig)
+
+	ignorePatterns, err := loadIgnorePatterns(params)
+	if err != nil {
+		return err
+	}
+
+	emptyEntryPolicy, err := parseEmptyEntryPolicy(params.Get("empty_entries"))
+	if err != nil {
+		return err
+	}
+
+	opts := &ExtractOptions{
+		FileTree:         params.Get("filetree") == "true",
+		IgnorePatterns:   ignorePatterns,
+		EmptyEntryPolicy: emptyEntryPolicy,
+		Password:         params.Get("password"),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+	defer cancel()
+
+	archiver := NewArchiver(globalConfig)
+	simulation, err := archiver.SimulateExtract(ctx, key, limits, opts)
+	if err != nil {
+		errorType, _ := extractErrorDetails(err)
+		return writeJSONError(w, errorType, err)
+	}
+
+	return writeJSONMessage(w, struct {
+		Success bool
+		*ExtractSimulation
+	}{true, simulation})
+}
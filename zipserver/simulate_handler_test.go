@@ -0,0 +1,81 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EstimateExtractDuration(t *testing.T) {
+	extractThroughput.Lock()
+	extractThroughput.bytesPerSecond = 0
+	extractThroughput.filesPerSecond = 0
+	extractThroughput.Unlock()
+
+	_, ok := estimateExtractDuration(1000, 10)
+	assert.False(t, ok)
+
+	// 1000 bytes and 10 files per second
+	recordExtractThroughput(2000, 20, 2*time.Second)
+
+	estimate, ok := estimateExtractDuration(5000, 10)
+	assert.True(t, ok)
+	assert.EqualValues(t, 5*time.Second, estimate)
+
+	estimate, _ = estimateExtractDuration(1000, 100)
+	assert.EqualValues(t, 10*time.Second, estimate)
+}
+
+func Test_SimulateExtract(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"index.html", "big.bin", "__MACOSX/._index.html", strings.Repeat("a", 300)} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		data := []byte("hello")
+		if name == "big.bin" {
+			data = bytes.Repeat([]byte{1}, 2000)
+		}
+		w.Write(data)
+	}
+	require.NoError(t, zw.Close())
+
+	err = storage.PutFile(ctx, config.Bucket, "upload.zip", bytes.NewReader(buf.Bytes()), "application/zip")
+	require.NoError(t, err)
+
+	limits := testLimits()
+	limits.MaxFileSize = 1000
+	limits.MaxFileNameLength = 100
+
+	archiver := &Archiver{storage, config}
+	simulation, err := archiver.SimulateExtract(ctx, "upload.zip", limits, &ExtractOptions{})
+	require.NoError(t, err)
+
+	assert.False(t, simulation.WouldSucceed)
+	assert.EqualValues(t, 3, simulation.Files)
+	assert.EqualValues(t, 1, simulation.Ignored)
+	assert.EqualValues(t, 2010, simulation.TotalBytes)
+
+	limitNames := []string{}
+	for _, violation := range simulation.Violations {
+		limitNames = append(limitNames, violation.Limit)
+	}
+	assert.EqualValues(t, []string{"MaxFileSize", "MaxFileNameLength"}, limitNames)
+
+	// nothing was uploaded
+	objects, err := storage.ListObjects(ctx, config.Bucket, "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+}
@@ -1,19 +1,187 @@
 package zipserver
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var slurpLockTable = NewLockTable()
 
+// slurpOptions set how a slurped file is stored
+type slurpOptions struct {
+	ContentType        string // taken from the response when empty
+	ContentDisposition string
+	ACL                string
+	MaxBytes           uint64 // 0 for no limit
+	FixExtension       bool   // append the extension of a sniffed content type to the key
+}
+
+// slurpedFile is what a slurp stored
+type slurpedFile struct {
+	Key         string // differs from the requested key when its extension was fixed
+	ContentType string
+	Size        int64
+}
+
+// content types servers send when they don't know better, the contents are
+// sniffed to find the real one
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/binary":       true,
+	"application/unknown":      true,
+}
+
+// extensions appended by FixExtension, only for the sniffed types worth
+// serving with their own extension
+var sniffedExtensions = map[string]string{
+	"image/png":        ".png",
+	"image/jpeg":       ".jpg",
+	"image/gif":        ".gif",
+	"image/webp":       ".webp",
+	"image/bmp":        ".bmp",
+	"application/zip":  ".zip",
+	"application/pdf":  ".pdf",
+	"application/wasm": ".wasm",
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"audio/mpeg":       ".mp3",
+	"audio/wave":       ".wav",
+	"application/ogg":  ".ogg",
+}
+
+// sniffSlurpContentType replaces a generic content type with the one detected
+// from the first bytes of the file, if anything more specific is detected
+func sniffSlurpContentType(contentType string, prefix []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !genericContentTypes[strings.ToLower(mediaType)] {
+		return contentType
+	}
+
+	sniffed := http.DetectContentType(prefix)
+	if sniffed == "application/octet-stream" {
+		return contentType
+	}
+	return sniffed
+}
+
+// fixSlurpExtension appends the extension of contentType to key unless key
+// already has an extension for that type
+func fixSlurpExtension(key, contentType string) string {
+	extension, ok := sniffedExtensions[contentType]
+	if !ok {
+		return key
+	}
+
+	existing, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(key)))
+	if existing == contentType {
+		return key
+	}
+	return key + extension
+}
+
+// slurpFile downloads slurpURL and stores it at key in primary storage. When
+// the response has no useful content type, the one sniffed from its contents
+// is stored instead.
+func slurpFile(ctx context.Context, storage Storage, key, slurpURL string, opts slurpOptions) (*slurpedFile, error) {
+	getCtx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.FileGetTimeout))
+	defer cancel()
+
+	logPrint(ctx, "Fetching URL: ", slurpURL)
+
+	req, err := http.NewRequestWithContext(getCtx, http.MethodGet, slurpURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	setOutboundHeaders(req, jobFromContext(ctx).jobID())
+
+	res, err := outboundHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to fetch file: %d", res.StatusCode)
+	}
+
+	body := io.Reader(res.Body)
+
+	if opts.MaxBytes > 0 {
+		if uint64(res.ContentLength) > opts.MaxBytes {
+			return nil, fmt.Errorf("Content-Length is greater than max bytes (%d > %d)",
+				res.ContentLength, opts.MaxBytes)
+		}
+
+		var bytesRead uint64
+		body = limitedReader(body, opts.MaxBytes, &bytesRead)
+	}
+
+	sniffed, err := newSniffedReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer sniffed.release()
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = sniffSlurpContentType(res.Header.Get("Content-Type"), sniffed.Prefix())
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	if opts.FixExtension {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if fixed := fixSlurpExtension(key, mediaType); fixed != key {
+			logPrint(ctx, "Appending extension for ", mediaType, ": ", fixed)
+			key = fixed
+		}
+	}
+
+	logPrint(ctx, "Uploading ", contentType, " (size: ", res.ContentLength, ") to ", key)
+	logPrint(ctx, "ACL: ", opts.ACL)
+	logPrint(ctx, "Content-Disposition: ", opts.ContentDisposition)
+
+	putCtx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.FilePutTimeout))
+	defer cancel()
+
+	mReader := newMeasuredReader(sniffed)
+	err = storage.PutFileWithSetup(putCtx, globalConfig.Bucket, key, mReader, func(req *http.Request) error {
+		req.Header.Add("Content-Type", contentType)
+
+		if opts.ContentDisposition != "" {
+			req.Header.Add("Content-Disposition", opts.ContentDisposition)
+		}
+
+		if opts.ACL != "" {
+			req.Header.Add("x-goog-acl", opts.ACL)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &slurpedFile{
+		Key:         key,
+		ContentType: contentType,
+		Size:        mReader.BytesRead,
+	}, nil
+}
+
 func slurpHandler(w http.ResponseWriter, r *http.Request) error {
 	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
 	defer cancel()
@@ -30,10 +198,41 @@ func slurpHandler(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if err := checkParamLength(params, "url", globalConfig.MaxSlurpURLLength); err != nil {
+		return err
+	}
+
+	if err := checkParamLength(params, "async", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
 	contentType := params.Get("content_type")
 	maxBytesStr := params.Get("max_bytes")
 	acl := params.Get("acl")
-	contentDisposition := params.Get("content_disposition")
+	contentDisposition, err := sanitizeContentDisposition(params.Get("content_disposition"))
+	if err != nil {
+		return badRequestf("Invalid content_disposition: %v", err)
+	}
+	fixExtension := params.Get("fix_extension") == "true"
+
+	if err := checkGCSACL(acl); err != nil {
+		return err
+	}
+
+	priority, err := parseJobPriority(params.Get("priority"))
+	if err != nil {
+		return err
+	}
 
 	var maxBytes uint64
 	if maxBytesStr != "" {
@@ -43,123 +242,96 @@ func slurpHandler(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	process := func(ctx context.Context) error {
-		if !slurpLockTable.tryLockKey(key) {
-			return fmt.Errorf("Key is currently being processed: %s", key)
+	process := func(ctx context.Context) (*slurpedFile, error) {
+		token, hasLock := slurpLockTable.tryLockKey(key)
+		if !hasLock {
+			return nil, fmt.Errorf("Key is currently being processed: %s", key)
 		}
-		defer slurpLockTable.releaseKey(key)
-
-		getCtx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.FileGetTimeout))
-		defer cancel()
+		defer slurpLockTable.releaseKey(key, token)
 
-		log.Print("Fetching URL: ", slurpURL)
-
-		req, err := http.NewRequestWithContext(getCtx, http.MethodGet, slurpURL, nil)
+		err := slurpScheduler.Acquire(ctx, priority)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		defer slurpScheduler.Release()
+		jobFromContext(ctx).start()
 
-		res, err := http.DefaultClient.Do(req)
+		storage, err := NewPrimaryStorage(globalConfig)
 		if err != nil {
-			return err
-		}
-
-		defer res.Body.Close()
-
-		if res.StatusCode != 200 {
-			return fmt.Errorf("Failed to fetch file: %d", res.StatusCode)
-		}
-
-		if contentType == "" {
-			contentType = res.Header.Get("Content-Type")
-		}
-
-		if contentType == "" {
-			contentType = "application/octet-stream"
+			return nil, fmt.Errorf("Failed to create storage: %v", err)
 		}
 
-		body := io.Reader(res.Body)
-
-		if maxBytes > 0 {
-			if uint64(res.ContentLength) > maxBytes {
-				return fmt.Errorf("Content-Length is greater than max bytes (%d > %d)",
-					res.ContentLength, maxBytes)
-			}
-
-			var bytesRead uint64
-			body = limitedReader(body, maxBytes, &bytesRead)
+		startTime := time.Now()
+		slurpCtx, span := startSpan(ctx, "slurp", "zipserver.key", key, "server.address", urlHost(slurpURL))
+		slurped, err := slurpFile(slurpCtx, storage, key, slurpURL, slurpOptions{
+			ContentType:        contentType,
+			ContentDisposition: contentDisposition,
+			ACL:                acl,
+			MaxBytes:           maxBytes,
+			FixExtension:       fixExtension,
+		})
+		span.finish(err)
+		storedKey := key
+		if slurped != nil {
+			storedKey = slurped.Key
 		}
-
-		log.Print("Uploading ", contentType, " (size: ", res.ContentLength, ") to ", key)
-		log.Print("ACL: ", acl)
-		log.Print("Content-Disposition: ", contentDisposition)
-
-		storage, err := NewGcsStorage(globalConfig)
-
-		if storage == nil {
-			log.Fatal("Failed to create storage:", err)
+		recordHistory(ctx, HistoryEntry{Type: "slurp", Keys: []string{storedKey}}, err)
+		if err != nil {
+			return nil, err
 		}
 
-		putCtx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.FilePutTimeout))
-		defer cancel()
-
-		return storage.PutFileWithSetup(putCtx, globalConfig.Bucket, key, body, func(req *http.Request) error {
-			req.Header.Add("Content-Type", contentType)
-
-			if contentDisposition != "" {
-				req.Header.Add("Content-Disposition", contentDisposition)
-			}
-
-			req.Header.Add("x-goog-acl", acl)
-			return nil
-		})
+		globalMetrics.TotalSlurpedFiles.Add(1)
+		globalMetrics.JobDuration.Observe(time.Since(startTime), "slurp", primaryTargetLabel)
+		jobFromContext(ctx).addProgress(1, uint64(slurped.Size))
+		return slurped, nil
 	}
 
 	asyncURL := params.Get("async")
 	if asyncURL == "" {
-		err = process(ctx)
+		slurped, err := process(ctx)
 		if err != nil {
 			return writeJSONError(w, "SlurpError", err)
 		}
 
+		recordSyncResponse(caller)
 		return writeJSONMessage(w, struct {
-			Success bool
-		}{true})
+			Success     bool
+			Key         string
+			ContentType string
+		}{true, slurped.Key, slurped.ContentType})
 	}
 
-	go (func() {
-		// This job is expected to outlive the incoming request, so create a detached context.
-		ctx := context.Background()
+	job := jobs.newJob("slurp", key, "", asyncURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
 
-		err = process(ctx)
-		log.Print("Notifying " + asyncURL)
+	startBackgroundJob(func() {
+		// This job is expected to outlive the incoming request, so it runs in
+		// detached contexts, see runJobAttempts
+		slurped, err := runJobAttempts(job, process)
+		job.finish(err)
 
 		resValues := url.Values{}
+		var result interface{}
 		if err != nil {
 			resValues.Add("Type", "SlurpError")
 			resValues.Add("Error", err.Error())
+			result = struct {
+				Type  string
+				Error string
+			}{"SlurpError", err.Error()}
 		} else {
 			resValues.Add("Success", "true")
+			resValues.Add("Key", slurped.Key)
+			resValues.Add("ContentType", slurped.ContentType)
+			result = struct {
+				Success     bool
+				Key         string
+				ContentType string
+			}{true, slurped.Key, slurped.ContentType}
 		}
 
-		ctx, cancel := context.WithTimeout(ctx, time.Duration(globalConfig.AsyncNotificationTimeout))
-		defer cancel()
-
-		outBody := bytes.NewBufferString(resValues.Encode())
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, asyncURL, outBody)
-		if err != nil {
-			log.Printf("Failed to create callback request: %v", err)
-		}
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-		_, err = http.DefaultClient.Do(req)
-		if err != nil {
-			log.Print("Failed to deliver callback: " + err.Error())
-		}
-	})()
+		notifyCallback(asyncURL, callbackTimeout, job, resValues, result)
+	})
 
-	return writeJSONMessage(w, struct {
-		Processing bool
-		Async      bool
-	}{true, true})
+	return writeJobStarted(w, job)
 }
@@ -0,0 +1,85 @@
+package zipserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SlurpSniffsContentType(t *testing.T) {
+	ctx := context.Background()
+
+	pngData := testPNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(pngData)
+		case "/labeled":
+			w.Header().Set("Content-Type", "image/x-custom")
+			w.Write(pngData)
+		default:
+			w.Header().Set("Content-Type", "binary/octet-stream")
+			w.Write([]byte{0, 1, 2, 3})
+		}
+	}))
+	defer server.Close()
+
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+
+	config := emptyConfig()
+	globalConfig = config
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	slurped, err := slurpFile(ctx, storage, "uploads/1", server.URL+"/image", slurpOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, &slurpedFile{Key: "uploads/1", ContentType: "image/png", Size: int64(len(pngData))}, slurped)
+
+	reader, headers, err := storage.GetFile(ctx, config.Bucket, "uploads/1")
+	require.NoError(t, err)
+	contents, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, pngData, contents, "the sniffed bytes are stored too")
+	assert.Equal(t, "image/png", headers.Get("Content-Type"))
+
+	slurped, err = slurpFile(ctx, storage, "uploads/2", server.URL+"/image", slurpOptions{FixExtension: true})
+	require.NoError(t, err)
+	assert.Equal(t, "uploads/2.png", slurped.Key)
+	_, err = storage.HeadFile(ctx, config.Bucket, "uploads/2.png")
+	assert.NoError(t, err)
+
+	// already has the right extension
+	slurped, err = slurpFile(ctx, storage, "uploads/3.png", server.URL+"/image", slurpOptions{FixExtension: true})
+	require.NoError(t, err)
+	assert.Equal(t, "uploads/3.png", slurped.Key)
+
+	// a specific content type from the server or the request is kept
+	slurped, err = slurpFile(ctx, storage, "uploads/4", server.URL+"/labeled", slurpOptions{FixExtension: true})
+	require.NoError(t, err)
+	assert.Equal(t, &slurpedFile{Key: "uploads/4", ContentType: "image/x-custom", Size: int64(len(pngData))}, slurped)
+
+	slurped, err = slurpFile(ctx, storage, "uploads/5", server.URL+"/image", slurpOptions{ContentType: "text/plain"})
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", slurped.ContentType)
+
+	// nothing better is detected
+	slurped, err = slurpFile(ctx, storage, "uploads/6", server.URL+"/unknown", slurpOptions{FixExtension: true})
+	require.NoError(t, err)
+	assert.Equal(t, &slurpedFile{Key: "uploads/6", ContentType: "binary/octet-stream", Size: 4}, slurped)
+}
+
+func Test_FixSlurpExtension(t *testing.T) {
+	assert.Equal(t, "a/file.zip", fixSlurpExtension("a/file", "application/zip"))
+	assert.Equal(t, "a/file.zip", fixSlurpExtension("a/file.zip", "application/zip"))
+	assert.Equal(t, "a/file.bin.jpg", fixSlurpExtension("a/file.bin", "image/jpeg"))
+	assert.Equal(t, "a/file.jpeg", fixSlurpExtension("a/file.jpeg", "image/jpeg"))
+	assert.Equal(t, "a/file", fixSlurpExtension("a/file", "text/plain; charset=utf-8"))
+}
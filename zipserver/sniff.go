@@ -0,0 +1,80 @@
+package zipserver
+
+import (
+	"io"
+	"sync"
+)
+
+// how many leading bytes of each file are buffered to detect its type
+const sniffLength = 512
+
+var sniffBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, sniffLength)
+		return &buffer
+	},
+}
+
+// SniffAnalyzer inspects the leading bytes of a file after its content type
+// and encoding were detected, eg. to tag or scan it. prefix is shared with the
+// upload and must not be modified or kept after returning. Returning an error
+// rejects the file.
+type SniffAnalyzer func(resource *ResourceSpec, prefix []byte) error
+
+// run in order on every sniffed file
+var sniffAnalyzers []SniffAnalyzer
+
+// sniffedReader replays the buffered prefix of a file, then the rest of it.
+// release must be called once the contents are no longer read.
+type sniffedReader struct {
+	buffer *[]byte
+	prefix []byte
+	reader io.Reader
+}
+
+// newSniffedReader buffers up to sniffLength bytes of reader in a pooled buffer
+func newSniffedReader(reader io.Reader) (*sniffedReader, error) {
+	buffer := sniffBufferPool.Get().(*[]byte)
+
+	n, err := io.ReadFull(reader, *buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		sniffBufferPool.Put(buffer)
+		return nil, err
+	}
+
+	return &sniffedReader{
+		buffer: buffer,
+		prefix: (*buffer)[:n],
+		reader: reader,
+	}, nil
+}
+
+// Prefix returns the buffered bytes, valid until release
+func (s *sniffedReader) Prefix() []byte {
+	return s.prefix
+}
+
+func (s *sniffedReader) Read(p []byte) (int, error) {
+	if len(s.prefix) > 0 {
+		n := copy(p, s.prefix)
+		s.prefix = s.prefix[n:]
+		return n, nil
+	}
+
+	if s.reader == nil {
+		return 0, io.EOF
+	}
+	return s.reader.Read(p)
+}
+
+// release hands the buffer back to the pool, the reader is empty afterwards
+func (s *sniffedReader) release() {
+	if s.buffer == nil {
+		return
+	}
+
+	sniffBufferPool.Put(s.buffer)
+	s.buffer = nil
+	s.prefix = nil
+	s.reader = nil
+}
@@ -0,0 +1,72 @@
+package zipserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SniffedReader(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 100)
+
+	sniffed, err := newSniffedReader(bytes.NewReader(contents))
+	require.NoError(t, err)
+	assert.Equal(t, contents[:sniffLength], sniffed.Prefix())
+
+	read, err := io.ReadAll(sniffed)
+	require.NoError(t, err)
+	assert.Equal(t, contents, read)
+
+	sniffed.release()
+	sniffed.release()
+
+	n, err := sniffed.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	// shorter than the sniff length
+	sniffed, err = newSniffedReader(strings.NewReader("tiny"))
+	require.NoError(t, err)
+	defer sniffed.release()
+	assert.Equal(t, []byte("tiny"), sniffed.Prefix())
+
+	read, err = io.ReadAll(sniffed)
+	require.NoError(t, err)
+	assert.Equal(t, "tiny", string(read))
+}
+
+func Test_SniffAnalyzers(t *testing.T) {
+	defer func(analyzers []SniffAnalyzer) { sniffAnalyzers = analyzers }(sniffAnalyzers)
+
+	var seen []string
+	sniffAnalyzers = []SniffAnalyzer{
+		func(resource *ResourceSpec, prefix []byte) error {
+			seen = append(seen, resource.contentType+":"+string(prefix))
+			return nil
+		},
+		func(resource *ResourceSpec, prefix []byte) error {
+			if bytes.HasPrefix(prefix, []byte("MZ")) {
+				return errors.New("Executables are not allowed")
+			}
+			return nil
+		},
+	}
+
+	resource, reader, err := sniffResource("index.html", strings.NewReader("<html></html>"))
+	require.NoError(t, err)
+	defer reader.release()
+	assert.Equal(t, "text/html; charset=utf-8", resource.contentType)
+	assert.Equal(t, []string{"text/html; charset=utf-8:<html></html>"}, seen)
+
+	read, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "<html></html>", string(read))
+
+	_, _, err = sniffResource("game.exe", strings.NewReader("MZ\x90\x00"))
+	assert.EqualError(t, err, "Executables are not allowed")
+}
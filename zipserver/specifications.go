@@ -1,12 +1,22 @@
 package zipserver
 
 import (
+	"archive/zip"
 	"fmt"
 	"net/http"
+	"os"
 	"path"
 	"strings"
+	"time"
 )
 
+// expiresHeader is the metadata header marking when a temporary object may be purged
+const expiresHeader = "x-goog-meta-zipserver-expires"
+
+// modeHeader is the metadata header holding the Unix permissions of an
+// extracted file, so clients can restore executable bits
+const modeHeader = "x-goog-meta-mode"
+
 // ResourceSpec contains all the info for an HTTP resource relevant for
 // setting http headers and keeping track of the extraction work
 type ResourceSpec struct {
@@ -14,6 +24,12 @@ type ResourceSpec struct {
 	key             string
 	contentType     string
 	contentEncoding string
+	expiresAt       time.Time
+	mode            os.FileMode // Unix permissions, 0 when the zip doesn't record them
+	md5             string      // set once the resource is stored
+	crc32           uint32      // of the zip entry, 0 when not extracted from one
+	sha256          string      // of the zip entry, before any transform
+	analysis        *Analysis   // of the zip entry, when extracting a kind of contents
 }
 
 func (rs *ResourceSpec) String() string {
@@ -34,9 +50,57 @@ func (rs *ResourceSpec) setupRequest(req *http.Request) error {
 	if rs.contentEncoding != "" {
 		req.Header.Set("content-encoding", rs.contentEncoding)
 	}
+	if !rs.expiresAt.IsZero() {
+		req.Header.Set(expiresHeader, rs.expiresAt.UTC().Format(time.RFC3339))
+	}
+	if rs.mode != 0 {
+		req.Header.Set(modeHeader, rs.formatMode())
+	}
 	return nil
 }
 
+// extractedFile describes the stored resource for extraction results
+func (rs *ResourceSpec) extractedFile() ExtractedFile {
+	file := ExtractedFile{
+		Key:             rs.key,
+		Size:            rs.size,
+		MD5:             rs.md5,
+		ContentType:     rs.contentType,
+		ContentEncoding: rs.contentEncoding,
+		Mode:            rs.formatMode(),
+		CRC32:           rs.crc32,
+		SHA256:          rs.sha256,
+	}
+	rs.analysis.apply(&file)
+	return file
+}
+
+// formatMode returns the Unix permissions in octal, or an empty string when
+// they're unknown
+func (rs *ResourceSpec) formatMode() string {
+	if rs.mode == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04o", rs.mode.Perm())
+}
+
+// zip "version made by" hosts whose external attributes hold Unix modes
+const (
+	zipCreatorUnix = 3
+	zipCreatorOSX  = 19
+)
+
+// zipEntryMode returns the Unix permissions of a zip entry, or 0 when it
+// wasn't made on a Unix-like system
+func zipEntryMode(file *zip.File) os.FileMode {
+	switch file.CreatorVersion >> 8 {
+	case zipCreatorUnix, zipCreatorOSX:
+		return file.Mode().Perm()
+	default:
+		return 0
+	}
+}
+
 // RewriteSpec contains rules for rewriting file extensions
 type RewriteSpec struct {
 	oldExtension string
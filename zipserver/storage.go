@@ -2,17 +2,85 @@ package zipserver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // StorageSetupFunc gives the consumer a chance to set HTTP headers before storing something
 type StorageSetupFunc func(*http.Request) error
 
+// ObjectInfo describes a single object returned when listing a bucket
+type ObjectInfo struct {
+	Key  string
+	Size uint64
+	MD5  string // hex encoded, empty when the storage doesn't report it
+}
+
+// ErrObjectNotFound is wrapped by HeadFile errors when the object doesn't exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// StorageStatusError is returned for unexpected responses from storage
+type StorageStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StorageStatusError) Error() string {
+	return e.Message
+}
+
+// etagMD5 returns the MD5 an ETag holds, or an empty string for ETags that
+// aren't one, eg. those of multipart uploads or composed objects
+func etagMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 32 || strings.Contains(etag, "-") {
+		return ""
+	}
+	return strings.ToLower(etag)
+}
+
+// rangeHeader formats an HTTP Range header value for length bytes starting at offset
+func rangeHeader(offset, length int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// NewPrimaryStorage returns the client for config.Bucket, as picked by
+// config.StorageType
+func NewPrimaryStorage(config *Config) (Storage, error) {
+	// careful not to return a nil pointer wrapped in a non-nil interface
+	switch config.StorageType {
+	case GCS:
+		storage, err := NewGcsStorage(config)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	case GCSSDK:
+		storage, err := NewGcsSdkStorage(config)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type for the primary bucket")
+	}
+}
+
 // Storage is a place we can get files from, put files into, or delete files from
 type Storage interface {
 	GetFile(ctx context.Context, bucket, key string) (io.ReadCloser, http.Header, error)
+	GetFileRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, http.Header, error)
+	HeadFile(ctx context.Context, bucket, key string) (http.Header, error)
 	PutFile(ctx context.Context, bucket, key string, contents io.Reader, mimeType string) error
 	PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error
+	CopyFile(ctx context.Context, bucket, srcKey, destKey string) error
 	DeleteFile(ctx context.Context, bucket, key string) error
+	ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error)
+	// ListObjectsPage returns up to limit objects whose key starts with
+	// prefix and comes after the given one, in key order, along with the key
+	// to continue from when there are more
+	ListObjectsPage(ctx context.Context, bucket, prefix, after string, limit int) ([]ObjectInfo, string, error)
 }
@@ -0,0 +1,91 @@
+package zipserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// idle connections kept per storage host until setupStorageTransport is
+// called, enough for the default extraction threads
+const defaultStorageMaxIdleConnsPerHost = 16
+
+// storageTransport is shared by every storage client so that connections,
+// and their TLS sessions, are reused across requests and jobs
+var storageTransport = newStorageTransport(defaultStorageMaxIdleConnsPerHost)
+
+// guards swapping storageTransport
+var storageTransportMutex sync.Mutex
+
+func newStorageTransport(maxIdleConnsPerHost int) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialOutbound(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			globalMetrics.TotalStorageConnections.Add(1)
+			globalMetrics.OpenStorageConnections.Add(1)
+			return &countedConn{Conn: conn}, nil
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func setupStorageTransport(config *Config) {
+	if config.StorageMaxIdleConnsPerHost <= 0 {
+		return
+	}
+
+	storageTransportMutex.Lock()
+	defer storageTransportMutex.Unlock()
+	storageTransport = newStorageTransport(config.StorageMaxIdleConnsPerHost)
+}
+
+// storageRoundTripper sends requests through storageTransport, counting the
+// ones served by an already open connection
+type storageRoundTripper struct{}
+
+func (storageRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				globalMetrics.TotalReusedStorageConnections.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	storageTransportMutex.Lock()
+	transport := storageTransport
+	storageTransportMutex.Unlock()
+
+	return transport.RoundTrip(req)
+}
+
+// storageHTTPClient returns a client using the shared storage transport
+func storageHTTPClient() *http.Client {
+	return &http.Client{Transport: storageRoundTripper{}}
+}
+
+// countedConn keeps OpenStorageConnections up to date
+type countedConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		globalMetrics.OpenStorageConnections.Add(-1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,49 @@
+package zipserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StorageTransportReusesConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	opened := globalMetrics.TotalStorageConnections.Load()
+	reused := globalMetrics.TotalReusedStorageConnections.Load()
+
+	client := storageHTTPClient()
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL)
+		require.NoError(t, err)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	assert.EqualValues(t, 1, globalMetrics.TotalStorageConnections.Load()-opened)
+	assert.EqualValues(t, 2, globalMetrics.TotalReusedStorageConnections.Load()-reused)
+
+	open := globalMetrics.OpenStorageConnections.Load()
+	storageTransport.CloseIdleConnections()
+	assert.EqualValues(t, open-1, globalMetrics.OpenStorageConnections.Load())
+
+	assert.Contains(t, globalMetrics.RenderMetrics(emptyConfig()), "# TYPE zipserver_storage_connections_open gauge\n")
+}
+
+func Test_SetupStorageTransport(t *testing.T) {
+	defer func(transport *http.Transport) { storageTransport = transport }(storageTransport)
+
+	setupStorageTransport(&Config{})
+	assert.EqualValues(t, defaultStorageMaxIdleConnsPerHost, storageTransport.MaxIdleConnsPerHost)
+
+	setupStorageTransport(&Config{StorageMaxIdleConnsPerHost: 64})
+	assert.EqualValues(t, 64, storageTransport.MaxIdleConnsPerHost)
+	assert.True(t, storageTransport.ForceAttemptHTTP2)
+}
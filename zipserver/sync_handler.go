@@ -0,0 +1,185 @@
+package zipserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyncResult counts what a prefix sync did
+type SyncResult struct {
+	Copied  int
+	Skipped int // already on the target with the same size and MD5
+	Bytes   int64
+}
+
+// targetHasCopy checks whether the head values of an object on a target
+// describe the same contents as object. Sizes must match, and so must the
+// MD5s when both sides report one.
+func targetHasCopy(object ObjectInfo, values url.Values) bool {
+	size, err := strconv.ParseUint(values.Get("ContentLength"), 10, 64)
+	if err != nil || size != object.Size {
+		return false
+	}
+
+	targetMD5 := etagMD5(values.Get("ETag"))
+	if object.MD5 != "" && targetMD5 != "" {
+		return strings.EqualFold(object.MD5, targetMD5)
+	}
+
+	return true
+}
+
+// SyncPrefix copies every object under prefix in primary storage to target,
+// skipping the ones the target already has.
+// Caller should set the job timeout in ctx.
+func (a *Archiver) SyncPrefix(ctx context.Context, prefix string, target *StorageConfig) (*SyncResult, error) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	objects, err := a.Storage.ListObjects(ctx, a.Bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	targetStorage, err := target.NewStorageClient()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create target storage: %v", err)
+	}
+
+	job := jobFromContext(ctx)
+	job.setTotalFiles(len(objects))
+
+	log.Printf("Syncing %d objects under %s to %s", len(objects), prefix, target.Name)
+
+	result := &SyncResult{}
+
+	for _, object := range objects {
+		values, err := targetStorage.HeadFile(ctx, target.Bucket, object.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return result, fmt.Errorf("Failed checking %s on target: %v", object.Key, err)
+		}
+
+		if err == nil && targetHasCopy(object, values) {
+			result.Skipped++
+			job.addProgress(1, 0)
+			continue
+		}
+
+		_, bytesRead, err := transferToTarget(ctx, a.Storage, target, object.Key, transferOptions{})
+		if err != nil {
+			return result, fmt.Errorf("Failed copying %s: %v", object.Key, err)
+		}
+
+		globalMetrics.TotalCopiedFiles.Add(1)
+		result.Copied++
+		result.Bytes += bytesRead
+		job.addProgress(1, uint64(bytesRead))
+	}
+
+	return result, nil
+}
+
+// Copies everything under a prefix in primary storage to a storage target,
+// eg. to migrate a game between providers
+func syncPrefixHandler(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+
+	prefix, err := getParam(params, "prefix")
+	if err != nil {
+		return err
+	}
+
+	if err := checkParamLength(params, "callback", globalConfig.MaxCallbackURLLength); err != nil {
+		return err
+	}
+
+	callbackTimeout, err := loadCallbackTimeout(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	caller, err := loadJobCaller(params, globalConfig)
+	if err != nil {
+		return err
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	target, err := loadCopyTarget(params, prefix)
+	if err != nil {
+		return err
+	}
+
+	lockKey := fmt.Sprintf("%s:%s", target.Name, prefix)
+	token, hasLock := copyLockTable.tryLockKey(lockKey)
+	if !hasLock {
+		return writeJSONMessage(w, struct{ Processing bool }{true})
+	}
+
+	callbackURL := params.Get("callback")
+	if callbackURL == "" {
+		defer copyLockTable.releaseKey(lockKey, token)
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		archiver := NewArchiver(globalConfig)
+		result, err := archiver.SyncPrefix(ctx, prefix, target)
+		recordHistory(ctx, HistoryEntry{Type: "sync", Keys: []string{prefix}, Target: target.Name}, err)
+		if err != nil {
+			globalMetrics.TotalErrors.Add(1)
+			return writeJSONError(w, "SyncError", err)
+		}
+
+		recordSyncResponse(caller)
+		return writeJSONMessage(w, struct {
+			Success bool
+			*SyncResult
+		}{true, result})
+	}
+
+	job := jobs.newJob("sync", prefix, "", callbackURL, callbackTimeout, caller)
+	job.linkRequest(r.Context())
+
+	startBackgroundJob(func() {
+		defer copyLockTable.releaseKey(lockKey, token)
+
+		// This job is expected to outlive the incoming request, so it runs in
+		// the job's detached context.
+		ctx, cancel := context.WithTimeout(job.detachedContext(), time.Duration(globalConfig.JobTimeout))
+		defer cancel()
+
+		job.start()
+		archiver := NewArchiver(globalConfig)
+		result, err := archiver.SyncPrefix(ctx, prefix, target)
+		recordHistory(ctx, HistoryEntry{Type: "sync", Keys: []string{prefix}, Target: target.Name}, err)
+		job.finish(err)
+		if err != nil {
+			log.Print("Sync failed ", err)
+			notifyError(callbackURL, callbackTimeout, job, err)
+			return
+		}
+
+		resValues := url.Values{}
+		resValues.Add("Success", "true")
+		resValues.Add("Prefix", prefix)
+		resValues.Add("Target", target.Name)
+		resValues.Add("Copied", fmt.Sprintf("%d", result.Copied))
+		resValues.Add("Skipped", fmt.Sprintf("%d", result.Skipped))
+		resValues.Add("Bytes", fmt.Sprintf("%d", result.Bytes))
+		notifyCallback(callbackURL, callbackTimeout, job, resValues, struct {
+			Success bool
+			Prefix  string
+			Target  string
+			*SyncResult
+		}{true, prefix, target.Name, result})
+	})
+
+	return writeJobStarted(w, job)
+}
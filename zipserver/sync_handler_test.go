@@ -0,0 +1,53 @@
+package zipserver
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TargetHasCopy(t *testing.T) {
+	object := ObjectInfo{Key: "games/1/index.html", Size: 5, MD5: "5d41402abc4b2a76b9719d911017c592"}
+
+	assert.True(t, targetHasCopy(object, url.Values{
+		"ContentLength": {"5"},
+		"ETag":          {`"5d41402abc4b2a76b9719d911017c592"`},
+	}))
+
+	assert.False(t, targetHasCopy(object, url.Values{
+		"ContentLength": {"5"},
+		"ETag":          {`"00000000000000000000000000000000"`},
+	}))
+
+	assert.False(t, targetHasCopy(object, url.Values{
+		"ContentLength": {"6"},
+		"ETag":          {`"5d41402abc4b2a76b9719d911017c592"`},
+	}))
+
+	// multipart ETags aren't an MD5, only the size is compared
+	assert.True(t, targetHasCopy(object, url.Values{
+		"ContentLength": {"5"},
+		"ETag":          {`"d41d8cd98f00b204e9800998ecf8427e-2"`},
+	}))
+
+	assert.False(t, targetHasCopy(object, url.Values{}))
+}
+
+func Test_MemStorageListMD5(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+
+	err = storage.PutFile(ctx, "bucket", "games/1/hello.txt", strings.NewReader("hello"), "text/plain")
+	require.NoError(t, err)
+
+	objects, err := storage.ListObjects(ctx, "bucket", "games/1/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.EqualValues(t, "5d41402abc4b2a76b9719d911017c592", objects[0].MD5)
+}
@@ -0,0 +1,194 @@
+package zipserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	errors "github.com/go-errors/errors"
+)
+
+// Tar archives (plain, gzip or bzip2 compressed) are extracted by first
+// repacking their files into a temporary uncompressed zip, so they go through
+// the same limits, ignore rules and upload path as zips.
+
+// openedArchive is an open zip, possibly converted from a tar archive
+type openedArchive struct {
+	*zip.ReadCloser
+	convertedName string
+}
+
+// Close closes the zip, removing it if it was converted
+func (o *openedArchive) Close() error {
+	err := o.ReadCloser.Close()
+	if o.convertedName != "" {
+		os.Remove(o.convertedName)
+	}
+	return err
+}
+
+// openArchive opens fname as a zip, converting it first when it's a tar
+func (a *Archiver) openArchive(ctx context.Context, fname string, limits *ExtractLimits, opts *ExtractOptions) (*openedArchive, error) {
+	convertedName, err := a.convertTarArchive(ctx, fname, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if convertedName == "" {
+		zipReader, err := openZipFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		return &openedArchive{zipReader, ""}, nil
+	}
+
+	zipReader, err := openZipFile(convertedName)
+	if err != nil {
+		os.Remove(convertedName)
+		return nil, err
+	}
+
+	return &openedArchive{zipReader, convertedName}, nil
+}
+
+// tarReader returns a reader for the tar stream in file, decompressing it if
+// needed, or nil if file isn't a tar archive
+func tarReader(file io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(3)
+
+	var stream io.Reader = buffered
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil
+		}
+		stream = gz
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		stream = bzip2.NewReader(buffered)
+	}
+
+	// the ustar magic is at offset 257 of the first header
+	streamBuffered := bufio.NewReaderSize(stream, 1024)
+	header, _ := streamBuffered.Peek(262)
+	if len(header) < 262 || !bytes.Equal(header[257:262], []byte("ustar")) {
+		return nil, nil
+	}
+
+	return streamBuffered, nil
+}
+
+// convertTarArchive repacks the regular files of a tar archive into a
+// temporary zip and returns its name, or "" if fname isn't a tar archive.
+// Entries are checked against limits as they're read so that a huge archive
+// is rejected before it's written out.
+func (a *Archiver) convertTarArchive(ctx context.Context, fname string, limits *ExtractLimits, opts *ExtractOptions) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	stream, err := tarReader(file)
+	if err != nil || stream == nil {
+		return "", err
+	}
+
+	ignorePatterns := append([]string{}, a.Config.ignorePatterns()...)
+	ignorePatterns = append(ignorePatterns, opts.IgnorePatterns...)
+
+	out, err := os.CreateTemp(a.tempDir(ctx), "tar-*.zip")
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	convertedName := out.Name()
+	err = func() error {
+		defer out.Close()
+
+		zw := zip.NewWriter(out)
+		tr := tar.NewReader(stream)
+
+		var byteCount uint64
+		fileCount := 0
+
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("Failed to read tar archive: %v", err)
+			}
+
+			if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+				if header.Typeflag != tar.TypeDir {
+					log.Printf("Skipping tar entry %s (type %c)", header.Name, header.Typeflag)
+				}
+				continue
+			}
+
+			name := strings.TrimPrefix(header.Name, "./")
+			if shouldIgnoreFile(name, ignorePatterns) {
+				continue
+			}
+
+			size := uint64(header.Size)
+			fileCount++
+			byteCount += size
+
+			if fileCount > limits.MaxNumFiles {
+				return &LimitError{LimitViolation{
+					Limit:   "MaxNumFiles",
+					Message: fmt.Sprintf("Too many files in archive (max %v)", limits.MaxNumFiles),
+				}}
+			}
+			if size > limits.MaxFileSize {
+				return &LimitError{LimitViolation{
+					Limit:   "MaxFileSize",
+					Name:    name,
+					Message: fmt.Sprintf("Archive contains file that is too large (%s)", name),
+				}}
+			}
+			if byteCount > limits.MaxTotalSize {
+				return &LimitError{LimitViolation{
+					Limit:   "MaxTotalSize",
+					Message: fmt.Sprintf("Extracted archive too large (max %v bytes)", limits.MaxTotalSize),
+				}}
+			}
+
+			writer, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     name,
+				Method:   zip.Store,
+				Modified: header.ModTime,
+			})
+			if err != nil {
+				return errors.Wrap(err, 0)
+			}
+
+			_, err = io.Copy(writer, tr)
+			if err != nil {
+				return fmt.Errorf("Failed to read tar entry %s: %v", name, err)
+			}
+		}
+
+		return zw.Close()
+	}()
+
+	if err != nil {
+		os.Remove(convertedName)
+		return "", err
+	}
+
+	return convertedName, nil
+}
@@ -0,0 +1,84 @@
+package zipserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestTar(t *testing.T, compress bool) string {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		out = gz
+	}
+
+	tw := tar.NewWriter(out)
+	entries := []struct {
+		name     string
+		typeflag byte
+		data     string
+	}{
+		{"./game/", tar.TypeDir, ""},
+		{"./game/index.html", tar.TypeReg, "<html></html>"},
+		{"./game/data/level.json", tar.TypeReg, `{"level":1}`},
+		{"./game/.DS_Store", tar.TypeReg, "junk"},
+		{"./game/link", tar.TypeSymlink, ""},
+	}
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Size: int64(len(entry.data)), Mode: 0644}
+		if entry.typeflag == tar.TypeSymlink {
+			header.Linkname = "/etc/passwd"
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(entry.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+
+	fname := filepath.Join(t.TempDir(), "build.tar.gz")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+	return fname
+}
+
+func Test_ExtractTarArchive(t *testing.T) {
+	ctx := context.Background()
+
+	for _, compress := range []bool{false, true} {
+		storage, err := NewMemStorage()
+		require.NoError(t, err)
+		archiver := &Archiver{storage, emptyConfig()}
+
+		extracted, err := archiver.ExtractZipFile(ctx, writeTestTar(t, compress), "tarball", testLimits(), ExtractOptions{})
+		require.NoError(t, err)
+
+		keys := []string{}
+		for _, file := range extracted {
+			keys = append(keys, file.Key)
+		}
+		assert.ElementsMatch(t, []string{"tarball/game/index.html", "tarball/game/data/level.json"}, keys)
+
+		headers, err := storage.HeadFile(ctx, "testbucket", "tarball/game/index.html")
+		require.NoError(t, err)
+		assert.Equal(t, "text/html; charset=utf-8", headers.Get("Content-Type"))
+
+		limits := testLimits()
+		limits.MaxNumFiles = 1
+		_, err = archiver.ExtractZipFile(ctx, writeTestTar(t, compress), "tarball2", limits, ExtractOptions{})
+		assert.Error(t, err)
+	}
+}
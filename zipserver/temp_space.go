@@ -0,0 +1,187 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	errors "github.com/go-errors/errors"
+)
+
+// defaultTmpDir holds temporary files when TmpDir isn't set, relative to the
+// working directory
+const defaultTmpDir = "zip_tmp"
+
+// tempDir is where temporary files go, each operation in a directory of its
+// own, see withTempDir
+func (c *Config) tempDir() string {
+	if c != nil && c.TmpDir != "" {
+		return c.TmpDir
+	}
+	return defaultTmpDir
+}
+
+type tempDirContextKey struct{}
+
+// withTempDir gives the operation running in ctx a temporary directory of its
+// own, which cleanup removes along with everything left in it. An operation
+// already having one keeps it, cleanup then does nothing.
+func (a *Archiver) withTempDir(ctx context.Context) (context.Context, func(), error) {
+	if _, ok := ctx.Value(tempDirContextKey{}).(string); ok {
+		return ctx, func() {}, nil
+	}
+
+	base := a.Config.tempDir()
+	err := os.MkdirAll(base, os.ModeDir|0777)
+	if err != nil {
+		return ctx, nil, errors.Wrap(err, 0)
+	}
+
+	dir, err := os.MkdirTemp(base, "job-*")
+	if err != nil {
+		return ctx, nil, errors.Wrap(err, 0)
+	}
+
+	return context.WithValue(ctx, tempDirContextKey{}, dir), func() { os.RemoveAll(dir) }, nil
+}
+
+// tempDir is the directory temporary files of the operation running in ctx
+// are created in, the shared one when it doesn't have its own
+func (a *Archiver) tempDir(ctx context.Context) string {
+	if dir, ok := ctx.Value(tempDirContextKey{}).(string); ok {
+		return dir
+	}
+
+	base := a.Config.tempDir()
+	os.MkdirAll(base, os.ModeDir|0777)
+	return base
+}
+
+// TempDirStatus reports the local temporary directory in /status
+type TempDirStatus struct {
+	Path         string
+	Files        int
+	Bytes        uint64
+	FreeBytes    uint64 `json:",omitempty"` // unknown outside of linux
+	MinFreeBytes uint64 `json:",omitempty"`
+
+	// of the last temp-janitor run
+	LastCleanup      time.Time `json:",omitempty"`
+	LastRemoved      int
+	LastRemovedBytes uint64
+}
+
+var tempCleanups = struct {
+	sync.Mutex
+	last         time.Time
+	removed      int
+	removedBytes uint64
+}{}
+
+// recordTempCleanup is called by cleanTempDir once it's done
+func recordTempCleanup(removed int, removedBytes uint64) {
+	globalMetrics.TotalTempFilesRemoved.Add(int64(removed))
+
+	tempCleanups.Lock()
+	defer tempCleanups.Unlock()
+	tempCleanups.last = time.Now()
+	tempCleanups.removed = removed
+	tempCleanups.removedBytes = removedBytes
+}
+
+// tempFreeBytes is the free space left for temporary files, it also updates
+// the gauge served by /metrics
+func tempFreeBytes(config *Config) (uint64, error) {
+	dir := config.tempDir()
+	os.MkdirAll(dir, os.ModeDir|0777)
+
+	free, err := diskFreeBytes(dir)
+	if err != nil {
+		return 0, err
+	}
+	globalMetrics.TempFreeBytes.Store(int64(free))
+	return free, nil
+}
+
+// getTempDirStatus counts the temporary files, including the ones in the
+// directories of running operations, and the space left next to them
+func getTempDirStatus(config *Config) TempDirStatus {
+	status := TempDirStatus{Path: config.tempDir(), MinFreeBytes: config.MinFreeTempSpace}
+	status.Files, status.Bytes = countTempFiles(status.Path)
+
+	if free, err := tempFreeBytes(config); err == nil {
+		status.FreeBytes = free
+	}
+
+	tempCleanups.Lock()
+	defer tempCleanups.Unlock()
+	status.LastCleanup = tempCleanups.last
+	status.LastRemoved = tempCleanups.removed
+	status.LastRemovedBytes = tempCleanups.removedBytes
+	return status
+}
+
+// countTempFiles counts the files under dir and their total size
+func countTempFiles(dir string) (int, uint64) {
+	files := 0
+	var bytes uint64
+
+	filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			files++
+			bytes += uint64(info.Size())
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+// lowDiskSpaceError is an extraction refused because temporary files may not
+// fit, reported with a 503 and a JSON body
+type lowDiskSpaceError struct {
+	free uint64
+	min  uint64
+}
+
+func (e *lowDiskSpaceError) Error() string {
+	return fmt.Sprintf("Not enough free disk space for temporary files (%d bytes, min %d)", e.free, e.min)
+}
+
+func (e *lowDiskSpaceError) writeTo(w http.ResponseWriter) {
+	blob, _ := json.Marshal(struct {
+		Type  string
+		Error string
+	}{"LowDiskSpace", e.Error()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(blob)
+}
+
+// checkTempSpace fails when less than MinFreeTempSpace is free for temporary
+// files. It lets everything through when the free space can't be known.
+func checkTempSpace(config *Config) error {
+	if config.MinFreeTempSpace == 0 {
+		return nil
+	}
+
+	free, err := tempFreeBytes(config)
+	if err != nil {
+		return nil
+	}
+
+	if free < config.MinFreeTempSpace {
+		globalMetrics.TotalLowDiskRejections.Add(1)
+		return &lowDiskSpaceError{free: free, min: config.MinFreeTempSpace}
+	}
+	return nil
+}
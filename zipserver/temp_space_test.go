@@ -0,0 +1,122 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TempDirStatus(t *testing.T) {
+	config := emptyConfig()
+	config.JobTimeout = Duration(time.Minute)
+
+	require.NoError(t, os.MkdirAll(defaultTmpDir, 0777))
+	stale := filepath.Join(defaultTmpDir, "stale-status-test.zip")
+	require.NoError(t, os.WriteFile(stale, []byte("leftover"), 0644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	require.NoError(t, cleanTempDir(context.Background(), config))
+
+	status := getTempDirStatus(config)
+	assert.Equal(t, defaultTmpDir, status.Path)
+	assert.False(t, status.LastCleanup.IsZero())
+	assert.GreaterOrEqual(t, status.LastRemoved, 1)
+	assert.GreaterOrEqual(t, status.LastRemovedBytes, uint64(len("leftover")))
+	if runtime.GOOS == "linux" {
+		assert.NotZero(t, status.FreeBytes)
+	}
+}
+
+func Test_MinFreeTempSpace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("free disk space is only known on linux")
+	}
+
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = emptyConfig()
+
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, ""))
+
+	assert.NoError(t, checkTempSpace(globalConfig))
+
+	// more than any disk has
+	globalConfig.MinFreeTempSpace = 1 << 62
+	rejections := globalMetrics.TotalLowDiskRejections.Load()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/extract?key=a.zip&prefix=b", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var body struct{ Type, Error string }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "LowDiskSpace", body.Type)
+	assert.Equal(t, rejections+1, globalMetrics.TotalLowDiskRejections.Load())
+}
+
+func Test_PerJobTempDir(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.TmpDir = t.TempDir()
+	config.JobTimeout = Duration(time.Minute)
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("hello.txt")
+	require.NoError(t, err)
+	w.Write([]byte("hello"))
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "game.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	jobCtx, cleanup, err := archiver.withTempDir(ctx)
+	require.NoError(t, err)
+	dir := archiver.tempDir(jobCtx)
+	assert.Equal(t, config.TmpDir, filepath.Dir(dir))
+
+	// nested operations share the directory
+	nestedCtx, nestedCleanup, err := archiver.withTempDir(jobCtx)
+	require.NoError(t, err)
+	assert.Equal(t, dir, archiver.tempDir(nestedCtx))
+	nestedCleanup()
+	assert.DirExists(t, dir)
+
+	cleanup()
+	assert.NoDirExists(t, dir)
+
+	_, err = archiver.ExtractZip(ctx, "game.zip", "games/1", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+	_, err = archiver.ExtractZip(ctx, "missing.zip", "games/2", testLimits(), ExtractOptions{})
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(config.TmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "job directories should have been removed")
+
+	// stranded by a crash
+	stranded := filepath.Join(config.TmpDir, "job-stranded")
+	require.NoError(t, os.MkdirAll(stranded, 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(stranded, "game.zip"), []byte("partial"), 0644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(stranded, old, old))
+
+	assert.Equal(t, 1, getTempDirStatus(config).Files)
+	require.NoError(t, cleanTempDir(ctx, config))
+	assert.NoDirExists(t, stranded)
+}
@@ -0,0 +1,73 @@
+#!/usr/bin/env python3
+"""Writes aes.zip, a WinZip AE-2 (AES-256) encrypted zip with the password
+hunter2, for zip_crypto_test.go.
+
+It's made independently of zipserver's decryption code: the keys come from
+Python's hashlib.pbkdf2_hmac, the AES keystream from the openssl command, the
+compression from zlib, following the WinZip AES specification
+(https://www.winzip.com/en/support/aes-encryption/).
+"""
+
+import hashlib
+import hmac
+import struct
+import subprocess
+import zlib
+
+PASSWORD = b"hunter2"
+
+ENTRIES = [
+    # name, contents, compression method
+    ("readme.txt", b"Hello from an AES encrypted zip\n" * 200, 8),
+    ("stored.txt", b"stored, not deflated\n", 0),
+]
+
+
+def keystream(key, blocks):
+    # WinZip's counter is little endian and starts at 1
+    counters = b"".join(struct.pack("<QQ", i + 1, 0) for i in range(blocks))
+    return subprocess.run(
+        ["openssl", "enc", "-aes-256-ecb", "-nopad", "-K", key.hex()],
+        input=counters, capture_output=True, check=True,
+    ).stdout
+
+
+def encrypt(name, data, method, salt):
+    keys = hashlib.pbkdf2_hmac("sha1", PASSWORD, salt, 1000, 66)
+    aes_key, mac_key, verifier = keys[:32], keys[32:64], keys[64:]
+
+    if method == 8:
+        compressor = zlib.compressobj(9, zlib.DEFLATED, -15)
+        data = compressor.compress(data) + compressor.flush()
+
+    stream = keystream(aes_key, (len(data) + 15) // 16)
+    encrypted = bytes(b ^ k for b, k in zip(data, stream))
+    mac = hmac.new(mac_key, encrypted, hashlib.sha1).digest()[:10]
+    return salt + verifier + encrypted + mac
+
+
+def main():
+    local, central = b"", b""
+    for index, (name, data, method) in enumerate(ENTRIES):
+        body = encrypt(name, data, method, bytes([index + 1]) * 16)
+        name = name.encode()
+        # AE-2, vendor AE, AES-256, actual method
+        extra = struct.pack("<HHH", 0x9901, 7, 2) + b"AE" + struct.pack("<BH", 3, method)
+
+        offset = len(local)
+        # the CRC is 0 for AE-2
+        header = struct.pack("<IHHHHHIIIHH", 0x04034B50, 51, 1, 99, 0, 0x21,
+                             0, len(body), len(data), len(name), len(extra))
+        local += header + name + extra + body
+        central += struct.pack("<IHHHHHHIIIHHHHHII", 0x02014B50, 51, 51, 1, 99, 0, 0x21,
+                               0, len(body), len(data), len(name), len(extra), 0, 0, 0, 0, offset)
+        central += name + extra
+
+    end = struct.pack("<IHHHHIIH", 0x06054B50, 0, 0, len(ENTRIES), len(ENTRIES),
+                      len(central), len(local), 0)
+    with open("aes.zip", "wb") as f:
+        f.write(local + central + end)
+
+
+if __name__ == "__main__":
+    main()
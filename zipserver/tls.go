@@ -0,0 +1,137 @@
+package zipserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// TLSConfig makes the server terminate TLS itself
+type TLSConfig struct {
+	// PEM certificate chain and private key. TLS is off when empty
+	CertFile string `json:",omitempty"`
+	KeyFile  string `json:",omitempty"`
+	// PEM bundle of the CAs client certificates must be signed by. When set,
+	// clients without a valid certificate are refused (mutual TLS)
+	ClientCAFile string `json:",omitempty"`
+}
+
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+func validateTLS(config TLSConfig) error {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return errors.New("Config error: TLS.CertFile and TLS.KeyFile must be set together")
+	}
+	if config.ClientCAFile != "" && config.CertFile == "" {
+		return errors.New("Config error: TLS.ClientCAFile requires TLS.CertFile and TLS.KeyFile")
+	}
+	return nil
+}
+
+// tlsReloader holds the certificate and client CAs currently served, so they
+// can be swapped without dropping the listener
+type tlsReloader struct {
+	config TLSConfig
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func newTLSReloader(config TLSConfig) (*tlsReloader, error) {
+	reloader := &tlsReloader{config: config}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload reads the certificate, key and client CAs again. The files currently
+// served are kept if any of them fails to load
+func (r *tlsReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate: %s", err.Error())
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read TLS client CAs: %s", err.Error())
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", r.config.ClientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	return nil
+}
+
+// tlsConfig is handed to the listener, every handshake picks up the files
+// most recently loaded
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// reloadOnSIGHUP reloads the TLS files every time the process gets SIGHUP
+func (r *tlsReloader) reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := r.reload(); err != nil {
+				log.Print("Keeping the current TLS certificate: ", err)
+				continue
+			}
+			log.Print("Reloaded TLS certificate")
+		}
+	}()
+}
+
+// listenTLS wraps listener so it terminates TLS when config.TLS is set
+func listenTLS(listener net.Listener, config *Config) (net.Listener, error) {
+	if !config.TLS.enabled() {
+		return listener, nil
+	}
+
+	reloader, err := newTLSReloader(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	reloader.reloadOnSIGHUP()
+
+	return tls.NewListener(listener, reloader.tlsConfig()), nil
+}
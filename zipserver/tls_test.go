@@ -0,0 +1,137 @@
+package zipserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// issueTestCertificate makes a certificate for 127.0.0.1 signed by parent, or
+// self-signed CA when parent is nil
+func issueTestCertificate(t *testing.T, serial int64, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "zipserver test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		issuer, signer = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCertificate{certificate, key}
+}
+
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key}
+}
+
+func Test_TLSListener(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{TLS: TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "clients.pem"),
+	}}
+	require.NoError(t, validateTLS(config.TLS))
+
+	serverCA := issueTestCertificate(t, 1, nil)
+	issueTestCertificate(t, 10, serverCA).write(t, config.TLS.CertFile, config.TLS.KeyFile)
+	clientCA := issueTestCertificate(t, 2, nil)
+	clientCA.write(t, config.TLS.ClientCAFile, filepath.Join(dir, "clients.key"))
+
+	reloader, err := newTLSReloader(config.TLS)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(tls.NewListener(listener, reloader.tlsConfig()))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.certificate)
+
+	get := func(clientCertificates ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: clientCertificates,
+		}}}
+		return client.Get("https://" + listener.Addr().String() + "/status")
+	}
+
+	_, err = get()
+	assert.Error(t, err, "clients need a certificate")
+
+	res, err := get(issueTestCertificate(t, 20, clientCA).tlsCertificate())
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int64(10), res.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// a new certificate is served after a reload
+	issueTestCertificate(t, 11, serverCA).write(t, config.TLS.CertFile, config.TLS.KeyFile)
+	require.NoError(t, reloader.reload())
+
+	res, err = get(issueTestCertificate(t, 21, clientCA).tlsCertificate())
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, int64(11), res.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// a broken file keeps the current certificate
+	require.NoError(t, os.WriteFile(config.TLS.KeyFile, []byte("nope"), 0600))
+	assert.Error(t, reloader.reload())
+
+	res, err = get(issueTestCertificate(t, 22, clientCA).tlsCertificate())
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, int64(11), res.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	assert.Error(t, validateTLS(TLSConfig{CertFile: "server.pem"}))
+	assert.Error(t, validateTLS(TLSConfig{ClientCAFile: "clients.pem"}))
+}
@@ -0,0 +1,407 @@
+package zipserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig sends spans to an OpenTelemetry collector with OTLP over HTTP
+type TracingConfig struct {
+	// OTLP/HTTP traces endpoint, eg. "http://localhost:4318/v1/traces".
+	// Tracing is off when empty
+	Endpoint string `json:",omitempty"`
+	// Sent along with every export, eg. for authentication
+	Headers map[string]string `json:",omitempty"`
+	// service.name of the spans, defaults to zipserver
+	ServiceName string `json:",omitempty"`
+}
+
+const (
+	// how often finished spans are exported
+	traceExportInterval = 5 * time.Second
+	// finished spans waiting to be exported, more are dropped
+	maxPendingSpans = 4096
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type spanAttribute struct {
+	key   string
+	value string
+}
+
+// span is a timed operation in a trace. A nil span is tracing being off, its
+// methods do nothing
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	kind     int
+	name     string
+
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	err        string
+}
+
+// spanExporter batches finished spans and posts them to the collector
+type spanExporter struct {
+	config TracingConfig
+
+	mutex   sync.Mutex
+	pending []*span
+	dropped int
+
+	// closed to stop run, which closes stopped once it returns
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// tracer is nil when tracing is off
+var tracer *spanExporter
+
+// setupTracing starts exporting spans as configured, after shutting down the
+// exporter of a previous call
+func setupTracing(config *Config) {
+	if tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), traceExportInterval)
+		tracer.shutdown(ctx)
+		cancel()
+		tracer = nil
+	}
+
+	if config.Tracing.Endpoint == "" {
+		return
+	}
+
+	tracer = &spanExporter{
+		config:  config.Tracing,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go tracer.run()
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the innermost span of ctx, or the span of the job
+// running in it
+func spanFromContext(ctx context.Context) *span {
+	if current, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		return current
+	}
+	return jobFromContext(ctx).traceSpan()
+}
+
+// withSpan makes s the current span of ctx
+func withSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+// urlHost is the host of rawURL, recorded instead of the whole URL since it
+// may hold secrets
+func urlHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// startSpan starts a span under the current one of ctx, attributes are key
+// value pairs. The returned context has the new span as its current one
+func startSpan(ctx context.Context, name string, attributes ...string) (context.Context, *span) {
+	return startSpanOfKind(ctx, spanKindInternal, name, attributes)
+}
+
+// startClientSpan is startSpan for a request zipserver makes to another
+// service, eg. a callback
+func startClientSpan(ctx context.Context, name string, attributes ...string) (context.Context, *span) {
+	return startSpanOfKind(ctx, spanKindClient, name, attributes)
+}
+
+func startSpanOfKind(ctx context.Context, kind int, name string, attributes []string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	current := newSpan(spanFromContext(ctx), kind, name, attributes)
+	return withSpan(ctx, current), current
+}
+
+func newSpan(parent *span, kind int, name string, attributes []string) *span {
+	current := &span{kind: kind, name: name, start: time.Now()}
+	rand.Read(current.spanID[:])
+
+	if parent != nil {
+		current.traceID = parent.traceID
+		current.parentID = parent.spanID
+	} else {
+		rand.Read(current.traceID[:])
+	}
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		current.setAttribute(attributes[i], attributes[i+1])
+	}
+	return current
+}
+
+// startRequestSpan starts the span of an incoming request, continuing the
+// trace of its traceparent header if it has one
+func startRequestSpan(r *http.Request) *http.Request {
+	if tracer == nil {
+		return r
+	}
+
+	params := r.URL.Query()
+	attributes := []string{"http.request.method", r.Method, "url.path", r.URL.Path}
+	for _, name := range []string{"key", "prefix", "target"} {
+		if value := params.Get(name); value != "" {
+			attributes = append(attributes, "zipserver."+name, value)
+		}
+	}
+
+	current := newSpan(parseTraceparent(r.Header.Get("traceparent")), spanKindServer, r.Method+" "+r.URL.Path, attributes)
+	return r.WithContext(withSpan(r.Context(), current))
+}
+
+// parseTraceparent reads a W3C trace context header, returning the remote
+// span it names or nil when it's missing or invalid
+func parseTraceparent(header string) *span {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+
+	remote := &span{}
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return nil
+	}
+	return remote
+}
+
+// traceparent is the W3C trace context header value passing s on
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+func (s *span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, spanAttribute{key, value})
+}
+
+// finish ends the span, marking it as failed when err isn't nil, and queues
+// it for export
+func (s *span) finish(err error) {
+	if s == nil || tracer == nil {
+		return
+	}
+
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	tracer.add(s)
+}
+
+func (e *spanExporter) add(s *span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.pending) >= maxPendingSpans {
+		e.dropped++
+		return
+	}
+	e.pending = append(e.pending, s)
+}
+
+// run exports the finished spans every traceExportInterval until stopped
+func (e *spanExporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.flush(context.Background()); err != nil {
+				log.Print("Failed to export traces: ", err)
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// shutdown stops run, then exports the spans still waiting
+func (e *spanExporter) shutdown(ctx context.Context) {
+	close(e.stop)
+	<-e.stopped
+
+	if err := e.flush(ctx); err != nil {
+		log.Print("Failed to export traces: ", err)
+	}
+}
+
+// flush exports the spans finished so far
+func (e *spanExporter) flush(ctx context.Context) error {
+	e.mutex.Lock()
+	spans := e.pending
+	dropped := e.dropped
+	e.pending = nil
+	e.dropped = 0
+	e.mutex.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Dropped %d spans, the trace exporter can't keep up", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(e.exportRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setOutboundHeaders(req, "")
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := outboundHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Trace collector returned unexpected code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+func otlpAttributes(attributes []spanAttribute) []otlpAttribute {
+	converted := make([]otlpAttribute, len(attributes))
+	for i, attribute := range attributes {
+		converted[i].Key = attribute.key
+		converted[i].Value.StringValue = attribute.value
+	}
+	return converted
+}
+
+// exportRequest is the OTLP/JSON ExportTraceServiceRequest for spans
+func (e *spanExporter) exportRequest(spans []*span) interface{} {
+	serviceName := e.config.ServiceName
+	if serviceName == "" {
+		serviceName = "zipserver"
+	}
+
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		exported := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			exported.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			exported.Status = &otlpStatus{Code: 2, Message: s.err}
+		}
+		converted = append(converted, exported)
+	}
+
+	type scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	return struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{{
+		Resource:   resource{otlpAttributes([]spanAttribute{{"service.name", serviceName}})},
+		ScopeSpans: []scopeSpans{{scope{"zipserver", Version}, converted}},
+	}}}
+}
+
+// flushTraces exports the spans still waiting, before the process exits
+func flushTraces(ctx context.Context) {
+	if tracer == nil {
+		return
+	}
+	if err := tracer.flush(ctx); err != nil {
+		log.Print("Failed to export traces: ", err)
+	}
+}
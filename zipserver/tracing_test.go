@@ -0,0 +1,146 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Tracing(t *testing.T) {
+	exports := make(chan []byte, 1)
+	var authorization string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		exports <- body
+	}))
+	defer collector.Close()
+
+	setupTracing(&Config{Tracing: TracingConfig{
+		Endpoint: collector.URL + "/v1/traces",
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+	}})
+	defer setupTracing(&Config{})
+
+	var outboundTraceparent string
+	handler := wrapErrors(func(w http.ResponseWriter, r *http.Request) error {
+		ctx, child := startSpan(r.Context(), "upload", "zipserver.target", "primary")
+		child.finish(errors.New("upload failed"))
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com/callback", nil)
+		require.NoError(t, err)
+		setOutboundHeaders(req, "")
+		outboundTraceparent = req.Header.Get("traceparent")
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/extract?key=zips/game.zip", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NoError(t, tracer.flush(context.Background()))
+	assert.Equal(t, "Bearer secret", authorization)
+
+	var exported struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute
+			}
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(<-exports, &exported))
+	require.Len(t, exported.ResourceSpans, 1)
+	assert.Equal(t, "zipserver", exported.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	child, request := spans[0], spans[1]
+
+	assert.Equal(t, "POST /extract", request.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", request.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", request.ParentSpanID)
+	assert.Contains(t, request.Attributes, otlpStringAttribute("zipserver.key", "zips/game.zip"))
+	assert.Nil(t, request.Status)
+
+	assert.Equal(t, "upload", child.Name)
+	assert.Equal(t, request.TraceID, child.TraceID)
+	assert.Equal(t, request.SpanID, child.ParentSpanID)
+	assert.Equal(t, &otlpStatus{Code: 2, Message: "upload failed"}, child.Status)
+
+	// outbound requests carry the trace along
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+child.SpanID+"-01", outboundTraceparent)
+}
+
+func Test_TracingSetupAgain(t *testing.T) {
+	exports := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		exports <- body
+	}))
+	defer collector.Close()
+
+	setupTracing(&Config{Tracing: TracingConfig{Endpoint: collector.URL}})
+	previous := tracer
+
+	_, callback := startClientSpan(context.Background(), "callback", "server.address", "example.com")
+	callback.finish(nil)
+
+	// the previous exporter stops, sending what it had
+	setupTracing(&Config{})
+	assert.Nil(t, tracer)
+	select {
+	case <-previous.stopped:
+	default:
+		t.Fatal("the previous exporter is still running")
+	}
+
+	var exported struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(<-exports, &exported))
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, "callback", spans[0].Name)
+	assert.Equal(t, spanKindClient, spans[0].Kind)
+}
+
+func Test_ParseTraceparent(t *testing.T) {
+	remote := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NotNil(t, remote)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", remote.traceparent())
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		assert.Nil(t, parseTraceparent(header), header)
+	}
+
+	// spans are only recorded with tracing on
+	_, off := startSpan(context.Background(), "upload")
+	assert.Nil(t, off)
+	off.finish(nil)
+}
+
+func otlpStringAttribute(key, value string) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	attribute.Value.StringValue = value
+	return attribute
+}
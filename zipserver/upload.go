@@ -0,0 +1,64 @@
+package zipserver
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+
+	errors "github.com/go-errors/errors"
+)
+
+// saveUploadedZip writes the zip sent as the request body to a temporary
+// file and returns its path. The body is either the raw zip, or a
+// multipart/form-data form with the zip in a "file" field. Bodies larger
+// than maxSize are refused.
+func saveUploadedZip(w http.ResponseWriter, r *http.Request, maxSize int64) (string, error) {
+	if maxSize <= 0 {
+		return "", fmt.Errorf("Extracting uploaded zips is disabled")
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxSize)
+	var src io.Reader = body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		r.Body = body
+		multipartReader, err := r.MultipartReader()
+		if err != nil {
+			return "", errors.Wrap(err, 0)
+		}
+
+		for {
+			part, err := multipartReader.NextPart()
+			if err == io.EOF {
+				return "", fmt.Errorf("Missing file field in upload")
+			}
+			if err != nil {
+				return "", errors.Wrap(err, 0)
+			}
+
+			if part.FormName() == "file" {
+				src = part
+				break
+			}
+		}
+	}
+
+	os.MkdirAll(globalConfig.tempDir(), os.ModeDir|0777)
+
+	dest, err := os.CreateTemp(globalConfig.tempDir(), "upload-*.zip")
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+	defer dest.Close()
+
+	_, err = io.Copy(dest, src)
+	if err != nil {
+		os.Remove(dest.Name())
+		return "", fmt.Errorf("Failed reading uploaded zip: %s", err.Error())
+	}
+
+	return dest.Name(), nil
+}
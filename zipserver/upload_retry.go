@@ -0,0 +1,106 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+// used when UploadRetryStatusCodes isn't set
+var defaultUploadRetryStatusCodes = []int{408, 429, 500, 502, 503, 504}
+
+// storageErrorStatus returns the HTTP status of a failed storage request, or
+// 0 when err doesn't come from a storage response
+func storageErrorStatus(err error) int {
+	var statusErr *StorageStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) {
+		return requestErr.StatusCode()
+	}
+
+	return 0
+}
+
+// uploadRetryPolicy is a retryPolicy for extracted file uploads, along with
+// which failures are worth retrying
+type uploadRetryPolicy struct {
+	retryPolicy
+	StatusCodes []int
+}
+
+func (a *Archiver) uploadRetries() uploadRetryPolicy {
+	policy := uploadRetryPolicy{
+		retryPolicy: retryPolicy{
+			Attempts:   a.Config.UploadRetryAttempts,
+			Backoff:    time.Duration(a.Config.UploadRetryBackoff),
+			MaxBackoff: time.Duration(a.Config.UploadRetryMaxBackoff),
+		},
+		StatusCodes: a.Config.UploadRetryStatusCodes,
+	}
+
+	if len(policy.StatusCodes) == 0 {
+		policy.StatusCodes = defaultUploadRetryStatusCodes
+	}
+
+	return policy
+}
+
+// retryable is true for storage responses with one of StatusCodes, for
+// requests that didn't get a response at all and for attempts that timed out
+func (p uploadRetryPolicy) retryable(err error) bool {
+	if status := storageErrorStatus(err); status != 0 {
+		for _, code := range p.StatusCodes {
+			if status == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled)
+}
+
+// extractWithRetries sends an individual file from a zip, trying again after
+// transient storage failures. Each attempt gets FilePutTimeout.
+func (a *Archiver) extractWithRetries(ctx context.Context, key string, file *zip.File, opts *ExtractOptions) (*ResourceSpec, error) {
+	policy := a.uploadRetries()
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FilePutTimeout))
+		resource, err := a.extractAndUploadOne(attemptCtx, key, file, opts)
+		cancel()
+
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil || !policy.retryable(err) {
+			return resource, err
+		}
+
+		wait := policy.wait(attempt)
+		globalMetrics.TotalUploadRetries.Add(1)
+		logPrintf(ctx, "Retrying %s in %v after attempt %d failed: %s", key, wait, attempt, err.Error())
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return resource, err
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+// flakyStorage fails the first failures uploads with status
+type flakyStorage struct {
+	*MemStorage
+	mutex    sync.Mutex
+	failures int
+	status   int
+}
+
+func (f *flakyStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	f.mutex.Lock()
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.mutex.Unlock()
+
+	if fail {
+		return &StorageStatusError{f.status, fmt.Sprintf("%d Oops", f.status)}
+	}
+	return f.MemStorage.PutFileWithSetup(ctx, bucket, key, contents, setup)
+}
+
+func Test_UploadRetryable(t *testing.T) {
+	archiver := &Archiver{nil, emptyConfig()}
+	policy := archiver.uploadRetries()
+
+	assert.True(t, policy.retryable(&StorageStatusError{503, "503 Service Unavailable"}))
+	assert.True(t, policy.retryable(fmt.Errorf("wrapped: %w", &googleapi.Error{Code: 429})))
+	assert.True(t, policy.retryable(awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "id")))
+	assert.True(t, policy.retryable(&url.Error{Op: "Put", URL: "https://storage.googleapis.com", Err: errors.New("connection reset by peer")}))
+	assert.True(t, policy.retryable(context.DeadlineExceeded))
+
+	assert.False(t, policy.retryable(&StorageStatusError{403, "403 Forbidden"}))
+	assert.False(t, policy.retryable(&url.Error{Op: "Put", URL: "https://storage.googleapis.com", Err: context.Canceled}))
+	assert.False(t, policy.retryable(errors.New("File too large (max 10 bytes)")))
+
+	archiver.Config.UploadRetryStatusCodes = []int{403}
+	assert.True(t, archiver.uploadRetries().retryable(&StorageStatusError{403, "403 Forbidden"}))
+	assert.False(t, archiver.uploadRetries().retryable(&StorageStatusError{503, "503 Service Unavailable"}))
+}
+
+func Test_ExtractRetriesUploads(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+	config.UploadRetryAttempts = 3
+	config.UploadRetryBackoff = Duration(time.Millisecond)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("index.html")
+	require.NoError(t, err)
+	w.Write([]byte("<html></html>"))
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "game.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	mem, err := NewMemStorage()
+	require.NoError(t, err)
+	storage := &flakyStorage{MemStorage: mem, failures: 2, status: 503}
+	archiver := &Archiver{storage, config}
+
+	retries := globalMetrics.TotalUploadRetries.Load()
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.EqualValues(t, 2, globalMetrics.TotalUploadRetries.Load()-retries)
+
+	// out of attempts
+	storage.failures = 3
+	_, err = archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, 503, storageErrorStatus(err))
+
+	// not retried at all
+	storage.failures = 1
+	storage.status = 403
+	retries = globalMetrics.TotalUploadRetries.Load()
+	_, err = archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	assert.Error(t, err)
+	assert.EqualValues(t, 0, globalMetrics.TotalUploadRetries.Load()-retries)
+}
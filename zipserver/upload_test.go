@@ -0,0 +1,51 @@
+package zipserver
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SaveUploadedZip(t *testing.T) {
+	contents := []byte("PK\x03\x04 pretend zip")
+
+	// raw body
+	req := httptest.NewRequest(http.MethodPost, "/extract?prefix=x", bytes.NewReader(contents))
+	req.Header.Set("Content-Type", "application/zip")
+
+	fname, err := saveUploadedZip(httptest.NewRecorder(), req, 1024)
+	assert.NoError(t, err)
+	saved, err := os.ReadFile(fname)
+	assert.NoError(t, err)
+	assert.EqualValues(t, contents, saved)
+	os.Remove(fname)
+
+	// multipart body
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("other", "field")
+	fw, err := mw.CreateFormFile("file", "game.zip")
+	assert.NoError(t, err)
+	fw.Write(contents)
+	assert.NoError(t, mw.Close())
+
+	req = httptest.NewRequest(http.MethodPost, "/extract?prefix=x", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	fname, err = saveUploadedZip(httptest.NewRecorder(), req, 1024)
+	assert.NoError(t, err)
+	saved, err = os.ReadFile(fname)
+	assert.NoError(t, err)
+	assert.EqualValues(t, contents, saved)
+	os.Remove(fname)
+
+	// too large
+	req = httptest.NewRequest(http.MethodPost, "/extract?prefix=x", bytes.NewReader(contents))
+	_, err = saveUploadedZip(httptest.NewRecorder(), req, 4)
+	assert.Error(t, err)
+}
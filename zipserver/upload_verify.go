@@ -0,0 +1,69 @@
+package zipserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	errors "github.com/go-errors/errors"
+)
+
+// how many times an extracted file is uploaded before a checksum mismatch
+// fails the extraction
+const uploadVerifyAttempts = 3
+
+// ChecksumMismatchError is returned when the MD5 storage reports for an
+// upload isn't the one of the bytes sent
+type ChecksumMismatchError struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("Stored %s has MD5 %s, expected %s", e.Key, e.Actual, e.Expected)
+}
+
+// storedMD5 returns the hex encoded MD5 of an object from its head values,
+// from x-goog-hash or else the ETag. It's empty when storage doesn't know it,
+// eg. for composed objects.
+func storedMD5(headers http.Header) string {
+	for _, value := range headers.Values("x-goog-hash") {
+		for _, hash := range strings.Split(value, ",") {
+			encoded := strings.TrimPrefix(strings.TrimSpace(hash), "md5=")
+			if encoded == strings.TrimSpace(hash) {
+				continue
+			}
+
+			sum, err := base64.StdEncoding.DecodeString(encoded)
+			if err == nil && len(sum) == 16 {
+				return hex.EncodeToString(sum)
+			}
+		}
+	}
+
+	return etagMD5(headers.Get("ETag"))
+}
+
+// verifyUpload checks what storage holds for resource against the MD5
+// computed while uploading it
+func (a *Archiver) verifyUpload(ctx context.Context, resource *ResourceSpec) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Config.FileGetTimeout))
+	defer cancel()
+
+	headers, err := a.Storage.HeadFile(ctx, a.Bucket, resource.key)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	actual := storedMD5(headers)
+	if actual != "" && actual != resource.md5 {
+		return &ChecksumMismatchError{resource.key, resource.md5, actual}
+	}
+
+	return nil
+}
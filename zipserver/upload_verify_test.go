@@ -0,0 +1,103 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptingStorage flips a byte of the first corruptions uploads
+type corruptingStorage struct {
+	*MemStorage
+	mutex       sync.Mutex
+	corruptions int
+}
+
+func (c *corruptingStorage) PutFileWithSetup(ctx context.Context, bucket, key string, contents io.Reader, setup StorageSetupFunc) error {
+	data, err := io.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	if c.corruptions > 0 && len(data) > 0 {
+		c.corruptions--
+		data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+	}
+	c.mutex.Unlock()
+
+	return c.MemStorage.PutFileWithSetup(ctx, bucket, key, bytes.NewReader(data), setup)
+}
+
+func Test_StoredMD5(t *testing.T) {
+	headers := http.Header{}
+	assert.Equal(t, "", storedMD5(headers))
+
+	headers.Set("ETag", `"9E107D9D372BB6826BD81D3542A419D6"`)
+	assert.Equal(t, "9e107d9d372bb6826bd81d3542a419d6", storedMD5(headers))
+
+	headers.Add("x-goog-hash", "crc32c=n03x6A==")
+	headers.Add("x-goog-hash", "md5=Ojk9c3dhfxgoKVVHYwFbHQ==")
+	assert.Equal(t, "3a393d7377617f182829554763015b1d", storedMD5(headers))
+
+	headers = http.Header{}
+	headers.Set("x-goog-hash", "crc32c=n03x6A==, md5=Ojk9c3dhfxgoKVVHYwFbHQ==")
+	assert.Equal(t, "3a393d7377617f182829554763015b1d", storedMD5(headers))
+
+	// composed objects
+	headers = http.Header{}
+	headers.Set("ETag", `"CKih16GjycICEAE="`)
+	assert.Equal(t, "", storedMD5(headers))
+}
+
+func Test_VerifyExtractedUploads(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("index.html")
+	require.NoError(t, err)
+	w.Write([]byte("<html></html>"))
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "game.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	mem, err := NewMemStorage()
+	require.NoError(t, err)
+	storage := &corruptingStorage{MemStorage: mem, corruptions: uploadVerifyAttempts - 1}
+	archiver := &Archiver{storage, config}
+
+	mismatches := globalMetrics.TotalChecksumMismatches.Load()
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "game", testLimits(), ExtractOptions{})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.EqualValues(t, uploadVerifyAttempts-1, globalMetrics.TotalChecksumMismatches.Load()-mismatches)
+
+	reader, _, err := mem.GetFile(ctx, config.Bucket, "game/index.html")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "<html></html>", string(data))
+
+	// gives up once every attempt was corrupted
+	storage.corruptions = uploadVerifyAttempts
+	_, err = archiver.ExtractZipFile(ctx, fname, "broken", testLimits(), ExtractOptions{})
+	require.Error(t, err)
+
+	var mismatchErr *ChecksumMismatchError
+	assert.True(t, errors.As(err, &mismatchErr))
+	assert.Equal(t, "broken/index.html", mismatchErr.Key)
+}
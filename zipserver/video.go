@@ -0,0 +1,502 @@
+package zipserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+
+	errors "github.com/go-errors/errors"
+)
+
+// the largest metadata element (mp4 moov box, matroska Info or Tracks) read
+// into memory while probing
+const maxVideoHeaderSize = 16 * 1024 * 1024
+
+// VideoMetadata describes an extracted video file
+type VideoMetadata struct {
+	Container string  // mp4, mov, webm or matroska
+	Duration  float64 // in seconds
+	Width     int
+	Height    int
+	Codec     string // as named by the container, eg. avc1 or V_VP9
+	Bitrate   int64  // average, in bits per second
+}
+
+var videoExtensions = map[string]bool{
+	".mp4": true, ".m4v": true, ".mov": true, ".webm": true, ".mkv": true,
+}
+
+func isVideoFile(name string) bool {
+	return videoExtensions[strings.ToLower(path.Ext(name))]
+}
+
+func init() {
+	RegisterAnalyzer(ExtractContentsVideo, videoAnalyzer{})
+}
+
+// videoAnalyzer keeps the videos probeVideo can read, for contents=video
+type videoAnalyzer struct{}
+
+func (videoAnalyzer) Accepts(filename string) bool {
+	return isVideoFile(filename)
+}
+
+func (videoAnalyzer) Analyze(reader io.Reader, filename string, size uint64) (*Analysis, error) {
+	metadata, err := probeVideo(filename, reader, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Analysis{Metadata: metadata}, nil
+}
+
+// probeVideo reads the metadata of the video stored in reader, failing for
+// files that don't have a video track. size is the full size of the file.
+func probeVideo(name string, reader io.Reader, size uint64) (*VideoMetadata, error) {
+	var metadata *VideoMetadata
+	var err error
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mp4", ".m4v", ".mov":
+		metadata, err = probeMP4(bufio.NewReader(reader))
+	case ".webm", ".mkv":
+		metadata, err = probeMatroska(bufio.NewReader(reader))
+	default:
+		return nil, errors.Errorf("Unsupported video format: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Codec == "" || metadata.Width == 0 || metadata.Height == 0 {
+		return nil, errors.Errorf("No video track in %s", name)
+	}
+	if metadata.Duration <= 0 {
+		return nil, errors.Errorf("Unknown duration for %s", name)
+	}
+
+	metadata.Bitrate = int64(float64(size) * 8 / metadata.Duration)
+	return metadata, nil
+}
+
+// probeMP4 walks the top level boxes of an mp4 or quicktime file, skipping
+// media data, until it has read the moov box
+func probeMP4(reader io.Reader) (*VideoMetadata, error) {
+	metadata := &VideoMetadata{Container: "mp4"}
+
+	for {
+		boxType, bodySize, err := readMP4BoxHeader(reader)
+		if err == io.EOF {
+			return nil, errors.Errorf("No moov box found")
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		switch boxType {
+		case "ftyp":
+			body, err := readBoxBody(reader, bodySize)
+			if err != nil {
+				return nil, err
+			}
+			if len(body) >= 4 && string(body[:4]) == "qt  " {
+				metadata.Container = "mov"
+			}
+		case "moov":
+			body, err := readBoxBody(reader, bodySize)
+			if err != nil {
+				return nil, err
+			}
+			parseMP4Movie(body, metadata)
+			return metadata, nil
+		default:
+			if bodySize < 0 {
+				return nil, errors.Errorf("No moov box found")
+			}
+			if _, err := io.CopyN(io.Discard, reader, bodySize); err != nil {
+				return nil, errors.Wrap(err, 0)
+			}
+		}
+	}
+}
+
+// readMP4BoxHeader returns the type of the next box and the size of its body,
+// -1 when it extends to the end of the file
+func readMP4BoxHeader(reader io.Reader) (string, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return "", 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	boxType := string(header[4:])
+	headerSize := int64(8)
+
+	switch size {
+	case 0:
+		return boxType, -1, nil
+	case 1:
+		var largeSize [8]byte
+		if _, err := io.ReadFull(reader, largeSize[:]); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(largeSize[:]))
+		headerSize += 8
+	}
+
+	if size < headerSize {
+		return "", 0, fmt.Errorf("Invalid size for %s box", boxType)
+	}
+	return boxType, size - headerSize, nil
+}
+
+func readBoxBody(reader io.Reader, size int64) ([]byte, error) {
+	if size < 0 || size > maxVideoHeaderSize {
+		return nil, errors.Errorf("Video header too large to probe")
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	return body, nil
+}
+
+// mp4Boxes iterates over the boxes in a parent box's body
+func mp4Boxes(body []byte, fn func(boxType string, body []byte)) {
+	for len(body) >= 8 {
+		size := int(binary.BigEndian.Uint32(body[:4]))
+		boxType := string(body[4:8])
+		headerSize := 8
+
+		if size == 1 && len(body) >= 16 {
+			size = int(binary.BigEndian.Uint64(body[8:16]))
+			headerSize = 16
+		} else if size == 0 {
+			size = len(body)
+		}
+
+		if size < headerSize || size > len(body) {
+			return
+		}
+
+		fn(boxType, body[headerSize:size])
+		body = body[size:]
+	}
+}
+
+// parseMP4Movie reads the duration from mvhd and the first video track's
+// size and codec
+func parseMP4Movie(moov []byte, metadata *VideoMetadata) {
+	mp4Boxes(moov, func(boxType string, body []byte) {
+		switch boxType {
+		case "mvhd":
+			metadata.Duration = parseMP4Duration(body)
+		case "trak":
+			if metadata.Codec == "" {
+				parseMP4Track(body, metadata)
+			}
+		}
+	})
+}
+
+func parseMP4Duration(mvhd []byte) float64 {
+	if len(mvhd) < 4 {
+		return 0
+	}
+
+	var timescale uint32
+	var duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[20:24])
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		if len(mvhd) < 20 {
+			return 0
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[12:16])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+
+	if timescale == 0 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+func parseMP4Track(trak []byte, metadata *VideoMetadata) {
+	var width, height int
+	var handler, codec string
+
+	mp4Boxes(trak, func(boxType string, body []byte) {
+		switch boxType {
+		case "tkhd":
+			// width and height are 16.16 fixed point, at the end of the box
+			if len(body) >= 8 {
+				width = int(binary.BigEndian.Uint32(body[len(body)-8:]) >> 16)
+				height = int(binary.BigEndian.Uint32(body[len(body)-4:]) >> 16)
+			}
+		case "mdia":
+			mp4Boxes(body, func(boxType string, body []byte) {
+				switch boxType {
+				case "hdlr":
+					if len(body) >= 12 {
+						handler = string(body[8:12])
+					}
+				case "minf":
+					mp4Boxes(body, func(boxType string, body []byte) {
+						if boxType != "stbl" {
+							return
+						}
+						mp4Boxes(body, func(boxType string, body []byte) {
+							// version, flags and entry count, then the first sample entry
+							if boxType == "stsd" && len(body) >= 16 {
+								codec = string(body[12:16])
+							}
+						})
+					})
+				}
+			})
+		}
+	})
+
+	if handler == "vide" {
+		metadata.Width = width
+		metadata.Height = height
+		metadata.Codec = strings.TrimSpace(codec)
+	}
+}
+
+// matroska element IDs, see https://www.matroska.org/technical/elements.html
+const (
+	mkvEBML          = 0x1A45DFA3
+	mkvDocType       = 0x4282
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDuration      = 0x4489
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvTrackType     = 0x83
+	mkvCodecID       = 0x86
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+)
+
+const mkvTrackTypeVideo = 1
+
+// probeMatroska walks the top level elements of a webm or mkv file, skipping
+// clusters, until it has read the segment's Info and Tracks
+func probeMatroska(reader io.Reader) (*VideoMetadata, error) {
+	metadata := &VideoMetadata{Container: "matroska"}
+
+	id, size, err := readEBMLHeader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	if id != mkvEBML {
+		return nil, errors.Errorf("Not a matroska file")
+	}
+	header, err := readBoxBody(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	ebmlElements(header, func(id uint64, body []byte) {
+		if id == mkvDocType && string(body) == "webm" {
+			metadata.Container = "webm"
+		}
+	})
+
+	id, _, err = readEBMLHeader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	if id != mkvSegment {
+		return nil, errors.Errorf("No matroska segment found")
+	}
+
+	timecodeScale := uint64(1000000)
+	var duration float64
+	var foundInfo, foundTracks bool
+
+	for !foundInfo || !foundTracks {
+		id, size, err := readEBMLHeader(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		switch id {
+		case mkvInfo:
+			body, err := readBoxBody(reader, size)
+			if err != nil {
+				return nil, err
+			}
+			foundInfo = true
+			ebmlElements(body, func(id uint64, body []byte) {
+				switch id {
+				case mkvTimecodeScale:
+					timecodeScale = ebmlUint(body)
+				case mkvDuration:
+					duration = ebmlFloat(body)
+				}
+			})
+		case mkvTracks:
+			body, err := readBoxBody(reader, size)
+			if err != nil {
+				return nil, err
+			}
+			foundTracks = true
+			parseMatroskaTracks(body, metadata)
+		default:
+			if size < 0 {
+				return nil, errors.Errorf("Matroska element of unknown size before the segment info")
+			}
+			if _, err := io.CopyN(io.Discard, reader, size); err != nil {
+				return nil, errors.Wrap(err, 0)
+			}
+		}
+	}
+
+	metadata.Duration = duration * float64(timecodeScale) / 1e9
+	return metadata, nil
+}
+
+func parseMatroskaTracks(tracks []byte, metadata *VideoMetadata) {
+	ebmlElements(tracks, func(id uint64, entry []byte) {
+		if id != mkvTrackEntry || metadata.Codec != "" {
+			return
+		}
+
+		var trackType uint64
+		var codec string
+		var width, height int
+		ebmlElements(entry, func(id uint64, body []byte) {
+			switch id {
+			case mkvTrackType:
+				trackType = ebmlUint(body)
+			case mkvCodecID:
+				codec = string(body)
+			case mkvVideo:
+				ebmlElements(body, func(id uint64, body []byte) {
+					switch id {
+					case mkvPixelWidth:
+						width = int(ebmlUint(body))
+					case mkvPixelHeight:
+						height = int(ebmlUint(body))
+					}
+				})
+			}
+		})
+
+		if trackType == mkvTrackTypeVideo {
+			metadata.Codec = codec
+			metadata.Width = width
+			metadata.Height = height
+		}
+	})
+}
+
+// readEBMLHeader reads an element's ID and the size of its body, -1 when the
+// size is unknown
+func readEBMLHeader(reader io.Reader) (uint64, int64, error) {
+	id, _, err := readVint(reader, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, unknown, err := readVint(reader, true)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if unknown {
+		return id, -1, nil
+	}
+	if size > math.MaxInt64 {
+		return 0, 0, fmt.Errorf("Invalid element size")
+	}
+	return id, int64(size), nil
+}
+
+// readVint reads a variable length integer, removing its length marker for
+// sizes. unknown is set for sizes with every value bit set.
+func readVint(reader io.Reader, isSize bool) (value uint64, unknown bool, err error) {
+	var first [1]byte
+	if _, err := io.ReadFull(reader, first[:]); err != nil {
+		return 0, false, err
+	}
+
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, false, fmt.Errorf("Invalid EBML integer")
+	}
+
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, false, err
+	}
+
+	value = uint64(first[0])
+	if isSize {
+		value &= uint64(0xFF >> length)
+	}
+	for _, b := range rest {
+		value = value<<8 | uint64(b)
+	}
+
+	if isSize {
+		unknown = value == (uint64(1)<<(7*length))-1
+	}
+	return value, unknown, nil
+}
+
+// ebmlElements iterates over the elements in a master element's body
+func ebmlElements(body []byte, fn func(id uint64, body []byte)) {
+	reader := bytes.NewReader(body)
+	for reader.Len() > 0 {
+		id, size, err := readEBMLHeader(reader)
+		if err != nil || size < 0 || size > int64(reader.Len()) {
+			return
+		}
+		offset := int64(len(body) - reader.Len())
+		fn(id, body[offset:offset+size])
+		reader.Seek(size, io.SeekCurrent)
+	}
+}
+
+func ebmlUint(body []byte) uint64 {
+	var value uint64
+	for _, b := range body {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(body []byte) float64 {
+	switch len(body) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(body)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(body))
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,162 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mp4Box(boxType string, body ...[]byte) []byte {
+	contents := bytes.Join(body, nil)
+	box := make([]byte, 8, 8+len(contents))
+	binary.BigEndian.PutUint32(box, uint32(8+len(contents)))
+	copy(box[4:], boxType)
+	return append(box, contents...)
+}
+
+// testMP4 has a 1280x720 avc1 track lasting 10 seconds, with its moov box
+// after the media data
+func testMP4() []byte {
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)  // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 10000) // duration
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1280<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 720<<16)
+
+	hdlr := append(make([]byte, 8), "vide"...)
+	stsd := append(make([]byte, 8), mp4Box("avc1", make([]byte, 8))...)
+
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom")),
+		mp4Box("mdat", make([]byte, 1000)),
+		mp4Box("moov",
+			mp4Box("mvhd", mvhd),
+			mp4Box("trak",
+				mp4Box("tkhd", tkhd),
+				mp4Box("mdia",
+					mp4Box("hdlr", hdlr, make([]byte, 12)),
+					mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd)))))),
+	}, nil)
+}
+
+func ebmlElement(id uint64, body ...[]byte) []byte {
+	contents := bytes.Join(body, nil)
+
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+
+	// 8 byte sizes keep it simple
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(contents)))
+	size[0] = 0x01
+	out = append(out, size...)
+
+	return append(out, contents...)
+}
+
+// testWebM has a 640x360 VP9 track lasting 2.5 seconds
+func testWebM() []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(2500))
+
+	return bytes.Join([][]byte{
+		ebmlElement(mkvEBML, ebmlElement(mkvDocType, []byte("webm"))),
+		ebmlElement(mkvSegment,
+			ebmlElement(0x114D9B74, make([]byte, 10)), // SeekHead, skipped
+			ebmlElement(mkvInfo,
+				ebmlElement(mkvTimecodeScale, []byte{0x0F, 0x42, 0x40}),
+				ebmlElement(mkvDuration, duration)),
+			ebmlElement(mkvTracks,
+				ebmlElement(mkvTrackEntry,
+					ebmlElement(mkvTrackType, []byte{2}),
+					ebmlElement(mkvCodecID, []byte("A_OPUS"))),
+				ebmlElement(mkvTrackEntry,
+					ebmlElement(mkvTrackType, []byte{1}),
+					ebmlElement(mkvCodecID, []byte("V_VP9")),
+					ebmlElement(mkvVideo,
+						ebmlElement(mkvPixelWidth, []byte{0x02, 0x80}),
+						ebmlElement(mkvPixelHeight, []byte{0x01, 0x68}))))),
+	}, nil)
+}
+
+func Test_ProbeVideo(t *testing.T) {
+	mp4 := testMP4()
+	metadata, err := probeVideo("trailer.mp4", bytes.NewReader(mp4), uint64(len(mp4)))
+	require.NoError(t, err)
+	assert.Equal(t, &VideoMetadata{
+		Container: "mp4",
+		Duration:  10,
+		Width:     1280,
+		Height:    720,
+		Codec:     "avc1",
+		Bitrate:   int64(len(mp4) * 8 / 10),
+	}, metadata)
+
+	webm := testWebM()
+	metadata, err = probeVideo("trailer.webm", bytes.NewReader(webm), uint64(len(webm)))
+	require.NoError(t, err)
+	assert.Equal(t, "webm", metadata.Container)
+	assert.Equal(t, 2.5, metadata.Duration)
+	assert.Equal(t, 640, metadata.Width)
+	assert.Equal(t, 360, metadata.Height)
+	assert.Equal(t, "V_VP9", metadata.Codec)
+
+	_, err = probeVideo("broken.mp4", bytes.NewReader([]byte("not a video at all")), 18)
+	assert.Error(t, err)
+
+	_, err = probeVideo("broken.webm", bytes.NewReader(mp4), uint64(len(mp4)))
+	assert.Error(t, err)
+}
+
+func Test_ExtractVideoContents(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"trailer.mp4":   testMP4(),
+		"teaser.webm":   testWebM(),
+		"broken.mp4":    []byte("nope"),
+		"readme.txt":    []byte("hello"),
+		"poster.png":    {0x89, 'P', 'N', 'G'},
+		"extra/cut.MP4": testMP4(),
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(data)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, storage.PutFile(ctx, config.Bucket, "trailers.zip", bytes.NewReader(buf.Bytes()), "application/zip"))
+
+	extracted, err := archiver.ExtractZip(ctx, "trailers.zip", "trailers", testLimits(), ExtractOptions{Contents: ExtractContentsVideo})
+	require.NoError(t, err)
+
+	videos := map[string]*VideoMetadata{}
+	for _, file := range extracted {
+		videos[file.Key] = file.Metadata["video"].(*VideoMetadata)
+	}
+	require.Len(t, videos, 3)
+	assert.Equal(t, "avc1", videos["trailers/trailer.mp4"].Codec)
+	assert.Equal(t, "V_VP9", videos["trailers/teaser.webm"].Codec)
+	assert.Equal(t, 1280, videos["trailers/extra/cut.MP4"].Width)
+
+	_, err = storage.HeadFile(ctx, config.Bucket, "trailers/readme.txt")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
@@ -0,0 +1,437 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Encrypted zip entries are decrypted when a password is given, both with
+// the traditional PKWARE cipher (ZipCrypto) and with WinZip's AES scheme
+// (AE-1 and AE-2, stored with method 99 and an 0x9901 extra field).
+
+const (
+	zipEncryptedFlag  = 0x1
+	zipDescriptorFlag = 0x8
+	zipAESMethod      = 99
+	zipAESExtraID     = 0x9901
+	zipAESMACSize     = 10
+	zipAESIterations  = 1000
+)
+
+const (
+	ZipPasswordMissing = "missing"
+	ZipPasswordWrong   = "wrong"
+)
+
+// ZipPasswordError is returned when a zip has encrypted entries and the
+// password is missing or doesn't decrypt them
+type ZipPasswordError struct {
+	Code string // ZipPasswordMissing or ZipPasswordWrong
+	Name string // the entry that couldn't be decrypted
+}
+
+func (e *ZipPasswordError) Error() string {
+	if e.Code == ZipPasswordMissing {
+		return fmt.Sprintf("Zip entry %s is encrypted, a password is required", e.Name)
+	}
+	return fmt.Sprintf("Wrong password for zip entry %s", e.Name)
+}
+
+func isEncryptedZipEntry(file *zip.File) bool {
+	return file.Flags&zipEncryptedFlag != 0
+}
+
+// checkZipPassword makes sure password decrypts every encrypted entry of
+// files, so a wrong password fails the extraction before anything is
+// uploaded. Only the encryption headers are read.
+func checkZipPassword(files []*zip.File, password string) error {
+	for _, file := range files {
+		if !isEncryptedZipEntry(file) {
+			continue
+		}
+		if password == "" {
+			return &ZipPasswordError{ZipPasswordMissing, file.Name}
+		}
+
+		raw, err := file.OpenRaw()
+		if err != nil {
+			return err
+		}
+		if file.Method == zipAESMethod {
+			_, err = readZipAESHeader(file, raw, password)
+		} else {
+			_, err = readZipCryptoHeader(file, raw, password)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openZipEntry opens file for reading, decrypting it with password if needed
+func openZipEntry(file *zip.File, password string) (io.ReadCloser, error) {
+	if !isEncryptedZipEntry(file) {
+		return file.Open()
+	}
+
+	if password == "" {
+		return nil, &ZipPasswordError{ZipPasswordMissing, file.Name}
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	if file.Method == zipAESMethod {
+		return openAESZipEntry(file, raw, password)
+	}
+	return openZipCryptoEntry(file, raw, password)
+}
+
+// decompressZipEntry decompresses the decrypted data of file, checking its
+// CRC when checkCRC is set
+func decompressZipEntry(file *zip.File, method uint16, data io.Reader, checkCRC bool) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	switch method {
+	case zip.Store:
+		reader = io.NopCloser(data)
+	case zip.Deflate:
+		reader = flate.NewReader(data)
+	default:
+		return nil, fmt.Errorf("Unsupported compression method %d for encrypted entry %s", method, file.Name)
+	}
+
+	if !checkCRC {
+		return reader, nil
+	}
+	return &crcCheckReader{reader, crc32.NewIEEE(), file.CRC32, file.Name}, nil
+}
+
+// crcCheckReader fails at the end of the data if its CRC doesn't match
+type crcCheckReader struct {
+	io.ReadCloser
+	hash     hash.Hash32
+	expected uint32
+	name     string
+}
+
+func (r *crcCheckReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.hash.Sum32() != r.expected {
+		return n, fmt.Errorf("Checksum mismatch for zip entry %s", r.name)
+	}
+	return n, err
+}
+
+// zipCryptoKeys is the state of the traditional PKWARE cipher
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		keys.update(password[i])
+	}
+	return keys
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) decryptByte(b byte) byte {
+	temp := k[2] | 2
+	plain := b ^ byte((temp*(temp^1))>>8)
+	k.update(plain)
+	return plain
+}
+
+type zipCryptoReader struct {
+	reader io.Reader
+	keys   *zipCryptoKeys
+}
+
+func (r *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] = r.keys.decryptByte(p[i])
+	}
+	return n, err
+}
+
+func openZipCryptoEntry(file *zip.File, raw io.Reader, password string) (io.ReadCloser, error) {
+	keys, err := readZipCryptoHeader(file, raw, password)
+	if err != nil {
+		return nil, err
+	}
+	return decompressZipEntry(file, file.Method, &zipCryptoReader{raw, keys}, true)
+}
+
+// readZipCryptoHeader reads the encryption header of file, it returns the
+// keys to decrypt the data that follows, or a ZipPasswordError when password
+// doesn't match
+func readZipCryptoHeader(file *zip.File, raw io.Reader, password string) (*zipCryptoKeys, error) {
+	keys := newZipCryptoKeys(password)
+
+	header := make([]byte, 12)
+	_, err := io.ReadFull(raw, header)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read encryption header of %s: %v", file.Name, err)
+	}
+	for i := range header {
+		header[i] = keys.decryptByte(header[i])
+	}
+
+	// the last header byte is the high byte of the CRC, or of the
+	// modification time when the CRC comes after the data
+	check := byte(file.CRC32 >> 24)
+	if file.Flags&zipDescriptorFlag != 0 {
+		check = byte(file.ModifiedTime >> 8)
+	}
+	if header[11] != check {
+		return nil, &ZipPasswordError{ZipPasswordWrong, file.Name}
+	}
+	return keys, nil
+}
+
+// zipAESExtra is the 0x9901 extra field of an AES encrypted entry
+type zipAESExtra struct {
+	version  uint16 // 1 for AE-1, 2 for AE-2 (no CRC)
+	strength byte   // 1, 2 or 3 for 128, 192 or 256 bit keys
+	method   uint16 // the actual compression method
+}
+
+func parseZipAESExtra(extra []byte) (*zipAESExtra, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return nil, false
+		}
+
+		field := extra[4 : 4+size]
+		if id == zipAESExtraID && size >= 7 {
+			return &zipAESExtra{
+				version:  binary.LittleEndian.Uint16(field),
+				strength: field[4],
+				method:   binary.LittleEndian.Uint16(field[5:]),
+			}, true
+		}
+
+		extra = extra[4+size:]
+	}
+	return nil, false
+}
+
+// zipAESHeader is what the encryption header of an AES entry and the
+// password give
+type zipAESHeader struct {
+	extra     *zipAESExtra
+	keyLength int
+	// the encryption key, the authentication key and the password verifier
+	keys []byte
+	// size of the salt, verifier and authentication code around the data
+	overhead uint64
+}
+
+// readZipAESHeader reads the salt and password verifier of file, it fails
+// with a ZipPasswordError when password doesn't match
+func readZipAESHeader(file *zip.File, raw io.Reader, password string) (*zipAESHeader, error) {
+	extra, ok := parseZipAESExtra(file.Extra)
+	if !ok || extra.strength < 1 || extra.strength > 3 {
+		return nil, fmt.Errorf("Invalid AES encryption header for %s", file.Name)
+	}
+
+	keyLength := 8 + 8*int(extra.strength)
+	saltLength := keyLength / 2
+
+	overhead := uint64(saltLength + 2 + zipAESMACSize)
+	if file.CompressedSize64 < overhead {
+		return nil, fmt.Errorf("AES encrypted entry %s is too short", file.Name)
+	}
+
+	header := make([]byte, saltLength+2)
+	_, err := io.ReadFull(raw, header)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read encryption header of %s: %v", file.Name, err)
+	}
+
+	keys := pbkdf2SHA1([]byte(password), header[:saltLength], zipAESIterations, 2*keyLength+2)
+	if !bytes.Equal(keys[2*keyLength:], header[saltLength:]) {
+		return nil, &ZipPasswordError{ZipPasswordWrong, file.Name}
+	}
+
+	return &zipAESHeader{extra, keyLength, keys, overhead}, nil
+}
+
+func openAESZipEntry(file *zip.File, raw io.Reader, password string) (io.ReadCloser, error) {
+	header, err := readZipAESHeader(file, raw, password)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(header.keys[:header.keyLength])
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha1.New, header.keys[header.keyLength:2*header.keyLength])
+	data := &zipAESReader{
+		data:   io.TeeReader(io.LimitReader(raw, int64(file.CompressedSize64-header.overhead)), mac),
+		raw:    raw,
+		mac:    mac,
+		stream: newZipAESCTR(block),
+		name:   file.Name,
+	}
+
+	// AE-2 leaves the CRC out, the authentication code covers the data
+	reader, err := decompressZipEntry(file, header.extra.method, data, header.extra.version == 1)
+	if err != nil {
+		return nil, err
+	}
+	return &zipAESEntryReader{reader, data}, nil
+}
+
+// zipAESReader decrypts an AES entry, see verify for the authentication code
+// that follows the data
+type zipAESReader struct {
+	data   io.Reader
+	raw    io.Reader
+	mac    hash.Hash
+	stream cipher.Stream
+	name   string
+
+	verified  bool
+	verifyErr error
+}
+
+func (r *zipAESReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	r.stream.XORKeyStream(p[:n], p[:n])
+
+	if err == io.EOF {
+		if verifyErr := r.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+// verify reads what's left of the encrypted data, then checks the
+// authentication code that follows it. The decompressor stops at its final
+// block and may never read to the end of the data, so this is also done once
+// the entry was read or closed, see zipAESEntryReader.
+func (r *zipAESReader) verify() error {
+	if r.verified {
+		return r.verifyErr
+	}
+	r.verified = true
+
+	// the code covers the encrypted data, what's left needn't be decrypted
+	if _, err := io.Copy(io.Discard, r.data); err != nil {
+		r.verifyErr = fmt.Errorf("Failed to read zip entry %s: %v", r.name, err)
+		return r.verifyErr
+	}
+
+	expected := make([]byte, zipAESMACSize)
+	_, err := io.ReadFull(r.raw, expected)
+	if err != nil || !hmac.Equal(expected, r.mac.Sum(nil)[:zipAESMACSize]) {
+		r.verifyErr = fmt.Errorf("Authentication failed for zip entry %s", r.name)
+	}
+	return r.verifyErr
+}
+
+// zipAESEntryReader is the decompressed data of an AES entry, it fails
+// instead of ending, and on Close, when the entry isn't authentic
+type zipAESEntryReader struct {
+	io.ReadCloser
+	aes *zipAESReader
+}
+
+func (r *zipAESEntryReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if verifyErr := r.aes.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (r *zipAESEntryReader) Close() error {
+	err := r.ReadCloser.Close()
+	if verifyErr := r.aes.verify(); verifyErr != nil {
+		return verifyErr
+	}
+	return err
+}
+
+// zipAESCTR is AES in counter mode as WinZip uses it: a little endian
+// counter starting at 1, unlike cipher.NewCTR
+type zipAESCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newZipAESCTR(block cipher.Block) *zipAESCTR {
+	return &zipAESCTR{block: block, used: aes.BlockSize}
+}
+
+func (c *zipAESCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+// pbkdf2SHA1 derives a key of keyLength bytes as described in RFC 8018
+func pbkdf2SHA1(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha1.New, password)
+	key := make([]byte, 0, keyLength+prf.Size())
+
+	for block := uint32(1); len(key) < keyLength; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+
+	return key[:keyLength]
+}
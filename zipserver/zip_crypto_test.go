@@ -0,0 +1,249 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeZipCryptoEntry stores data in zw encrypted with the traditional
+// PKWARE cipher
+func writeZipCryptoEntry(t *testing.T, zw *zip.Writer, name string, data []byte, password string) {
+	header := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		Flags:              zipEncryptedFlag,
+		CRC32:              crc32.ChecksumIEEE(data),
+		UncompressedSize64: uint64(len(data)),
+		CompressedSize64:   uint64(12 + len(data)),
+	}
+
+	plain := make([]byte, 12)
+	plain[11] = byte(header.CRC32 >> 24)
+	plain = append(plain, data...)
+
+	keys := newZipCryptoKeys(password)
+	encrypted := make([]byte, len(plain))
+	for i, b := range plain {
+		temp := keys[2] | 2
+		encrypted[i] = b ^ byte((temp*(temp^1))>>8)
+		keys.update(b)
+	}
+
+	w, err := zw.CreateRaw(header)
+	require.NoError(t, err)
+	_, err = w.Write(encrypted)
+	require.NoError(t, err)
+}
+
+// writeAESEntry stores data in zw encrypted with WinZip AE-2, 256 bit
+func writeAESEntry(t *testing.T, zw *zip.Writer, name string, data []byte, password string) {
+	salt := bytes.Repeat([]byte{7}, 16)
+	keys := pbkdf2SHA1([]byte(password), salt, zipAESIterations, 66)
+
+	block, err := aes.NewCipher(keys[:32])
+	require.NoError(t, err)
+
+	encrypted := make([]byte, len(data))
+	newZipAESCTR(block).XORKeyStream(encrypted, data)
+
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(encrypted)
+
+	body := append(append(append(salt, keys[64:]...), encrypted...), mac.Sum(nil)[:zipAESMACSize]...)
+
+	header := &zip.FileHeader{
+		Name:               name,
+		Method:             zipAESMethod,
+		Flags:              zipEncryptedFlag,
+		UncompressedSize64: uint64(len(data)),
+		CompressedSize64:   uint64(len(body)),
+		Extra:              []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 0, 0},
+	}
+
+	w, err := zw.CreateRaw(header)
+	require.NoError(t, err)
+	_, err = w.Write(body)
+	require.NoError(t, err)
+}
+
+func Test_PBKDF2SHA1(t *testing.T) {
+	// RFC 6070 test vectors
+	key := pbkdf2SHA1([]byte("password"), []byte("salt"), 1, 20)
+	assert.EqualValues(t, "0c60c80f961f0e71f3a9b524af6012062fe037a6", hex.EncodeToString(key))
+
+	key = pbkdf2SHA1([]byte("password"), []byte("salt"), 2, 20)
+	assert.EqualValues(t, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957", hex.EncodeToString(key))
+
+	key = pbkdf2SHA1([]byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt"), 4096, 25)
+	assert.EqualValues(t, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038", hex.EncodeToString(key))
+}
+
+func Test_OpenZipEntry(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writeZipCryptoEntry(t, zw, "crypto.txt", []byte("zipcrypto contents"), "hunter2")
+	writeAESEntry(t, zw, "aes.txt", []byte("aes contents"), "hunter2")
+	require.NoError(t, zw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	expected := []string{"zipcrypto contents", "aes contents"}
+	for i, file := range zr.File {
+		reader, err := openZipEntry(file, "hunter2")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		assert.NoError(t, err)
+		assert.EqualValues(t, expected[i], string(data))
+
+		var passwordErr *ZipPasswordError
+		_, err = openZipEntry(file, "wrong")
+		require.True(t, errors.As(err, &passwordErr), file.Name)
+		assert.EqualValues(t, ZipPasswordWrong, passwordErr.Code)
+
+		_, err = openZipEntry(file, "")
+		require.True(t, errors.As(err, &passwordErr), file.Name)
+		assert.EqualValues(t, ZipPasswordMissing, passwordErr.Code)
+	}
+}
+
+// Fixtures made by other tools than zipserver: zipcrypto.zip by Info-ZIP's
+// zip -P, aes.zip by testdata/make_aes_zip.py
+func Test_OpenZipEntryFixtures(t *testing.T) {
+	expected := map[string]string{
+		"zipcrypto.zip/readme.txt": strings.Repeat("Hello from a ZipCrypto encrypted zip\n", 200),
+		"zipcrypto.zip/tiny.txt":   "hi\n",
+		"aes.zip/readme.txt":       strings.Repeat("Hello from an AES encrypted zip\n", 200),
+		"aes.zip/stored.txt":       "stored, not deflated\n",
+	}
+
+	for _, name := range []string{"zipcrypto.zip", "aes.zip"} {
+		zr, err := zip.OpenReader(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		defer zr.Close()
+
+		assert.NoError(t, checkZipPassword(zr.File, "hunter2"))
+		var passwordErr *ZipPasswordError
+		require.True(t, errors.As(checkZipPassword(zr.File, "wrong"), &passwordErr), name)
+		assert.EqualValues(t, ZipPasswordWrong, passwordErr.Code)
+
+		for _, file := range zr.File {
+			reader, err := openZipEntry(file, "hunter2")
+			require.NoError(t, err, file.Name)
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err, file.Name)
+			assert.NoError(t, reader.Close(), file.Name)
+			assert.EqualValues(t, expected[name+"/"+file.Name], string(data))
+		}
+	}
+}
+
+func Test_AESAuthentication(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "aes.zip"))
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(fixture), int64(len(fixture)))
+	require.NoError(t, err)
+	file := zr.File[0]
+	require.EqualValues(t, "readme.txt", file.Name)
+
+	// flip a bit of the authentication code of the deflated entry, AE-2 has
+	// no CRC to catch it
+	offset, err := file.DataOffset()
+	require.NoError(t, err)
+	tampered := append([]byte{}, fixture...)
+	tampered[offset+int64(file.CompressedSize64)-1] ^= 1
+
+	zr, err = zip.NewReader(bytes.NewReader(tampered), int64(len(tampered)))
+	require.NoError(t, err)
+
+	reader, err := openZipEntry(zr.File[0], "hunter2")
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.EqualError(t, err, "Authentication failed for zip entry readme.txt")
+	assert.Error(t, reader.Close())
+
+	// also when the entry is closed before it's read to the end
+	reader, err = openZipEntry(zr.File[0], "hunter2")
+	require.NoError(t, err)
+	_, err = reader.Read(make([]byte, 10))
+	require.NoError(t, err)
+	assert.EqualError(t, reader.Close(), "Authentication failed for zip entry readme.txt")
+}
+
+func Test_CheckZipPassword(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writeZipCryptoEntry(t, zw, "first.txt", []byte("first"), "hunter2")
+	writeAESEntry(t, zw, "second.txt", []byte("second"), "hunter3")
+	require.NoError(t, zw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	// every entry is checked, not only the first one
+	var passwordErr *ZipPasswordError
+	require.True(t, errors.As(checkZipPassword(zr.File, "hunter2"), &passwordErr))
+	assert.EqualValues(t, ZipPasswordWrong, passwordErr.Code)
+	assert.EqualValues(t, "second.txt", passwordErr.Name)
+
+	require.True(t, errors.As(checkZipPassword(zr.File, ""), &passwordErr))
+	assert.EqualValues(t, ZipPasswordMissing, passwordErr.Code)
+}
+
+func Test_ExtractEncryptedZip(t *testing.T) {
+	ctx := context.Background()
+	config := emptyConfig()
+
+	storage, err := NewMemStorage()
+	require.NoError(t, err)
+	archiver := &Archiver{storage, config}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("readme.txt")
+	require.NoError(t, err)
+	w.Write([]byte("not encrypted"))
+	writeZipCryptoEntry(t, zw, "secret.txt", []byte("encrypted"), "hunter2")
+	require.NoError(t, zw.Close())
+
+	fname := filepath.Join(t.TempDir(), "encrypted.zip")
+	require.NoError(t, os.WriteFile(fname, buf.Bytes(), 0644))
+
+	_, err = archiver.ExtractZipFile(ctx, fname, "encrypted", testLimits(), ExtractOptions{Password: "nope"})
+	errorType, details := extractErrorDetails(err)
+	assert.EqualValues(t, "ZipPasswordError", errorType)
+	assert.EqualValues(t, ZipPasswordWrong, details["Code"])
+
+	// nothing gets uploaded when the password is wrong
+	objects, err := storage.ListObjects(ctx, config.Bucket, "encrypted")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+
+	files, err := archiver.ExtractZipFile(ctx, fname, "encrypted", testLimits(), ExtractOptions{Password: "hunter2"})
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	reader, _, err := storage.GetFile(ctx, config.Bucket, "encrypted/secret.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.EqualValues(t, "encrypted", string(data))
+}
@@ -0,0 +1,195 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	errors "github.com/go-errors/errors"
+)
+
+// Codes reported in ZipDiagnosticError
+const (
+	ZipEmpty       = "empty"
+	ZipTruncated   = "truncated"
+	ZipHTMLPage    = "html_page"
+	ZipMultiPart   = "multi_part"
+	ZipWrongFormat = "wrong_format"
+	ZipInvalid     = "invalid"
+	ZipBadSizes    = "bad_sizes"
+)
+
+// ZipDiagnosticError explains why a file couldn't be opened as a zip, in
+// terms an uploader can act on
+type ZipDiagnosticError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *ZipDiagnosticError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%v)", e.Message, e.Err)
+}
+
+func (e *ZipDiagnosticError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	localFileSignature = []byte("PK\x03\x04")
+	spannedSignature   = []byte("PK\x07\x08")
+	endOfDirSignature  = []byte("PK\x05\x06")
+)
+
+// the end of central directory record is 22 bytes, followed by a comment of
+// up to 64KB
+const maxEndOfDirSearch = 22 + 65535
+
+var otherArchiveSignatures = []struct {
+	signature []byte
+	name      string
+}{
+	{[]byte("Rar!\x1a\x07"), "a RAR archive"},
+	{[]byte("7z\xbc\xaf\x27\x1c"), "a 7-Zip archive"},
+	{[]byte("\x1f\x8b"), "a gzip file"},
+	{[]byte("ustar"), "a tar archive"},
+}
+
+// openZipFile is zip.OpenReader, with a diagnosis of what's wrong with the
+// file when it isn't a valid zip
+func openZipFile(fname string) (*zip.ReadCloser, error) {
+	zipReader, err := zip.OpenReader(fname)
+	if err == nil {
+		stat, err := os.Stat(fname)
+		if err == nil {
+			err = verifyZipEntries(zipReader.File, stat.Size())
+		}
+		if err != nil {
+			zipReader.Close()
+			return nil, err
+		}
+		return zipReader, nil
+	}
+
+	file, openErr := os.Open(fname)
+	if openErr != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	defer file.Close()
+
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return nil, diagnoseZip(file, stat.Size(), err)
+}
+
+// diagnoseZip probes a file that zip failed to open with openErr and
+// returns a ZipDiagnosticError describing the likely cause
+func diagnoseZip(r io.ReaderAt, size int64, openErr error) error {
+	diagnosis := func(code, message string) error {
+		return &ZipDiagnosticError{code, message, openErr}
+	}
+
+	if size == 0 {
+		return diagnosis(ZipEmpty, "The file is empty")
+	}
+
+	head := make([]byte, 512)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	trimmed := bytes.ToLower(bytes.TrimSpace(head))
+	if bytes.HasPrefix(trimmed, []byte("<!doctype html")) || bytes.HasPrefix(trimmed, []byte("<html")) ||
+		bytes.HasPrefix(trimmed, []byte("<?xml")) {
+		return diagnosis(ZipHTMLPage, "The file is a web page or error message, not a zip")
+	}
+
+	for _, other := range otherArchiveSignatures {
+		if bytes.HasPrefix(head, other.signature) {
+			return diagnosis(ZipWrongFormat, fmt.Sprintf("The file is %s, not a zip", other.name))
+		}
+	}
+	// tar stores its magic at offset 257
+	if len(head) > 262 && bytes.Equal(head[257:262], []byte("ustar")) {
+		return diagnosis(ZipWrongFormat, "The file is a tar archive, not a zip")
+	}
+
+	if bytes.HasPrefix(head, spannedSignature) {
+		return diagnosis(ZipMultiPart, "The file is one part of a multi-part zip")
+	}
+
+	tailSize := int64(maxEndOfDirSearch)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	n, _ = r.ReadAt(tail, size-tailSize)
+	tail = tail[:n]
+
+	if idx := bytes.LastIndex(tail, endOfDirSignature); idx >= 0 && idx+8 <= len(tail) {
+		diskNumber := binary.LittleEndian.Uint16(tail[idx+4:])
+		directoryDisk := binary.LittleEndian.Uint16(tail[idx+6:])
+		if diskNumber != 0 || directoryDisk != 0 {
+			return diagnosis(ZipMultiPart, "The file is the last part of a multi-part zip")
+		}
+	} else if bytes.HasPrefix(head, localFileSignature) {
+		return diagnosis(ZipTruncated, "The zip is incomplete, the download or upload was probably cut short")
+	}
+
+	return diagnosis(ZipInvalid, "The file is not a valid zip")
+}
+
+// verifyZipEntries checks that every entry's data fits between its local
+// header and the next entry. Archivers that write entries over 4GB without
+// zip64 records store wrapped sizes, which would otherwise only surface as a
+// checksum error after streaming gigabytes.
+func verifyZipEntries(files []*zip.File, size int64) error {
+	type entryRange struct {
+		name       string
+		start, end int64
+	}
+
+	ranges := make([]entryRange, 0, len(files))
+	for _, file := range files {
+		offset, err := file.DataOffset()
+		if err != nil {
+			return &ZipDiagnosticError{ZipTruncated, fmt.Sprintf("Can't read entry %s, the zip is probably incomplete", file.Name), err}
+		}
+
+		end := offset + int64(file.CompressedSize64)
+		if file.CompressedSize64 > uint64(size) || end > size {
+			return &ZipDiagnosticError{ZipTruncated, fmt.Sprintf("Entry %s goes past the end of the zip, which is probably incomplete", file.Name), nil}
+		}
+
+		ranges = append(ranges, entryRange{file.Name, offset, end})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	for i, entry := range ranges {
+		next := size
+		if i+1 < len(ranges) {
+			next = ranges[i+1].start
+		}
+
+		if entry.end > next {
+			return &ZipDiagnosticError{ZipBadSizes, fmt.Sprintf("Entry %s overlaps the next one", entry.name), nil}
+		}
+
+		// a gap of 4GB or more is the rest of an entry whose size wrapped around
+		if next-entry.end >= 1<<32 {
+			return &ZipDiagnosticError{ZipBadSizes, fmt.Sprintf("Entry %s is larger than its recorded size, it was probably written without zip64 support", entry.name), nil}
+		}
+	}
+
+	return nil
+}
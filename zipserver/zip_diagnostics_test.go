@@ -0,0 +1,102 @@
+package zipserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DiagnoseZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writer, err := zw.Create("index.html")
+	require.NoError(t, err)
+	_, err = writer.Write(bytes.Repeat([]byte("hello "), 100))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	valid := buf.Bytes()
+
+	diagnose := func(data []byte) string {
+		var diagnosticErr *ZipDiagnosticError
+		err := diagnoseZip(bytes.NewReader(data), int64(len(data)), zip.ErrFormat)
+		require.True(t, errors.As(err, &diagnosticErr))
+		assert.ErrorIs(t, err, zip.ErrFormat)
+		return diagnosticErr.Code
+	}
+
+	assert.Equal(t, ZipEmpty, diagnose([]byte{}))
+	assert.Equal(t, ZipTruncated, diagnose(valid[:len(valid)/2]))
+	assert.Equal(t, ZipHTMLPage, diagnose([]byte("\n<!DOCTYPE html><html><body>403 Forbidden</body></html>")))
+	assert.Equal(t, ZipWrongFormat, diagnose([]byte("Rar!\x1a\x07\x00 some rar data")))
+	assert.Equal(t, ZipMultiPart, diagnose(append([]byte("PK\x07\x08"), valid[:len(valid)/2]...)))
+	assert.Equal(t, ZipInvalid, diagnose([]byte("just some text")))
+
+	// last part of a split archive: the end of directory record points at another disk
+	lastPart := append([]byte{}, valid...)
+	eocd := bytes.LastIndex(lastPart, endOfDirSignature)
+	lastPart[eocd+4] = 2
+	lastPart[eocd+6] = 1
+	assert.Equal(t, ZipMultiPart, diagnose(lastPart))
+}
+
+func Test_VerifyZipEntries(t *testing.T) {
+	data := multipartTestZip(t)
+
+	verify := func(data []byte) error {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		return verifyZipEntries(reader.File, int64(len(data)))
+	}
+
+	assert.NoError(t, verify(data))
+
+	code := func(err error) string {
+		var diagnosticErr *ZipDiagnosticError
+		require.True(t, errors.As(err, &diagnosticErr))
+		return diagnosticErr.Code
+	}
+
+	// first entry's recorded size runs into the second entry
+	overlapping := append([]byte{}, data...)
+	header := bytes.Index(overlapping, []byte("PK\x01\x02"))
+	size := binary.LittleEndian.Uint32(overlapping[header+20:])
+	binary.LittleEndian.PutUint32(overlapping[header+20:], size+100)
+	assert.Equal(t, ZipBadSizes, code(verify(overlapping)))
+
+	// zip64 entry claiming more data than the file holds
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writer, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "huge.bin",
+		Method:             zip.Store,
+		CompressedSize64:   5 << 30,
+		UncompressedSize64: 5 << 30,
+	})
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("not quite five gigabytes"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.EqualValues(t, 5<<30, reader.File[0].UncompressedSize64)
+	assert.Equal(t, ZipTruncated, code(verify(buf.Bytes())))
+
+	// the central directory alone is enough to reject it upfront
+	config := emptyConfig()
+	config.MaxEntrySize = 4 << 30
+	archiver := &Archiver{nil, config}
+	limits := testLimits()
+	limits.MaxFileSize = 10 << 30
+	limits.MaxTotalSize = 10 << 30
+
+	_, err = archiver.selectZipFiles(context.Background(), reader.File, limits, &ExtractOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "server max")
+}